@@ -100,6 +100,27 @@ func installFlags(flags *pflag.FlagSet, c *Opts) {
 	flags.DurationVar(&c.StreamCreationTimeout, "stream-creation-timeout", c.StreamCreationTimeout,
 		"stream-creation-timeout is the maximum time for streaming connection, default 30s.")
 
+	flags.BoolVar(&c.RotateServerCertificates, "rotate-server-certificates", c.RotateServerCertificates,
+		"request the serving certificate from the kubernetes.io/kubelet-serving signer and rotate it before it expires,"+
+			" instead of using the key pair from APISERVER_CERT_LOCATION and APISERVER_KEY_LOCATION")
+	flags.StringVar(&c.CertDirectory, "cert-dir", c.CertDirectory, "directory to store rotated certificates in (default is to keep them in memory)")
+
+	flags.StringVar(&c.AuditLogPath, "audit-log-path", c.AuditLogPath, "file to write audit events of kubelet API requests to as JSON lines")
+	flags.IntVar(&c.AuditLogMaxSize, "audit-log-maxsize", c.AuditLogMaxSize, "size in megabytes at which the audit log is rotated (default 100)")
+	flags.IntVar(&c.AuditLogMaxBackups, "audit-log-maxbackup", c.AuditLogMaxBackups, "number of rotated audit logs to keep (default is to keep all)")
+	flags.StringVar(&c.AuditWebhookURL, "audit-webhook-url", c.AuditWebhookURL, "URL to send audit events of kubelet API requests to, as audit.k8s.io/v1 EventLists")
+
+	flags.StringVar(&c.SessionRecordingDir, "session-recording-dir", c.SessionRecordingDir, "directory to record exec and attach sessions to as asciicast v2 files")
+	flags.Int64Var(&c.SessionRecordingMaxSize, "session-recording-max-size", c.SessionRecordingMaxSize, "size in bytes at which session recordings are truncated (default 100MiB)")
+
+	flags.IntVar(&c.MaxStreamsPerUser, "max-streams-per-user", c.MaxStreamsPerUser, "maximum number of concurrent exec, attach, port-forward and followed log streams per user (0 for no limit)")
+	flags.IntVar(&c.MaxStreamsPerPod, "max-streams-per-pod", c.MaxStreamsPerPod, "maximum number of concurrent exec, attach, port-forward and followed log streams per pod (0 for no limit)")
+	flags.Float64Var(&c.APIRequestsPerSecond, "api-requests-per-second", c.APIRequestsPerSecond, "rate of other kubelet API requests allowed per user (0 for no limit)")
+	flags.IntVar(&c.APIRequestBurst, "api-request-burst", c.APIRequestBurst, "burst of kubelet API requests allowed per user (default is the rate, rounded up)")
+
+	flags.StringVar(&c.PodStatusWebhookSecretFile, "pod-status-webhook-secret-file", c.PodStatusWebhookSecretFile, "file holding the secret pod status callbacks posted to /podStatusCallback are signed with")
+	flags.StringSliceVar(&c.PodStatusWebhookClientCertNames, "pod-status-webhook-client-cert-names", c.PodStatusWebhookClientCertNames, "common names of client certificates pod status callbacks may be authenticated with")
+
 	flagset := flag.NewFlagSet("klog", flag.PanicOnError)
 	klog.InitFlags(flagset)
 	flagset.VisitAll(func(f *flag.Flag) {
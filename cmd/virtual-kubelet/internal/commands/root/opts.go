@@ -93,6 +93,39 @@ type Opts struct {
 	// StreamCreationTimeout is the maximum time for streaming connection
 	StreamCreationTimeout time.Duration
 
+	// RotateServerCertificates makes the node request its serving certificate through the
+	// CertificateSigningRequest API, and rotate it before it expires.
+	RotateServerCertificates bool
+	// CertDirectory is the directory rotated certificates are stored in.
+	CertDirectory string
+
+	// AuditLogPath is the file audit events of requests to the kubelet API are written to.
+	AuditLogPath string
+	// AuditLogMaxSize is the size in megabytes at which the audit log is rotated.
+	AuditLogMaxSize int
+	// AuditLogMaxBackups is the number of rotated audit logs to keep.
+	AuditLogMaxBackups int
+	// AuditWebhookURL is the URL audit events of requests to the kubelet API are sent to.
+	AuditWebhookURL string
+
+	// SessionRecordingDir is the directory exec and attach sessions are recorded to.
+	SessionRecordingDir string
+	// SessionRecordingMaxSize is the size in bytes at which session recordings are truncated.
+	SessionRecordingMaxSize int64
+
+	// MaxStreamsPerUser and MaxStreamsPerPod limit the concurrent exec, attach, port-forward and followed log streams.
+	MaxStreamsPerUser int
+	MaxStreamsPerPod  int
+	// APIRequestsPerSecond and APIRequestBurst limit the rate of other requests to the kubelet API per user.
+	APIRequestsPerSecond float64
+	APIRequestBurst      int
+
+	// PodStatusWebhookSecretFile is the file holding the secret pod status callbacks are signed with.
+	PodStatusWebhookSecretFile string
+	// PodStatusWebhookClientCertNames are the common names of client certificates pod status callbacks may be
+	// authenticated with.
+	PodStatusWebhookClientCertNames []string
+
 	Version string
 }
 
@@ -15,8 +15,10 @@
 package root
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
+	"net"
 	"net/http"
 	"os"
 	"runtime"
@@ -31,7 +33,7 @@ import (
 	"github.com/virtual-kubelet/virtual-kubelet/node/api"
 	"github.com/virtual-kubelet/virtual-kubelet/node/nodeutil"
 	corev1 "k8s.io/api/core/v1"
-	"k8s.io/apiserver/pkg/server/dynamiccertificates"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
 )
 
 // NewCommand creates a new top-level command.
@@ -114,6 +116,65 @@ func runRootCommand(ctx context.Context, s *provider.Store, c Opts) error {
 		return err
 	}
 
+	// The TLS files are reloaded when they change, so that they can be rotated without restarting.
+	// The serving key pair is not loaded from files when it is rotated through the certificates API.
+	reloadCfg := nodeutil.TLSFileReloaderConfig{CACertPath: apiConfig.CACertPath}
+	var tlsOpts []func(*tls.Config) error
+	if c.RotateServerCertificates {
+		certManager, err := nodeutil.NewServingCertificateManager(nodeutil.CertificateManagerConfig{
+			Client:        clientSet,
+			NodeName:      c.NodeName,
+			IPAddresses:   nodeIPs(os.Getenv("VKUBELET_POD_IP")),
+			DNSNames:      []string{c.NodeName},
+			CertDirectory: c.CertDirectory,
+		})
+		if err != nil {
+			return err
+		}
+		certManager.Start()
+		defer certManager.Stop()
+		tlsOpts = append(tlsOpts, nodeutil.WithCertificateManager(certManager))
+	} else {
+		if apiConfig.CertPath == "" || apiConfig.KeyPath == "" {
+			return errdefs.InvalidInput("APISERVER_CERT_LOCATION and APISERVER_KEY_LOCATION must be set unless server certificates are rotated")
+		}
+		reloadCfg.CertPath = apiConfig.CertPath
+		reloadCfg.KeyPath = apiConfig.KeyPath
+	}
+
+	var tlsReloader *nodeutil.TLSFileReloader
+	if reloadCfg.CertPath != "" || reloadCfg.CACertPath != "" {
+		tlsReloader, err = nodeutil.NewTLSFileReloader(reloadCfg)
+		if err != nil {
+			return errors.Wrap(err, "error loading TLS files")
+		}
+		tlsOpts = append(tlsOpts, nodeutil.WithTLSFileReloader(tlsReloader))
+	}
+
+	auditSink, err := getAuditSink(c)
+	if err != nil {
+		return err
+	}
+	if auditSink != nil {
+		defer auditSink.Close()
+	}
+
+	var sessionRecorder *api.SessionRecorder
+	if c.SessionRecordingDir != "" {
+		sessionRecorder, err = api.NewSessionRecorder(api.SessionRecorderConfig{
+			Dir:     c.SessionRecordingDir,
+			MaxSize: c.SessionRecordingMaxSize,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	podStatusWebhook, err := getPodStatusWebhookConfig(c)
+	if err != nil {
+		return err
+	}
+
 	cm, err := nodeutil.NewNode(c.NodeName, newProvider, func(cfg *nodeutil.NodeConfig) error {
 		cfg.KubeconfigPath = c.KubeConfigPath
 		cfg.Handler = mux
@@ -129,17 +190,26 @@ func runRootCommand(ctx context.Context, s *provider.Store, c Opts) error {
 		cfg.StreamCreationTimeout = apiConfig.StreamCreationTimeout
 		cfg.StreamIdleTimeout = apiConfig.StreamIdleTimeout
 		cfg.DebugHTTP = true
+		cfg.TLSReloader = tlsReloader
+		if auditSink != nil {
+			cfg.AuditSink = auditSink
+		}
+		cfg.SessionRecorder = sessionRecorder
+		cfg.PodStatusWebhook = podStatusWebhook
+		cfg.RequestLimits = api.RequestLimitsConfig{
+			MaxStreamsPerUser: c.MaxStreamsPerUser,
+			MaxStreamsPerPod:  c.MaxStreamsPerPod,
+			RequestsPerSecond: c.APIRequestsPerSecond,
+			RequestBurst:      c.APIRequestBurst,
+		}
 
 		cfg.NumWorkers = c.PodSyncWorkers
 
 		return nil
 	},
 		nodeutil.WithClient(clientSet),
-		setAuth(c.NodeName, apiConfig),
-		nodeutil.WithTLSConfig(
-			nodeutil.WithKeyPairFromPath(apiConfig.CertPath, apiConfig.KeyPath),
-			maybeCA(apiConfig.CACertPath),
-		),
+		setAuth(c.NodeName, tlsReloader),
+		nodeutil.WithTLSConfig(tlsOpts...),
 		nodeutil.AttachProviderRoutes(mux),
 	)
 	if err != nil {
@@ -180,8 +250,8 @@ func runRootCommand(ctx context.Context, s *provider.Store, c Opts) error {
 	return nil
 }
 
-func setAuth(node string, apiCfg *apiServerConfig) nodeutil.NodeOpt {
-	if apiCfg.CACertPath == "" {
+func setAuth(node string, tlsReloader *nodeutil.TLSFileReloader) nodeutil.NodeOpt {
+	if tlsReloader == nil || len(tlsReloader.CurrentCABundleContent()) == 0 {
 		return func(cfg *nodeutil.NodeConfig) error {
 			cfg.Handler = api.InstrumentHandler(nodeutil.WithAuth(nodeutil.NoAuth(), cfg.Handler))
 			return nil
@@ -190,9 +260,8 @@ func setAuth(node string, apiCfg *apiServerConfig) nodeutil.NodeOpt {
 
 	return func(cfg *nodeutil.NodeConfig) error {
 		auth, err := nodeutil.WebhookAuth(cfg.Client, node, func(cfg *nodeutil.WebhookAuthConfig) error {
-			var err error
-			cfg.AuthnConfig.ClientCertificateCAContentProvider, err = dynamiccertificates.NewDynamicCAContentFromFile("ca-cert-bundle", apiCfg.CACertPath)
-			return err
+			cfg.AuthnConfig.ClientCertificateCAContentProvider = tlsReloader
+			return nil
 		})
 		if err != nil {
 			return err
@@ -202,9 +271,80 @@ func setAuth(node string, apiCfg *apiServerConfig) nodeutil.NodeOpt {
 	}
 }
 
-func maybeCA(p string) func(*tls.Config) error {
-	if p == "" {
-		return func(*tls.Config) error { return nil }
+type auditSinkCloser interface {
+	api.AuditSink
+	Close() error
+}
+
+type auditSinks []auditSinkCloser
+
+func (s auditSinks) WriteAuditEvent(ctx context.Context, e *api.AuditEvent) error {
+	var errs []error
+	for _, sink := range s {
+		if err := sink.WriteAuditEvent(ctx, e); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+func (s auditSinks) Close() error {
+	var errs []error
+	for _, sink := range s {
+		if err := sink.Close(); err != nil {
+			errs = append(errs, err)
+		}
 	}
-	return nodeutil.WithCAFromPath(p)
+	return utilerrors.NewAggregate(errs)
+}
+
+func getAuditSink(c Opts) (auditSinkCloser, error) {
+	var sinks auditSinks
+	if c.AuditLogPath != "" {
+		sink, err := api.NewAuditFileSink(api.AuditFileSinkConfig{
+			Path:       c.AuditLogPath,
+			MaxSize:    c.AuditLogMaxSize,
+			MaxBackups: c.AuditLogMaxBackups,
+		})
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+	}
+	if c.AuditWebhookURL != "" {
+		sink, err := api.NewAuditWebhookSink(api.AuditWebhookSinkConfig{URL: c.AuditWebhookURL})
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+	}
+	if len(sinks) == 0 {
+		return nil, nil
+	}
+	return sinks, nil
+}
+
+func getPodStatusWebhookConfig(c Opts) (*api.PodStatusWebhookConfig, error) {
+	if c.PodStatusWebhookSecretFile == "" && len(c.PodStatusWebhookClientCertNames) == 0 {
+		return nil, nil
+	}
+	cfg := &api.PodStatusWebhookConfig{ClientCertNames: c.PodStatusWebhookClientCertNames}
+	if c.PodStatusWebhookSecretFile != "" {
+		secret, err := os.ReadFile(c.PodStatusWebhookSecretFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "error reading pod status webhook secret")
+		}
+		cfg.Secret = bytes.TrimSpace(secret)
+		if len(cfg.Secret) == 0 {
+			return nil, errors.Errorf("pod status webhook secret file %q is empty", c.PodStatusWebhookSecretFile)
+		}
+	}
+	return cfg, nil
+}
+
+func nodeIPs(ip string) []net.IP {
+	if parsed := net.ParseIP(ip); parsed != nil {
+		return []net.IP{parsed}
+	}
+	return nil
 }
@@ -0,0 +1,611 @@
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
+	"github.com/virtual-kubelet/virtual-kubelet/internal/manager"
+	"github.com/virtual-kubelet/virtual-kubelet/log"
+	"github.com/virtual-kubelet/virtual-kubelet/node"
+	"github.com/virtual-kubelet/virtual-kubelet/trace"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corev1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const (
+	podDeletedReason = "RemotePodDeleted"
+
+	// defaultResyncPeriod is how often the config maps and secrets of the pods are copied to the remote cluster again
+	// by default.
+	defaultResyncPeriod = time.Minute
+
+	// Values used in tracing as attribute keys.
+	namespaceKey = "namespace"
+	nameKey      = "name"
+)
+
+var _ node.PodNotifier = (*ClusterProvider)(nil)
+
+// Config contains the configurable parameters of a virtual node backed by a remote cluster.
+type Config struct {
+	// Kubeconfig is the path of the kubeconfig of the remote cluster.
+	Kubeconfig string `json:"kubeconfig,omitempty"`
+	// NamespacePrefix is prepended to the namespaces of the pods, config maps and secrets copied to the remote
+	// cluster. It defaults to the name of the node followed by a dash, so that several virtual nodes can share a
+	// remote cluster.
+	NamespacePrefix string `json:"namespacePrefix,omitempty"`
+	// NodeSelector is the label selector of the remote nodes whose capacity is reported as the capacity of the
+	// virtual node. By default, the capacity of all remote nodes is reported.
+	NodeSelector string `json:"nodeSelector,omitempty"`
+	// ResyncPeriod is how often the config maps and secrets the pods reference are copied to the remote cluster
+	// again, so that changes to them reach the remote pods. It defaults to a minute.
+	ResyncPeriod metav1.Duration `json:"resyncPeriod,omitempty"`
+}
+
+// ClusterProvider implements the virtual-kubelet provider interface by running pods in a remote Kubernetes cluster.
+//
+// The pods, and the config maps and secrets they reference, are copied to translated namespaces of the remote
+// cluster. The statuses of the remote pods are watched, and notified as the statuses of the local pods. Logs, exec,
+// attach and port forwarding are proxied to the remote kubelets through the remote API server.
+type ClusterProvider struct { //nolint:revive
+	nodeName           string
+	operatingSystem    string
+	internalIP         string
+	daemonEndpointPort int32
+	config             Config
+	nodeSelector       labels.Selector
+
+	resourceManager *manager.ResourceManager
+	remote          kubernetes.Interface
+	// restConfig is used to stream to the remote kubelets. If it is nil, streaming is not supported.
+	restConfig *rest.Config
+
+	informers informers.SharedInformerFactory
+	pods      corev1listers.PodLister
+	notifier  func(*v1.Pod)
+
+	// localPods holds the last version of each pod which was created or updated, keyed by "namespace/name".
+	// The remote pods are translated back to them, so that they compare equal to the pods in Kubernetes.
+	localPods sync.Map
+}
+
+// NewClusterProvider creates a ClusterProvider from the configuration file of the given node.
+func NewClusterProvider(configPath, nodeName, operatingSystem, internalIP string, daemonEndpointPort int32, rm *manager.ResourceManager) (*ClusterProvider, error) {
+	config, err := loadConfig(configPath, nodeName)
+	if err != nil {
+		return nil, err
+	}
+	restConfig, err := clientcmd.BuildConfigFromFlags("", config.Kubeconfig)
+	if err != nil {
+		return nil, errors.Wrap(err, "error loading kubeconfig of the remote cluster")
+	}
+	remote, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating client of the remote cluster")
+	}
+	return NewClusterProviderFromClient(config, remote, restConfig, nodeName, operatingSystem, internalIP, daemonEndpointPort, rm)
+}
+
+// NewClusterProviderFromClient creates a ClusterProvider which uses the given client of the remote cluster.
+// If restConfig is nil, logs are still supported, but exec, attach and port forwarding are not.
+func NewClusterProviderFromClient(config Config, remote kubernetes.Interface, restConfig *rest.Config, nodeName, operatingSystem, internalIP string, daemonEndpointPort int32, rm *manager.ResourceManager) (*ClusterProvider, error) {
+	if config.NamespacePrefix == "" {
+		config.NamespacePrefix = nodeName + "-"
+	}
+	if config.ResyncPeriod.Duration <= 0 {
+		config.ResyncPeriod.Duration = defaultResyncPeriod
+	}
+	nodeSelector, err := labels.Parse(config.NodeSelector)
+	if err != nil {
+		return nil, errdefs.AsInvalidInput(errors.Wrap(err, "invalid node selector"))
+	}
+
+	factory := informers.NewSharedInformerFactoryWithOptions(remote, 0,
+		informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+			opts.LabelSelector = labels.Set{NodeLabel: nodeName}.String()
+		}))
+	p := &ClusterProvider{
+		nodeName:           nodeName,
+		operatingSystem:    operatingSystem,
+		internalIP:         internalIP,
+		daemonEndpointPort: daemonEndpointPort,
+		config:             config,
+		nodeSelector:       nodeSelector,
+		resourceManager:    rm,
+		remote:             remote,
+		restConfig:         restConfig,
+		informers:          factory,
+		pods:               factory.Core().V1().Pods().Lister(),
+		notifier:           func(*v1.Pod) {},
+	}
+	return p, nil
+}
+
+// loadConfig loads the configuration of the node from the given json file, which maps node names to their
+// configuration.
+func loadConfig(configPath, nodeName string) (Config, error) {
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return Config{}, err
+	}
+	configs := map[string]Config{}
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return Config{}, err
+	}
+	config, ok := configs[nodeName]
+	if !ok {
+		return Config{}, errdefs.InvalidInputf("no configuration for node %q in %s", nodeName, configPath)
+	}
+	return config, nil
+}
+
+// NotifyPods starts watching the remote pods, and notifies the callback of their statuses. It returns once the remote
+// pods are listed, and must be called before any operations are done within the provider.
+// It also starts copying the config maps and secrets of the pods to the remote cluster periodically.
+func (p *ClusterProvider) NotifyPods(ctx context.Context, notifier func(*v1.Pod)) {
+	p.notifier = notifier
+
+	informer := p.informers.Core().V1().Pods().Informer()
+	_, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj any) {
+			p.notifyRemotePod(obj.(*v1.Pod), false)
+		},
+		UpdateFunc: func(_, obj any) {
+			p.notifyRemotePod(obj.(*v1.Pod), false)
+		},
+		DeleteFunc: func(obj any) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			if remote, ok := obj.(*v1.Pod); ok {
+				p.notifyRemotePod(remote, true)
+			}
+		},
+	})
+	if err != nil {
+		log.G(ctx).WithError(err).Error("Error watching remote pods")
+		return
+	}
+	p.informers.Start(ctx.Done())
+	// The remote pods are listed before returning, so that the pods which leaked while we were not running are
+	// known, and deleted, on startup.
+	if !cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+		log.G(ctx).Error("Error waiting for the remote pods to be listed")
+		return
+	}
+
+	go wait.UntilWithContext(ctx, p.resyncReferencedObjects, p.config.ResyncPeriod.Duration)
+}
+
+// resyncReferencedObjects copies the config maps and secrets the pods reference to the remote cluster again.
+func (p *ClusterProvider) resyncReferencedObjects(ctx context.Context) {
+	ctx, span := trace.StartSpan(ctx, "cluster.resyncReferencedObjects")
+	defer span.End()
+
+	p.localPods.Range(func(_, value any) bool {
+		pod := value.(*v1.Pod)
+		if _, err := p.syncReferencedObjects(ctx, pod); err != nil {
+			log.G(ctx).WithError(err).WithField("pod", pod.Namespace+"/"+pod.Name).Warn("Error syncing referenced objects")
+		}
+		return ctx.Err() == nil
+	})
+}
+
+func (p *ClusterProvider) notifyRemotePod(remote *v1.Pod, deleted bool) {
+	pod, ok := p.toLocalPod(remote)
+	if !ok {
+		return
+	}
+	if deleted {
+		p.localPods.Delete(pod.Namespace + "/" + pod.Name)
+		pod = terminated(pod)
+	}
+	p.notifier(pod)
+}
+
+// CreatePod copies the config maps and secrets the pod references to the remote cluster, and creates the pod there.
+func (p *ClusterProvider) CreatePod(ctx context.Context, pod *v1.Pod) error {
+	ctx, span := trace.StartSpan(ctx, "cluster.CreatePod")
+	defer span.End()
+	ctx = addAttributes(ctx, span, namespaceKey, pod.Namespace, nameKey, pod.Name)
+
+	p.localPods.Store(pod.Namespace+"/"+pod.Name, pod.DeepCopy())
+	remote := p.toRemotePod(pod)
+	if err := p.ensureNamespace(ctx, remote.Namespace); err != nil {
+		span.SetStatus(err)
+		return err
+	}
+	synced, err := p.syncReferencedObjects(ctx, pod)
+	if err != nil {
+		span.SetStatus(err)
+		return err
+	}
+
+	created, err := p.remote.CoreV1().Pods(remote.Namespace).Create(ctx, remote, metav1.CreateOptions{})
+	if k8serrors.IsAlreadyExists(err) {
+		// The pod may have been created by a previous attempt, whose result was lost.
+		created, err = p.remote.CoreV1().Pods(remote.Namespace).Get(ctx, remote.Name, metav1.GetOptions{})
+		if err == nil && !isRemotePodOf(created, pod) {
+			err = errors.Errorf("remote pod %s/%s belongs to another pod", remote.Namespace, remote.Name)
+		}
+	}
+	if err != nil {
+		err = errors.Wrap(err, "error creating remote pod")
+		span.SetStatus(err)
+		return err
+	}
+
+	// The copied objects are garbage collected by the remote cluster once all the pods which reference them are
+	// deleted.
+	owner := metav1.OwnerReference{APIVersion: "v1", Kind: "Pod", Name: created.Name, UID: created.UID}
+	for _, obj := range synced {
+		if err := obj.addOwner(ctx, owner); err != nil {
+			log.G(ctx).WithError(err).Warn("Error adding owner reference to remote object")
+		}
+	}
+	log.G(ctx).Debug("Created remote pod")
+	return nil
+}
+
+// UpdatePod updates the mutable fields of the remote pod: its labels, annotations, container images and active
+// deadline. The config maps and secrets it references are copied to the remote cluster again.
+func (p *ClusterProvider) UpdatePod(ctx context.Context, pod *v1.Pod) error {
+	ctx, span := trace.StartSpan(ctx, "cluster.UpdatePod")
+	defer span.End()
+	ctx = addAttributes(ctx, span, namespaceKey, pod.Namespace, nameKey, pod.Name)
+
+	desired := p.toRemotePod(pod)
+	pods := p.remote.CoreV1().Pods(desired.Namespace)
+	remote, err := pods.Get(ctx, desired.Name, metav1.GetOptions{})
+	if err != nil {
+		if k8serrors.IsNotFound(err) {
+			return errdefs.AsNotFound(err)
+		}
+		return errors.Wrap(err, "error getting remote pod")
+	}
+	if !isRemotePodOf(remote, pod) {
+		return errdefs.NotFoundf("remote pod %s/%s belongs to another pod", remote.Namespace, remote.Name)
+	}
+	p.localPods.Store(pod.Namespace+"/"+pod.Name, pod.DeepCopy())
+	if _, err := p.syncReferencedObjects(ctx, pod); err != nil {
+		span.SetStatus(err)
+		return err
+	}
+
+	remote.Labels = desired.Labels
+	remote.Annotations = desired.Annotations
+	remote.Spec.ActiveDeadlineSeconds = desired.Spec.ActiveDeadlineSeconds
+	for i := range remote.Spec.InitContainers {
+		if i < len(desired.Spec.InitContainers) {
+			remote.Spec.InitContainers[i].Image = desired.Spec.InitContainers[i].Image
+		}
+	}
+	for i := range remote.Spec.Containers {
+		if i < len(desired.Spec.Containers) {
+			remote.Spec.Containers[i].Image = desired.Spec.Containers[i].Image
+		}
+	}
+	if _, err := pods.Update(ctx, remote, metav1.UpdateOptions{}); err != nil {
+		err = errors.Wrap(err, "error updating remote pod")
+		span.SetStatus(err)
+		return err
+	}
+	return nil
+}
+
+// DeletePod deletes the remote pod. The terminal status of the pod is notified once the remote pod is gone.
+func (p *ClusterProvider) DeletePod(ctx context.Context, pod *v1.Pod) error {
+	ctx, span := trace.StartSpan(ctx, "cluster.DeletePod")
+	defer span.End()
+	ctx = addAttributes(ctx, span, namespaceKey, pod.Namespace, nameKey, pod.Name)
+
+	opts := metav1.DeleteOptions{GracePeriodSeconds: pod.DeletionGracePeriodSeconds}
+	if remote, err := p.pods.Pods(p.remoteNamespace(pod.Namespace)).Get(pod.Name); err == nil {
+		if !isRemotePodOf(remote, pod) {
+			return errdefs.NotFoundf("remote pod %s/%s belongs to another pod", remote.Namespace, remote.Name)
+		}
+		if remote.UID != "" {
+			// Make sure a pod of the same name which replaced the remote pod in the meantime is not deleted.
+			opts.Preconditions = metav1.NewUIDPreconditions(string(remote.UID))
+		}
+	}
+	err := p.remote.CoreV1().Pods(p.remoteNamespace(pod.Namespace)).Delete(ctx, pod.Name, opts)
+	if err != nil {
+		if k8serrors.IsNotFound(err) {
+			return errdefs.AsNotFound(err)
+		}
+		err = errors.Wrap(err, "error deleting remote pod")
+		span.SetStatus(err)
+		return err
+	}
+	log.G(ctx).Debug("Deleted remote pod")
+	return nil
+}
+
+// GetPod returns the local pod of the remote pod.
+func (p *ClusterProvider) GetPod(ctx context.Context, namespace, name string) (*v1.Pod, error) {
+	_, span := trace.StartSpan(ctx, "cluster.GetPod")
+	defer span.End()
+
+	remote, err := p.pods.Pods(p.remoteNamespace(namespace)).Get(name)
+	if err != nil {
+		if k8serrors.IsNotFound(err) {
+			return nil, errdefs.NotFoundf("pod \"%s/%s\" is not known to the provider", namespace, name)
+		}
+		return nil, err
+	}
+	pod, ok := p.toLocalPod(remote)
+	if !ok {
+		return nil, errdefs.NotFoundf("pod \"%s/%s\" is not known to the provider", namespace, name)
+	}
+	return pod, nil
+}
+
+// GetPodStatus returns the status of the remote pod.
+func (p *ClusterProvider) GetPodStatus(ctx context.Context, namespace, name string) (*v1.PodStatus, error) {
+	pod, err := p.GetPod(ctx, namespace, name)
+	if err != nil {
+		return nil, err
+	}
+	return &pod.Status, nil
+}
+
+// GetPods returns the local pods of all remote pods of the node.
+func (p *ClusterProvider) GetPods(ctx context.Context) ([]*v1.Pod, error) {
+	_, span := trace.StartSpan(ctx, "cluster.GetPods")
+	defer span.End()
+
+	remotes, err := p.pods.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	pods := make([]*v1.Pod, 0, len(remotes))
+	for _, remote := range remotes {
+		if pod, ok := p.toLocalPod(remote); ok {
+			pods = append(pods, pod)
+		}
+	}
+	return pods, nil
+}
+
+// ConfigureNode reports the allocatable resources of the ready and schedulable remote nodes as the capacity of the
+// virtual node.
+func (p *ClusterProvider) ConfigureNode(ctx context.Context, n *v1.Node) {
+	ctx, span := trace.StartSpan(ctx, "cluster.ConfigureNode")
+	defer span.End()
+
+	capacity := v1.ResourceList{}
+	ready := 0
+	nodes, err := p.remote.CoreV1().Nodes().List(ctx, metav1.ListOptions{LabelSelector: p.nodeSelector.String()})
+	if err != nil {
+		span.SetStatus(err)
+		log.G(ctx).WithError(err).Error("Error listing remote nodes")
+	} else {
+		for _, remote := range nodes.Items {
+			if remote.Spec.Unschedulable || !isNodeReady(&remote) {
+				continue
+			}
+			ready++
+			for name, q := range remote.Status.Allocatable {
+				total := capacity[name]
+				total.Add(q)
+				capacity[name] = total
+			}
+		}
+	}
+
+	n.Status.Capacity = capacity
+	n.Status.Allocatable = capacity.DeepCopy()
+	n.Status.Conditions = nodeConditions(ready)
+	n.Status.Addresses = []v1.NodeAddress{{Type: v1.NodeInternalIP, Address: p.internalIP}}
+	n.Status.DaemonEndpoints = v1.NodeDaemonEndpoints{KubeletEndpoint: v1.DaemonEndpoint{Port: p.daemonEndpointPort}}
+	os := p.operatingSystem
+	if os == "" {
+		os = "linux"
+	}
+	n.Status.NodeInfo.OperatingSystem = os
+	n.Labels["node.kubernetes.io/exclude-from-external-load-balancers"] = "true"
+}
+
+func isNodeReady(n *v1.Node) bool {
+	for _, c := range n.Status.Conditions {
+		if c.Type == v1.NodeReady {
+			return c.Status == v1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// nodeConditions returns the conditions of the virtual node, which is ready if any remote node is.
+func nodeConditions(ready int) []v1.NodeCondition {
+	now := metav1.Now()
+	readyCondition := v1.NodeCondition{
+		Type:               v1.NodeReady,
+		Status:             v1.ConditionTrue,
+		LastHeartbeatTime:  now,
+		LastTransitionTime: now,
+		Reason:             "KubeletReady",
+		Message:            fmt.Sprintf("%d remote nodes are ready", ready),
+	}
+	if ready == 0 {
+		readyCondition.Status = v1.ConditionFalse
+		readyCondition.Reason = "KubeletNotReady"
+		readyCondition.Message = "no remote nodes are ready"
+	}
+	conditions := []v1.NodeCondition{readyCondition}
+	for _, t := range []v1.NodeConditionType{v1.NodeMemoryPressure, v1.NodeDiskPressure, v1.NodePIDPressure, v1.NodeNetworkUnavailable} {
+		conditions = append(conditions, v1.NodeCondition{
+			Type:               t,
+			Status:             v1.ConditionFalse,
+			LastHeartbeatTime:  now,
+			LastTransitionTime: now,
+		})
+	}
+	return conditions
+}
+
+// ensureNamespace creates the remote namespace if it does not exist.
+func (p *ClusterProvider) ensureNamespace(ctx context.Context, name string) error {
+	ns := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{NodeLabel: p.nodeName}}}
+	_, err := p.remote.CoreV1().Namespaces().Create(ctx, ns, metav1.CreateOptions{})
+	if err != nil && !k8serrors.IsAlreadyExists(err) {
+		return errors.Wrapf(err, "error creating remote namespace %q", name)
+	}
+	return nil
+}
+
+// remoteObject is a config map or secret copied to the remote cluster.
+type remoteObject struct {
+	addOwner func(context.Context, metav1.OwnerReference) error
+}
+
+// syncReferencedObjects copies the config maps and secrets the pod references to the remote cluster. Objects which
+// do not exist are skipped, so that the remote kubelet reports them as missing unless they are optional.
+func (p *ClusterProvider) syncReferencedObjects(ctx context.Context, pod *v1.Pod) ([]remoteObject, error) {
+	configMaps, secrets := referencedObjects(pod)
+	var synced []remoteObject
+
+	for _, name := range configMaps {
+		local, err := p.resourceManager.GetConfigMap(name, pod.Namespace)
+		if err != nil {
+			if k8serrors.IsNotFound(err) {
+				log.G(ctx).WithField("configMap", name).Debug("Skipping missing config map")
+				continue
+			}
+			return nil, errors.Wrapf(err, "error getting config map %q", name)
+		}
+		obj, err := p.syncConfigMap(ctx, local)
+		if err != nil {
+			return nil, err
+		}
+		synced = append(synced, obj)
+	}
+
+	for _, name := range secrets {
+		local, err := p.resourceManager.GetSecret(name, pod.Namespace)
+		if err != nil {
+			if k8serrors.IsNotFound(err) {
+				log.G(ctx).WithField("secret", name).Debug("Skipping missing secret")
+				continue
+			}
+			return nil, errors.Wrapf(err, "error getting secret %q", name)
+		}
+		obj, err := p.syncSecret(ctx, local)
+		if err != nil {
+			return nil, err
+		}
+		synced = append(synced, obj)
+	}
+	return synced, nil
+}
+
+func (p *ClusterProvider) syncConfigMap(ctx context.Context, local *v1.ConfigMap) (remoteObject, error) {
+	desired := &v1.ConfigMap{
+		ObjectMeta: p.remoteMeta(local.ObjectMeta),
+		Data:       local.Data,
+		BinaryData: local.BinaryData,
+	}
+	client := p.remote.CoreV1().ConfigMaps(desired.Namespace)
+	existing, err := client.Get(ctx, desired.Name, metav1.GetOptions{})
+	switch {
+	case k8serrors.IsNotFound(err):
+		_, err = client.Create(ctx, desired, metav1.CreateOptions{})
+	case err == nil && !(equality.Semantic.DeepEqual(existing.Labels, desired.Labels) &&
+		equality.Semantic.DeepEqual(existing.Data, desired.Data) &&
+		equality.Semantic.DeepEqual(existing.BinaryData, desired.BinaryData)):
+		existing.Labels, existing.Data, existing.BinaryData = desired.Labels, desired.Data, desired.BinaryData
+		_, err = client.Update(ctx, existing, metav1.UpdateOptions{})
+	}
+	if err != nil {
+		return remoteObject{}, errors.Wrapf(err, "error copying config map %q to the remote cluster", local.Name)
+	}
+	return remoteObject{addOwner: func(ctx context.Context, owner metav1.OwnerReference) error {
+		existing, err := client.Get(ctx, desired.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if !addOwnerReference(&existing.ObjectMeta, owner) {
+			return nil
+		}
+		_, err = client.Update(ctx, existing, metav1.UpdateOptions{})
+		return err
+	}}, nil
+}
+
+func (p *ClusterProvider) syncSecret(ctx context.Context, local *v1.Secret) (remoteObject, error) {
+	desired := &v1.Secret{
+		ObjectMeta: p.remoteMeta(local.ObjectMeta),
+		Data:       local.Data,
+		Type:       local.Type,
+	}
+	// Service account tokens would be managed by the remote cluster.
+	if desired.Type == v1.SecretTypeServiceAccountToken {
+		desired.Type = v1.SecretTypeOpaque
+		delete(desired.Annotations, v1.ServiceAccountNameKey)
+		delete(desired.Annotations, v1.ServiceAccountUIDKey)
+	}
+	client := p.remote.CoreV1().Secrets(desired.Namespace)
+	existing, err := client.Get(ctx, desired.Name, metav1.GetOptions{})
+	switch {
+	case k8serrors.IsNotFound(err):
+		_, err = client.Create(ctx, desired, metav1.CreateOptions{})
+	case err == nil && !(equality.Semantic.DeepEqual(existing.Labels, desired.Labels) &&
+		equality.Semantic.DeepEqual(existing.Data, desired.Data)):
+		existing.Labels, existing.Data = desired.Labels, desired.Data
+		_, err = client.Update(ctx, existing, metav1.UpdateOptions{})
+	}
+	if err != nil {
+		return remoteObject{}, errors.Wrapf(err, "error copying secret %q to the remote cluster", local.Name)
+	}
+	return remoteObject{addOwner: func(ctx context.Context, owner metav1.OwnerReference) error {
+		existing, err := client.Get(ctx, desired.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if !addOwnerReference(&existing.ObjectMeta, owner) {
+			return nil
+		}
+		_, err = client.Update(ctx, existing, metav1.UpdateOptions{})
+		return err
+	}}, nil
+}
+
+// addOwnerReference adds the owner reference to the object, and returns whether it was missing.
+func addOwnerReference(meta *metav1.ObjectMeta, owner metav1.OwnerReference) bool {
+	for _, ref := range meta.OwnerReferences {
+		if ref.UID == owner.UID && ref.Name == owner.Name {
+			return false
+		}
+	}
+	meta.OwnerReferences = append(meta.OwnerReferences, owner)
+	return true
+}
+
+// addAttributes adds the specified attributes to the provided span.
+// attrs must be an even-sized list of string arguments.
+// Otherwise, the span won't be modified.
+func addAttributes(ctx context.Context, span trace.Span, attrs ...string) context.Context {
+	if len(attrs)%2 == 1 {
+		return ctx
+	}
+	for i := 0; i < len(attrs); i += 2 {
+		ctx = span.WithField(ctx, attrs[i], attrs[i+1])
+	}
+	return ctx
+}
@@ -0,0 +1,345 @@
+package cluster
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
+	"github.com/virtual-kubelet/virtual-kubelet/internal/manager"
+	"github.com/virtual-kubelet/virtual-kubelet/node"
+	"github.com/virtual-kubelet/virtual-kubelet/node/api"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	kubeinformers "k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	corev1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+)
+
+const testNodeName = "vk"
+
+func newTestProvider(t *testing.T, objs ...any) (*ClusterProvider, *fake.Clientset) {
+	t.Helper()
+
+	indexer := func() cache.Indexer {
+		return cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	}
+	pods, secrets, configMaps, services := indexer(), indexer(), indexer(), indexer()
+	for _, obj := range objs {
+		switch obj.(type) {
+		case *v1.Secret:
+			assert.NilError(t, secrets.Add(obj))
+		case *v1.ConfigMap:
+			assert.NilError(t, configMaps.Add(obj))
+		}
+	}
+	rm, err := manager.NewResourceManager(
+		corev1listers.NewPodLister(pods),
+		corev1listers.NewSecretLister(secrets),
+		corev1listers.NewConfigMapLister(configMaps),
+		corev1listers.NewServiceLister(services),
+	)
+	assert.NilError(t, err)
+
+	remote := fake.NewSimpleClientset()
+	p, err := NewClusterProviderFromClient(Config{}, remote, nil, testNodeName, "linux", "10.0.0.1", 10250, rm)
+	assert.NilError(t, err)
+	return p, remote
+}
+
+func newTestPod() *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "pod", UID: "uid", Labels: map[string]string{"app": "test"}},
+		Spec: v1.PodSpec{
+			NodeName:           testNodeName,
+			ServiceAccountName: "default",
+			Containers: []v1.Container{{
+				Name:  "c",
+				Image: "image",
+				EnvFrom: []v1.EnvFromSource{{
+					ConfigMapRef: &v1.ConfigMapEnvSource{LocalObjectReference: v1.LocalObjectReference{Name: "config"}},
+				}},
+				VolumeMounts: []v1.VolumeMount{
+					{Name: "secret", MountPath: "/secret"},
+					{Name: "token", MountPath: "/var/run/secrets/kubernetes.io/serviceaccount"},
+				},
+			}},
+			Volumes: []v1.Volume{
+				{Name: "secret", VolumeSource: v1.VolumeSource{Secret: &v1.SecretVolumeSource{SecretName: "secret"}}},
+				{Name: "token", VolumeSource: v1.VolumeSource{Projected: &v1.ProjectedVolumeSource{
+					Sources: []v1.VolumeProjection{{ServiceAccountToken: &v1.ServiceAccountTokenProjection{Path: "token"}}},
+				}}},
+			},
+		},
+	}
+}
+
+func TestCreatePod(t *testing.T) {
+	ctx := context.Background()
+	p, remote := newTestProvider(t,
+		&v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "config"}, Data: map[string]string{"k": "v"}},
+		&v1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "secret"}, Data: map[string][]byte{"k": []byte("v")}},
+	)
+
+	pod := newTestPod()
+	assert.NilError(t, p.CreatePod(ctx, pod))
+	// Creating the pod again, as after a lost result, succeeds.
+	assert.NilError(t, p.CreatePod(ctx, pod))
+
+	_, err := remote.CoreV1().Namespaces().Get(ctx, "vk-default", metav1.GetOptions{})
+	assert.NilError(t, err)
+	cm, err := remote.CoreV1().ConfigMaps("vk-default").Get(ctx, "config", metav1.GetOptions{})
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(cm.Data["k"], "v"))
+	assert.Check(t, is.Equal(cm.Labels[NodeLabel], testNodeName))
+	assert.Check(t, is.Len(cm.OwnerReferences, 1))
+	secret, err := remote.CoreV1().Secrets("vk-default").Get(ctx, "secret", metav1.GetOptions{})
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(string(secret.Data["k"]), "v"))
+
+	created, err := remote.CoreV1().Pods("vk-default").Get(ctx, "pod", metav1.GetOptions{})
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(created.Labels[NodeLabel], testNodeName))
+	assert.Check(t, is.Equal(created.Labels["app"], "test"))
+	assert.Check(t, is.Equal(created.Annotations[originUIDAnnotation], "uid"))
+	assert.Check(t, is.Equal(created.Spec.NodeName, ""))
+	assert.Check(t, is.Equal(created.Spec.ServiceAccountName, ""))
+	assert.Check(t, is.Len(created.Spec.Volumes, 1))
+	assert.Check(t, is.Len(created.Spec.Containers[0].VolumeMounts, 1))
+
+	// A pod of the same name which belongs to another local pod is not taken over.
+	other := newTestPod()
+	other.UID = "other"
+	assert.Check(t, p.CreatePod(ctx, other) != nil)
+}
+
+func TestNotifyPods(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p, remote := newTestProvider(t)
+
+	notified := make(chan *v1.Pod, 10)
+	p.NotifyPods(ctx, func(pod *v1.Pod) {
+		notified <- pod
+	})
+	next := func() *v1.Pod {
+		t.Helper()
+		select {
+		case pod := <-notified:
+			return pod
+		case <-time.After(10 * time.Second):
+			t.Fatal("timed out waiting for notification")
+			return nil
+		}
+	}
+
+	pod := newTestPod()
+	assert.NilError(t, p.CreatePod(ctx, pod))
+	assert.Check(t, is.Equal(next().Name, "pod"))
+
+	created, err := remote.CoreV1().Pods("vk-default").Get(ctx, "pod", metav1.GetOptions{})
+	assert.NilError(t, err)
+	created.Status.Phase = v1.PodRunning
+	_, err = remote.CoreV1().Pods("vk-default").UpdateStatus(ctx, created, metav1.UpdateOptions{})
+	assert.NilError(t, err)
+
+	running := next()
+	assert.Check(t, is.Equal(running.Namespace, "default"))
+	assert.Check(t, is.Equal(running.Name, "pod"))
+	assert.Check(t, is.Equal(string(running.UID), "uid"))
+	assert.Check(t, is.Equal(running.Status.Phase, v1.PodRunning))
+	assert.Check(t, is.Equal(running.Status.HostIP, "10.0.0.1"))
+	// The local pod is restored, so that it compares equal to the pod in Kubernetes.
+	assert.Check(t, is.DeepEqual(running.Spec, pod.Spec))
+	assert.Check(t, is.DeepEqual(running.Labels, pod.Labels))
+
+	got, err := p.GetPod(ctx, "default", "pod")
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(got.Status.Phase, v1.PodRunning))
+	pods, err := p.GetPods(ctx)
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(pods, 1))
+
+	assert.NilError(t, p.DeletePod(ctx, pod))
+	deleted := next()
+	assert.Check(t, is.Equal(deleted.Status.Phase, v1.PodSucceeded))
+	assert.Check(t, is.Equal(deleted.Status.Reason, podDeletedReason))
+
+	_, err = p.GetPod(ctx, "default", "missing")
+	assert.Check(t, errdefs.IsNotFound(err))
+}
+
+func TestConfigureNode(t *testing.T) {
+	ctx := context.Background()
+	p, remote := newTestProvider(t)
+
+	newNode := func(name string, ready v1.ConditionStatus, unschedulable bool) *v1.Node {
+		return &v1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec:       v1.NodeSpec{Unschedulable: unschedulable},
+			Status: v1.NodeStatus{
+				Allocatable: v1.ResourceList{
+					v1.ResourceCPU:    resource.MustParse("2"),
+					v1.ResourceMemory: resource.MustParse("4Gi"),
+				},
+				Conditions: []v1.NodeCondition{{Type: v1.NodeReady, Status: ready}},
+			},
+		}
+	}
+	for _, n := range []*v1.Node{
+		newNode("a", v1.ConditionTrue, false),
+		newNode("b", v1.ConditionTrue, false),
+		newNode("not-ready", v1.ConditionFalse, false),
+		newNode("cordoned", v1.ConditionTrue, true),
+	} {
+		_, err := remote.CoreV1().Nodes().Create(ctx, n, metav1.CreateOptions{})
+		assert.NilError(t, err)
+	}
+
+	n := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: testNodeName, Labels: map[string]string{}}}
+	p.ConfigureNode(ctx, n)
+	cpu := n.Status.Capacity[v1.ResourceCPU]
+	memory := n.Status.Allocatable[v1.ResourceMemory]
+	assert.Check(t, is.Equal(cpu.String(), "4"))
+	assert.Check(t, is.Equal(memory.String(), "8Gi"))
+	assert.Check(t, is.Equal(n.Status.Conditions[0].Type, v1.NodeReady))
+	assert.Check(t, is.Equal(n.Status.Conditions[0].Status, v1.ConditionTrue))
+	assert.Check(t, is.Equal(n.Status.NodeInfo.OperatingSystem, "linux"))
+	assert.Check(t, is.Equal(n.Status.DaemonEndpoints.KubeletEndpoint.Port, int32(10250)))
+}
+
+func TestStreaming(t *testing.T) {
+	ctx := context.Background()
+	p, _ := newTestProvider(t)
+
+	logs, err := p.GetContainerLogs(ctx, "default", "pod", "c", api.ContainerLogOpts{Tail: 10})
+	assert.NilError(t, err)
+	data, err := io.ReadAll(logs)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(string(data), "fake logs"))
+
+	// Exec and port forwarding need a rest config to stream to the remote cluster.
+	err = p.RunInContainer(ctx, "default", "pod", "c", []string{"sh"}, testAttachIO{})
+	assert.Check(t, errdefs.IsInvalidInput(err))
+	err = p.PortForward(ctx, "default", "pod", 80, nil)
+	assert.Check(t, errdefs.IsInvalidInput(err))
+}
+
+type testAttachIO struct{}
+
+func (testAttachIO) Stdin() io.Reader            { return nil }
+func (testAttachIO) Stdout() io.WriteCloser      { return nil }
+func (testAttachIO) Stderr() io.WriteCloser      { return nil }
+func (testAttachIO) TTY() bool                   { return false }
+func (testAttachIO) Resize() <-chan api.TermSize { return nil }
+
+func TestRemoteNamespace(t *testing.T) {
+	p := &ClusterProvider{config: Config{NamespacePrefix: "vk-"}}
+	assert.Check(t, is.Equal(p.remoteNamespace("default"), "vk-default"))
+
+	long := p.remoteNamespace(strings.Repeat("a", 63))
+	assert.Check(t, is.Len(long, maxNamespaceLength))
+	assert.Check(t, long != p.remoteNamespace(strings.Repeat("a", 62)+"b"))
+}
+
+func TestPodControllerEndToEnd(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	local := fake.NewSimpleClientset(&v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "config"},
+		Data:       map[string]string{"k": "v"},
+	})
+	informers := kubeinformers.NewSharedInformerFactory(local, 0)
+	rm, err := manager.NewResourceManager(
+		informers.Core().V1().Pods().Lister(),
+		informers.Core().V1().Secrets().Lister(),
+		informers.Core().V1().ConfigMaps().Lister(),
+		informers.Core().V1().Services().Lister(),
+	)
+	assert.NilError(t, err)
+
+	remote := fake.NewSimpleClientset()
+	config := Config{ResyncPeriod: metav1.Duration{Duration: 100 * time.Millisecond}}
+	p, err := NewClusterProviderFromClient(config, remote, nil, testNodeName, "linux", "10.0.0.1", 10250, rm)
+	assert.NilError(t, err)
+
+	pc, err := node.NewPodController(node.PodControllerConfig{
+		PodClient:         local.CoreV1(),
+		PodInformer:       informers.Core().V1().Pods(),
+		EventRecorder:     &record.FakeRecorder{},
+		Provider:          p,
+		ConfigMapInformer: informers.Core().V1().ConfigMaps(),
+		SecretInformer:    informers.Core().V1().Secrets(),
+		ServiceInformer:   informers.Core().V1().Services(),
+	})
+	assert.NilError(t, err)
+	informers.Start(ctx.Done())
+	go pc.Run(ctx, 1) //nolint:errcheck
+	select {
+	case <-pc.Ready():
+	case <-pc.Done():
+		t.Fatal(pc.Err())
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for the pod controller to be ready")
+	}
+
+	waitFor := func(msg string, condition func() bool) {
+		t.Helper()
+		err := wait.PollUntilContextCancel(ctx, 10*time.Millisecond, true, func(context.Context) (bool, error) {
+			return condition(), nil
+		})
+		assert.NilError(t, err, msg)
+	}
+
+	// Environment variables are resolved by the pod controller, so only the volumes reference the config map.
+	pod := newTestPod()
+	pod.Spec.Containers[0].EnvFrom = nil
+	pod.Spec.Containers[0].VolumeMounts[0] = v1.VolumeMount{Name: "config", MountPath: "/config"}
+	pod.Spec.Volumes[0] = v1.Volume{Name: "config", VolumeSource: v1.VolumeSource{
+		ConfigMap: &v1.ConfigMapVolumeSource{LocalObjectReference: v1.LocalObjectReference{Name: "config"}},
+	}}
+	_, err = local.CoreV1().Pods("default").Create(ctx, pod, metav1.CreateOptions{})
+	assert.NilError(t, err)
+
+	var created *v1.Pod
+	waitFor("pod was not created in the remote cluster", func() bool {
+		created, err = remote.CoreV1().Pods("vk-default").Get(ctx, "pod", metav1.GetOptions{})
+		return err == nil
+	})
+	assert.Check(t, is.Equal(created.Annotations[originUIDAnnotation], "uid"))
+
+	created.Status.Phase = v1.PodRunning
+	_, err = remote.CoreV1().Pods("vk-default").UpdateStatus(ctx, created, metav1.UpdateOptions{})
+	assert.NilError(t, err)
+	waitFor("remote status was not propagated", func() bool {
+		got, err := local.CoreV1().Pods("default").Get(ctx, "pod", metav1.GetOptions{})
+		return err == nil && got.Status.Phase == v1.PodRunning && got.Status.HostIP == "10.0.0.1"
+	})
+
+	// Changes to the config maps the pod references are copied to the remote cluster.
+	_, err = local.CoreV1().ConfigMaps("default").Update(ctx, &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "config"},
+		Data:       map[string]string{"k": "changed"},
+	}, metav1.UpdateOptions{})
+	assert.NilError(t, err)
+	waitFor("config map was not resynced", func() bool {
+		cm, err := remote.CoreV1().ConfigMaps("vk-default").Get(ctx, "config", metav1.GetOptions{})
+		return err == nil && cm.Data["k"] == "changed"
+	})
+
+	assert.NilError(t, local.CoreV1().Pods("default").Delete(ctx, "pod", metav1.DeleteOptions{}))
+	waitFor("pod was not deleted from the remote cluster", func() bool {
+		_, err := remote.CoreV1().Pods("vk-default").Get(ctx, "pod", metav1.GetOptions{})
+		return apierrors.IsNotFound(err)
+	})
+}
@@ -0,0 +1,289 @@
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
+	"github.com/virtual-kubelet/virtual-kubelet/log"
+	"github.com/virtual-kubelet/virtual-kubelet/node/api"
+	"github.com/virtual-kubelet/virtual-kubelet/trace"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/portforward"
+	"k8s.io/client-go/tools/remotecommand"
+	"k8s.io/client-go/transport/spdy"
+	stats "k8s.io/kubelet/pkg/apis/stats/v1alpha1"
+)
+
+// GetContainerLogs streams the logs of the container of the remote pod.
+func (p *ClusterProvider) GetContainerLogs(ctx context.Context, namespace, podName, containerName string, opts api.ContainerLogOpts) (io.ReadCloser, error) {
+	ctx, span := trace.StartSpan(ctx, "cluster.GetContainerLogs")
+	defer span.End()
+
+	logOpts := &v1.PodLogOptions{
+		Container:  containerName,
+		Follow:     opts.Follow,
+		Previous:   opts.Previous,
+		Timestamps: opts.Timestamps,
+	}
+	if opts.Tail > 0 {
+		tail := int64(opts.Tail)
+		logOpts.TailLines = &tail
+	}
+	if opts.LimitBytes > 0 {
+		limit := int64(opts.LimitBytes)
+		logOpts.LimitBytes = &limit
+	}
+	if opts.SinceSeconds > 0 {
+		since := int64(opts.SinceSeconds)
+		logOpts.SinceSeconds = &since
+	}
+	if !opts.SinceTime.IsZero() {
+		since := metav1.NewTime(opts.SinceTime)
+		logOpts.SinceTime = &since
+	}
+
+	logs, err := p.remote.CoreV1().Pods(p.remoteNamespace(namespace)).GetLogs(podName, logOpts).Stream(ctx)
+	if err != nil {
+		err = errors.Wrap(err, "error streaming logs of remote pod")
+		span.SetStatus(err)
+		return nil, err
+	}
+	return logs, nil
+}
+
+// RunInContainer executes the command in the container of the remote pod.
+func (p *ClusterProvider) RunInContainer(ctx context.Context, namespace, name, container string, cmd []string, attach api.AttachIO) error {
+	ctx, span := trace.StartSpan(ctx, "cluster.RunInContainer")
+	defer span.End()
+
+	err := p.stream(ctx, namespace, name, "exec", &v1.PodExecOptions{
+		Container: container,
+		Command:   cmd,
+		Stdin:     attach.Stdin() != nil,
+		Stdout:    attach.Stdout() != nil,
+		Stderr:    attach.Stderr() != nil && !attach.TTY(),
+		TTY:       attach.TTY(),
+	}, attach)
+	span.SetStatus(err)
+	return err
+}
+
+// AttachToContainer attaches to the container of the remote pod.
+func (p *ClusterProvider) AttachToContainer(ctx context.Context, namespace, name, container string, attach api.AttachIO) error {
+	ctx, span := trace.StartSpan(ctx, "cluster.AttachToContainer")
+	defer span.End()
+
+	err := p.stream(ctx, namespace, name, "attach", &v1.PodAttachOptions{
+		Container: container,
+		Stdin:     attach.Stdin() != nil,
+		Stdout:    attach.Stdout() != nil,
+		Stderr:    attach.Stderr() != nil && !attach.TTY(),
+		TTY:       attach.TTY(),
+	}, attach)
+	span.SetStatus(err)
+	return err
+}
+
+// stream streams the exec or attach subresource of the remote pod.
+func (p *ClusterProvider) stream(ctx context.Context, namespace, name, subresource string, opts runtime.Object, attach api.AttachIO) error {
+	if p.restConfig == nil {
+		return errdefs.InvalidInputf("%s is not supported without a rest config of the remote cluster", subresource)
+	}
+
+	req := p.remote.CoreV1().RESTClient().Post().
+		Resource("pods").
+		Namespace(p.remoteNamespace(namespace)).
+		Name(name).
+		SubResource(subresource).
+		VersionedParams(opts, scheme.ParameterCodec)
+	executor, err := remotecommand.NewSPDYExecutor(p.restConfig, http.MethodPost, req.URL())
+	if err != nil {
+		return errors.Wrapf(err, "error creating %s stream to remote pod", subresource)
+	}
+
+	streamOpts := remotecommand.StreamOptions{
+		Stdin: attach.Stdin(),
+		Tty:   attach.TTY(),
+	}
+	if out := attach.Stdout(); out != nil {
+		streamOpts.Stdout = out
+	}
+	if errOut := attach.Stderr(); errOut != nil && !attach.TTY() {
+		streamOpts.Stderr = errOut
+	}
+	if attach.TTY() {
+		streamOpts.TerminalSizeQueue = &terminalSizeQueue{ctx: ctx, resize: attach.Resize()}
+	}
+	return executor.StreamWithContext(ctx, streamOpts)
+}
+
+// terminalSizeQueue passes the terminal sizes of the attached client to the remote pod.
+type terminalSizeQueue struct {
+	ctx    context.Context
+	resize <-chan api.TermSize
+}
+
+func (q *terminalSizeQueue) Next() *remotecommand.TerminalSize {
+	select {
+	case <-q.ctx.Done():
+		return nil
+	case size, ok := <-q.resize:
+		if !ok {
+			return nil
+		}
+		return &remotecommand.TerminalSize{Width: size.Width, Height: size.Height}
+	}
+}
+
+// PortForward forwards the stream to the port of the remote pod.
+//
+// Based on the handling of connections by the port forwarder of k8s.io/client-go/tools/portforward.
+func (p *ClusterProvider) PortForward(ctx context.Context, namespace, pod string, port int32, stream io.ReadWriteCloser) error {
+	ctx, span := trace.StartSpan(ctx, "cluster.PortForward")
+	defer span.End()
+
+	if p.restConfig == nil {
+		return errdefs.InvalidInput("port forwarding is not supported without a rest config of the remote cluster")
+	}
+	transport, upgrader, err := spdy.RoundTripperFor(p.restConfig)
+	if err != nil {
+		return errors.Wrap(err, "error creating port forward transport")
+	}
+	req := p.remote.CoreV1().RESTClient().Post().
+		Resource("pods").
+		Namespace(p.remoteNamespace(namespace)).
+		Name(pod).
+		SubResource("portforward")
+	dialer := spdy.NewDialer(upgrader, &http.Client{Transport: transport}, http.MethodPost, req.URL())
+	conn, _, err := dialer.Dial(portforward.PortForwardProtocolV1Name)
+	if err != nil {
+		err = errors.Wrap(err, "error dialing remote pod")
+		span.SetStatus(err)
+		return err
+	}
+	defer conn.Close()
+
+	headers := http.Header{}
+	headers.Set(v1.StreamType, v1.StreamTypeError)
+	headers.Set(v1.PortHeader, strconv.Itoa(int(port)))
+	headers.Set(v1.PortForwardRequestIDHeader, "0")
+	errorStream, err := conn.CreateStream(headers)
+	if err != nil {
+		return errors.Wrap(err, "error creating port forward error stream")
+	}
+	// The error stream is only read from.
+	errorStream.Close()
+	errCh := make(chan error, 1)
+	go func() {
+		message, err := io.ReadAll(errorStream)
+		switch {
+		case err != nil:
+			errCh <- errors.Wrap(err, "error reading port forward error stream")
+		case len(message) > 0:
+			errCh <- errors.Errorf("error forwarding port %d to remote pod: %s", port, message)
+		}
+		close(errCh)
+	}()
+
+	headers.Set(v1.StreamType, v1.StreamTypeData)
+	dataStream, err := conn.CreateStream(headers)
+	if err != nil {
+		return errors.Wrap(err, "error creating port forward data stream")
+	}
+
+	remoteDone := make(chan struct{})
+	go func() {
+		// Copy from the remote pod until it closes the stream.
+		if _, err := io.Copy(stream, dataStream); err != nil {
+			log.G(ctx).WithError(err).Debug("Error copying from remote pod")
+		}
+		close(remoteDone)
+	}()
+	go func() {
+		// Copy to the remote pod, and close the stream once the client is done.
+		defer dataStream.Close()
+		if _, err := io.Copy(dataStream, stream); err != nil {
+			log.G(ctx).WithError(err).Debug("Error copying to remote pod")
+		}
+	}()
+
+	select {
+	case <-remoteDone:
+	case <-ctx.Done():
+		return nil
+	}
+	if err := <-errCh; err != nil {
+		span.SetStatus(err)
+		return err
+	}
+	return nil
+}
+
+// GetStatsSummary returns the stats of the remote pods, from the stats summaries of the remote nodes which run them.
+func (p *ClusterProvider) GetStatsSummary(ctx context.Context) (*stats.Summary, error) {
+	ctx, span := trace.StartSpan(ctx, "cluster.GetStatsSummary")
+	defer span.End()
+
+	remotes, err := p.pods.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	byNode := make(map[string]map[string]*v1.Pod)
+	for _, remote := range remotes {
+		if remote.Spec.NodeName == "" {
+			continue
+		}
+		if byNode[remote.Spec.NodeName] == nil {
+			byNode[remote.Spec.NodeName] = make(map[string]*v1.Pod)
+		}
+		byNode[remote.Spec.NodeName][remote.Namespace+"/"+remote.Name] = remote
+	}
+
+	summary := &stats.Summary{Node: stats.NodeStats{NodeName: p.nodeName, StartTime: metav1.NewTime(time.Now())}}
+	for nodeName, pods := range byNode {
+		data, err := p.remote.CoreV1().RESTClient().Get().
+			Resource("nodes").
+			Name(nodeName).
+			SubResource("proxy").
+			Suffix("stats/summary").
+			DoRaw(ctx)
+		if err != nil {
+			log.G(ctx).WithError(err).WithField("remoteNode", nodeName).Warn("Error getting stats summary of remote node")
+			continue
+		}
+		var nodeSummary stats.Summary
+		if err := json.Unmarshal(data, &nodeSummary); err != nil {
+			log.G(ctx).WithError(err).WithField("remoteNode", nodeName).Warn("Error decoding stats summary of remote node")
+			continue
+		}
+		for _, podStats := range nodeSummary.Pods {
+			remote, ok := pods[podStats.PodRef.Namespace+"/"+podStats.PodRef.Name]
+			if !ok {
+				continue
+			}
+			pod, ok := p.toLocalPod(remote)
+			if !ok {
+				continue
+			}
+			podStats.PodRef = stats.PodReference{Namespace: pod.Namespace, Name: pod.Name, UID: string(pod.UID)}
+			summary.Pods = append(summary.Pods, podStats)
+		}
+	}
+	return summary, nil
+}
+
+// GetMetricsResource is not supported, since the remote kubelets' resource metrics describe their own nodes.
+func (p *ClusterProvider) GetMetricsResource(ctx context.Context) ([]*dto.MetricFamily, error) {
+	return []*dto.MetricFamily{}, nil
+}
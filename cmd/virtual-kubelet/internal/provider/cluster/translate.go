@@ -0,0 +1,232 @@
+package cluster
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"maps"
+	"slices"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// NodeLabel is set on the objects the provider creates in the remote cluster to the name of the virtual node.
+	NodeLabel = "virtual-kubelet.io/node"
+
+	// The annotations of remote pods which hold the coordinates of their local pod.
+	originNamespaceAnnotation = "virtual-kubelet.io/origin-namespace"
+	originNameAnnotation      = "virtual-kubelet.io/origin-name"
+	originUIDAnnotation       = "virtual-kubelet.io/origin-uid"
+
+	maxNamespaceLength = 63
+)
+
+// remoteNamespace translates the namespace of a local object to the namespace of its copy in the remote cluster.
+// Namespaces which would be too long are truncated, and suffixed with a hash of their full name.
+func (p *ClusterProvider) remoteNamespace(namespace string) string {
+	ns := p.config.NamespacePrefix + namespace
+	if len(ns) <= maxNamespaceLength {
+		return ns
+	}
+	sum := sha256.Sum256([]byte(ns))
+	hash := hex.EncodeToString(sum[:])[:8]
+	return ns[:maxNamespaceLength-len(hash)-1] + "-" + hash
+}
+
+// remoteMeta returns the metadata of the remote copy of a local object.
+func (p *ClusterProvider) remoteMeta(meta metav1.ObjectMeta) metav1.ObjectMeta {
+	labels := maps.Clone(meta.Labels)
+	if labels == nil {
+		labels = make(map[string]string)
+	}
+	labels[NodeLabel] = p.nodeName
+	return metav1.ObjectMeta{
+		Name:        meta.Name,
+		Namespace:   p.remoteNamespace(meta.Namespace),
+		Labels:      labels,
+		Annotations: maps.Clone(meta.Annotations),
+	}
+}
+
+// toRemotePod translates a local pod to the pod which runs it in the remote cluster.
+//
+// The remote pod is scheduled by the remote cluster, so the scheduling constraints which target the virtual node
+// are dropped. It does not use the pod's service account, which does not exist in the remote cluster.
+func (p *ClusterProvider) toRemotePod(pod *v1.Pod) *v1.Pod {
+	remote := &v1.Pod{
+		ObjectMeta: p.remoteMeta(pod.ObjectMeta),
+		Spec:       *pod.Spec.DeepCopy(),
+	}
+	if remote.Annotations == nil {
+		remote.Annotations = make(map[string]string)
+	}
+	remote.Annotations[originNamespaceAnnotation] = pod.Namespace
+	remote.Annotations[originNameAnnotation] = pod.Name
+	remote.Annotations[originUIDAnnotation] = string(pod.UID)
+
+	spec := &remote.Spec
+	spec.NodeName = ""
+	spec.NodeSelector = nil
+	spec.Affinity = nil
+	spec.SchedulerName = ""
+	spec.PriorityClassName = ""
+	spec.Priority = nil
+	spec.PreemptionPolicy = nil
+	spec.ServiceAccountName = ""
+	spec.DeprecatedServiceAccount = ""
+	automount := false
+	spec.AutomountServiceAccountToken = &automount
+
+	// Drop the volumes of service account tokens, which are only valid in the local cluster.
+	var dropped []string
+	spec.Volumes = slices.DeleteFunc(spec.Volumes, func(v v1.Volume) bool {
+		if v.Projected == nil {
+			return false
+		}
+		for _, source := range v.Projected.Sources {
+			if source.ServiceAccountToken != nil {
+				dropped = append(dropped, v.Name)
+				return true
+			}
+		}
+		return false
+	})
+	dropMounts := func(containers []v1.Container) {
+		for i := range containers {
+			containers[i].VolumeMounts = slices.DeleteFunc(containers[i].VolumeMounts, func(m v1.VolumeMount) bool {
+				return slices.Contains(dropped, m.Name)
+			})
+		}
+	}
+	dropMounts(spec.InitContainers)
+	dropMounts(spec.Containers)
+	spec.EphemeralContainers = nil
+	return remote
+}
+
+// isRemotePodOf returns whether the remote pod runs the local pod.
+func isRemotePodOf(remote, pod *v1.Pod) bool {
+	return remote.Annotations[originUIDAnnotation] == string(pod.UID)
+}
+
+// toLocalPod translates a remote pod back to its local pod. It returns false if the remote pod was not created by
+// the provider. The metadata and spec of the local pod are restored if the provider knows it.
+func (p *ClusterProvider) toLocalPod(remote *v1.Pod) (*v1.Pod, bool) {
+	namespace, name := remote.Annotations[originNamespaceAnnotation], remote.Annotations[originNameAnnotation]
+	if namespace == "" || name == "" {
+		return nil, false
+	}
+
+	pod := remote.DeepCopy()
+	pod.Namespace = namespace
+	pod.Name = name
+	pod.UID = types.UID(remote.Annotations[originUIDAnnotation])
+	pod.ResourceVersion = ""
+	pod.OwnerReferences = nil
+	delete(pod.Labels, NodeLabel)
+	delete(pod.Annotations, originNamespaceAnnotation)
+	delete(pod.Annotations, originNameAnnotation)
+	delete(pod.Annotations, originUIDAnnotation)
+
+	if obj, ok := p.localPods.Load(namespace + "/" + name); ok {
+		if local := obj.(*v1.Pod); local.UID == pod.UID {
+			pod.Labels = maps.Clone(local.Labels)
+			pod.Annotations = maps.Clone(local.Annotations)
+			pod.Spec = *local.Spec.DeepCopy()
+		}
+	}
+	pod.Spec.NodeName = p.nodeName
+	if p.internalIP != "" {
+		pod.Status.HostIP = p.internalIP
+		pod.Status.HostIPs = []v1.HostIP{{IP: p.internalIP}}
+	}
+	return pod, true
+}
+
+// referencedObjects returns the names of the config maps and secrets the pod references.
+func referencedObjects(pod *v1.Pod) (configMaps, secrets []string) {
+	addConfigMap := func(name string) {
+		if name != "" && !slices.Contains(configMaps, name) {
+			configMaps = append(configMaps, name)
+		}
+	}
+	addSecret := func(name string) {
+		if name != "" && !slices.Contains(secrets, name) {
+			secrets = append(secrets, name)
+		}
+	}
+
+	for _, v := range pod.Spec.Volumes {
+		switch {
+		case v.ConfigMap != nil:
+			addConfigMap(v.ConfigMap.Name)
+		case v.Secret != nil:
+			addSecret(v.Secret.SecretName)
+		case v.Projected != nil:
+			for _, source := range v.Projected.Sources {
+				if source.ConfigMap != nil {
+					addConfigMap(source.ConfigMap.Name)
+				}
+				if source.Secret != nil {
+					addSecret(source.Secret.Name)
+				}
+			}
+		}
+	}
+	for _, containers := range [][]v1.Container{pod.Spec.InitContainers, pod.Spec.Containers} {
+		for _, c := range containers {
+			for _, env := range c.Env {
+				if env.ValueFrom == nil {
+					continue
+				}
+				if ref := env.ValueFrom.ConfigMapKeyRef; ref != nil {
+					addConfigMap(ref.Name)
+				}
+				if ref := env.ValueFrom.SecretKeyRef; ref != nil {
+					addSecret(ref.Name)
+				}
+			}
+			for _, from := range c.EnvFrom {
+				if from.ConfigMapRef != nil {
+					addConfigMap(from.ConfigMapRef.Name)
+				}
+				if from.SecretRef != nil {
+					addSecret(from.SecretRef.Name)
+				}
+			}
+		}
+	}
+	for _, ref := range pod.Spec.ImagePullSecrets {
+		addSecret(ref.Name)
+	}
+	return configMaps, secrets
+}
+
+// terminated returns the pod with a terminal status, for pods which were deleted from the remote cluster before
+// they terminated.
+func terminated(pod *v1.Pod) *v1.Pod {
+	if pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed {
+		return pod
+	}
+	now := metav1.Now()
+	pod.Status.Phase = v1.PodSucceeded
+	pod.Status.Reason = podDeletedReason
+	for i, cs := range pod.Status.ContainerStatuses {
+		if cs.State.Terminated != nil {
+			continue
+		}
+		terminated := &v1.ContainerStateTerminated{
+			Reason:     podDeletedReason,
+			Message:    "Container was deleted from the remote cluster",
+			FinishedAt: now,
+		}
+		if cs.State.Running != nil {
+			terminated.StartedAt = cs.State.Running.StartedAt
+		}
+		pod.Status.ContainerStatuses[i].Ready = false
+		pod.Status.ContainerStatuses[i].State = v1.ContainerState{Terminated: terminated}
+	}
+	return pod
+}
@@ -0,0 +1,205 @@
+package process
+
+import (
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
+	v1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// containerEnv resolves the environment variables of the container, in the form NAME=value.
+func (p *ProcessProvider) containerEnv(pod *v1.Pod, c *v1.Container) ([]string, error) {
+	vars := make(map[string]string)
+	var env []string
+	set := func(name, value string) {
+		vars[name] = value
+		env = append(env, name+"="+value)
+	}
+	set("HOSTNAME", pod.Name)
+
+	for _, from := range c.EnvFrom {
+		switch {
+		case from.ConfigMapRef != nil:
+			cm, err := p.configMap(pod.Namespace, from.ConfigMapRef.Name)
+			if err != nil {
+				if k8serrors.IsNotFound(err) && isOptional(from.ConfigMapRef.Optional) {
+					continue
+				}
+				return nil, errors.Wrapf(err, "error getting config map %q of container %q", from.ConfigMapRef.Name, c.Name)
+			}
+			for _, key := range slices.Sorted(maps.Keys(cm.Data)) {
+				set(from.Prefix+key, cm.Data[key])
+			}
+		case from.SecretRef != nil:
+			secret, err := p.secret(pod.Namespace, from.SecretRef.Name)
+			if err != nil {
+				if k8serrors.IsNotFound(err) && isOptional(from.SecretRef.Optional) {
+					continue
+				}
+				return nil, errors.Wrapf(err, "error getting secret %q of container %q", from.SecretRef.Name, c.Name)
+			}
+			for _, key := range slices.Sorted(maps.Keys(secret.Data)) {
+				set(from.Prefix+key, string(secret.Data[key]))
+			}
+		}
+	}
+
+	for _, e := range c.Env {
+		if e.ValueFrom == nil {
+			set(e.Name, expand(e.Value, vars))
+			continue
+		}
+		value, ok, err := p.envValueFrom(pod, e.ValueFrom)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error resolving environment variable %q of container %q", e.Name, c.Name)
+		}
+		if ok {
+			set(e.Name, value)
+		}
+	}
+	return env, nil
+}
+
+// envValueFrom resolves the source of the value of an environment variable. It returns false if the source is
+// optional and missing.
+func (p *ProcessProvider) envValueFrom(pod *v1.Pod, from *v1.EnvVarSource) (string, bool, error) {
+	switch {
+	case from.FieldRef != nil:
+		value, err := p.podField(pod, from.FieldRef.FieldPath)
+		return value, err == nil, err
+	case from.ConfigMapKeyRef != nil:
+		ref := from.ConfigMapKeyRef
+		cm, err := p.configMap(pod.Namespace, ref.Name)
+		if err != nil {
+			if k8serrors.IsNotFound(err) && isOptional(ref.Optional) {
+				return "", false, nil
+			}
+			return "", false, err
+		}
+		value, ok := cm.Data[ref.Key]
+		if !ok && !isOptional(ref.Optional) {
+			return "", false, errdefs.NotFoundf("key %q not found in config map %q", ref.Key, ref.Name)
+		}
+		return value, ok, nil
+	case from.SecretKeyRef != nil:
+		ref := from.SecretKeyRef
+		secret, err := p.secret(pod.Namespace, ref.Name)
+		if err != nil {
+			if k8serrors.IsNotFound(err) && isOptional(ref.Optional) {
+				return "", false, nil
+			}
+			return "", false, err
+		}
+		value, ok := secret.Data[ref.Key]
+		if !ok && !isOptional(ref.Optional) {
+			return "", false, errdefs.NotFoundf("key %q not found in secret %q", ref.Key, ref.Name)
+		}
+		return string(value), ok, nil
+	default:
+		return "", false, errdefs.InvalidInput("only field, config map and secret references are supported")
+	}
+}
+
+// podField returns the value of the field of the pod, for the field paths supported by the downward API.
+func (p *ProcessProvider) podField(pod *v1.Pod, path string) (string, error) {
+	if key, ok := subscript(path, "metadata.labels"); ok {
+		return pod.Labels[key], nil
+	}
+	if key, ok := subscript(path, "metadata.annotations"); ok {
+		return pod.Annotations[key], nil
+	}
+	switch path {
+	case "metadata.name":
+		return pod.Name, nil
+	case "metadata.namespace":
+		return pod.Namespace, nil
+	case "metadata.uid":
+		return string(pod.UID), nil
+	case "spec.nodeName":
+		return p.nodeName, nil
+	case "spec.serviceAccountName":
+		return pod.Spec.ServiceAccountName, nil
+	case "status.hostIP", "status.hostIPs", "status.podIP", "status.podIPs":
+		// The processes share the network of the host.
+		return p.internalIP, nil
+	default:
+		return "", errdefs.InvalidInputf("unsupported field path %q", path)
+	}
+}
+
+// subscript returns the key of a field path of the form prefix['key'].
+func subscript(path, prefix string) (string, bool) {
+	rest, ok := strings.CutPrefix(path, prefix+"['")
+	if !ok {
+		return "", false
+	}
+	return strings.CutSuffix(rest, "']")
+}
+
+func (p *ProcessProvider) configMap(namespace, name string) (*v1.ConfigMap, error) {
+	if p.resourceManager == nil {
+		return nil, errdefs.InvalidInputf("config map %q cannot be resolved without a resource manager", name)
+	}
+	return p.resourceManager.GetConfigMap(name, namespace)
+}
+
+func (p *ProcessProvider) secret(namespace, name string) (*v1.Secret, error) {
+	if p.resourceManager == nil {
+		return nil, errdefs.InvalidInputf("secret %q cannot be resolved without a resource manager", name)
+	}
+	return p.resourceManager.GetSecret(name, namespace)
+}
+
+func isOptional(optional *bool) bool {
+	return optional != nil && *optional
+}
+
+// envMapping returns the values of the environment variables, in the form NAME=value, by name.
+func envMapping(env []string) map[string]string {
+	mapping := make(map[string]string, len(env))
+	for _, e := range env {
+		if name, value, ok := strings.Cut(e, "="); ok {
+			mapping[name] = value
+		}
+	}
+	return mapping
+}
+
+// expand expands the references to variables of the form $(NAME) in s. References to undefined variables are kept
+// as they are, and $$ escapes a $.
+//
+// Based on k8s.io/kubernetes/third_party/forked/golang/expansion.
+func expand(s string, mapping map[string]string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		switch s[i+1] {
+		case '$':
+			b.WriteByte('$')
+			i++
+		case '(':
+			end := strings.IndexByte(s[i+2:], ')')
+			if end < 0 {
+				b.WriteString(s[i:])
+				return b.String()
+			}
+			reference := s[i : i+3+end]
+			if value, ok := mapping[reference[2:len(reference)-1]]; ok {
+				b.WriteString(value)
+			} else {
+				b.WriteString(reference)
+			}
+			i += 2 + end
+		default:
+			b.WriteByte('$')
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,178 @@
+package process
+
+import (
+	"context"
+	"io"
+	"net"
+	"os/exec"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
+	"github.com/virtual-kubelet/virtual-kubelet/log"
+	"github.com/virtual-kubelet/virtual-kubelet/node/api"
+	"github.com/virtual-kubelet/virtual-kubelet/trace"
+	utilexec "k8s.io/utils/exec"
+)
+
+// RunInContainer runs the command as a process in the working directory and environment of the container.
+// With a TTY, the process runs in a terminal of its own.
+func (p *ProcessProvider) RunInContainer(ctx context.Context, namespace, name, container string, cmd []string, attach api.AttachIO) error {
+	ctx, span := trace.StartSpan(ctx, "process.RunInContainer")
+	defer span.End()
+	ctx = addAttributes(ctx, span, namespaceKey, namespace, nameKey, name, containerNameKey, container)
+
+	if len(cmd) == 0 {
+		return errdefs.InvalidInput("no command to run")
+	}
+	p.mu.Lock()
+	c, err := p.container(namespace, name, container)
+	if err == nil && c.cmd == nil {
+		err = errdefs.InvalidInputf("container %q in pod \"%s/%s\" is not running", container, namespace, name)
+	}
+	if err != nil {
+		p.mu.Unlock()
+		return err
+	}
+	workDir, env := c.workDir, c.env
+	p.mu.Unlock()
+
+	proc := exec.CommandContext(ctx, cmd[0], cmd[1:]...) // #nosec G204 -- running the command in the container is the point.
+	proc.Dir = workDir
+	proc.Env = env
+	proc.WaitDelay = waitDelay
+	if attach.TTY() {
+		err = runInTerminal(ctx, proc, attach)
+	} else {
+		if in := attach.Stdin(); in != nil {
+			proc.Stdin = in
+		}
+		if out := attach.Stdout(); out != nil {
+			proc.Stdout = out
+		}
+		if errOut := attach.Stderr(); errOut != nil {
+			proc.Stderr = errOut
+		}
+		err = proc.Run()
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		// The exit code is reported to the client, rather than an error.
+		return utilexec.CodeExitError{Err: err, Code: int(exitCode(exitErr.ProcessState))}
+	}
+	if err != nil {
+		err = errors.Wrap(err, "error running command in container")
+		span.SetStatus(err)
+	}
+	return err
+}
+
+// runInTerminal runs the process with a terminal as its stdin, stdout and stderr, which is resized along with the
+// terminal of the client.
+func runInTerminal(ctx context.Context, proc *exec.Cmd, attach api.AttachIO) error {
+	terminal, tty, err := openTerminal()
+	if err != nil {
+		return err
+	}
+	defer terminal.Close()
+	proc.Stdin, proc.Stdout, proc.Stderr = tty, tty, tty
+	setControllingTerminal(proc)
+	err = proc.Start()
+	tty.Close()
+	if err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case size, ok := <-attach.Resize():
+				if !ok {
+					return
+				}
+				if err := resizeTerminal(terminal, size); err != nil {
+					log.G(ctx).WithError(err).Debug("Error resizing terminal")
+				}
+			}
+		}
+	}()
+	if in := attach.Stdin(); in != nil {
+		go io.Copy(terminal, in) //nolint:errcheck
+	}
+	var out io.Writer = io.Discard
+	if stdout := attach.Stdout(); stdout != nil {
+		out = stdout
+	}
+	copied := make(chan struct{})
+	go func() {
+		// Reading the terminal fails once all processes using it exited.
+		io.Copy(out, terminal) //nolint:errcheck
+		close(copied)
+	}()
+
+	err = proc.Wait()
+	select {
+	case <-copied:
+	case <-time.After(waitDelay):
+	}
+	return err
+}
+
+// AttachToContainer is not supported, since the output of containers is only logged.
+func (p *ProcessProvider) AttachToContainer(ctx context.Context, namespace, name, container string, attach api.AttachIO) error {
+	return errdefs.InvalidInput("attaching to containers is not supported by the process provider")
+}
+
+// PortForward forwards the stream to the port on localhost, since the processes share the network of the host.
+func (p *ProcessProvider) PortForward(ctx context.Context, namespace, pod string, port int32, stream io.ReadWriteCloser) error {
+	ctx, span := trace.StartSpan(ctx, "process.PortForward")
+	defer span.End()
+	ctx = addAttributes(ctx, span, namespaceKey, namespace, nameKey, pod)
+
+	p.mu.Lock()
+	_, ok := p.pods[buildKey(namespace, pod)]
+	p.mu.Unlock()
+	if !ok {
+		return errdefs.NotFoundf("pod \"%s/%s\" is not known to the provider", namespace, pod)
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort("localhost", strconv.Itoa(int(port))))
+	if err != nil {
+		err = errors.Wrapf(err, "error connecting to port %d", port)
+		span.SetStatus(err)
+		return err
+	}
+	defer conn.Close()
+
+	go func() {
+		if _, err := io.Copy(conn, stream); err != nil {
+			log.G(ctx).WithError(err).Debug("Error copying to port")
+		}
+		// Let the process know the client is done writing.
+		if tcp, ok := conn.(*net.TCPConn); ok {
+			tcp.CloseWrite() //nolint:errcheck
+		}
+	}()
+	copied := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(stream, conn)
+		copied <- err
+	}()
+
+	select {
+	case <-ctx.Done():
+		return nil
+	case err := <-copied:
+		if err != nil {
+			return errors.Wrapf(err, "error copying from port %d", port)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,325 @@
+package process
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
+	"github.com/virtual-kubelet/virtual-kubelet/node/api"
+	"github.com/virtual-kubelet/virtual-kubelet/trace"
+)
+
+const (
+	// maxLogLine is the length after which lines are split in several log records.
+	maxLogLine = 16 * 1024
+
+	// logPollInterval is the interval at which followed logs are checked for new records.
+	logPollInterval = 100 * time.Millisecond
+)
+
+// errLogLimit is returned by writes to a limitWriter once its limit is reached.
+var errLogLimit = errors.New("log limit reached")
+
+// logFile writes the output of a container to a file in the CRI logging format of the kubelet. Each record holds a
+// line of output, prefixed by its time, its stream and whether it is a full line or part of a longer line:
+//
+//	2016-10-06T00:17:09.669794202Z stdout F log content
+type logFile struct {
+	mu      sync.Mutex
+	f       *os.File
+	streams []*logStream
+}
+
+func createLogFile(path string) (*logFile, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating log file")
+	}
+	return &logFile{f: f}, nil
+}
+
+// stream returns a writer which logs the output of the named stream.
+func (l *logFile) stream(name string) io.Writer {
+	s := &logStream{file: l, name: name}
+	l.streams = append(l.streams, s)
+	return s
+}
+
+func (l *logFile) write(stream string, partial bool, line []byte) error {
+	tag := "F"
+	if partial {
+		tag = "P"
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	record := make([]byte, 0, len(time.RFC3339Nano)+len(stream)+len(line)+4)
+	record = time.Now().UTC().AppendFormat(record, time.RFC3339Nano)
+	record = append(record, ' ')
+	record = append(record, stream...)
+	record = append(record, ' ')
+	record = append(record, tag...)
+	record = append(record, ' ')
+	record = append(record, line...)
+	record = append(record, '\n')
+	_, err := l.f.Write(record)
+	return err
+}
+
+// Close logs the output which does not end with a new line, and closes the file.
+func (l *logFile) Close() error {
+	for _, s := range l.streams {
+		if len(s.buf) > 0 {
+			l.write(s.name, true, s.buf) //nolint:errcheck
+		}
+	}
+	return l.f.Close()
+}
+
+// logStream buffers the output of a stream until it ends a line.
+type logStream struct {
+	file *logFile
+	name string
+	buf  []byte
+}
+
+func (s *logStream) Write(p []byte) (int, error) {
+	s.buf = append(s.buf, p...)
+	for {
+		i := bytes.IndexByte(s.buf, '\n')
+		if i < 0 {
+			break
+		}
+		if err := s.file.write(s.name, false, s.buf[:i]); err != nil {
+			return 0, err
+		}
+		s.buf = s.buf[i+1:]
+	}
+	for len(s.buf) >= maxLogLine {
+		if err := s.file.write(s.name, true, s.buf[:maxLogLine]); err != nil {
+			return 0, err
+		}
+		s.buf = s.buf[maxLogLine:]
+	}
+	s.buf = append([]byte(nil), s.buf...)
+	return len(p), nil
+}
+
+// logRecord is a record of a log file.
+type logRecord struct {
+	time      time.Time
+	timestamp []byte
+	partial   bool
+	content   []byte
+}
+
+func parseLogRecord(line []byte) (logRecord, bool) {
+	fields := bytes.SplitN(bytes.TrimSuffix(line, []byte("\n")), []byte(" "), 4)
+	if len(fields) != 4 {
+		return logRecord{}, false
+	}
+	t, err := time.Parse(time.RFC3339Nano, string(fields[0]))
+	if err != nil {
+		return logRecord{}, false
+	}
+	return logRecord{time: t, timestamp: fields[0], partial: string(fields[2]) == "P", content: fields[3]}, true
+}
+
+// GetContainerLogs returns the logs of the current run of the container, or of its previous run.
+func (p *ProcessProvider) GetContainerLogs(ctx context.Context, namespace, podName, containerName string, opts api.ContainerLogOpts) (io.ReadCloser, error) {
+	ctx, span := trace.StartSpan(ctx, "process.GetContainerLogs")
+	defer span.End()
+	ctx = addAttributes(ctx, span, namespaceKey, namespace, nameKey, podName, containerNameKey, containerName)
+
+	p.mu.Lock()
+	c, err := p.container(namespace, podName, containerName)
+	if err != nil {
+		p.mu.Unlock()
+		return nil, err
+	}
+	run, logClosed := c.run, c.logClosed
+	p.mu.Unlock()
+
+	if opts.Previous {
+		run--
+		if run < 0 {
+			return nil, errdefs.InvalidInputf("previous terminated container %q in pod %q not found", containerName, podName)
+		}
+		// The previous run is done writing its log.
+		logClosed = nil
+	} else if run < 0 {
+		return nil, errdefs.InvalidInputf("container %q in pod %q is waiting to start", containerName, podName)
+	}
+
+	f, err := os.Open(c.logPath(run))
+	if err != nil {
+		err = errors.Wrap(err, "error opening log file")
+		span.SetStatus(err)
+		return nil, err
+	}
+	if !opts.Follow {
+		logClosed = nil
+	}
+
+	r, w := io.Pipe()
+	go func() {
+		defer f.Close()
+		err := copyLogs(ctx, w, f, logClosed, opts)
+		if errors.Is(err, errLogLimit) {
+			err = nil
+		}
+		w.CloseWithError(err)
+	}()
+	return r, nil
+}
+
+// copyLogs copies the records of the log file to w. If logClosed is not nil, new records are copied as they are
+// written, until the log is closed or ctx is done.
+func copyLogs(ctx context.Context, w io.Writer, f *os.File, logClosed <-chan struct{}, opts api.ContainerLogOpts) error {
+	var since time.Time
+	if opts.SinceSeconds > 0 {
+		since = time.Now().Add(-time.Duration(opts.SinceSeconds) * time.Second)
+	}
+	if !opts.SinceTime.IsZero() {
+		since = opts.SinceTime
+	}
+	if opts.LimitBytes > 0 {
+		w = &limitWriter{w: w, n: int64(opts.LimitBytes)}
+	}
+
+	// The records which are already written are read first, to keep the tail of them.
+	r := &recordReader{r: bufio.NewReader(f)}
+	var records []logRecord
+	for {
+		record, ok, err := r.next()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+		if record.time.Before(since) {
+			continue
+		}
+		records = append(records, record)
+		if opts.Tail > 0 && len(records) > opts.Tail {
+			records = records[1:]
+		}
+	}
+	lw := &logWriter{w: w, timestamps: opts.Timestamps}
+	for _, record := range records {
+		if err := lw.write(record); err != nil {
+			return err
+		}
+	}
+	if logClosed == nil {
+		return nil
+	}
+
+	ticker := time.NewTicker(logPollInterval)
+	defer ticker.Stop()
+	for {
+		closed := false
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-logClosed:
+			closed = true
+		case <-ticker.C:
+		}
+		for {
+			record, ok, err := r.next()
+			if err != nil {
+				return err
+			}
+			if !ok {
+				break
+			}
+			if err := lw.write(record); err != nil {
+				return err
+			}
+		}
+		if closed {
+			return nil
+		}
+	}
+}
+
+// recordReader reads the records of a log file which is being written.
+type recordReader struct {
+	r *bufio.Reader
+	// pending is the start of a record which is not written completely yet.
+	pending []byte
+}
+
+// next returns the next record, or false if none is written completely yet.
+func (r *recordReader) next() (logRecord, bool, error) {
+	for {
+		line, err := r.r.ReadBytes('\n')
+		if err != nil {
+			if err == io.EOF {
+				r.pending = append(r.pending, line...)
+				return logRecord{}, false, nil
+			}
+			return logRecord{}, false, errors.Wrap(err, "error reading log file")
+		}
+		if len(r.pending) > 0 {
+			line = append(r.pending, line...)
+			r.pending = nil
+		}
+		if record, ok := parseLogRecord(line); ok {
+			return record, true, nil
+		}
+	}
+}
+
+// logWriter writes the content of log records.
+type logWriter struct {
+	w          io.Writer
+	timestamps bool
+	// midLine is set while the last record written was part of a longer line.
+	midLine bool
+}
+
+func (lw *logWriter) write(record logRecord) error {
+	var out []byte
+	if lw.timestamps && !lw.midLine {
+		out = append(out, record.timestamp...)
+		out = append(out, ' ')
+	}
+	out = append(out, record.content...)
+	if !record.partial {
+		out = append(out, '\n')
+	}
+	lw.midLine = record.partial
+	_, err := lw.w.Write(out)
+	return err
+}
+
+// limitWriter writes up to n bytes, and fails with errLogLimit once they are written.
+type limitWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (l *limitWriter) Write(p []byte) (int, error) {
+	if l.n <= 0 {
+		return 0, errLogLimit
+	}
+	truncated := false
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+		truncated = true
+	}
+	n, err := l.w.Write(p)
+	l.n -= int64(n)
+	if err == nil && truncated {
+		err = errLogLimit
+	}
+	return n, err
+}
@@ -0,0 +1,421 @@
+package process
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// podProcesses runs the containers of a pod as processes.
+type podProcesses struct {
+	// dir holds the working directories and logs of the containers.
+	dir           string
+	restartPolicy v1.RestartPolicy
+	init          []*containerProcess
+	containers    []*containerProcess
+	startTime     metav1.Time
+	cancel        context.CancelFunc
+	// done is closed once the pod stopped running containers.
+	done chan struct{}
+
+	// The fields below are guarded by the mutex of the provider.
+	pod        *v1.Pod
+	deleting   bool
+	conditions []v1.PodCondition
+}
+
+// containerProcess runs a container of a pod as a process, which is restarted according to the restart policy of
+// the pod.
+type containerProcess struct {
+	name    string
+	image   string
+	command []string
+	env     []string
+	workDir string
+	logDir  string
+
+	// The fields below are guarded by the mutex of the provider.
+	// run is the number of the current run of the container, which is -1 until it first started.
+	run int
+	// backOffs is the number of restarts since the container last ran for the back-off reset period, which the
+	// back-off doubles with.
+	backOffs int
+	// cmd is the process of the current run, while it runs.
+	cmd         *exec.Cmd
+	containerID string
+	// logClosed is closed once the current run stopped writing its log.
+	logClosed chan struct{}
+	state     v1.ContainerState
+	lastState v1.ContainerState
+}
+
+// newPodProcesses prepares the directories and commands of the containers of the pod.
+func (p *ProcessProvider) newPodProcesses(pod *v1.Pod) (*podProcesses, error) {
+	pp := &podProcesses{
+		dir:           filepath.Join(p.config.RootDir, fmt.Sprintf("%s_%s_%s", pod.Namespace, pod.Name, pod.UID)),
+		restartPolicy: pod.Spec.RestartPolicy,
+		startTime:     metav1.Now(),
+		done:          make(chan struct{}),
+		pod:           pod.DeepCopy(),
+	}
+
+	reason := "ContainerCreating"
+	if len(pod.Spec.InitContainers) > 0 {
+		reason = "PodInitializing"
+	}
+	newContainer := func(c *v1.Container) (*containerProcess, error) {
+		env, err := p.containerEnv(pod, c)
+		if err != nil {
+			return nil, err
+		}
+		command, err := containerCommand(c, env)
+		if err != nil {
+			return nil, err
+		}
+		cp := &containerProcess{
+			name:    c.Name,
+			image:   c.Image,
+			command: command,
+			env:     append(os.Environ(), env...),
+			workDir: c.WorkingDir,
+			logDir:  filepath.Join(pp.dir, "logs", c.Name),
+			run:     -1,
+			state:   v1.ContainerState{Waiting: &v1.ContainerStateWaiting{Reason: reason}},
+		}
+		if cp.workDir == "" {
+			cp.workDir = filepath.Join(pp.dir, "containers", c.Name)
+		}
+		for _, dir := range []string{cp.workDir, cp.logDir} {
+			if err := os.MkdirAll(dir, 0o700); err != nil {
+				return nil, errors.Wrapf(err, "error creating directory of container %q", c.Name)
+			}
+		}
+		return cp, nil
+	}
+
+	for i := range pod.Spec.InitContainers {
+		c, err := newContainer(&pod.Spec.InitContainers[i])
+		if err != nil {
+			os.RemoveAll(pp.dir) //nolint:errcheck
+			return nil, err
+		}
+		pp.init = append(pp.init, c)
+	}
+	for i := range pod.Spec.Containers {
+		c, err := newContainer(&pod.Spec.Containers[i])
+		if err != nil {
+			os.RemoveAll(pp.dir) //nolint:errcheck
+			return nil, err
+		}
+		pp.containers = append(pp.containers, c)
+	}
+	return pp, nil
+}
+
+// containerCommand returns the command line of the container, with references to its environment variables expanded.
+// Containers without a command run their arguments, since there is no image to provide an entrypoint.
+func containerCommand(c *v1.Container, env []string) ([]string, error) {
+	command := append(c.Command[:len(c.Command):len(c.Command)], c.Args...)
+	if len(command) == 0 {
+		return nil, errdefs.InvalidInputf("container %q has neither a command nor arguments to run", c.Name)
+	}
+	mapping := envMapping(env)
+	for i := range command {
+		command[i] = expand(command[i], mapping)
+	}
+	return command, nil
+}
+
+// runPod runs the init containers of the pod in order, then all of its containers, until ctx is done or the
+// restart policy of the pod stops them.
+func (p *ProcessProvider) runPod(ctx context.Context, pp *podProcesses) {
+	defer close(pp.done)
+	policy := pp.restartPolicy
+
+	for _, c := range pp.init {
+		for !p.runContainer(ctx, pp, c) {
+			if policy == v1.RestartPolicyNever || !p.backOff(ctx, pp, c) {
+				return
+			}
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, c := range pp.containers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				succeeded := p.runContainer(ctx, pp, c)
+				if policy == v1.RestartPolicyNever || (policy == v1.RestartPolicyOnFailure && succeeded) {
+					return
+				}
+				if !p.backOff(ctx, pp, c) {
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// runContainer runs the container until it exits, and returns whether it succeeded.
+func (p *ProcessProvider) runContainer(ctx context.Context, pp *podProcesses, c *containerProcess) bool {
+	p.mu.Lock()
+	if ctx.Err() != nil {
+		p.mu.Unlock()
+		return false
+	}
+	c.run++
+	c.logClosed = make(chan struct{})
+	logClosed := c.logClosed
+	logs, cmd, err := c.start()
+	now := metav1.Now()
+	if err != nil {
+		close(logClosed)
+		c.setState(v1.ContainerState{Terminated: &v1.ContainerStateTerminated{
+			ExitCode:   128,
+			Reason:     "StartError",
+			Message:    err.Error(),
+			StartedAt:  now,
+			FinishedAt: now,
+		}})
+		p.mu.Unlock()
+		p.notify(pp)
+		return false
+	}
+	c.cmd = cmd
+	c.containerID = "process://" + strconv.Itoa(cmd.Process.Pid)
+	c.setState(v1.ContainerState{Running: &v1.ContainerStateRunning{StartedAt: now}})
+	p.mu.Unlock()
+	p.notify(pp)
+
+	// The exit status is read from the state of the process.
+	cmd.Wait()   //nolint:errcheck
+	logs.Close() //nolint:errcheck
+	close(logClosed)
+
+	terminated := &v1.ContainerStateTerminated{
+		ExitCode:    exitCode(cmd.ProcessState),
+		Reason:      "Completed",
+		StartedAt:   now,
+		FinishedAt:  metav1.Now(),
+		ContainerID: c.containerID,
+	}
+	if terminated.ExitCode != 0 {
+		terminated.Reason = "Error"
+	}
+	p.mu.Lock()
+	c.cmd = nil
+	if terminated.FinishedAt.Sub(now.Time) >= p.restartBackOffReset {
+		c.backOffs = 0
+	}
+	c.setState(v1.ContainerState{Terminated: terminated})
+	p.mu.Unlock()
+	p.notify(pp)
+	return terminated.ExitCode == 0
+}
+
+// start starts the process of the current run of the container, which logs to a file of its own. Only the logs of
+// the current and previous runs are kept, as in the kubelet.
+func (c *containerProcess) start() (*logFile, *exec.Cmd, error) {
+	logs, err := createLogFile(c.logPath(c.run))
+	if err != nil {
+		return nil, nil, err
+	}
+	if c.run >= 2 {
+		os.Remove(c.logPath(c.run - 2)) //nolint:errcheck
+	}
+	cmd := exec.Command(c.command[0], c.command[1:]...) // #nosec G204 -- running the command of the container is the point.
+	cmd.Dir = c.workDir
+	cmd.Env = c.env
+	cmd.Stdout = logs.stream("stdout")
+	cmd.Stderr = logs.stream("stderr")
+	cmd.WaitDelay = waitDelay
+	setProcessGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		logs.Close() //nolint:errcheck
+		return nil, nil, err
+	}
+	return logs, cmd, nil
+}
+
+// backOff waits before the container is restarted, and returns false if ctx is done first.
+func (p *ProcessProvider) backOff(ctx context.Context, pp *podProcesses, c *containerProcess) bool {
+	p.mu.Lock()
+	delay := p.restartBackOff
+	for i := 0; i < c.backOffs && delay < maxRestartBackOff; i++ {
+		delay *= 2
+	}
+	delay = min(delay, maxRestartBackOff)
+	c.backOffs++
+	c.setState(v1.ContainerState{Waiting: &v1.ContainerStateWaiting{
+		Reason:  "CrashLoopBackOff",
+		Message: fmt.Sprintf("back-off %s restarting failed container=%s pod=%s_%s(%s)", delay, c.name, pp.pod.Name, pp.pod.Namespace, pp.pod.UID),
+	}})
+	p.mu.Unlock()
+	p.notify(pp)
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// setState sets the state of the container. The last termination of the container is kept.
+// It must be called with the mutex of the provider held.
+func (c *containerProcess) setState(state v1.ContainerState) {
+	if c.state.Terminated != nil {
+		c.lastState = c.state
+	}
+	c.state = state
+}
+
+// logPath returns the path of the log of the given run of the container.
+func (c *containerProcess) logPath(run int) string {
+	return filepath.Join(c.logDir, strconv.Itoa(run)+".log")
+}
+
+// stop stops the containers of the pod from being started or restarted, and signals their processes to exit.
+// It must be called with the mutex of the provider held.
+func (pp *podProcesses) stop(kill bool) {
+	if pp.cancel != nil {
+		pp.cancel()
+	}
+	for _, c := range append(pp.init[:len(pp.init):len(pp.init)], pp.containers...) {
+		if c.cmd != nil {
+			terminate(c.cmd, kill) //nolint:errcheck
+		}
+	}
+}
+
+// podLocked returns a copy of the pod with the current status of its containers.
+// It must be called with the mutex of the provider held.
+func (p *ProcessProvider) podLocked(pp *podProcesses) *v1.Pod {
+	pod := pp.pod.DeepCopy()
+	status := v1.PodStatus{
+		HostIP:    p.internalIP,
+		PodIP:     p.internalIP,
+		StartTime: pp.startTime.DeepCopy(),
+	}
+	if p.internalIP != "" {
+		status.HostIPs = []v1.HostIP{{IP: p.internalIP}}
+		status.PodIPs = []v1.PodIP{{IP: p.internalIP}}
+	}
+
+	var running, waiting, restarting, failed int
+	initialized, initFailed := true, false
+	for _, c := range pp.init {
+		cs := c.status()
+		status.InitContainerStatuses = append(status.InitContainerStatuses, cs)
+		if cs.State.Running != nil {
+			running++
+		}
+		if t := cs.State.Terminated; t == nil || t.ExitCode != 0 {
+			initialized = false
+			initFailed = initFailed || (t != nil && pp.restartPolicy == v1.RestartPolicyNever)
+		}
+	}
+	for _, c := range pp.containers {
+		cs := c.status()
+		status.ContainerStatuses = append(status.ContainerStatuses, cs)
+		switch {
+		case cs.State.Running != nil:
+			running++
+		case cs.State.Waiting != nil:
+			waiting++
+			if cs.LastTerminationState.Terminated != nil {
+				restarting++
+			}
+		case cs.State.Terminated.ExitCode != 0:
+			failed++
+		}
+	}
+
+	// Based on getPhase in k8s.io/kubernetes/pkg/kubelet/kubelet_pods.go.
+	switch {
+	case pp.deleting && running == 0:
+		// The processes of the pod were stopped for good.
+		status.Phase = v1.PodSucceeded
+		if failed > 0 || !initialized {
+			status.Phase = v1.PodFailed
+		}
+	case initFailed:
+		status.Phase = v1.PodFailed
+	case !initialized:
+		status.Phase = v1.PodPending
+	case running > 0 || restarting > 0:
+		status.Phase = v1.PodRunning
+	case waiting > 0:
+		status.Phase = v1.PodPending
+	case pp.restartPolicy == v1.RestartPolicyNever:
+		// All containers terminated, and are not restarted.
+		status.Phase = v1.PodSucceeded
+		if failed > 0 {
+			status.Phase = v1.PodFailed
+		}
+	case pp.restartPolicy == v1.RestartPolicyOnFailure && failed == 0:
+		status.Phase = v1.PodSucceeded
+	default:
+		// The containers are about to be restarted.
+		status.Phase = v1.PodRunning
+	}
+
+	ready := initialized && running == len(pp.containers) && !pp.deleting
+	pp.conditions = setCondition(pp.conditions, v1.PodScheduled, true)
+	pp.conditions = setCondition(pp.conditions, v1.PodInitialized, initialized)
+	pp.conditions = setCondition(pp.conditions, v1.ContainersReady, ready)
+	pp.conditions = setCondition(pp.conditions, v1.PodReady, ready)
+	status.Conditions = append([]v1.PodCondition(nil), pp.conditions...)
+
+	pod.Status = status
+	return pod
+}
+
+// status returns the status of the container.
+// It must be called with the mutex of the provider held.
+func (c *containerProcess) status() v1.ContainerStatus {
+	running := c.state.Running != nil
+	return v1.ContainerStatus{
+		Name:                 c.name,
+		Image:                c.image,
+		ContainerID:          c.containerID,
+		State:                *c.state.DeepCopy(),
+		LastTerminationState: *c.lastState.DeepCopy(),
+		Ready:                running,
+		Started:              &running,
+		RestartCount:         int32(max(c.run, 0)),
+	}
+}
+
+// setCondition sets the status of the condition, and keeps its transition time if it did not change.
+func setCondition(conditions []v1.PodCondition, conditionType v1.PodConditionType, value bool) []v1.PodCondition {
+	status := v1.ConditionFalse
+	if value {
+		status = v1.ConditionTrue
+	}
+	for i := range conditions {
+		if conditions[i].Type == conditionType {
+			if conditions[i].Status != status {
+				conditions[i].Status = status
+				conditions[i].LastTransitionTime = metav1.Now()
+			}
+			return conditions
+		}
+	}
+	return append(conditions, v1.PodCondition{Type: conditionType, Status: status, LastTransitionTime: metav1.Now()})
+}
@@ -0,0 +1,410 @@
+package process
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
+	"github.com/virtual-kubelet/virtual-kubelet/internal/manager"
+	"github.com/virtual-kubelet/virtual-kubelet/log"
+	"github.com/virtual-kubelet/virtual-kubelet/node"
+	"github.com/virtual-kubelet/virtual-kubelet/trace"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// Provider configuration defaults.
+	defaultMemoryCapacity = "8Gi"
+	defaultPodCapacity    = "20"
+
+	// defaultRestartBackOff is the delay before the first restart of a container. It doubles with each restart, up
+	// to maxRestartBackOff, as in the kubelet.
+	defaultRestartBackOff = 10 * time.Second
+	maxRestartBackOff     = 5 * time.Minute
+	// defaultRestartBackOffReset is how long a container has to run for its back-off to start over, as in the kubelet.
+	defaultRestartBackOffReset = 10 * time.Minute
+
+	// waitDelay bounds the time waited for the output of a process once it exited, which its children may hold.
+	waitDelay = time.Second
+
+	// Values used in tracing as attribute keys.
+	namespaceKey     = "namespace"
+	nameKey          = "name"
+	containerNameKey = "containerName"
+)
+
+var _ node.PodNotifier = (*ProcessProvider)(nil)
+
+// Config contains the configurable parameters of a virtual node which runs pods as local processes.
+type Config struct {
+	// RootDir is the directory which holds the working directories and logs of the containers. It defaults to a
+	// directory named after the node in the temporary directory of the host.
+	RootDir string `json:"rootDir,omitempty"`
+	// CPU, Memory and Pods are the capacity of the node. CPU defaults to the number of CPUs of the host.
+	CPU    string `json:"cpu,omitempty"`
+	Memory string `json:"memory,omitempty"`
+	Pods   string `json:"pods,omitempty"`
+}
+
+// ProcessProvider implements the virtual-kubelet provider interface by running the containers of pods as processes
+// of the host.
+//
+// Containers run their command, or their arguments if they have no command, since images are not supported. Each
+// container gets a working directory of its own, unless it sets one, and its output is logged to files in the
+// format of the kubelet. Containers are restarted according to the restart policy of their pod.
+type ProcessProvider struct { //nolint:revive
+	nodeName            string
+	operatingSystem     string
+	internalIP          string
+	daemonEndpointPort  int32
+	config              Config
+	resourceManager     *manager.ResourceManager
+	startTime           time.Time
+	restartBackOff      time.Duration
+	restartBackOffReset time.Duration
+
+	mu         sync.Mutex
+	pods       map[string]*podProcesses
+	cpuSamples map[string]cpuSample
+
+	// notifyMu serializes notifications, so that the last status notified for a pod is its latest.
+	notifyMu sync.Mutex
+	notifier func(*v1.Pod)
+}
+
+// NewProcessProviderConfig creates a ProcessProvider from the given configuration.
+// The resource manager is used to resolve the environment variables which reference config maps and secrets. It may
+// be nil if the pods do not reference any.
+func NewProcessProviderConfig(config Config, nodeName, operatingSystem, internalIP string, daemonEndpointPort int32, rm *manager.ResourceManager) (*ProcessProvider, error) {
+	if config.RootDir == "" {
+		config.RootDir = filepath.Join(os.TempDir(), "virtual-kubelet-process", nodeName)
+	}
+	if config.CPU == "" {
+		config.CPU = strconv.Itoa(runtime.NumCPU())
+	}
+	if config.Memory == "" {
+		config.Memory = defaultMemoryCapacity
+	}
+	if config.Pods == "" {
+		config.Pods = defaultPodCapacity
+	}
+	for name, value := range map[string]string{"CPU": config.CPU, "memory": config.Memory, "pods": config.Pods} {
+		if _, err := resource.ParseQuantity(value); err != nil {
+			return nil, errdefs.InvalidInputf("invalid %s value %v", name, value)
+		}
+	}
+	if err := os.MkdirAll(config.RootDir, 0o700); err != nil {
+		return nil, errors.Wrap(err, "error creating root directory")
+	}
+
+	return &ProcessProvider{
+		nodeName:            nodeName,
+		operatingSystem:     operatingSystem,
+		internalIP:          internalIP,
+		daemonEndpointPort:  daemonEndpointPort,
+		config:              config,
+		resourceManager:     rm,
+		startTime:           time.Now(),
+		restartBackOff:      defaultRestartBackOff,
+		restartBackOffReset: defaultRestartBackOffReset,
+		pods:                make(map[string]*podProcesses),
+		cpuSamples:          make(map[string]cpuSample),
+		notifier:            func(*v1.Pod) {},
+	}, nil
+}
+
+// NewProcessProvider creates a ProcessProvider from the configuration file of the given node. Without a
+// configuration file, the defaults are used.
+func NewProcessProvider(configPath, nodeName, operatingSystem, internalIP string, daemonEndpointPort int32, rm *manager.ResourceManager) (*ProcessProvider, error) {
+	var config Config
+	if configPath != "" {
+		var err error
+		config, err = loadConfig(configPath, nodeName)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return NewProcessProviderConfig(config, nodeName, operatingSystem, internalIP, daemonEndpointPort, rm)
+}
+
+// loadConfig loads the configuration of the node from the given json file, which maps node names to their
+// configuration.
+func loadConfig(configPath, nodeName string) (Config, error) {
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return Config{}, err
+	}
+	configs := map[string]Config{}
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return Config{}, err
+	}
+	return configs[nodeName], nil
+}
+
+// NotifyPods sets the callback notified of the statuses of the pods. It must be called before any operations are done
+// within the provider. The processes of all pods are killed once ctx is done.
+func (p *ProcessProvider) NotifyPods(ctx context.Context, notifier func(*v1.Pod)) {
+	p.notifier = notifier
+	go func() {
+		<-ctx.Done()
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		for _, pp := range p.pods {
+			pp.stop(true)
+		}
+	}()
+}
+
+// CreatePod starts the processes of the pod's containers.
+func (p *ProcessProvider) CreatePod(ctx context.Context, pod *v1.Pod) error {
+	ctx, span := trace.StartSpan(ctx, "process.CreatePod")
+	defer span.End()
+	ctx = addAttributes(ctx, span, namespaceKey, pod.Namespace, nameKey, pod.Name)
+
+	key := buildKey(pod.Namespace, pod.Name)
+	p.mu.Lock()
+	_, exists := p.pods[key]
+	p.mu.Unlock()
+	if exists {
+		err := errors.Errorf("pod %s/%s already exists", pod.Namespace, pod.Name)
+		span.SetStatus(err)
+		return err
+	}
+
+	pp, err := p.newPodProcesses(pod)
+	if err != nil {
+		span.SetStatus(err)
+		return err
+	}
+
+	p.mu.Lock()
+	if _, exists := p.pods[key]; exists {
+		p.mu.Unlock()
+		return errors.Errorf("pod %s/%s already exists", pod.Namespace, pod.Name)
+	}
+	p.pods[key] = pp
+	p.mu.Unlock()
+
+	runCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	pp.cancel = cancel
+	go p.runPod(runCtx, pp)
+
+	log.G(ctx).Debug("Started pod processes")
+	p.notify(pp)
+	return nil
+}
+
+// UpdatePod updates the metadata of the pod. The processes of running containers are not changed.
+func (p *ProcessProvider) UpdatePod(ctx context.Context, pod *v1.Pod) error {
+	ctx, span := trace.StartSpan(ctx, "process.UpdatePod")
+	defer span.End()
+	addAttributes(ctx, span, namespaceKey, pod.Namespace, nameKey, pod.Name)
+
+	p.mu.Lock()
+	pp, ok := p.pods[buildKey(pod.Namespace, pod.Name)]
+	if !ok || pp.pod.UID != pod.UID {
+		p.mu.Unlock()
+		return errdefs.NotFoundf("pod \"%s/%s\" is not known to the provider", pod.Namespace, pod.Name)
+	}
+	pp.pod = pod.DeepCopy()
+	p.mu.Unlock()
+
+	p.notify(pp)
+	return nil
+}
+
+// DeletePod stops the processes of the pod. They are sent SIGTERM, and killed once the grace period of the pod
+// expired. The terminal status of the pod is notified once they all exited.
+func (p *ProcessProvider) DeletePod(ctx context.Context, pod *v1.Pod) error {
+	ctx, span := trace.StartSpan(ctx, "process.DeletePod")
+	defer span.End()
+	ctx = addAttributes(ctx, span, namespaceKey, pod.Namespace, nameKey, pod.Name)
+
+	key := buildKey(pod.Namespace, pod.Name)
+	p.mu.Lock()
+	pp, ok := p.pods[key]
+	if !ok {
+		p.mu.Unlock()
+		return errdefs.NotFoundf("pod \"%s/%s\" is not known to the provider", pod.Namespace, pod.Name)
+	}
+	if pp.deleting {
+		p.mu.Unlock()
+		return nil
+	}
+	pp.deleting = true
+	pp.stop(false)
+	p.mu.Unlock()
+
+	gracePeriod := time.Duration(v1.DefaultTerminationGracePeriodSeconds) * time.Second
+	if pod.DeletionGracePeriodSeconds != nil {
+		gracePeriod = time.Duration(*pod.DeletionGracePeriodSeconds) * time.Second
+	} else if pod.Spec.TerminationGracePeriodSeconds != nil {
+		gracePeriod = time.Duration(*pod.Spec.TerminationGracePeriodSeconds) * time.Second
+	}
+
+	ctx = context.WithoutCancel(ctx)
+	go func() {
+		timer := time.NewTimer(gracePeriod)
+		defer timer.Stop()
+		select {
+		case <-pp.done:
+		case <-timer.C:
+			log.G(ctx).Debug("Killing pod processes after grace period")
+			p.mu.Lock()
+			pp.stop(true)
+			p.mu.Unlock()
+			<-pp.done
+		}
+
+		if err := os.RemoveAll(pp.dir); err != nil {
+			log.G(ctx).WithError(err).Warn("Error removing pod directory")
+		}
+
+		p.notifyMu.Lock()
+		defer p.notifyMu.Unlock()
+		p.mu.Lock()
+		deleted := p.podLocked(pp)
+		if p.pods[key] == pp {
+			delete(p.pods, key)
+		}
+		p.mu.Unlock()
+		log.G(ctx).Debug("Stopped pod processes")
+		p.notifier(deleted)
+	}()
+	return nil
+}
+
+// GetPod returns the pod with the current status of its processes.
+func (p *ProcessProvider) GetPod(ctx context.Context, namespace, name string) (*v1.Pod, error) {
+	_, span := trace.StartSpan(ctx, "process.GetPod")
+	defer span.End()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pp, ok := p.pods[buildKey(namespace, name)]
+	if !ok {
+		return nil, errdefs.NotFoundf("pod \"%s/%s\" is not known to the provider", namespace, name)
+	}
+	return p.podLocked(pp), nil
+}
+
+// GetPodStatus returns the current status of the processes of the pod.
+func (p *ProcessProvider) GetPodStatus(ctx context.Context, namespace, name string) (*v1.PodStatus, error) {
+	pod, err := p.GetPod(ctx, namespace, name)
+	if err != nil {
+		return nil, err
+	}
+	return &pod.Status, nil
+}
+
+// GetPods returns all pods known to the provider.
+func (p *ProcessProvider) GetPods(ctx context.Context) ([]*v1.Pod, error) {
+	_, span := trace.StartSpan(ctx, "process.GetPods")
+	defer span.End()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pods := make([]*v1.Pod, 0, len(p.pods))
+	for _, pp := range p.pods {
+		pods = append(pods, p.podLocked(pp))
+	}
+	return pods, nil
+}
+
+// ConfigureNode reports the configured capacity of the node.
+func (p *ProcessProvider) ConfigureNode(ctx context.Context, n *v1.Node) {
+	_, span := trace.StartSpan(ctx, "process.ConfigureNode")
+	defer span.End()
+
+	capacity := v1.ResourceList{
+		v1.ResourceCPU:    resource.MustParse(p.config.CPU),
+		v1.ResourceMemory: resource.MustParse(p.config.Memory),
+		v1.ResourcePods:   resource.MustParse(p.config.Pods),
+	}
+	n.Status.Capacity = capacity
+	n.Status.Allocatable = capacity.DeepCopy()
+	n.Status.Conditions = nodeConditions()
+	n.Status.Addresses = []v1.NodeAddress{{Type: v1.NodeInternalIP, Address: p.internalIP}}
+	n.Status.DaemonEndpoints = v1.NodeDaemonEndpoints{KubeletEndpoint: v1.DaemonEndpoint{Port: p.daemonEndpointPort}}
+	os := p.operatingSystem
+	if os == "" {
+		os = runtime.GOOS
+	}
+	n.Status.NodeInfo.OperatingSystem = os
+	n.Status.NodeInfo.Architecture = runtime.GOARCH
+	n.Labels["node.kubernetes.io/exclude-from-external-load-balancers"] = "true"
+}
+
+// nodeConditions returns the conditions of the node, which is ready as long as the provider runs.
+func nodeConditions() []v1.NodeCondition {
+	now := metav1.Now()
+	conditions := []v1.NodeCondition{{
+		Type:               v1.NodeReady,
+		Status:             v1.ConditionTrue,
+		LastHeartbeatTime:  now,
+		LastTransitionTime: now,
+		Reason:             "KubeletReady",
+		Message:            "kubelet is ready.",
+	}}
+	for _, t := range []v1.NodeConditionType{v1.NodeMemoryPressure, v1.NodeDiskPressure, v1.NodePIDPressure, v1.NodeNetworkUnavailable} {
+		conditions = append(conditions, v1.NodeCondition{
+			Type:               t,
+			Status:             v1.ConditionFalse,
+			LastHeartbeatTime:  now,
+			LastTransitionTime: now,
+		})
+	}
+	return conditions
+}
+
+// notify notifies the current status of the pod.
+func (p *ProcessProvider) notify(pp *podProcesses) {
+	p.notifyMu.Lock()
+	defer p.notifyMu.Unlock()
+	p.mu.Lock()
+	pod := p.podLocked(pp)
+	p.mu.Unlock()
+	p.notifier(pod)
+}
+
+// container returns the container of the pod, or a NotFound error.
+// It must be called with the mutex of the provider held.
+func (p *ProcessProvider) container(namespace, name, container string) (*containerProcess, error) {
+	pp, ok := p.pods[buildKey(namespace, name)]
+	if !ok {
+		return nil, errdefs.NotFoundf("pod \"%s/%s\" is not known to the provider", namespace, name)
+	}
+	for _, c := range append(pp.init[:len(pp.init):len(pp.init)], pp.containers...) {
+		if c.name == container {
+			return c, nil
+		}
+	}
+	return nil, errdefs.NotFoundf("container %q not found in pod \"%s/%s\"", container, namespace, name)
+}
+
+func buildKey(namespace, name string) string {
+	return fmt.Sprintf("%s/%s", namespace, name)
+}
+
+// addAttributes adds the specified attributes to the provided span.
+// attrs must be an even-sized list of string arguments.
+// Otherwise, the span won't be modified.
+func addAttributes(ctx context.Context, span trace.Span, attrs ...string) context.Context {
+	if len(attrs)%2 == 1 {
+		return ctx
+	}
+	for i := 0; i < len(attrs); i += 2 {
+		ctx = span.WithField(ctx, attrs[i], attrs[i+1])
+	}
+	return ctx
+}
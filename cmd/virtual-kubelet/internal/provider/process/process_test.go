@@ -0,0 +1,399 @@
+//go:build linux
+
+package process
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
+	"github.com/virtual-kubelet/virtual-kubelet/node/api"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	utilexec "k8s.io/utils/exec"
+)
+
+func newTestProvider(t *testing.T) *ProcessProvider {
+	t.Helper()
+	p, err := NewProcessProviderConfig(Config{RootDir: t.TempDir()}, "vk", "linux", "127.0.0.1", 10250, nil)
+	assert.NilError(t, err)
+	p.restartBackOff = 10 * time.Millisecond
+	t.Cleanup(func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		for _, pp := range p.pods {
+			pp.stop(true)
+		}
+	})
+	return p
+}
+
+func newTestPod(name string, policy v1.RestartPolicy, script string) *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name, UID: types.UID("uid-" + name)},
+		Spec: v1.PodSpec{
+			RestartPolicy: policy,
+			Containers: []v1.Container{{
+				Name:    "c",
+				Command: []string{"sh", "-c"},
+				Args:    []string{script},
+			}},
+		},
+	}
+}
+
+// waitForPod waits for the pod to meet the condition, and returns it.
+func waitForPod(t *testing.T, p *ProcessProvider, name string, condition func(*v1.Pod) bool) *v1.Pod {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		pod, err := p.GetPod(context.Background(), "default", name)
+		assert.NilError(t, err)
+		if condition(pod) {
+			return pod
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for pod, last status: %+v", pod.Status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func hasPhase(phase v1.PodPhase) func(*v1.Pod) bool {
+	return func(pod *v1.Pod) bool {
+		return pod.Status.Phase == phase
+	}
+}
+
+func readLogs(t *testing.T, p *ProcessProvider, name string, opts api.ContainerLogOpts) string {
+	t.Helper()
+	logs, err := p.GetContainerLogs(context.Background(), "default", name, "c", opts)
+	assert.NilError(t, err)
+	defer logs.Close()
+	data, err := io.ReadAll(logs)
+	assert.NilError(t, err)
+	return string(data)
+}
+
+func TestPodLifecycle(t *testing.T) {
+	ctx := context.Background()
+	p := newTestProvider(t)
+	notified := make(chan *v1.Pod, 100)
+	p.NotifyPods(ctx, func(pod *v1.Pod) {
+		notified <- pod
+	})
+
+	pod := newTestPod("lifecycle", v1.RestartPolicyAlways, `echo "$(GREETING) $POD_NAME" '$(UNDEFINED) $$(GREETING)'; exec sleep 30`)
+	pod.Spec.InitContainers = []v1.Container{{Name: "init", Command: []string{"true"}}}
+	pod.Spec.Containers[0].Env = []v1.EnvVar{
+		{Name: "GREETING", Value: "hello"},
+		{Name: "POD_NAME", ValueFrom: &v1.EnvVarSource{FieldRef: &v1.ObjectFieldSelector{FieldPath: "metadata.name"}}},
+	}
+	grace := int64(5)
+	pod.DeletionGracePeriodSeconds = &grace
+	assert.NilError(t, p.CreatePod(ctx, pod))
+	assert.Check(t, p.CreatePod(ctx, pod) != nil)
+
+	running := waitForPod(t, p, "lifecycle", func(pod *v1.Pod) bool {
+		return pod.Status.Phase == v1.PodRunning && pod.Status.ContainerStatuses[0].Ready
+	})
+	assert.Check(t, is.Equal(running.Status.InitContainerStatuses[0].State.Terminated.Reason, "Completed"))
+	assert.Check(t, is.Equal(running.Status.PodIP, "127.0.0.1"))
+	for _, c := range running.Status.Conditions {
+		assert.Check(t, is.Equal(c.Status, v1.ConditionTrue), c.Type)
+	}
+	pods, err := p.GetPods(ctx)
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(pods, 1))
+
+	waitForLogs := func() string {
+		for i := 0; i < 100; i++ {
+			if logs := readLogs(t, p, "lifecycle", api.ContainerLogOpts{}); logs != "" {
+				return logs
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return ""
+	}
+	assert.Check(t, is.Equal(waitForLogs(), "hello lifecycle $(UNDEFINED) $(GREETING)\n"))
+
+	assert.NilError(t, p.DeletePod(ctx, pod))
+	var deleted *v1.Pod
+	for deleted == nil {
+		select {
+		case pod := <-notified:
+			if pod.Status.Phase == v1.PodFailed {
+				deleted = pod
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("timed out waiting for the pod to be deleted")
+		}
+	}
+	// sleep was terminated by SIGTERM.
+	assert.Check(t, is.Equal(deleted.Status.ContainerStatuses[0].State.Terminated.ExitCode, int32(143)))
+	for i := 0; ; i++ {
+		_, err = p.GetPod(ctx, "default", "lifecycle")
+		if errdefs.IsNotFound(err) {
+			break
+		}
+		assert.Assert(t, i < 100, "pod was not removed")
+		time.Sleep(10 * time.Millisecond)
+	}
+	entries, err := os.ReadDir(p.config.RootDir)
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(entries, 0))
+}
+
+func TestRestartPolicy(t *testing.T) {
+	p := newTestProvider(t)
+
+	assert.NilError(t, p.CreatePod(context.Background(), newTestPod("never", v1.RestartPolicyNever, "exit 3")))
+	failed := waitForPod(t, p, "never", hasPhase(v1.PodFailed))
+	status := failed.Status.ContainerStatuses[0]
+	assert.Check(t, is.Equal(status.State.Terminated.ExitCode, int32(3)))
+	assert.Check(t, is.Equal(status.State.Terminated.Reason, "Error"))
+	assert.Check(t, is.Equal(status.RestartCount, int32(0)))
+
+	// The container fails on its first run only.
+	script := "if [ -e ran ]; then echo second; exit 0; fi; touch ran; echo first; exit 1"
+	assert.NilError(t, p.CreatePod(context.Background(), newTestPod("on-failure", v1.RestartPolicyOnFailure, script)))
+	succeeded := waitForPod(t, p, "on-failure", hasPhase(v1.PodSucceeded))
+	status = succeeded.Status.ContainerStatuses[0]
+	assert.Check(t, is.Equal(status.RestartCount, int32(1)))
+	assert.Check(t, is.Equal(status.LastTerminationState.Terminated.ExitCode, int32(1)))
+	assert.Check(t, is.Equal(readLogs(t, p, "on-failure", api.ContainerLogOpts{}), "second\n"))
+	assert.Check(t, is.Equal(readLogs(t, p, "on-failure", api.ContainerLogOpts{Previous: true}), "first\n"))
+
+	pod := newTestPod("missing", v1.RestartPolicyAlways, "")
+	pod.Spec.Containers[0].Command = []string{"/nonexistent"}
+	pod.Spec.Containers[0].Args = nil
+	assert.NilError(t, p.CreatePod(context.Background(), pod))
+	crashing := waitForPod(t, p, "missing", func(pod *v1.Pod) bool {
+		return pod.Status.ContainerStatuses[0].RestartCount > 0
+	})
+	assert.Check(t, is.Equal(crashing.Status.Phase, v1.PodRunning))
+	assert.Check(t, is.Equal(crashing.Status.ContainerStatuses[0].LastTerminationState.Terminated.Reason, "StartError"))
+
+	pod = newTestPod("no-command", v1.RestartPolicyAlways, "")
+	pod.Spec.Containers[0].Command, pod.Spec.Containers[0].Args = nil, nil
+	assert.Check(t, errdefs.IsInvalidInput(p.CreatePod(context.Background(), pod)))
+}
+
+func TestRestartCleanup(t *testing.T) {
+	p := newTestProvider(t)
+	restarted := func(n int32) func(*v1.Pod) bool {
+		return func(pod *v1.Pod) bool {
+			return pod.Status.ContainerStatuses[0].RestartCount >= n
+		}
+	}
+	container := func(name string) *containerProcess {
+		t.Helper()
+		c, err := p.container("default", name, "c")
+		assert.NilError(t, err)
+		return c
+	}
+
+	// Only the logs of the current and previous runs are kept.
+	assert.NilError(t, p.CreatePod(context.Background(), newTestPod("crashing", v1.RestartPolicyAlways, "echo run; exit 1")))
+	waitForPod(t, p, "crashing", restarted(4))
+	p.mu.Lock()
+	logDir := container("crashing").logDir
+	p.mu.Unlock()
+	entries, err := os.ReadDir(logDir)
+	assert.NilError(t, err)
+	assert.Check(t, len(entries) <= 2, "%d logs were kept", len(entries))
+	assert.Check(t, is.Equal(readLogs(t, p, "crashing", api.ContainerLogOpts{Previous: true}), "run\n"))
+
+	// The back-off grows while the container keeps failing, and starts over once it ran for long enough.
+	p.mu.Lock()
+	assert.Check(t, container("crashing").backOffs >= 4)
+	p.restartBackOffReset = 0
+	p.mu.Unlock()
+	assert.NilError(t, p.CreatePod(context.Background(), newTestPod("reset", v1.RestartPolicyAlways, "exit 1")))
+	waitForPod(t, p, "reset", restarted(4))
+	p.mu.Lock()
+	assert.Check(t, container("reset").backOffs <= 1)
+	p.mu.Unlock()
+}
+
+func TestGetContainerLogs(t *testing.T) {
+	p := newTestProvider(t)
+	pod := newTestPod("logs", v1.RestartPolicyNever, "echo one; sleep 0.1; echo two >&2; printf three; sleep 0.5; echo; echo four")
+	assert.NilError(t, p.CreatePod(context.Background(), pod))
+	waitForPod(t, p, "logs", func(pod *v1.Pod) bool {
+		return pod.Status.ContainerStatuses[0].State.Running != nil
+	})
+
+	// Following the logs returns once the container exits.
+	assert.Check(t, is.Equal(readLogs(t, p, "logs", api.ContainerLogOpts{Follow: true}), "one\ntwo\nthree\nfour\n"))
+	waitForPod(t, p, "logs", hasPhase(v1.PodSucceeded))
+
+	assert.Check(t, is.Equal(readLogs(t, p, "logs", api.ContainerLogOpts{Tail: 2}), "three\nfour\n"))
+	assert.Check(t, is.Equal(readLogs(t, p, "logs", api.ContainerLogOpts{LimitBytes: 6}), "one\ntw"))
+
+	scanner := bufio.NewScanner(strings.NewReader(readLogs(t, p, "logs", api.ContainerLogOpts{Timestamps: true})))
+	var lines []string
+	for scanner.Scan() {
+		timestamp, line, ok := strings.Cut(scanner.Text(), " ")
+		assert.Check(t, ok)
+		_, err := time.Parse(time.RFC3339Nano, timestamp)
+		assert.Check(t, err)
+		lines = append(lines, line)
+	}
+	assert.Check(t, is.DeepEqual(lines, []string{"one", "two", "three", "four"}))
+
+	_, err := p.GetContainerLogs(context.Background(), "default", "logs", "c", api.ContainerLogOpts{Previous: true})
+	assert.Check(t, errdefs.IsInvalidInput(err))
+	_, err = p.GetContainerLogs(context.Background(), "default", "logs", "missing", api.ContainerLogOpts{})
+	assert.Check(t, errdefs.IsNotFound(err))
+}
+
+type testAttachIO struct {
+	stdin  io.Reader
+	stdout *bytes.Buffer
+	tty    bool
+	resize chan api.TermSize
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
+
+func (a *testAttachIO) Stdin() io.Reader            { return a.stdin }
+func (a *testAttachIO) Stdout() io.WriteCloser      { return nopCloser{a.stdout} }
+func (a *testAttachIO) Stderr() io.WriteCloser      { return nopCloser{a.stdout} }
+func (a *testAttachIO) TTY() bool                   { return a.tty }
+func (a *testAttachIO) Resize() <-chan api.TermSize { return a.resize }
+
+func TestRunInContainer(t *testing.T) {
+	ctx := context.Background()
+	p := newTestProvider(t)
+	pod := newTestPod("exec", v1.RestartPolicyAlways, "exec sleep 30")
+	pod.Spec.Containers[0].Env = []v1.EnvVar{{Name: "GREETING", Value: "hello"}}
+	assert.NilError(t, p.CreatePod(ctx, pod))
+	waitForPod(t, p, "exec", hasPhase(v1.PodRunning))
+
+	attach := &testAttachIO{stdin: strings.NewReader("input"), stdout: &bytes.Buffer{}}
+	assert.NilError(t, p.RunInContainer(ctx, "default", "exec", "c", []string{"sh", "-c", "pwd; echo $GREETING; cat"}, attach))
+	workDir := p.pods["default/exec"].containers[0].workDir
+	assert.Check(t, is.Equal(attach.stdout.String(), workDir+"\nhello\ninput"))
+
+	err := p.RunInContainer(ctx, "default", "exec", "c", []string{"sh", "-c", "exit 3"}, &testAttachIO{stdout: &bytes.Buffer{}})
+	exitErr, ok := err.(utilexec.ExitError)
+	assert.Assert(t, ok, err)
+	assert.Check(t, is.Equal(exitErr.ExitStatus(), 3))
+
+	resize := make(chan api.TermSize, 1)
+	resize <- api.TermSize{Width: 100, Height: 40}
+	attach = &testAttachIO{stdout: &bytes.Buffer{}, tty: true, resize: resize}
+	assert.NilError(t, p.RunInContainer(ctx, "default", "exec", "c", []string{"sh", "-c", "sleep 0.2; test -t 0 && stty size"}, attach))
+	assert.Check(t, is.Equal(strings.TrimSpace(attach.stdout.String()), "40 100"))
+
+	err = p.RunInContainer(ctx, "default", "missing", "c", []string{"true"}, attach)
+	assert.Check(t, errdefs.IsNotFound(err))
+}
+
+// testStream reads from in, and writes to out.
+type testStream struct {
+	in  io.Reader
+	out bytes.Buffer
+}
+
+func (s *testStream) Read(p []byte) (int, error)  { return s.in.Read(p) }
+func (s *testStream) Write(p []byte) (int, error) { return s.out.Write(p) }
+func (s *testStream) Close() error                { return nil }
+
+func TestPortForward(t *testing.T) {
+	ctx := context.Background()
+	p := newTestProvider(t)
+	assert.NilError(t, p.CreatePod(ctx, newTestPod("port-forward", v1.RestartPolicyAlways, "exec sleep 30")))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		data, _ := io.ReadAll(conn)
+		conn.Write(bytes.ToUpper(data)) //nolint:errcheck
+	}()
+	port, err := strconv.Atoi(strings.TrimPrefix(l.Addr().String(), "127.0.0.1:"))
+	assert.NilError(t, err)
+
+	stream := &testStream{in: strings.NewReader("ping")}
+	assert.NilError(t, p.PortForward(ctx, "default", "port-forward", int32(port), stream))
+	assert.Check(t, is.Equal(stream.out.String(), "PING"))
+
+	err = p.PortForward(ctx, "default", "missing", int32(port), &testStream{in: strings.NewReader("")})
+	assert.Check(t, errdefs.IsNotFound(err))
+}
+
+func TestGetStatsSummary(t *testing.T) {
+	ctx := context.Background()
+	p := newTestProvider(t)
+	assert.NilError(t, p.CreatePod(ctx, newTestPod("stats", v1.RestartPolicyAlways, "exec sleep 30")))
+	waitForPod(t, p, "stats", hasPhase(v1.PodRunning))
+
+	summary, err := p.GetStatsSummary(ctx)
+	assert.NilError(t, err)
+	assert.Check(t, summary.Node.Memory != nil && *summary.Node.Memory.WorkingSetBytes > 0)
+	assert.Assert(t, is.Len(summary.Pods, 1))
+	assert.Assert(t, is.Len(summary.Pods[0].Containers, 1))
+	assert.Check(t, *summary.Pods[0].Containers[0].Memory.WorkingSetBytes > 0)
+	assert.Check(t, summary.Pods[0].Containers[0].CPU.UsageNanoCores == nil)
+
+	// The current CPU usage is computed from the previous summary.
+	summary, err = p.GetStatsSummary(ctx)
+	assert.NilError(t, err)
+	assert.Check(t, summary.Pods[0].Containers[0].CPU.UsageNanoCores != nil)
+	assert.Check(t, summary.Node.CPU.UsageNanoCores != nil)
+
+	families, err := p.GetMetricsResource(ctx)
+	assert.NilError(t, err)
+	var names []string
+	for _, family := range families {
+		names = append(names, family.GetName())
+	}
+	assert.Check(t, is.DeepEqual(names, []string{
+		"node_cpu_usage_seconds_total",
+		"node_memory_working_set_bytes",
+		"pod_cpu_usage_seconds_total",
+		"pod_memory_working_set_bytes",
+		"container_cpu_usage_seconds_total",
+		"container_memory_working_set_bytes",
+	}))
+}
+
+func TestExpand(t *testing.T) {
+	mapping := map[string]string{"A": "a", "B": "b"}
+	for in, out := range map[string]string{
+		"":             "",
+		"$(A)":         "a",
+		"$(A)-$(B)":    "a-b",
+		"$(C)":         "$(C)",
+		"$$(A)":        "$(A)",
+		"$A":           "$A",
+		"$(A":          "$(A",
+		"cost: 5$":     "cost: 5$",
+		"$$$(A)$$$$":   "$a$$",
+		"x$(A)y$(B)z$": "xaybz$",
+	} {
+		assert.Check(t, is.Equal(expand(in, mapping), out), in)
+	}
+}
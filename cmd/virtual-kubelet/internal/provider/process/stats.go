@@ -0,0 +1,304 @@
+package process
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/virtual-kubelet/virtual-kubelet/log"
+	"github.com/virtual-kubelet/virtual-kubelet/trace"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	stats "k8s.io/kubelet/pkg/apis/stats/v1alpha1"
+)
+
+const (
+	procDir = "/proc"
+
+	// clockTicks is the number of clock ticks per second in which /proc reports CPU times. It is 100 on all
+	// architectures Linux supports.
+	clockTicks = 100
+
+	// nodeSampleKey is the key of the CPU samples of the node.
+	nodeSampleKey = "node"
+)
+
+// cpuSample is a reading of the cumulative CPU usage of a container or of the node, from which the following reading
+// computes the current usage.
+type cpuSample struct {
+	time  time.Time
+	usage uint64
+}
+
+// processUsage is the resource usage of a group of processes.
+type processUsage struct {
+	cpuNanoSeconds uint64
+	memoryBytes    uint64
+}
+
+// GetStatsSummary returns the CPU and memory usage of the node and of the running containers, read from /proc.
+// The usage of a container is the usage of the processes of its process group.
+func (p *ProcessProvider) GetStatsSummary(ctx context.Context) (*stats.Summary, error) {
+	ctx, span := trace.StartSpan(ctx, "process.GetStatsSummary")
+	defer span.End()
+
+	groups, err := readProcessGroups()
+	if err != nil {
+		err = errors.Wrap(err, "error reading process stats")
+		span.SetStatus(err)
+		return nil, err
+	}
+	now := metav1.Now()
+	summary := &stats.Summary{Node: stats.NodeStats{NodeName: p.nodeName, StartTime: metav1.NewTime(p.startTime)}}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if usage, err := readNodeCPU(); err == nil {
+		summary.Node.CPU = p.cpuStats(nodeSampleKey, now, usage)
+	} else {
+		log.G(ctx).WithError(err).Debug("Error reading CPU stats of the node")
+	}
+	if memory, err := readNodeMemory(now); err == nil {
+		summary.Node.Memory = memory
+	} else {
+		log.G(ctx).WithError(err).Debug("Error reading memory stats of the node")
+	}
+
+	sampled := map[string]bool{nodeSampleKey: true}
+	for _, pp := range p.pods {
+		podStats := stats.PodStats{
+			PodRef:    stats.PodReference{Namespace: pp.pod.Namespace, Name: pp.pod.Name, UID: string(pp.pod.UID)},
+			StartTime: pp.startTime,
+		}
+		var podCPU, podNanoCores, podMemory uint64
+		for _, c := range append(pp.init[:len(pp.init):len(pp.init)], pp.containers...) {
+			if c.cmd == nil || c.state.Running == nil {
+				continue
+			}
+			usage := groups[c.cmd.Process.Pid]
+			key := c.containerID
+			sampled[key] = true
+			cpu := p.cpuStats(key, now, usage.cpuNanoSeconds)
+			podCPU += usage.cpuNanoSeconds
+			if cpu.UsageNanoCores != nil {
+				podNanoCores += *cpu.UsageNanoCores
+			}
+			podMemory += usage.memoryBytes
+			podStats.Containers = append(podStats.Containers, stats.ContainerStats{
+				Name:      c.name,
+				StartTime: c.state.Running.StartedAt,
+				CPU:       cpu,
+				Memory:    memoryStats(now, usage.memoryBytes),
+			})
+		}
+		podStats.CPU = &stats.CPUStats{Time: now, UsageCoreNanoSeconds: &podCPU, UsageNanoCores: &podNanoCores}
+		podStats.Memory = memoryStats(now, podMemory)
+		summary.Pods = append(summary.Pods, podStats)
+	}
+
+	// The samples of the containers which stopped are dropped.
+	for key := range p.cpuSamples {
+		if !sampled[key] {
+			delete(p.cpuSamples, key)
+		}
+	}
+	return summary, nil
+}
+
+// cpuStats returns the CPU stats of the cumulative usage. The current usage is computed from the previous sample of
+// the same key, and is unknown for the first one.
+// It must be called with the mutex of the provider held.
+func (p *ProcessProvider) cpuStats(key string, now metav1.Time, usage uint64) *stats.CPUStats {
+	cpu := &stats.CPUStats{Time: now, UsageCoreNanoSeconds: &usage}
+	if prev, ok := p.cpuSamples[key]; ok && usage >= prev.usage && now.After(prev.time) {
+		nanoCores := uint64(float64(usage-prev.usage) / now.Sub(prev.time).Seconds())
+		cpu.UsageNanoCores = &nanoCores
+	}
+	p.cpuSamples[key] = cpuSample{time: now.Time, usage: usage}
+	return cpu
+}
+
+func memoryStats(now metav1.Time, bytes uint64) *stats.MemoryStats {
+	return &stats.MemoryStats{Time: now, UsageBytes: &bytes, WorkingSetBytes: &bytes, RSSBytes: &bytes}
+}
+
+// readProcessGroups returns the usage of the processes of the host by process group.
+func readProcessGroups() (map[int]processUsage, error) {
+	entries, err := os.ReadDir(procDir)
+	if err != nil {
+		return nil, err
+	}
+	pageSize := uint64(os.Getpagesize())
+	groups := make(map[int]processUsage)
+	for _, entry := range entries {
+		if _, err := strconv.Atoi(entry.Name()); err != nil {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(procDir, entry.Name(), "stat"))
+		if err != nil {
+			// The process exited.
+			continue
+		}
+		// The fields are read after the name of the command, which may contain spaces. The first of them is the
+		// third field of the file.
+		i := bytes.LastIndexByte(data, ')')
+		if i < 0 {
+			continue
+		}
+		fields := strings.Fields(string(data[i+1:]))
+		if len(fields) < 22 {
+			continue
+		}
+		pgrp, err := strconv.Atoi(fields[2])
+		if err != nil {
+			continue
+		}
+		utime, _ := strconv.ParseUint(fields[11], 10, 64)
+		stime, _ := strconv.ParseUint(fields[12], 10, 64)
+		rss, _ := strconv.ParseUint(fields[21], 10, 64)
+
+		usage := groups[pgrp]
+		usage.cpuNanoSeconds += (utime + stime) * uint64(time.Second/clockTicks)
+		usage.memoryBytes += rss * pageSize
+		groups[pgrp] = usage
+	}
+	return groups, nil
+}
+
+// readNodeCPU returns the cumulative CPU time the host spent out of idle.
+func readNodeCPU() (uint64, error) {
+	f, err := os.Open(filepath.Join(procDir, "stat"))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 9 || fields[0] != "cpu" {
+			continue
+		}
+		var ticks uint64
+		// user, nice, system, then irq, softirq and steal, after idle and iowait.
+		for _, i := range []int{1, 2, 3, 6, 7, 8} {
+			n, err := strconv.ParseUint(fields[i], 10, 64)
+			if err != nil {
+				return 0, errors.Wrap(err, "error parsing CPU stats")
+			}
+			ticks += n
+		}
+		return ticks * uint64(time.Second/clockTicks), nil
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, errors.New("no CPU stats found")
+}
+
+// readNodeMemory returns the memory usage of the host.
+func readNodeMemory(now metav1.Time) (*stats.MemoryStats, error) {
+	f, err := os.Open(filepath.Join(procDir, "meminfo"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info := make(map[string]uint64)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// Lines are of the form "MemTotal:       16318412 kB".
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		n, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		if len(fields) == 3 && fields[2] == "kB" {
+			n *= 1024
+		}
+		info[strings.TrimSuffix(fields[0], ":")] = n
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	total, ok := info["MemTotal"]
+	if !ok {
+		return nil, errors.New("no memory stats found")
+	}
+	available := info["MemAvailable"]
+	usage := total - info["MemFree"]
+	workingSet := total - available
+	return &stats.MemoryStats{Time: now, AvailableBytes: &available, UsageBytes: &usage, WorkingSetBytes: &workingSet}, nil
+}
+
+// GetMetricsResource returns the resource metrics of the kubelet, computed from the stats summary.
+func (p *ProcessProvider) GetMetricsResource(ctx context.Context) ([]*dto.MetricFamily, error) {
+	ctx, span := trace.StartSpan(ctx, "process.GetMetricsResource")
+	defer span.End()
+
+	summary, err := p.GetStatsSummary(ctx)
+	if err != nil {
+		span.SetStatus(err)
+		return nil, err
+	}
+
+	var m metricFamilies
+	m.addUsage("node", summary.Node.CPU, summary.Node.Memory)
+	for _, pod := range summary.Pods {
+		m.addUsage("pod", pod.CPU, pod.Memory, "namespace", pod.PodRef.Namespace, "pod", pod.PodRef.Name)
+		for _, c := range pod.Containers {
+			m.addUsage("container", c.CPU, c.Memory, "container", c.Name, "namespace", pod.PodRef.Namespace, "pod", pod.PodRef.Name)
+		}
+	}
+	return m.families, nil
+}
+
+// metricFamilies builds the families of resource metrics.
+type metricFamilies struct {
+	families []*dto.MetricFamily
+}
+
+// addUsage adds the CPU and memory usage of the node, a pod or a container, as metrics with the given labels.
+// labels must be an even-sized list of label names and values.
+func (m *metricFamilies) addUsage(prefix string, cpu *stats.CPUStats, memory *stats.MemoryStats, labels ...string) {
+	var pairs []*dto.LabelPair
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, &dto.LabelPair{Name: &labels[i], Value: &labels[i+1]})
+	}
+	if cpu != nil && cpu.UsageCoreNanoSeconds != nil {
+		seconds := float64(*cpu.UsageCoreNanoSeconds) / float64(time.Second)
+		timestamp := cpu.Time.UnixMilli()
+		m.add(prefix+"_cpu_usage_seconds_total", dto.MetricType_COUNTER, &dto.Metric{
+			Label:       pairs,
+			Counter:     &dto.Counter{Value: &seconds},
+			TimestampMs: &timestamp,
+		})
+	}
+	if memory != nil && memory.WorkingSetBytes != nil {
+		bytes := float64(*memory.WorkingSetBytes)
+		timestamp := memory.Time.UnixMilli()
+		m.add(prefix+"_memory_working_set_bytes", dto.MetricType_GAUGE, &dto.Metric{
+			Label:       pairs,
+			Gauge:       &dto.Gauge{Value: &bytes},
+			TimestampMs: &timestamp,
+		})
+	}
+}
+
+func (m *metricFamilies) add(name string, metricType dto.MetricType, metric *dto.Metric) {
+	for _, family := range m.families {
+		if family.GetName() == name {
+			family.Metric = append(family.Metric, metric)
+			return
+		}
+	}
+	m.families = append(m.families, &dto.MetricFamily{Name: &name, Type: &metricType, Metric: []*dto.Metric{metric}})
+}
@@ -0,0 +1,94 @@
+//go:build linux
+
+package process
+
+import (
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/virtual-kubelet/virtual-kubelet/node/api"
+	"golang.org/x/sys/unix"
+)
+
+// setProcessGroup makes the process the leader of a process group of its own, so that its children are signalled
+// along with it.
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// terminate sends SIGTERM to the process group of the process, or SIGKILL if kill is set.
+func terminate(cmd *exec.Cmd, kill bool) error {
+	sig := syscall.SIGTERM
+	if kill {
+		sig = syscall.SIGKILL
+	}
+	return syscall.Kill(-cmd.Process.Pid, sig)
+}
+
+// exitCode returns the exit code of the process, which is 128 plus the number of the signal which killed it, as in
+// shells.
+func exitCode(state *os.ProcessState) int32 {
+	if state == nil {
+		return -1
+	}
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int32(status.Signal())
+	}
+	return int32(state.ExitCode())
+}
+
+// openTerminal opens a pseudo-terminal, and returns its controlling side and the terminal device of the process.
+func openTerminal() (*os.File, *os.File, error) {
+	terminal, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "error opening terminal")
+	}
+	var n int
+	err = control(terminal, func(fd int) error {
+		if err := unix.IoctlSetPointerInt(fd, unix.TIOCSPTLCK, 0); err != nil {
+			return err
+		}
+		n, err = unix.IoctlGetInt(fd, unix.TIOCGPTN)
+		return err
+	})
+	if err != nil {
+		terminal.Close()
+		return nil, nil, errors.Wrap(err, "error unlocking terminal")
+	}
+	tty, err := os.OpenFile("/dev/pts/"+strconv.Itoa(n), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		terminal.Close()
+		return nil, nil, errors.Wrap(err, "error opening terminal device")
+	}
+	return terminal, tty, nil
+}
+
+// setControllingTerminal makes the stdin of the process, which must be a terminal, its controlling terminal.
+func setControllingTerminal(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true, Ctty: 0}
+}
+
+// resizeTerminal sets the size of the terminal.
+func resizeTerminal(terminal *os.File, size api.TermSize) error {
+	return control(terminal, func(fd int) error {
+		return unix.IoctlSetWinsize(fd, unix.TIOCSWINSZ, &unix.Winsize{Row: size.Height, Col: size.Width})
+	})
+}
+
+// control calls fn with the file descriptor of the file, without switching the file to blocking mode as Fd does.
+func control(f *os.File, fn func(fd int) error) error {
+	conn, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var fnErr error
+	if err := conn.Control(func(fd uintptr) {
+		fnErr = fn(int(fd))
+	}); err != nil {
+		return err
+	}
+	return fnErr
+}
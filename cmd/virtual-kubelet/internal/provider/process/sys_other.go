@@ -0,0 +1,41 @@
+//go:build !linux
+
+package process
+
+import (
+	"os"
+	"os/exec"
+
+	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
+	"github.com/virtual-kubelet/virtual-kubelet/node/api"
+)
+
+// setProcessGroup does nothing, since process groups are only used on Linux.
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// terminate interrupts the process, or kills it if kill is set.
+func terminate(cmd *exec.Cmd, kill bool) error {
+	if kill {
+		return cmd.Process.Kill()
+	}
+	return cmd.Process.Signal(os.Interrupt)
+}
+
+// exitCode returns the exit code of the process.
+func exitCode(state *os.ProcessState) int32 {
+	if state == nil {
+		return -1
+	}
+	return int32(state.ExitCode())
+}
+
+// openTerminal fails, since terminals are only supported on Linux.
+func openTerminal() (*os.File, *os.File, error) {
+	return nil, nil, errdefs.InvalidInput("terminals are only supported on Linux")
+}
+
+func setControllingTerminal(cmd *exec.Cmd) {}
+
+func resizeTerminal(terminal *os.File, size api.TermSize) error {
+	return nil
+}
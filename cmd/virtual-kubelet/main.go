@@ -59,6 +59,8 @@ func main() {
 
 	s := provider.NewStore()
 	registerMock(s)
+	registerCluster(s)
+	registerProcess(s)
 
 	rootCmd := root.NewCommand(ctx, filepath.Base(os.Args[0]), s, opts)
 	rootCmd.AddCommand(version.NewCommand(buildVersion, buildTime), providers.NewCommand(s))
@@ -2,7 +2,9 @@ package main
 
 import (
 	"github.com/virtual-kubelet/virtual-kubelet/cmd/virtual-kubelet/internal/provider"
+	"github.com/virtual-kubelet/virtual-kubelet/cmd/virtual-kubelet/internal/provider/cluster"
 	"github.com/virtual-kubelet/virtual-kubelet/cmd/virtual-kubelet/internal/provider/mock"
+	"github.com/virtual-kubelet/virtual-kubelet/cmd/virtual-kubelet/internal/provider/process"
 )
 
 func registerMock(s *provider.Store) {
@@ -17,3 +19,31 @@ func registerMock(s *provider.Store) {
 		)
 	})
 }
+
+func registerCluster(s *provider.Store) {
+	/* #nosec */
+	s.Register("cluster", func(cfg provider.InitConfig) (provider.Provider, error) { //nolint:errcheck
+		return cluster.NewClusterProvider(
+			cfg.ConfigPath,
+			cfg.NodeName,
+			cfg.OperatingSystem,
+			cfg.InternalIP,
+			cfg.DaemonPort,
+			cfg.ResourceManager,
+		)
+	})
+}
+
+func registerProcess(s *provider.Store) {
+	/* #nosec */
+	s.Register("process", func(cfg provider.InitConfig) (provider.Provider, error) { //nolint:errcheck
+		return process.NewProcessProvider(
+			cfg.ConfigPath,
+			cfg.NodeName,
+			cfg.OperatingSystem,
+			cfg.InternalIP,
+			cfg.DaemonPort,
+			cfg.ResourceManager,
+		)
+	})
+}
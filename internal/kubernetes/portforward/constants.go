@@ -21,4 +21,5 @@ package portforward
 const ProtocolV1Name = "portforward.k8s.io"
 
 // SupportedProtocols are the supported port forwarding protocols.
+// They can also be tunneled through WebSockets, prefixed with "SPDY/3.1+".
 var SupportedProtocols = []string{ProtocolV1Name}
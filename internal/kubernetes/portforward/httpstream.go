@@ -25,6 +25,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/virtual-kubelet/virtual-kubelet/internal/kubernetes/spdytunnel"
 	api "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/httpstream"
@@ -51,6 +52,25 @@ func handleHTTPStreams(req *http.Request, w http.ResponseWriter, portForwarder P
 	if conn == nil {
 		return errors.New("unable to upgrade httpstream connection")
 	}
+	serveHTTPStreams(conn, streamChan, portForwarder, podName, uid, idleTimeout, streamCreationTimeout)
+	return nil
+}
+
+// handleTunneledHTTPStreams handles port forward streams of SPDY connections tunneled through WebSockets.
+func handleTunneledHTTPStreams(req *http.Request, w http.ResponseWriter, portForwarder PortForwarder, podName string, uid types.UID, protocol string, idleTimeout, streamCreationTimeout time.Duration) error {
+	streamChan := make(chan httpstream.Stream, 1)
+
+	klog.V(5).InfoS("Upgrading tunneled port forward response", "protocol", protocol)
+	conn, err := spdytunnel.Upgrade(w, req, protocol, httpStreamReceived(streamChan))
+	if err != nil {
+		return err
+	}
+	serveHTTPStreams(conn, streamChan, portForwarder, podName, uid, idleTimeout, streamCreationTimeout)
+	return nil
+}
+
+// serveHTTPStreams forwards the streams received on the connection until it is closed.
+func serveHTTPStreams(conn httpstream.Connection, streamChan chan httpstream.Stream, portForwarder PortForwarder, podName string, uid types.UID, idleTimeout, streamCreationTimeout time.Duration) {
 	defer conn.Close()
 
 	klog.V(5).InfoS("Connection setting port forwarding streaming connection idle timeout", "connection", conn, "idleTimeout", idleTimeout)
@@ -66,8 +86,6 @@ func handleHTTPStreams(req *http.Request, w http.ResponseWriter, portForwarder P
 		forwarder:             portForwarder,
 	}
 	h.run()
-
-	return nil
 }
 
 // httpStreamReceived is the httpstream.NewStreamHandler for port
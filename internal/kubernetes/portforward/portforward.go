@@ -22,6 +22,7 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/virtual-kubelet/virtual-kubelet/internal/kubernetes/spdytunnel"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/httpstream/wsstream"
 	"k8s.io/apimachinery/pkg/util/runtime"
@@ -39,9 +40,15 @@ type PortForwarder interface {
 // been timed out due to idleness. This function handles multiple forwarded
 // connections; i.e., multiple `curl http://localhost:8888/` requests will be
 // handled by a single invocation of ServePortForward.
+//
+// WebSocket requests for a tunneling protocol ("SPDY/3.1+" followed by one of the
+// supported protocols) are served as SPDY connections tunneled through the
+// WebSocket connection.
 func ServePortForward(w http.ResponseWriter, req *http.Request, portForwarder PortForwarder, podName string, uid types.UID, portForwardOptions *V4Options, idleTimeout time.Duration, streamCreationTimeout time.Duration, supportedProtocols []string) {
 	var err error
-	if wsstream.IsWebSocketRequest(req) {
+	if protocol, ok := spdytunnel.Protocol(req, supportedProtocols); ok {
+		err = handleTunneledHTTPStreams(req, w, portForwarder, podName, uid, protocol, idleTimeout, streamCreationTimeout)
+	} else if wsstream.IsWebSocketRequest(req) {
 		err = handleWebSocketStreams(req, w, portForwarder, podName, uid, portForwardOptions, supportedProtocols, idleTimeout, streamCreationTimeout)
 	} else {
 		err = handleHTTPStreams(req, w, portForwarder, podName, uid, supportedProtocols, idleTimeout, streamCreationTimeout)
@@ -0,0 +1,100 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package portforward
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	api "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	restclient "k8s.io/client-go/rest"
+	clientportforward "k8s.io/client-go/tools/portforward"
+)
+
+// echoForwarder prefixes the data of each stream with its port and echoes it back.
+type echoForwarder struct{}
+
+func (echoForwarder) PortForward(_ context.Context, _ string, _ types.UID, port int32, stream io.ReadWriteCloser) error {
+	defer stream.Close()
+	if _, err := fmt.Fprintf(stream, "%d:", port); err != nil {
+		return err
+	}
+	_, err := io.Copy(stream, stream)
+	return err
+}
+
+func TestServePortForwardTunneled(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ServePortForward(w, req, echoForwarder{}, "pod", "", &V4Options{}, time.Minute, 10*time.Second, SupportedProtocols)
+	}))
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL + "/portForward/ns/pod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The same dialer kubectl uses to tunnel port-forward through websockets.
+	dialer, err := clientportforward.NewSPDYOverWebsocketDialer(u, &restclient.Config{Host: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, protocol, err := dialer.Dial(ProtocolV1Name)
+	if err != nil {
+		t.Fatalf("unexpected error dialing: %v", err)
+	}
+	defer conn.Close()
+	if protocol != ProtocolV1Name {
+		t.Errorf("expected protocol %q, got %q", ProtocolV1Name, protocol)
+	}
+
+	for i, port := range []string{"80", "8080"} {
+		headers := http.Header{}
+		headers.Set(api.StreamType, api.StreamTypeError)
+		headers.Set(api.PortHeader, port)
+		headers.Set(api.PortForwardRequestIDHeader, fmt.Sprint(i))
+		errorStream, err := conn.CreateStream(headers)
+		if err != nil {
+			t.Fatalf("unexpected error creating error stream: %v", err)
+		}
+		errorStream.Close()
+
+		headers.Set(api.StreamType, api.StreamTypeData)
+		dataStream, err := conn.CreateStream(headers)
+		if err != nil {
+			t.Fatalf("unexpected error creating data stream: %v", err)
+		}
+		if _, err := dataStream.Write([]byte("hello")); err != nil {
+			t.Fatalf("unexpected error writing: %v", err)
+		}
+		dataStream.Close()
+
+		got, err := io.ReadAll(dataStream)
+		if err != nil {
+			t.Fatalf("unexpected error reading: %v", err)
+		}
+		if e, a := port+":hello", string(got); e != a {
+			t.Errorf("expected %q, got %q", e, a)
+		}
+	}
+}
@@ -24,6 +24,7 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/virtual-kubelet/virtual-kubelet/internal/kubernetes/spdytunnel"
 	api "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -37,6 +38,16 @@ import (
 	"k8s.io/klog/v2"
 )
 
+// SupportedStreamingProtocols are the supported remote command protocols, in order of preference.
+// They can also be tunneled through WebSockets, prefixed with "SPDY/3.1+".
+var SupportedStreamingProtocols = []string{
+	remotecommandconsts.StreamProtocolV5Name,
+	remotecommandconsts.StreamProtocolV4Name,
+	remotecommandconsts.StreamProtocolV3Name,
+	remotecommandconsts.StreamProtocolV2Name,
+	remotecommandconsts.StreamProtocolV1Name,
+}
+
 // Options contains details about which streams are required for
 // remote command execution.
 type Options struct {
@@ -105,7 +116,9 @@ func waitStreamReply(replySent <-chan struct{}, notify chan<- struct{}, stop <-c
 func createStreams(req *http.Request, w http.ResponseWriter, opts *Options, supportedStreamProtocols []string, idleTimeout, streamCreationTimeout time.Duration) (*context, bool) {
 	var ctx *context
 	var ok bool
-	if wsstream.IsWebSocketRequest(req) {
+	if protocol, isTunnel := spdytunnel.Protocol(req, supportedStreamProtocols); isTunnel {
+		ctx, ok = createTunneledHTTPStreamStreams(req, w, opts, protocol, idleTimeout, streamCreationTimeout)
+	} else if wsstream.IsWebSocketRequest(req) {
 		ctx, ok = createWebSocketStreams(req, w, opts, idleTimeout)
 	} else {
 		ctx, ok = createHTTPStreamStreams(req, w, opts, supportedStreamProtocols, idleTimeout, streamCreationTimeout)
@@ -144,6 +157,28 @@ func createHTTPStreamStreams(req *http.Request, w http.ResponseWriter, opts *Opt
 		return nil, false
 	}
 
+	return waitForHTTPStreams(conn, protocol, streamCh, opts, idleTimeout, streamCreationTimeout)
+}
+
+// createTunneledHTTPStreamStreams returns a context containing the streams of a SPDY connection tunneled through
+// WebSockets.
+func createTunneledHTTPStreamStreams(req *http.Request, w http.ResponseWriter, opts *Options, protocol string, idleTimeout, streamCreationTimeout time.Duration) (*context, bool) {
+	streamCh := make(chan streamAndReply)
+
+	conn, err := spdytunnel.Upgrade(w, req, protocol, func(stream httpstream.Stream, replySent <-chan struct{}) error {
+		streamCh <- streamAndReply{Stream: stream, replySent: replySent}
+		return nil
+	})
+	if err != nil {
+		runtime.HandleError(err)
+		return nil, false
+	}
+
+	return waitForHTTPStreams(conn, protocol, streamCh, opts, idleTimeout, streamCreationTimeout)
+}
+
+// waitForHTTPStreams waits for the client to create the streams of the negotiated protocol on the connection.
+func waitForHTTPStreams(conn httpstream.Connection, protocol string, streamCh <-chan streamAndReply, opts *Options, idleTimeout, streamCreationTimeout time.Duration) (*context, bool) {
 	conn.SetIdleTimeout(idleTimeout)
 
 	var handler protocolHandler
@@ -163,6 +198,7 @@ func createHTTPStreamStreams(req *http.Request, w http.ResponseWriter, opts *Opt
 		handler = &v1ProtocolHandler{}
 	default:
 		klog.Errorf("unable to create HTTP stream: unknown protocol %q", protocol)
+		conn.Close()
 		return nil, false
 	}
 
@@ -187,6 +223,7 @@ func createHTTPStreamStreams(req *http.Request, w http.ResponseWriter, opts *Opt
 	ctx, err := handler.waitForStreams(streamCh, expectedStreams, expired.C)
 	if err != nil {
 		runtime.HandleError(err)
+		conn.Close()
 		return nil, false
 	}
 
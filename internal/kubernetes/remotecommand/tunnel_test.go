@@ -0,0 +1,122 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package remotecommand
+
+import (
+	"bytes"
+	gocontext "context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	restclient "k8s.io/client-go/rest"
+	clientportforward "k8s.io/client-go/tools/portforward"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+// echoExecutor writes the command, followed by its stdin, to stdout.
+type echoExecutor struct{}
+
+func (echoExecutor) ExecInContainer(_ string, _ types.UID, _ string, cmd []string, in io.Reader, out, _ io.WriteCloser, _ bool, _ <-chan remotecommand.TerminalSize, _ time.Duration) error {
+	if _, err := io.WriteString(out, strings.Join(cmd, " ")+":"); err != nil {
+		return err
+	}
+	_, err := io.Copy(out, in)
+	return err
+}
+
+func newExecServer(t *testing.T) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		opts := &Options{Stdin: true, Stdout: true}
+		ServeExec(w, req, echoExecutor{}, "pod", "", "c", []string{"cat"}, opts, time.Minute, 10*time.Second, SupportedStreamingProtocols)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func streamEcho(t *testing.T, exec remotecommand.Executor) {
+	t.Helper()
+	ctx, cancel := gocontext.WithTimeout(gocontext.Background(), 30*time.Second)
+	defer cancel()
+	var stdout bytes.Buffer
+	err := exec.StreamWithContext(ctx, remotecommand.StreamOptions{
+		Stdin:  strings.NewReader("hello"),
+		Stdout: &stdout,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error streaming: %v", err)
+	}
+	if e, a := "cat:hello", stdout.String(); e != a {
+		t.Errorf("expected %q, got %q", e, a)
+	}
+}
+
+func TestServeExecWebSocketV5(t *testing.T) {
+	srv := newExecServer(t)
+	// The websocket executor of kubectl, which relies on the v5 CLOSE signal to end stdin.
+	exec, err := remotecommand.NewWebSocketExecutor(&restclient.Config{Host: srv.URL}, "GET", srv.URL+"/exec/ns/pod/c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	streamEcho(t, exec)
+}
+
+// tunnelingUpgrader lets the SPDY executor use a SPDY connection tunneled through websockets: the request is sent by
+// dialing the tunnel, and the tunneled connection is returned as the upgraded connection.
+type tunnelingUpgrader struct {
+	dialer httpstream.Dialer
+	conn   httpstream.Connection
+}
+
+func (u *tunnelingUpgrader) RoundTrip(req *http.Request) (*http.Response, error) {
+	conn, protocol, err := u.dialer.Dial(req.Header.Values(httpstream.HeaderProtocolVersion)...)
+	if err != nil {
+		return nil, err
+	}
+	u.conn = conn
+	header := http.Header{}
+	header.Set(httpstream.HeaderProtocolVersion, protocol)
+	return &http.Response{StatusCode: http.StatusSwitchingProtocols, Header: header, Body: http.NoBody}, nil
+}
+
+func (u *tunnelingUpgrader) NewConnection(*http.Response) (httpstream.Connection, error) {
+	return u.conn, nil
+}
+
+func TestServeExecTunneled(t *testing.T) {
+	srv := newExecServer(t)
+	u, err := url.Parse(srv.URL + "/exec/ns/pod/c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialer, err := clientportforward.NewSPDYOverWebsocketDialer(u, &restclient.Config{Host: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	upgrader := &tunnelingUpgrader{dialer: dialer}
+	exec, err := remotecommand.NewSPDYExecutorForTransports(upgrader, upgrader, "POST", u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	streamEcho(t, exec)
+}
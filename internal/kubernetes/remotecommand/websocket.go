@@ -22,6 +22,7 @@ import (
 	"time"
 
 	"k8s.io/apimachinery/pkg/util/httpstream/wsstream"
+	remotecommandconsts "k8s.io/apimachinery/pkg/util/remotecommand"
 	"k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apiserver/pkg/server/httplog"
 )
@@ -37,6 +38,7 @@ const (
 	preV4Base64WebsocketProtocol = wsstream.Base64ChannelWebSocketProtocol
 	v4BinaryWebsocketProtocol    = "v4." + wsstream.ChannelWebSocketProtocol
 	v4Base64WebsocketProtocol    = "v4." + wsstream.Base64ChannelWebSocketProtocol
+	v5BinaryWebsocketProtocol    = remotecommandconsts.StreamProtocolV5Name
 )
 
 // createChannels returns the standard channel types for a shell connection (STDIN 0, STDOUT 1, STDERR 2)
@@ -93,6 +95,11 @@ func createWebSocketStreams(req *http.Request, w http.ResponseWriter, opts *Opti
 			Binary:   false,
 			Channels: channels,
 		},
+		// v5 adds the CLOSE signal for half-closing stdin, which wsstream handles.
+		v5BinaryWebsocketProtocol: {
+			Binary:   true,
+			Channels: channels,
+		},
 	})
 	conn.SetIdleTimeout(idleTimeout)
 	negotiatedProtocol, streams, err := conn.Open(httplog.Unlogged(req, w), req)
@@ -122,7 +129,7 @@ func createWebSocketStreams(req *http.Request, w http.ResponseWriter, opts *Opti
 	}
 
 	switch negotiatedProtocol {
-	case v4BinaryWebsocketProtocol, v4Base64WebsocketProtocol:
+	case v4BinaryWebsocketProtocol, v4Base64WebsocketProtocol, v5BinaryWebsocketProtocol:
 		ctx.writeStatus = v4WriteStatusFunc(streams[errorChannel])
 	default:
 		ctx.writeStatus = v1WriteStatusFunc(streams[errorChannel])
@@ -0,0 +1,83 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package spdytunnel contains the server side of SPDY tunneled through WebSockets, as used by kubectl for
+// port-forward (and the API server for its tunneling handler) so that streams survive proxies which only support
+// WebSocket upgrades.
+//
+// Based on k8s.io/apiserver/pkg/util/proxy/streamtunnel.go, which translates the tunnel to a SPDY upgrade to the
+// kubelet. Here the tunneled SPDY connection is served directly instead.
+package spdytunnel
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	gwebsocket "github.com/gorilla/websocket"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/apimachinery/pkg/util/httpstream/spdy"
+	"k8s.io/apimachinery/pkg/util/httpstream/wsstream"
+	constants "k8s.io/apimachinery/pkg/util/portforward"
+	"k8s.io/client-go/tools/portforward"
+	"k8s.io/klog/v2"
+)
+
+// Protocol returns the first tunneling protocol requested by the WebSocket request whose SPDY protocol is
+// supported, with the tunneling prefix removed. It returns false if the request is not a WebSocket request or does
+// not request a supported tunneling protocol.
+func Protocol(req *http.Request, supportedProtocols []string) (string, bool) {
+	if !wsstream.IsWebSocketRequest(req) {
+		return "", false
+	}
+	for _, protocol := range gwebsocket.Subprotocols(req) {
+		if !strings.HasPrefix(protocol, constants.WebsocketsSPDYTunnelingPrefix) {
+			continue
+		}
+		protocol = strings.TrimPrefix(protocol, constants.WebsocketsSPDYTunnelingPrefix)
+		for _, supported := range supportedProtocols {
+			if protocol == supported {
+				return protocol, true
+			}
+		}
+	}
+	return "", false
+}
+
+// Upgrade upgrades the request to a WebSocket connection using the tunneling protocol for the SPDY protocol, and
+// returns the SPDY server connection tunneled through it. Streams created by the client are passed to
+// newStreamHandler.
+//
+// If the upgrade fails, an error response has been written to the client.
+func Upgrade(w http.ResponseWriter, req *http.Request, protocol string, newStreamHandler httpstream.NewStreamHandler) (httpstream.Connection, error) {
+	upgrader := gwebsocket.Upgrader{
+		// Requests are authenticated by their credentials, not by cookies, so there is no cross-origin risk.
+		CheckOrigin:  func(r *http.Request) bool { return true },
+		Subprotocols: []string{constants.WebsocketsSPDYTunnelingPrefix + protocol},
+	}
+	wsConn, err := upgrader.Upgrade(w, req, nil)
+	if err != nil {
+		// The upgrader writes the error to the client.
+		return nil, fmt.Errorf("error upgrading tunneling websocket connection: %w", err)
+	}
+	klog.V(4).InfoS("Tunneling SPDY through websocket connection", "protocol", wsConn.Subprotocol())
+
+	conn, err := spdy.NewServerConnection(portforward.NewTunnelingConnection("server", wsConn), newStreamHandler)
+	if err != nil {
+		return nil, fmt.Errorf("error creating tunneled SPDY connection: %w", err)
+	}
+	return conn, nil
+}
@@ -68,23 +68,31 @@ const (
 var masterServices = sets.NewString("kubernetes")
 
 // PopulateEnvironmentVariables populates the environment of each init container, container, and ephemeral container in the specified pod.
-func PopulateEnvironmentVariables(ctx context.Context, pod *corev1.Pod, rm *manager.ResourceManager, recorder record.EventRecorder) error {
+// Once a container's environment is resolved, $(VAR) references in its command, args and volume mount subPathExpr
+// fields are expanded with it.
+//
+// Resource field references (".valueFrom.resourceFieldRef") to limits which are not set on the container resolve to
+// the value in nodeAllocatable, like the kubelet does. Field references to the pod's IPs and host IPs are resolved
+// from the pod's status, which must therefore be populated before calling this if they are to be non-empty.
+func PopulateEnvironmentVariables(ctx context.Context, pod *corev1.Pod, rm *manager.ResourceManager, recorder record.EventRecorder, nodeAllocatable corev1.ResourceList) error {
+	// Resource field references are resolved against a copy of the pod where the limits have been defaulted.
+	defaultedPod := podWithDefaultedLimits(pod, nodeAllocatable)
 
 	// Populate each init container's environment.
 	for idx := range pod.Spec.InitContainers {
-		if err := populateContainerEnvironment(ctx, pod, &pod.Spec.InitContainers[idx], rm, recorder); err != nil {
+		if err := populateContainerEnvironment(ctx, pod, defaultedPod, &pod.Spec.InitContainers[idx], rm, recorder); err != nil {
 			return err
 		}
 	}
 	// Populate each container's environment.
 	for idx := range pod.Spec.Containers {
-		if err := populateContainerEnvironment(ctx, pod, &pod.Spec.Containers[idx], rm, recorder); err != nil {
+		if err := populateContainerEnvironment(ctx, pod, defaultedPod, &pod.Spec.Containers[idx], rm, recorder); err != nil {
 			return err
 		}
 	}
 	// Populate each ephemeral container's environment.
 	for idx := range pod.Spec.EphemeralContainers {
-		if err := populateEphemeralContainerEnvironment(ctx, pod, &pod.Spec.EphemeralContainers[idx], rm, recorder); err != nil {
+		if err := populateEphemeralContainerEnvironment(ctx, pod, defaultedPod, &pod.Spec.EphemeralContainers[idx], rm, recorder); err != nil {
 			return err
 		}
 	}
@@ -92,7 +100,7 @@ func PopulateEnvironmentVariables(ctx context.Context, pod *corev1.Pod, rm *mana
 }
 
 // populateContainerEnvironment populates the environment of a single container in the specified pod.
-func populateContainerEnvironment(ctx context.Context, pod *corev1.Pod, container *corev1.Container, rm *manager.ResourceManager, recorder record.EventRecorder) error {
+func populateContainerEnvironment(ctx context.Context, pod, defaultedPod *corev1.Pod, container *corev1.Container, rm *manager.ResourceManager, recorder record.EventRecorder) error {
 	// Create an "environment map" based on the value of the specified container's ".envFrom" field.
 	tmpEnv, err := makeEnvironmentMapBasedOnEnvFrom(ctx, pod, container.EnvFrom, rm, recorder)
 	if err != nil {
@@ -100,7 +108,7 @@ func populateContainerEnvironment(ctx context.Context, pod *corev1.Pod, containe
 	}
 	// Create the final "environment map" for the container using the ".env" and ".envFrom" field
 	// and service environment variables.
-	err = makeEnvironmentMap(ctx, pod, container.Env, rm, recorder, tmpEnv)
+	err = makeEnvironmentMap(ctx, pod, defaultedPod, container.Name, container.Env, rm, recorder, tmpEnv)
 	if err != nil {
 		return err
 	}
@@ -120,11 +128,13 @@ func populateContainerEnvironment(ctx context.Context, pod *corev1.Pod, containe
 	}
 	container.Env = res
 
-	return nil
+	// Expand variable references in the command, args and volume mount sub paths using the final environment.
+	expandContainerCommandAndArgs(pod, container.Name, container.Command, container.Args, tmpEnv, recorder)
+	return expandContainerVolumeMounts(pod, container.Name, container.VolumeMounts, tmpEnv, recorder)
 }
 
 // populateEphemeralContainerEnvironment populates the environment of a single ephemeral container in the specified pod.
-func populateEphemeralContainerEnvironment(ctx context.Context, pod *corev1.Pod, container *corev1.EphemeralContainer, rm *manager.ResourceManager, recorder record.EventRecorder) error {
+func populateEphemeralContainerEnvironment(ctx context.Context, pod, defaultedPod *corev1.Pod, container *corev1.EphemeralContainer, rm *manager.ResourceManager, recorder record.EventRecorder) error {
 	// Create an "environment map" based on the value of the specified container's ".envFrom" field.
 	tmpEnv, err := makeEnvironmentMapBasedOnEnvFrom(ctx, pod, container.EnvFrom, rm, recorder)
 	if err != nil {
@@ -132,7 +142,7 @@ func populateEphemeralContainerEnvironment(ctx context.Context, pod *corev1.Pod,
 	}
 	// Create the final "environment map" for the container using the ".env" and ".envFrom" field
 	// and service environment variables.
-	err = makeEnvironmentMap(ctx, pod, container.Env, rm, recorder, tmpEnv)
+	err = makeEnvironmentMap(ctx, pod, defaultedPod, container.Name, container.Env, rm, recorder, tmpEnv)
 	if err != nil {
 		return err
 	}
@@ -152,7 +162,9 @@ func populateEphemeralContainerEnvironment(ctx context.Context, pod *corev1.Pod,
 	}
 	container.Env = res
 
-	return nil
+	// Expand variable references in the command, args and volume mount sub paths using the final environment.
+	expandContainerCommandAndArgs(pod, container.Name, container.Command, container.Args, tmpEnv, recorder)
+	return expandContainerVolumeMounts(pod, container.Name, container.VolumeMounts, tmpEnv, recorder)
 }
 
 // getServiceEnvVarMap makes a map[string]string of env vars for services a
@@ -325,7 +337,7 @@ loop:
 }
 
 // makeEnvironmentMap returns a map representing the resolved environment of the specified container after being populated from the entries in the ".env" and ".envFrom" field.
-func makeEnvironmentMap(ctx context.Context, pod *corev1.Pod, envVars []corev1.EnvVar, rm *manager.ResourceManager, recorder record.EventRecorder, res map[string]string) error {
+func makeEnvironmentMap(ctx context.Context, pod, defaultedPod *corev1.Pod, containerName string, envVars []corev1.EnvVar, rm *manager.ResourceManager, recorder record.EventRecorder, res map[string]string) error {
 	// TODO If pod.Spec.EnableServiceLinks is nil then fail as per 1.14 kubelet.
 	enableServiceLinks := corev1.DefaultEnableServiceLinks
 	if pod.Spec.EnableServiceLinks != nil {
@@ -348,7 +360,7 @@ func makeEnvironmentMap(ctx context.Context, pod *corev1.Pod, envVars []corev1.E
 
 	// Iterate over environment variables in order to populate the map.
 	for _, env := range envVars {
-		val, err := getEnvironmentVariableValue(ctx, &env, mappingFunc, pod, rm, recorder)
+		val, err := getEnvironmentVariableValue(ctx, &env, mappingFunc, pod, defaultedPod, containerName, rm, recorder)
 		if err != nil {
 			return err
 		}
@@ -367,15 +379,15 @@ func makeEnvironmentMap(ctx context.Context, pod *corev1.Pod, envVars []corev1.E
 	return nil
 }
 
-func getEnvironmentVariableValue(ctx context.Context, env *corev1.EnvVar, mappingFunc func(string) string, pod *corev1.Pod, rm *manager.ResourceManager, recorder record.EventRecorder) (*string, error) {
+func getEnvironmentVariableValue(ctx context.Context, env *corev1.EnvVar, mappingFunc func(string) string, pod, defaultedPod *corev1.Pod, containerName string, rm *manager.ResourceManager, recorder record.EventRecorder) (*string, error) {
 	if env.ValueFrom != nil {
-		return getEnvironmentVariableValueWithValueFrom(ctx, env, mappingFunc, pod, rm, recorder)
+		return getEnvironmentVariableValueWithValueFrom(ctx, env, mappingFunc, pod, defaultedPod, containerName, rm, recorder)
 	}
 	// Handle values that have been directly provided after expanding variable references.
 	return ptr.To(expansion.Expand(env.Value, mappingFunc)), nil
 }
 
-func getEnvironmentVariableValueWithValueFrom(ctx context.Context, env *corev1.EnvVar, mappingFunc func(string) string, pod *corev1.Pod, rm *manager.ResourceManager, recorder record.EventRecorder) (*string, error) {
+func getEnvironmentVariableValueWithValueFrom(ctx context.Context, env *corev1.EnvVar, mappingFunc func(string) string, pod, defaultedPod *corev1.Pod, containerName string, rm *manager.ResourceManager, recorder record.EventRecorder) (*string, error) {
 	// Handle population from a configmap key.
 	if env.ValueFrom.ConfigMapKeyRef != nil {
 		return getEnvironmentVariableValueWithValueFromConfigMapKeyRef(ctx, env, pod, rm, recorder)
@@ -390,9 +402,9 @@ func getEnvironmentVariableValueWithValueFrom(ctx context.Context, env *corev1.E
 	if env.ValueFrom.FieldRef != nil {
 		return getEnvironmentVariableValueWithValueFromFieldRef(env, pod)
 	}
+	// Handle population from a resource field (downward API).
 	if env.ValueFrom.ResourceFieldRef != nil {
-		// TODO Implement populating resource requests.
-		return nil, nil
+		return getEnvironmentVariableValueWithValueFromResourceFieldRef(env, defaultedPod, containerName)
 	}
 
 	log.G(ctx).WithField("env", env).Error("Unhandled environment variable with non-nil env.ValueFrom, do not know how to populate")
@@ -517,6 +529,22 @@ func getEnvironmentVariableValueWithValueFromFieldRef(env *corev1.EnvVar, pod *c
 	return ptr.To(runtimeVal), nil
 }
 
+// Handle population from a resource field (downward API).
+func getEnvironmentVariableValueWithValueFromResourceFieldRef(env *corev1.EnvVar, defaultedPod *corev1.Pod, containerName string) (*string, error) {
+	vf := env.ValueFrom.ResourceFieldRef
+	// The resource field reference defaults to the container the environment variable is being populated for.
+	if vf.ContainerName != "" {
+		containerName = vf.ContainerName
+	}
+
+	runtimeVal, err := ExtractResourceValueByContainerName(vf, defaultedPod, containerName)
+	if err != nil {
+		return nil, err
+	}
+
+	return ptr.To(runtimeVal), nil
+}
+
 // podFieldSelectorRuntimeValue returns the runtime value of the given
 // selector for a pod.
 func podFieldSelectorRuntimeValue(fs *corev1.ObjectFieldSelector, pod *corev1.Pod) (string, error) {
@@ -529,7 +557,28 @@ func podFieldSelectorRuntimeValue(fs *corev1.ObjectFieldSelector, pod *corev1.Po
 		return pod.Spec.NodeName, nil
 	case "spec.serviceAccountName":
 		return pod.Spec.ServiceAccountName, nil
-
+	case "status.hostIP":
+		return pod.Status.HostIP, nil
+	case "status.hostIPs":
+		ips := make([]string, 0, len(pod.Status.HostIPs))
+		for _, ip := range pod.Status.HostIPs {
+			ips = append(ips, ip.IP)
+		}
+		if len(ips) == 0 && pod.Status.HostIP != "" {
+			ips = append(ips, pod.Status.HostIP)
+		}
+		return strings.Join(ips, ","), nil
+	case "status.podIP":
+		return pod.Status.PodIP, nil
+	case "status.podIPs":
+		ips := make([]string, 0, len(pod.Status.PodIPs))
+		for _, ip := range pod.Status.PodIPs {
+			ips = append(ips, ip.IP)
+		}
+		if len(ips) == 0 && pod.Status.PodIP != "" {
+			ips = append(ips, pod.Status.PodIP)
+		}
+		return strings.Join(ips, ","), nil
 	}
 	return ExtractFieldPathAsString(pod, internalFieldPath)
 }
@@ -23,6 +23,7 @@ import (
 	"gotest.tools/assert"
 	is "gotest.tools/assert/cmp"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	testutil "github.com/virtual-kubelet/virtual-kubelet/internal/test/util"
@@ -215,7 +216,7 @@ func TestPopulatePodWithInitContainersUsingEnv(t *testing.T) {
 	}
 
 	// Populate the pod's environment.
-	err := PopulateEnvironmentVariables(context.Background(), pod, rm, er)
+	err := PopulateEnvironmentVariables(context.Background(), pod, rm, er, nil)
 	assert.Check(t, err)
 
 	// Make sure that all the containers' environments contain all the expected keys and values.
@@ -375,7 +376,7 @@ func TestPopulatePodWithInitContainersUsingEnvWithFieldRef(t *testing.T) {
 	}
 
 	// Populate the pod's environment.
-	err := PopulateEnvironmentVariables(context.Background(), pod, rm, er)
+	err := PopulateEnvironmentVariables(context.Background(), pod, rm, er, nil)
 	assert.NilError(t, err)
 
 	// Make sure that all the containers' environments contain all the expected keys and values.
@@ -491,7 +492,7 @@ func TestPopulatePodWithInitContainersUsingEnvFrom(t *testing.T) {
 	}
 
 	// Populate the pod's environment.
-	err := PopulateEnvironmentVariables(context.Background(), pod, rm, er)
+	err := PopulateEnvironmentVariables(context.Background(), pod, rm, er, nil)
 	assert.Check(t, err)
 
 	// Make sure that all the containers' environments contain all the expected keys and values.
@@ -570,7 +571,7 @@ func TestEnvFromTwoConfigMapsAndOneSecret(t *testing.T) {
 	}
 
 	// Populate the container's environment.
-	err := populateContainerEnvironment(context.Background(), pod, &pod.Spec.Containers[0], rm, er)
+	err := populateContainerEnvironment(context.Background(), pod, pod, &pod.Spec.Containers[0], rm, er)
 	assert.Check(t, err)
 
 	// Make sure that the container's environment contains all the expected keys and values.
@@ -632,7 +633,7 @@ func TestEnvFromConfigMapAndSecretWithInvalidKeys(t *testing.T) {
 	}
 
 	// Populate the pods's environment.
-	err := PopulateEnvironmentVariables(context.Background(), pod, rm, er)
+	err := PopulateEnvironmentVariables(context.Background(), pod, rm, er, nil)
 	assert.Check(t, err)
 
 	// Make sure that the container's environment has two variables (corresponding to the single valid key in both the configmap and the secret).
@@ -703,7 +704,7 @@ func TestEnvOverridesEnvFrom(t *testing.T) {
 	}
 
 	// Populate the pods's environment.
-	err := PopulateEnvironmentVariables(context.Background(), pod, rm, er)
+	err := PopulateEnvironmentVariables(context.Background(), pod, rm, er, nil)
 	assert.Check(t, err)
 
 	// Make sure that the container's environment contains all the expected keys and values.
@@ -780,7 +781,7 @@ func TestEnvFromInexistentConfigMaps(t *testing.T) {
 	}
 
 	// Populate the pods's environment.
-	err := PopulateEnvironmentVariables(context.Background(), pod, rm, er)
+	err := PopulateEnvironmentVariables(context.Background(), pod, rm, er, nil)
 	assert.Check(t, is.ErrorContains(err, ""))
 
 	// Make sure that two events have been recorded with the correct reason and message.
@@ -837,7 +838,7 @@ func TestEnvFromInexistentSecrets(t *testing.T) {
 	}
 
 	// Populate the pods's environment.
-	err := PopulateEnvironmentVariables(context.Background(), pod, rm, er)
+	err := PopulateEnvironmentVariables(context.Background(), pod, rm, er, nil)
 	assert.Check(t, is.ErrorContains(err, ""))
 
 	// Make sure that two events have been recorded with the correct reason and message.
@@ -890,7 +891,7 @@ func TestEnvReferencingInexistentConfigMapKey(t *testing.T) {
 	}
 
 	// Populate the pods's environment.
-	err := PopulateEnvironmentVariables(context.Background(), pod, rm, er)
+	err := PopulateEnvironmentVariables(context.Background(), pod, rm, er, nil)
 	assert.Check(t, is.ErrorContains(err, ""))
 
 	// Make sure that two events have been recorded with the correct reason and message.
@@ -940,7 +941,7 @@ func TestEnvReferencingInexistentSecretKey(t *testing.T) {
 	}
 
 	// Populate the pods's environment.
-	err := PopulateEnvironmentVariables(context.Background(), pod, rm, er)
+	err := PopulateEnvironmentVariables(context.Background(), pod, rm, er, nil)
 	assert.Check(t, is.ErrorContains(err, ""))
 
 	// Make sure that two events have been recorded with the correct reason and message.
@@ -1023,7 +1024,7 @@ func TestServiceEnvVar(t *testing.T) {
 	for _, tc := range testCases {
 		pod.Spec.EnableServiceLinks = tc.enableServiceLinks
 
-		err := PopulateEnvironmentVariables(context.Background(), pod, rm, er)
+		err := PopulateEnvironmentVariables(context.Background(), pod, rm, er, nil)
 		assert.NilError(t, err, "[%s]", tc.name)
 		assert.Check(t, is.DeepEqual(pod.Spec.Containers[0].Env, tc.expectedEnvs, sortOpt))
 	}
@@ -1066,7 +1067,7 @@ func TestComposingEnv(t *testing.T) {
 	}
 
 	// Populate the pods's environment.
-	err := PopulateEnvironmentVariables(context.Background(), pod, rm, er)
+	err := PopulateEnvironmentVariables(context.Background(), pod, rm, er, nil)
 	assert.Check(t, err)
 
 	// Make sure that the container's environment contains all the expected keys and values.
@@ -1117,7 +1118,7 @@ func TestEmptyEnvVar(t *testing.T) {
 	}
 
 	// Populate the pods's environment.
-	err := PopulateEnvironmentVariables(context.Background(), pod, rm, er)
+	err := PopulateEnvironmentVariables(context.Background(), pod, rm, er, nil)
 	assert.Check(t, err)
 
 	// Make sure that the container's environment contains all the expected keys and values.
@@ -1206,7 +1207,7 @@ func TestPopulatePodWithEphemeralContainersUsingEnv(t *testing.T) {
 	}
 
 	// Populate the pod's environment.
-	err := PopulateEnvironmentVariables(context.Background(), pod, rm, er)
+	err := PopulateEnvironmentVariables(context.Background(), pod, rm, er, nil)
 	assert.Check(t, err)
 
 	// Make sure the regular container's environment is populated.
@@ -1299,7 +1300,7 @@ func TestPopulatePodWithEphemeralContainersUsingEnvFrom(t *testing.T) {
 	}
 
 	// Populate the pod's environment.
-	err := PopulateEnvironmentVariables(context.Background(), pod, rm, er)
+	err := PopulateEnvironmentVariables(context.Background(), pod, rm, er, nil)
 	assert.Check(t, err)
 
 	// Make sure the first ephemeral container's environment is populated from the configmap.
@@ -1388,7 +1389,7 @@ func TestPopulatePodWithEphemeralContainersUsingFieldRef(t *testing.T) {
 	}
 
 	// Populate the pod's environment.
-	err := PopulateEnvironmentVariables(context.Background(), pod, rm, er)
+	err := PopulateEnvironmentVariables(context.Background(), pod, rm, er, nil)
 	assert.NilError(t, err)
 
 	// Make sure the ephemeral container's environment is populated from the downward API.
@@ -1407,3 +1408,307 @@ func TestPopulatePodWithEphemeralContainersUsingFieldRef(t *testing.T) {
 		},
 	}, sortOpt))
 }
+
+func TestPopulatePodWithResourceFieldRef(t *testing.T) {
+	rm := testutil.FakeResourceManager()
+	er := testutil.FakeEventRecorder(defaultEventRecorderBufferSize)
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: namespace,
+			Name:      "pod-0",
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Name: "app",
+					Resources: corev1.ResourceRequirements{
+						Requests: corev1.ResourceList{
+							corev1.ResourceCPU:    resource.MustParse("250m"),
+							corev1.ResourceMemory: resource.MustParse("64Mi"),
+						},
+						Limits: corev1.ResourceList{
+							corev1.ResourceMemory: resource.MustParse("128Mi"),
+						},
+					},
+					Env: []corev1.EnvVar{
+						{
+							Name: "CPU_REQUEST_MILLIS",
+							ValueFrom: &corev1.EnvVarSource{
+								ResourceFieldRef: &corev1.ResourceFieldSelector{
+									Resource: "requests.cpu",
+									Divisor:  resource.MustParse("1m"),
+								},
+							},
+						},
+						{
+							Name: "CPU_REQUEST",
+							ValueFrom: &corev1.EnvVarSource{
+								ResourceFieldRef: &corev1.ResourceFieldSelector{
+									Resource: "requests.cpu",
+								},
+							},
+						},
+						{
+							Name: "MEMORY_LIMIT_MI",
+							ValueFrom: &corev1.EnvVarSource{
+								ResourceFieldRef: &corev1.ResourceFieldSelector{
+									Resource: "limits.memory",
+									Divisor:  resource.MustParse("1Mi"),
+								},
+							},
+						},
+						{
+							Name: "CPU_LIMIT",
+							ValueFrom: &corev1.EnvVarSource{
+								ResourceFieldRef: &corev1.ResourceFieldSelector{
+									Resource: "limits.cpu",
+								},
+							},
+						},
+					},
+				},
+				{
+					Name: "sidecar",
+					Env: []corev1.EnvVar{
+						{
+							Name: "APP_MEMORY_REQUEST",
+							ValueFrom: &corev1.EnvVarSource{
+								ResourceFieldRef: &corev1.ResourceFieldSelector{
+									ContainerName: "app",
+									Resource:      "requests.memory",
+								},
+							},
+						},
+					},
+				},
+			},
+			EnableServiceLinks: &bFalse,
+		},
+	}
+
+	allocatable := corev1.ResourceList{
+		corev1.ResourceCPU:    resource.MustParse("4"),
+		corev1.ResourceMemory: resource.MustParse("8Gi"),
+	}
+	err := PopulateEnvironmentVariables(context.Background(), pod, rm, er, allocatable)
+	assert.NilError(t, err)
+
+	assert.Check(t, is.DeepEqual(pod.Spec.Containers[0].Env, []corev1.EnvVar{
+		{Name: "CPU_REQUEST_MILLIS", Value: "250"},
+		{Name: "CPU_REQUEST", Value: "1"},
+		{Name: "MEMORY_LIMIT_MI", Value: "128"},
+		// The cpu limit is not set, so it defaults to the node's allocatable cpu.
+		{Name: "CPU_LIMIT", Value: "4"},
+	}, sortOpt))
+	assert.Check(t, is.DeepEqual(pod.Spec.Containers[1].Env, []corev1.EnvVar{
+		{Name: "APP_MEMORY_REQUEST", Value: "67108864"},
+	}, sortOpt))
+	// The pod itself must not be modified by defaulting the limits.
+	_, ok := pod.Spec.Containers[0].Resources.Limits[corev1.ResourceCPU]
+	assert.Check(t, !ok)
+}
+
+func TestPopulatePodWithStatusFieldRef(t *testing.T) {
+	rm := testutil.FakeResourceManager()
+	er := testutil.FakeEventRecorder(defaultEventRecorderBufferSize)
+
+	fieldRef := func(name, path string) corev1.EnvVar {
+		return corev1.EnvVar{
+			Name: name,
+			ValueFrom: &corev1.EnvVarSource{
+				FieldRef: &corev1.ObjectFieldSelector{
+					APIVersion: "v1",
+					FieldPath:  path,
+				},
+			},
+		}
+	}
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: namespace,
+			Name:      "pod-0",
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Env: []corev1.EnvVar{
+						fieldRef("POD_IP", "status.podIP"),
+						fieldRef("POD_IPS", "status.podIPs"),
+						fieldRef("HOST_IP", "status.hostIP"),
+						fieldRef("HOST_IPS", "status.hostIPs"),
+					},
+				},
+			},
+			EnableServiceLinks: &bFalse,
+		},
+		Status: corev1.PodStatus{
+			PodIP:  "10.0.0.1",
+			PodIPs: []corev1.PodIP{{IP: "10.0.0.1"}, {IP: "fd00::1"}},
+			HostIP: "192.168.0.1",
+		},
+	}
+
+	err := PopulateEnvironmentVariables(context.Background(), pod, rm, er, nil)
+	assert.NilError(t, err)
+
+	assert.Check(t, is.DeepEqual(pod.Spec.Containers[0].Env, []corev1.EnvVar{
+		{Name: "POD_IP", Value: "10.0.0.1"},
+		{Name: "POD_IPS", Value: "10.0.0.1,fd00::1"},
+		{Name: "HOST_IP", Value: "192.168.0.1"},
+		{Name: "HOST_IPS", Value: "192.168.0.1"},
+	}, sortOpt))
+}
+
+func TestExpandCommandArgsAndSubPathExpr(t *testing.T) {
+	rm := testutil.FakeResourceManager(configMap1)
+	er := testutil.FakeEventRecorder(defaultEventRecorderBufferSize)
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: namespace,
+			Name:      "pod-0",
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Name:    "app",
+					Command: []string{"/bin/$(BINARY)"},
+					Args:    []string{"--foo=$(FROM_CONFIGMAP_1_FOO)", "--name=$(POD_NAME)", "$$(ESCAPED)", "$(UNDEFINED)"},
+					EnvFrom: []corev1.EnvFromSource{
+						{
+							ConfigMapRef: &corev1.ConfigMapEnvSource{
+								LocalObjectReference: corev1.LocalObjectReference{
+									Name: configMap1.Name,
+								},
+							},
+							Prefix: prefixConfigMap1,
+						},
+					},
+					Env: []corev1.EnvVar{
+						{
+							Name:  "BINARY",
+							Value: "server",
+						},
+						{
+							Name: "POD_NAME",
+							ValueFrom: &corev1.EnvVarSource{
+								FieldRef: &corev1.ObjectFieldSelector{
+									APIVersion: "v1",
+									FieldPath:  "metadata.name",
+								},
+							},
+						},
+					},
+					VolumeMounts: []corev1.VolumeMount{
+						{
+							Name:        "logs",
+							MountPath:   "/var/log",
+							SubPathExpr: "$(POD_NAME)/$(BINARY)",
+						},
+					},
+				},
+			},
+			EnableServiceLinks: &bFalse,
+		},
+	}
+
+	err := PopulateEnvironmentVariables(context.Background(), pod, rm, er, nil)
+	assert.NilError(t, err)
+
+	c := pod.Spec.Containers[0]
+	assert.Check(t, is.DeepEqual(c.Command, []string{"/bin/server"}))
+	assert.Check(t, is.DeepEqual(c.Args, []string{"--foo=__foo__", "--name=pod-0", "$(ESCAPED)", "$(UNDEFINED)"}))
+	assert.Check(t, is.Equal(c.VolumeMounts[0].SubPath, "pod-0/server"))
+	assert.Check(t, is.Equal(c.VolumeMounts[0].SubPathExpr, ""))
+
+	// The reference to the undefined variable must have been reported.
+	assert.Check(t, is.Len(er.Events, 1))
+	event := <-er.Events
+	assert.Check(t, is.Contains(event, ReasonUnresolvedVariableReferences))
+	assert.Check(t, is.Contains(event, "UNDEFINED"))
+}
+
+func TestExpandSubPathExprFailures(t *testing.T) {
+	for name, expr := range map[string]string{
+		"undefined": "$(UNDEFINED)",
+		"empty":     "$(EMPTY)",
+		"absolute":  "/$(DIR)",
+		"backsteps": "../$(DIR)",
+	} {
+		t.Run(name, func(t *testing.T) {
+			rm := testutil.FakeResourceManager()
+			er := testutil.FakeEventRecorder(defaultEventRecorderBufferSize)
+
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: namespace,
+					Name:      "pod-0",
+				},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{
+							Name: "app",
+							Env: []corev1.EnvVar{
+								{Name: "DIR", Value: "dir"},
+								{Name: "EMPTY"},
+							},
+							VolumeMounts: []corev1.VolumeMount{
+								{
+									Name:        "data",
+									MountPath:   "/data",
+									SubPathExpr: expr,
+								},
+							},
+						},
+					},
+					EnableServiceLinks: &bFalse,
+				},
+			}
+
+			err := PopulateEnvironmentVariables(context.Background(), pod, rm, er, nil)
+			assert.Check(t, is.ErrorContains(err, "subPathExpr"))
+			assert.Check(t, is.Len(er.Events, 1))
+			event := <-er.Events
+			assert.Check(t, is.Contains(event, ReasonFailedToExpandSubPathExpr))
+		})
+	}
+}
+
+func TestExpandMalformedCommandReferences(t *testing.T) {
+	rm := testutil.FakeResourceManager()
+	er := testutil.FakeEventRecorder(defaultEventRecorderBufferSize)
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: namespace,
+			Name:      "pod-0",
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Name:    "app",
+					Command: []string{"/bin/$(BINARY)"},
+					Args:    []string{"--name=$(BINARY", "$$(ESCAPED", "$(BINARY)-$("},
+					Env: []corev1.EnvVar{
+						{Name: "BINARY", Value: "server"},
+					},
+				},
+			},
+			EnableServiceLinks: &bFalse,
+		},
+	}
+
+	err := PopulateEnvironmentVariables(context.Background(), pod, rm, er, nil)
+	assert.NilError(t, err)
+
+	// Malformed references are left as is, and reported.
+	c := pod.Spec.Containers[0]
+	assert.Check(t, is.DeepEqual(c.Command, []string{"/bin/server"}))
+	assert.Check(t, is.DeepEqual(c.Args, []string{"--name=$(BINARY", "$(ESCAPED", "server-$("}))
+	assert.Check(t, is.Len(er.Events, 1))
+	event := <-er.Events
+	assert.Check(t, is.Contains(event, ReasonMalformedVariableReferences))
+	assert.Check(t, is.Contains(event, "[$(, $(BINARY]"))
+}
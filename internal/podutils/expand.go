@@ -0,0 +1,136 @@
+// Copyright © 2017 The virtual-kubelet authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package podutils
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/virtual-kubelet/virtual-kubelet/internal/expansion"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/tools/record"
+)
+
+const (
+	// ReasonUnresolvedVariableReferences is the reason used in events emitted when a container's command or args
+	// reference variables which are not defined in the container's environment.
+	ReasonUnresolvedVariableReferences = "UnresolvedVariableReferences"
+	// ReasonMalformedVariableReferences is the reason used in events emitted when a container's command or args
+	// contain a variable reference which is not closed, and is therefore left as is.
+	ReasonMalformedVariableReferences = "MalformedVariableReferences"
+	// ReasonFailedToExpandSubPathExpr is the reason used in events emitted when a volume mount's subPathExpr cannot
+	// be expanded.
+	ReasonFailedToExpandSubPathExpr = "FailedToExpandSubPathExpr"
+)
+
+// expandContainerCommandAndArgs expands $(VAR) references in the container's command and args using the container's
+// resolved environment. References to undefined variables and malformed references are left as is, like the kubelet
+// does, but an event is recorded for them.
+// Based on ExpandContainerCommandAndArgs in pkg/kubelet/container/helpers.go.
+func expandContainerCommandAndArgs(pod *corev1.Pod, containerName string, command, args []string, env map[string]string, recorder record.EventRecorder) {
+	missing := sets.New[string]()
+	malformed := sets.New[string]()
+	fallback := expansion.MappingFuncFor(env)
+	mapping := func(name string) string {
+		if _, ok := env[name]; !ok {
+			missing.Insert(name)
+		}
+		return fallback(name)
+	}
+
+	for i := range command {
+		if ref, ok := malformedReference(command[i]); ok {
+			malformed.Insert(ref)
+		}
+		command[i] = expansion.Expand(command[i], mapping)
+	}
+	for i := range args {
+		if ref, ok := malformedReference(args[i]); ok {
+			malformed.Insert(ref)
+		}
+		args[i] = expansion.Expand(args[i], mapping)
+	}
+
+	if missing.Len() > 0 {
+		recorder.Eventf(pod, corev1.EventTypeWarning, ReasonUnresolvedVariableReferences, "command and args of container %q reference undefined variables [%s]", containerName, strings.Join(sets.List(missing), ", "))
+	}
+	if malformed.Len() > 0 {
+		recorder.Eventf(pod, corev1.EventTypeWarning, ReasonMalformedVariableReferences, "command and args of container %q contain malformed variable references [%s]", containerName, strings.Join(sets.List(malformed), ", "))
+	}
+}
+
+// malformedReference returns the reference in the input which is opened with "$(" but never closed, if any. Such a
+// reference is not expanded, and is kept as is by expansion.Expand.
+func malformedReference(input string) (string, bool) {
+	for i := 0; i+1 < len(input); i++ {
+		if input[i] != '$' {
+			continue
+		}
+		switch input[i+1] {
+		case '$':
+			// Escaped operator.
+			i++
+		case '(':
+			end := strings.IndexByte(input[i+2:], ')')
+			if end < 0 {
+				return input[i:], true
+			}
+			i += end + 2
+		}
+	}
+	return "", false
+}
+
+// expandContainerVolumeMounts expands $(VAR) references in the subPathExpr of each of the container's volume mounts,
+// and replaces it with the resulting subPath. Unlike the command and args, it is an error for a subPathExpr to
+// reference a variable which is not defined or empty, or to expand to a path which is not relative to the volume.
+// Based on ExpandContainerVolumeMounts in pkg/kubelet/container/helpers.go.
+func expandContainerVolumeMounts(pod *corev1.Pod, containerName string, mounts []corev1.VolumeMount, env map[string]string, recorder record.EventRecorder) error {
+	for i := range mounts {
+		mount := &mounts[i]
+		if mount.SubPathExpr == "" {
+			continue
+		}
+
+		missing := sets.New[string]()
+		expanded := expansion.Expand(mount.SubPathExpr, func(name string) string {
+			value, ok := env[name]
+			if !ok || len(value) == 0 {
+				missing.Insert(name)
+			}
+			return value
+		})
+
+		var err error
+		switch {
+		case missing.Len() > 0:
+			err = fmt.Errorf("missing value for %s", strings.Join(sets.List(missing), ", "))
+		case filepath.IsAbs(expanded):
+			err = fmt.Errorf("subPath %q must not be an absolute path", expanded)
+		case !filepath.IsLocal(expanded):
+			err = fmt.Errorf("subPath %q must not contain '..'", expanded)
+		}
+		if err != nil {
+			recorder.Eventf(pod, corev1.EventTypeWarning, ReasonFailedToExpandSubPathExpr, "failed to expand subPathExpr %q of volume mount %q in container %q: %v", mount.SubPathExpr, mount.Name, containerName, err)
+			return fmt.Errorf("failed to expand subPathExpr of volume mount %q in container %q: %w", mount.Name, containerName, err)
+		}
+
+		mount.SubPath = expanded
+		mount.SubPathExpr = ""
+	}
+	return nil
+}
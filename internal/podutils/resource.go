@@ -0,0 +1,158 @@
+/*
+Copyright 2014 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package podutils
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// ExtractResourceValueByContainerName extracts the value of a resource
+// by providing container name.
+// Based on ExtractResourceValueByContainerName in pkg/api/v1/resource/helpers.go.
+func ExtractResourceValueByContainerName(fs *corev1.ResourceFieldSelector, pod *corev1.Pod, containerName string) (string, error) {
+	container, err := findContainerInPod(pod, containerName)
+	if err != nil {
+		return "", err
+	}
+	return ExtractContainerResourceValue(fs, container)
+}
+
+// ExtractContainerResourceValue extracts the value of a resource
+// in an already known container.
+// Based on ExtractContainerResourceValue in pkg/api/v1/resource/helpers.go.
+func ExtractContainerResourceValue(fs *corev1.ResourceFieldSelector, container *corev1.Container) (string, error) {
+	divisor := resource.Quantity{}
+	if divisor.Cmp(fs.Divisor) == 0 {
+		divisor = resource.MustParse("1")
+	} else {
+		divisor = fs.Divisor
+	}
+
+	switch fs.Resource {
+	case "limits.cpu":
+		return convertResourceCPUToString(container.Resources.Limits.Cpu(), divisor)
+	case "limits.memory":
+		return convertResourceQuantityToString(container.Resources.Limits.Memory(), divisor)
+	case "limits.ephemeral-storage":
+		return convertResourceQuantityToString(container.Resources.Limits.StorageEphemeral(), divisor)
+	case "requests.cpu":
+		return convertResourceCPUToString(container.Resources.Requests.Cpu(), divisor)
+	case "requests.memory":
+		return convertResourceQuantityToString(container.Resources.Requests.Memory(), divisor)
+	case "requests.ephemeral-storage":
+		return convertResourceQuantityToString(container.Resources.Requests.StorageEphemeral(), divisor)
+	}
+	// handle extended standard resources with dynamic names
+	// example: requests.hugepages-<pageSize> or limits.hugepages-<pageSize>
+	if strings.HasPrefix(fs.Resource, "requests.") {
+		resourceName := corev1.ResourceName(strings.TrimPrefix(fs.Resource, "requests."))
+		if isHugePageResourceName(resourceName) {
+			return convertResourceQuantityToString(container.Resources.Requests.Name(resourceName, resource.BinarySI), divisor)
+		}
+	}
+	if strings.HasPrefix(fs.Resource, "limits.") {
+		resourceName := corev1.ResourceName(strings.TrimPrefix(fs.Resource, "limits."))
+		if isHugePageResourceName(resourceName) {
+			return convertResourceQuantityToString(container.Resources.Limits.Name(resourceName, resource.BinarySI), divisor)
+		}
+	}
+	return "", fmt.Errorf("unsupported container resource : %v", fs.Resource)
+}
+
+// MergeContainerResourceLimits checks if a limit is applied for
+// the container, and if not, it sets the limit to the passed resource list.
+// Based on MergeContainerResourceLimits in pkg/kubelet/cm/helpers.go.
+func MergeContainerResourceLimits(container *corev1.Container, allocatable corev1.ResourceList) {
+	if container.Resources.Limits == nil {
+		container.Resources.Limits = make(corev1.ResourceList)
+	}
+	// NOTE: we exclude hugepages-* resources because hugepages are never overcommitted.
+	// This means that the container always has a limit specified.
+	for _, resource := range []corev1.ResourceName{corev1.ResourceCPU, corev1.ResourceMemory, corev1.ResourceEphemeralStorage} {
+		if quantity, exists := container.Resources.Limits[resource]; !exists || quantity.IsZero() {
+			if capacity, exists := allocatable[resource]; exists {
+				container.Resources.Limits[resource] = capacity.DeepCopy()
+			}
+		}
+	}
+}
+
+// podWithDefaultedLimits returns a copy of the pod in which every container without a cpu, memory, or ephemeral
+// storage limit has it set to the node's allocatable value, which is what the downward API reports in that case.
+// Based on defaultPodLimitsForDownwardAPI in pkg/kubelet/kubelet_resources.go.
+func podWithDefaultedLimits(pod *corev1.Pod, allocatable corev1.ResourceList) *corev1.Pod {
+	pod = pod.DeepCopy()
+	for idx := range pod.Spec.InitContainers {
+		MergeContainerResourceLimits(&pod.Spec.InitContainers[idx], allocatable)
+	}
+	for idx := range pod.Spec.Containers {
+		MergeContainerResourceLimits(&pod.Spec.Containers[idx], allocatable)
+	}
+	for idx := range pod.Spec.EphemeralContainers {
+		c := corev1.Container(pod.Spec.EphemeralContainers[idx].EphemeralContainerCommon)
+		MergeContainerResourceLimits(&c, allocatable)
+		pod.Spec.EphemeralContainers[idx].EphemeralContainerCommon = corev1.EphemeralContainerCommon(c)
+	}
+	return pod
+}
+
+// findContainerInPod finds a container by its name in the provided pod
+func findContainerInPod(pod *corev1.Pod, containerName string) (*corev1.Container, error) {
+	for idx := range pod.Spec.Containers {
+		if pod.Spec.Containers[idx].Name == containerName {
+			return &pod.Spec.Containers[idx], nil
+		}
+	}
+	for idx := range pod.Spec.InitContainers {
+		if pod.Spec.InitContainers[idx].Name == containerName {
+			return &pod.Spec.InitContainers[idx], nil
+		}
+	}
+	for idx := range pod.Spec.EphemeralContainers {
+		if pod.Spec.EphemeralContainers[idx].Name == containerName {
+			c := corev1.Container(pod.Spec.EphemeralContainers[idx].EphemeralContainerCommon)
+			return &c, nil
+		}
+	}
+	return nil, fmt.Errorf("container %s not found", containerName)
+}
+
+// convertResourceCPUToString converts cpu value to the format of divisor and returns
+// ceiling of the value.
+func convertResourceCPUToString(cpu *resource.Quantity, divisor resource.Quantity) (string, error) {
+	c := int64(math.Ceil(float64(cpu.MilliValue()) / float64(divisor.MilliValue())))
+	return strconv.FormatInt(c, 10), nil
+}
+
+// convertResourceQuantityToString converts a memory, ephemeral storage or hugepages value to the format of divisor
+// and returns ceiling of the value.
+func convertResourceQuantityToString(quantity *resource.Quantity, divisor resource.Quantity) (string, error) {
+	m := int64(math.Ceil(float64(quantity.Value()) / float64(divisor.Value())))
+	return strconv.FormatInt(m, 10), nil
+}
+
+// isHugePageResourceName returns true if the resource name has the huge page
+// resource prefix.
+func isHugePageResourceName(name corev1.ResourceName) bool {
+	return strings.HasPrefix(string(name), corev1.ResourceHugePagesPrefix)
+}
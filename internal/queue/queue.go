@@ -18,6 +18,8 @@ import (
 	"container/list"
 	"context"
 	"fmt"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -33,6 +35,10 @@ import (
 const (
 	// MaxRetries is the number of times we try to process a given key before permanently forgetting it.
 	MaxRetries = 20
+
+	// DefaultMaxWait is the default time items may be ready to be processed before they are processed ahead of the
+	// items of other priority lanes.
+	DefaultMaxWait = 10 * time.Second
 )
 
 // ShouldRetryFunc is a mechanism to have a custom retry policy
@@ -41,6 +47,59 @@ type ShouldRetryFunc func(ctx context.Context, key string, timesTried int, origi
 // ItemHandler is a callback that handles a single key on the Queue
 type ItemHandler func(ctx context.Context, key string) error
 
+// PriorityConfig configures the priority lanes of a Queue.
+type PriorityConfig struct {
+	// LaneWeights are the weights of the lanes, starting with lane 0, which has the highest priority.
+	// When the items of several lanes are ready to be processed, each lane gets a share of the items that are
+	// processed proportional to its weight. Weights which are not positive are treated as 1.
+	LaneWeights []int
+	// MaxWait is how long an item may be ready to be processed before it is processed ahead of the items of other
+	// lanes, regardless of their weights, so that low priority lanes are not starved.
+	// It defaults to DefaultMaxWait. If it is negative, items are only processed according to the weights.
+	MaxWait time.Duration
+}
+
+// FairnessConfig configures fair queuing of items between tenants.
+//
+// Each tenant has its own sub-queue in every lane, and the tenants whose items are ready are served by a smooth
+// weighted round-robin, so that a tenant with many items cannot hold back the items of other tenants.
+type FairnessConfig struct {
+	// TenantFunc returns the tenant of a key. It defaults to NamespaceTenant.
+	TenantFunc func(key string) string
+	// TenantWeight returns the weight of a tenant. Weights which are not positive are treated as 1.
+	// If it is nil, all tenants have the same weight.
+	TenantWeight func(tenant string) int
+	// MaxInFlightPerTenant is the maximum number of items of a tenant which are processed at the same time.
+	// If it is zero (or negative), it is not limited.
+	MaxInFlightPerTenant int
+}
+
+// Config configures a Queue.
+type Config struct {
+	// Priorities configures the priority lanes of the queue. By default, the queue has a single lane.
+	Priorities PriorityConfig
+	// Fairness configures fair queuing between tenants. If it is nil, all items belong to the same tenant.
+	Fairness *FairnessConfig
+}
+
+// NamespaceTenant returns the namespace of keys of the form namespace/name (or namespace/name/uid), or the empty
+// string for keys without a namespace.
+func NamespaceTenant(key string) string {
+	namespace, _, ok := strings.Cut(key, "/")
+	if !ok {
+		return ""
+	}
+	return namespace
+}
+
+// TenantStats are the statistics of the items of a tenant of a Queue.
+type TenantStats struct {
+	// Queued is the number of items waiting to be processed.
+	Queued int
+	// InFlight is the number of items being processed.
+	InFlight int
+}
+
 // Queue implements a wrapper around workqueue with native VK instrumentation
 type Queue struct {
 	// clock is used for testing
@@ -52,9 +111,18 @@ type Queue struct {
 	handler ItemHandler
 
 	ratelimiter workqueue.TypedRateLimiter[any]
-	// items are items that are marked dirty waiting for processing.
-	items *list.List
-	// itemInQueue is a map of (string) key -> item while it is in the items list
+	// lanes hold the items that are marked dirty waiting for processing, one per priority lane.
+	lanes []*lane
+	// maxWait is how long an item may be ready before it is processed ahead of other lanes, if positive.
+	maxWait time.Duration
+	// tenantFunc returns the tenant of a key, and tenantWeight its weight.
+	tenantFunc   func(key string) string
+	tenantWeight func(tenant string) int
+	// maxInFlightPerTenant is the maximum number of items of a tenant being processed, if positive.
+	maxInFlightPerTenant int
+	// tenantsInFlight is a map of tenant -> number of its items being processed
+	tenantsInFlight map[string]int
+	// itemInQueue is a map of (string) key -> item while it is in one of the lanes
 	itemsInQueue map[string]*list.Element
 	// itemsBeingProcessed is a map of (string) key -> item once it has been moved
 	itemsBeingProcessed map[string]*queueItem
@@ -68,11 +136,34 @@ type Queue struct {
 	retryFunc ShouldRetryFunc
 }
 
+// lane is a priority lane of a Queue.
+type lane struct {
+	// weight is the weight of the lane, and credits the state of the weighted round-robin between lanes.
+	weight  int
+	credits int
+	// tenants is a map of tenant -> list of the tenant's items in the lane. Each list is ordered by the time work on
+	// its items is planned to start. Lists are removed once they are empty.
+	tenants map[string]*list.List
+	// tenantCredits is the state of the weighted round-robin between the tenants of the lane.
+	tenantCredits map[string]int
+}
+
+func (l *lane) len() int {
+	var n int
+	for _, items := range l.tenants {
+		n += items.Len()
+	}
+	return n
+}
+
 type queueItem struct {
 	key                    string
+	tenant                 string
+	lane                   int
 	plannedToStartWorkAt   time.Time
 	redirtiedAt            time.Time
 	redirtiedWithRatelimit bool
+	redirtiedLane          int
 	forget                 bool
 	requeues               int
 
@@ -83,7 +174,7 @@ type queueItem struct {
 }
 
 func (item *queueItem) String() string {
-	return fmt.Sprintf("<plannedToStartWorkAt:%s key: %s>", item.plannedToStartWorkAt.String(), item.key)
+	return fmt.Sprintf("<plannedToStartWorkAt:%s key: %s lane: %d tenant: %s>", item.plannedToStartWorkAt.String(), item.key, item.lane, item.tenant)
 }
 
 // New creates a queue
@@ -91,14 +182,62 @@ func (item *queueItem) String() string {
 // It expects to get a item rate limiter, and a friendly name which is used in logs, and in the internal kubernetes
 // metrics. If retryFunc is nil, the default retry function.
 func New(ratelimiter workqueue.TypedRateLimiter[any], name string, handler ItemHandler, retryFunc ShouldRetryFunc) *Queue {
+	return NewWithPriorities(ratelimiter, name, handler, retryFunc, PriorityConfig{LaneWeights: []int{1}})
+}
+
+// NewWithPriorities creates a queue with priority lanes
+//
+// Keys are enqueued into a lane with EnqueueWithPriority; the other enqueue functions use lane 0. Within a lane, items
+// are processed in the order they are ready, like in a queue without priorities.
+func NewWithPriorities(ratelimiter workqueue.TypedRateLimiter[any], name string, handler ItemHandler, retryFunc ShouldRetryFunc, cfg PriorityConfig) *Queue {
+	return NewWithConfig(ratelimiter, name, handler, retryFunc, Config{Priorities: cfg})
+}
+
+// NewWithConfig creates a queue with priority lanes and fair queuing between tenants
+//
+// Items are processed by priority lane first (see NewWithPriorities), and then by tenant.
+func NewWithConfig(ratelimiter workqueue.TypedRateLimiter[any], name string, handler ItemHandler, retryFunc ShouldRetryFunc, cfg Config) *Queue {
 	if retryFunc == nil {
 		retryFunc = DefaultRetryFunc
 	}
+	priorities := cfg.Priorities
+	if len(priorities.LaneWeights) == 0 {
+		priorities.LaneWeights = []int{1}
+	}
+	if priorities.MaxWait == 0 {
+		priorities.MaxWait = DefaultMaxWait
+	}
+	fairness := FairnessConfig{
+		TenantFunc: func(string) string { return "" },
+	}
+	if cfg.Fairness != nil {
+		fairness = *cfg.Fairness
+		if fairness.TenantFunc == nil {
+			fairness.TenantFunc = NamespaceTenant
+		}
+	}
+	if fairness.TenantWeight == nil {
+		fairness.TenantWeight = func(string) int { return 1 }
+	}
+
+	lanes := make([]*lane, len(priorities.LaneWeights))
+	for i, w := range priorities.LaneWeights {
+		lanes[i] = &lane{
+			weight:        max(w, 1),
+			tenants:       make(map[string]*list.List),
+			tenantCredits: make(map[string]int),
+		}
+	}
 	return &Queue{
 		clock:                    clock.RealClock{},
 		name:                     name,
 		ratelimiter:              ratelimiter,
-		items:                    list.New(),
+		lanes:                    lanes,
+		maxWait:                  priorities.MaxWait,
+		tenantFunc:               fairness.TenantFunc,
+		tenantWeight:             fairness.TenantWeight,
+		maxInFlightPerTenant:     fairness.MaxInFlightPerTenant,
+		tenantsInFlight:          make(map[string]int),
 		itemsBeingProcessed:      make(map[string]*queueItem),
 		itemsInQueue:             make(map[string]*list.Element),
 		handler:                  handler,
@@ -113,7 +252,18 @@ func (q *Queue) Enqueue(ctx context.Context, key string) {
 	q.lock.Lock()
 	defer q.lock.Unlock()
 
-	q.insert(ctx, key, true, nil)
+	q.insert(ctx, key, true, nil, 0)
+}
+
+// EnqueueWithPriority enqueues the key in a rate limited fashion into the given priority lane
+//
+// If the key is already queued (or is being processed, and is queued again afterwards) it keeps the highest priority
+// it was enqueued with. Lanes beyond the last lane of the queue are treated as the last lane.
+func (q *Queue) EnqueueWithPriority(ctx context.Context, key string, lane int) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.insert(ctx, key, true, nil, lane)
 }
 
 // EnqueueWithoutRateLimit enqueues the key without a rate limit
@@ -121,7 +271,7 @@ func (q *Queue) EnqueueWithoutRateLimit(ctx context.Context, key string) {
 	q.lock.Lock()
 	defer q.lock.Unlock()
 
-	q.insert(ctx, key, false, nil)
+	q.insert(ctx, key, false, nil, 0)
 }
 
 // Forget forgets the key
@@ -139,7 +289,7 @@ func (q *Queue) Forget(ctx context.Context, key string) {
 	if item, ok := q.itemsInQueue[key]; ok {
 		span.WithField(ctx, "status", "itemInQueue")
 		delete(q.itemsInQueue, key)
-		q.items.Remove(item)
+		q.remove(item)
 		return
 	}
 
@@ -164,14 +314,17 @@ func durationDeref(duration *time.Duration, def time.Duration) time.Duration {
 // If ratelimit is specified, and delay is nil, then the ratelimiter's delay (return from When function) will be used
 // If ratelimit is specified, and the delay is non-nil, then the delay value will be used
 // If ratelimit is false, then only delay is used to schedule the work. If delay is nil, it will be considered 0.
-func (q *Queue) insert(ctx context.Context, key string, ratelimit bool, delay *time.Duration) *queueItem {
+// Items which are already queued are moved to the lane if it has a higher priority than the one they are in.
+func (q *Queue) insert(ctx context.Context, key string, ratelimit bool, delay *time.Duration, lane int) *queueItem {
 	ctx, span := trace.StartSpan(ctx, "insert")
 	defer span.End()
 
+	lane = max(min(lane, len(q.lanes)-1), 0)
 	ctx = span.WithFields(ctx, map[string]any{
 		"queue":     q.name,
 		"key":       key,
 		"ratelimit": ratelimit,
+		"lane":      lane,
 	})
 	if delay == nil {
 		ctx = span.WithField(ctx, "delay", "nil")
@@ -194,9 +347,13 @@ func (q *Queue) insert(ctx context.Context, key string, ratelimit bool, delay *t
 		if item.redirtiedAt.IsZero() {
 			item.redirtiedAt = when
 			item.redirtiedWithRatelimit = ratelimit
-		} else if when.Before(item.redirtiedAt) {
-			item.redirtiedAt = when
-			item.redirtiedWithRatelimit = ratelimit
+			item.redirtiedLane = lane
+		} else {
+			if when.Before(item.redirtiedAt) {
+				item.redirtiedAt = when
+				item.redirtiedWithRatelimit = ratelimit
+			}
+			item.redirtiedLane = min(item.redirtiedLane, lane)
 		}
 		item.forget = false
 		return item
@@ -206,6 +363,13 @@ func (q *Queue) insert(ctx context.Context, key string, ratelimit bool, delay *t
 	if item, ok := q.itemsInQueue[key]; ok {
 		span.WithField(ctx, "status", "itemsInQueue")
 		qi := item.Value.(*queueItem)
+		if lane < qi.lane {
+			// Move the item to the higher priority lane, keeping its planned time.
+			q.remove(item)
+			qi.lane = lane
+			item = q.insertSorted(qi)
+			q.itemsInQueue[key] = item
+		}
 		when := q.clock.Now().Add(durationDeref(delay, 0))
 		q.adjustPosition(qi, item, when)
 		return qi
@@ -215,6 +379,8 @@ func (q *Queue) insert(ctx context.Context, key string, ratelimit bool, delay *t
 	now := q.clock.Now()
 	val := &queueItem{
 		key:                  key,
+		tenant:               q.tenantFunc(key),
+		lane:                 lane,
 		plannedToStartWorkAt: now,
 		originallyAdded:      now,
 	}
@@ -232,16 +398,38 @@ func (q *Queue) insert(ctx context.Context, key string, ratelimit bool, delay *t
 		val.plannedToStartWorkAt = val.plannedToStartWorkAt.Add(durationDeref(delay, 0))
 	}
 
-	for item := q.items.Back(); item != nil; item = item.Prev() {
+	q.itemsInQueue[key] = q.insertSorted(val)
+	return val
+}
+
+// insertSorted inserts the item into its lane, after the items of its tenant which are planned to start work before
+// it.
+func (q *Queue) insertSorted(val *queueItem) *list.Element {
+	l := q.lanes[val.lane]
+	items, ok := l.tenants[val.tenant]
+	if !ok {
+		items = list.New()
+		l.tenants[val.tenant] = items
+	}
+	for item := items.Back(); item != nil; item = item.Prev() {
 		qi := item.Value.(*queueItem)
 		if qi.plannedToStartWorkAt.Before(val.plannedToStartWorkAt) {
-			q.itemsInQueue[key] = q.items.InsertAfter(val, item)
-			return val
+			return items.InsertAfter(val, item)
 		}
 	}
+	return items.PushFront(val)
+}
 
-	q.itemsInQueue[key] = q.items.PushFront(val)
-	return val
+// remove removes the element from its lane, and removes the list of its tenant if it is empty.
+func (q *Queue) remove(element *list.Element) {
+	qi := element.Value.(*queueItem)
+	l := q.lanes[qi.lane]
+	items := l.tenants[qi.tenant]
+	items.Remove(element)
+	if items.Len() == 0 {
+		delete(l.tenants, qi.tenant)
+		delete(l.tenantCredits, qi.tenant)
+	}
 }
 
 func (q *Queue) adjustPosition(qi *queueItem, element *list.Element, when time.Time) {
@@ -251,23 +439,24 @@ func (q *Queue) adjustPosition(qi *queueItem, element *list.Element, when time.T
 	}
 
 	qi.plannedToStartWorkAt = when
+	items := q.lanes[qi.lane].tenants[qi.tenant]
 	for prev := element.Prev(); prev != nil; prev = prev.Prev() {
 		item := prev.Value.(*queueItem)
 		// does this item plan to start work *before* the new time? If so add it
 		if item.plannedToStartWorkAt.Before(when) {
-			q.items.MoveAfter(element, prev)
+			items.MoveAfter(element, prev)
 			return
 		}
 	}
 
-	q.items.MoveToFront(element)
+	items.MoveToFront(element)
 }
 
 // EnqueueWithoutRateLimitWithDelay enqueues without rate limiting, but work will not start for this given delay period
 func (q *Queue) EnqueueWithoutRateLimitWithDelay(ctx context.Context, key string, after time.Duration) {
 	q.lock.Lock()
 	defer q.lock.Unlock()
-	q.insert(ctx, key, false, &after)
+	q.insert(ctx, key, false, &after, 0)
 }
 
 // Empty returns if the queue has no items in it
@@ -281,24 +470,54 @@ func (q *Queue) Empty() bool {
 func (q *Queue) Len() int {
 	q.lock.Lock()
 	defer q.lock.Unlock()
-	if q.items.Len() != len(q.itemsInQueue) {
+	if q.lanesLen() != len(q.itemsInQueue) {
 		panic("Internally inconsistent state")
 	}
 
-	return q.items.Len() + len(q.itemsBeingProcessed)
+	return len(q.itemsInQueue) + len(q.itemsBeingProcessed)
 }
 
 // UnprocessedLen returns the count of items yet to be processed in the queue
 func (q *Queue) UnprocessedLen() int {
 	q.lock.Lock()
 	defer q.lock.Unlock()
-	if q.items.Len() != len(q.itemsInQueue) {
+	if q.lanesLen() != len(q.itemsInQueue) {
 		panic("Internally inconsistent state")
 	}
 
 	return len(q.itemsInQueue)
 }
 
+func (q *Queue) lanesLen() int {
+	var n int
+	for _, l := range q.lanes {
+		n += l.len()
+	}
+	return n
+}
+
+// TenantStats returns the statistics of the items of each tenant which has items queued or being processed.
+// If the queue is not fair, all items belong to the tenant "".
+func (q *Queue) TenantStats() map[string]TenantStats {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	stats := make(map[string]TenantStats)
+	for _, l := range q.lanes {
+		for tenant, items := range l.tenants {
+			s := stats[tenant]
+			s.Queued += items.Len()
+			stats[tenant] = s
+		}
+	}
+	for tenant, n := range q.tenantsInFlight {
+		s := stats[tenant]
+		s.InFlight = n
+		stats[tenant] = s
+	}
+	return stats
+}
+
 // ProcessedLen returns the count items that are being processed
 func (q *Queue) ItemsBeingProcessedLen() int {
 	q.lock.Lock()
@@ -359,7 +578,7 @@ func (q *Queue) getNextItem(ctx context.Context) (*queueItem, error) {
 
 	for {
 		q.lock.Lock()
-		element := q.items.Front()
+		element, timeUntilProcessing := q.nextElement()
 		if element == nil {
 			// Wait for the next item
 			q.lock.Unlock()
@@ -370,12 +589,12 @@ func (q *Queue) getNextItem(ctx context.Context) (*queueItem, error) {
 			}
 		} else {
 			qi := element.Value.(*queueItem)
-			timeUntilProcessing := time.Until(qi.plannedToStartWorkAt)
 
 			// Do we need to sleep? If not, let's party.
 			if timeUntilProcessing <= 0 {
 				q.itemsBeingProcessed[qi.key] = qi
-				q.items.Remove(element)
+				q.tenantsInFlight[qi.tenant]++
+				q.remove(element)
 				delete(q.itemsInQueue, qi.key)
 				q.lock.Unlock()
 				return qi, nil
@@ -399,6 +618,85 @@ func (q *Queue) getNextItem(ctx context.Context) (*queueItem, error) {
 	}
 }
 
+// nextElement returns the element to process next, and how long until work on it is planned to start.
+// It must be called with the lock held.
+//
+// Items of tenants which have reached their limit of items being processed are skipped. Of the remaining items which
+// are ready, the lane of the item which has been ready for longer than maxWait the longest is picked. Otherwise, a
+// lane is picked by a smooth weighted round-robin between the lanes with ready items. Then a tenant of the lane is
+// picked by a smooth weighted round-robin between its tenants with ready items. If no item is ready, the item which is
+// planned to start first is returned.
+func (q *Queue) nextElement() (*list.Element, time.Duration) {
+	var (
+		next       *list.Element
+		nextUntil  time.Duration
+		readyLanes []int
+		ready      = make([][]string, len(q.lanes))
+		starved    = -1
+		oldest     time.Duration
+	)
+	for i, l := range q.lanes {
+		for tenant, items := range l.tenants {
+			if q.maxInFlightPerTenant > 0 && q.tenantsInFlight[tenant] >= q.maxInFlightPerTenant {
+				continue
+			}
+			element := items.Front()
+			until := time.Until(element.Value.(*queueItem).plannedToStartWorkAt)
+			if until > 0 {
+				if next == nil || until < nextUntil {
+					next, nextUntil = element, until
+				}
+				continue
+			}
+			ready[i] = append(ready[i], tenant)
+			if q.maxWait > 0 && -until >= q.maxWait && (starved < 0 || -until > oldest) {
+				starved, oldest = i, -until
+			}
+		}
+		if len(ready[i]) > 0 {
+			readyLanes = append(readyLanes, i)
+		}
+	}
+
+	if len(readyLanes) == 0 {
+		return next, nextUntil
+	}
+
+	best := readyLanes[0]
+	if starved >= 0 {
+		best = starved
+	} else if len(readyLanes) > 1 {
+		total := 0
+		for _, i := range readyLanes {
+			l := q.lanes[i]
+			l.credits += l.weight
+			total += l.weight
+			if l.credits > q.lanes[best].credits {
+				best = i
+			}
+		}
+		q.lanes[best].credits -= total
+	}
+
+	l, tenants := q.lanes[best], ready[best]
+	if len(tenants) == 1 {
+		return l.tenants[tenants[0]].Front(), 0
+	}
+	// Sort the tenants so that ties are broken consistently.
+	sort.Strings(tenants)
+	tenant, total := tenants[0], 0
+	for _, t := range tenants {
+		w := max(q.tenantWeight(t), 1)
+		l.tenantCredits[t] += w
+		total += w
+		if l.tenantCredits[t] > l.tenantCredits[tenant] {
+			tenant = t
+		}
+	}
+	l.tenantCredits[tenant] -= total
+	return l.tenants[tenant].Front(), 0
+}
+
 // handleQueueItem handles a single item
 //
 // A return value of "false" indicates that further processing should be stopped.
@@ -457,6 +755,7 @@ func (q *Queue) handleQueueItemObject(ctx context.Context, qi *queueItem) error
 	defer q.lock.Unlock()
 
 	delete(q.itemsBeingProcessed, qi.key)
+	q.finishInFlight(qi.tenant)
 	if qi.forget {
 		q.ratelimiter.Forget(qi.key)
 		log.G(ctx).WithError(err).Warnf("forgetting %q as told to forget while in progress", qi.key)
@@ -473,7 +772,7 @@ func (q *Queue) handleQueueItemObject(ctx context.Context, qi *queueItem) error
 		if err == nil {
 			// Put the item back on the work Queue to handle any transient errors.
 			log.G(ctx).WithError(originalError).Warnf("requeuing %q due to failed sync", qi.key)
-			newQI := q.insert(ctx, qi.key, true, delay)
+			newQI := q.insert(ctx, qi.key, true, delay, qi.lane)
 			newQI.requeues = qi.requeues + 1
 			newQI.originallyAdded = qi.originallyAdded
 
@@ -490,7 +789,7 @@ func (q *Queue) handleQueueItemObject(ctx context.Context, qi *queueItem) error
 	q.ratelimiter.Forget(qi.key)
 	if !qi.redirtiedAt.IsZero() {
 		delay := time.Until(qi.redirtiedAt)
-		newQI := q.insert(ctx, qi.key, qi.redirtiedWithRatelimit, &delay)
+		newQI := q.insert(ctx, qi.key, qi.redirtiedWithRatelimit, &delay, qi.redirtiedLane)
 		newQI.addedViaRedirty = true
 	}
 
@@ -498,14 +797,38 @@ func (q *Queue) handleQueueItemObject(ctx context.Context, qi *queueItem) error
 	return err
 }
 
+// finishInFlight records that an item of the tenant is no longer being processed. It must be called with the lock
+// held.
+func (q *Queue) finishInFlight(tenant string) {
+	if q.tenantsInFlight[tenant]--; q.tenantsInFlight[tenant] <= 0 {
+		delete(q.tenantsInFlight, tenant)
+	}
+	if q.maxInFlightPerTenant > 0 {
+		// Items of the tenant may have been held back, wake up the worker waiting for the next item.
+		select {
+		case q.wakeupCh <- struct{}{}:
+		default:
+		}
+	}
+}
+
 func (q *Queue) String() string {
 	q.lock.Lock()
 	defer q.lock.Unlock()
 
-	items := make([]string, 0, q.items.Len())
+	items := make([]string, 0, len(q.itemsInQueue))
 
-	for next := q.items.Front(); next != nil; next = next.Next() {
-		items = append(items, next.Value.(*queueItem).String())
+	for _, l := range q.lanes {
+		tenants := make([]string, 0, len(l.tenants))
+		for tenant := range l.tenants {
+			tenants = append(tenants, tenant)
+		}
+		sort.Strings(tenants)
+		for _, tenant := range tenants {
+			for next := l.tenants[tenant].Front(); next != nil; next = next.Next() {
+				items = append(items, next.Value.(*queueItem).String())
+			}
+		}
 	}
 	return fmt.Sprintf("<items:%s>", items)
 }
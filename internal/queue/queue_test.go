@@ -136,8 +136,8 @@ func TestQueueItemNoSleep(t *testing.T) {
 	}, nil)
 
 	q.lock.Lock()
-	q.insert(ctx, "foo", false, ptr.To(-1*time.Hour))
-	q.insert(ctx, "bar", false, ptr.To(-1*time.Hour))
+	q.insert(ctx, "foo", false, ptr.To(-1*time.Hour), 0)
+	q.insert(ctx, "bar", false, ptr.To(-1*time.Hour), 0)
 	q.lock.Unlock()
 
 	item, err := q.getNextItem(ctx)
@@ -159,8 +159,8 @@ func TestQueueItemSleep(t *testing.T) {
 		return nil
 	}, nil)
 	q.lock.Lock()
-	q.insert(ctx, "foo", false, ptr.To(100*time.Millisecond))
-	q.insert(ctx, "bar", false, ptr.To(100*time.Millisecond))
+	q.insert(ctx, "foo", false, ptr.To(100*time.Millisecond), 0)
+	q.insert(ctx, "bar", false, ptr.To(100*time.Millisecond), 0)
 	q.lock.Unlock()
 
 	item, err := q.getNextItem(ctx)
@@ -181,7 +181,7 @@ func TestQueueBackgroundAdd(t *testing.T) {
 	time.AfterFunc(100*time.Millisecond, func() {
 		q.lock.Lock()
 		defer q.lock.Unlock()
-		q.insert(ctx, "foo", false, nil)
+		q.insert(ctx, "foo", false, nil, 0)
 	})
 
 	item, err := q.getNextItem(ctx)
@@ -201,13 +201,13 @@ func TestQueueBackgroundAdvance(t *testing.T) {
 	}, nil)
 	start := time.Now()
 	q.lock.Lock()
-	q.insert(ctx, "foo", false, ptr.To(10*time.Second))
+	q.insert(ctx, "foo", false, ptr.To(10*time.Second), 0)
 	q.lock.Unlock()
 
 	time.AfterFunc(200*time.Millisecond, func() {
 		q.lock.Lock()
 		defer q.lock.Unlock()
-		q.insert(ctx, "foo", false, nil)
+		q.insert(ctx, "foo", false, nil, 0)
 	})
 
 	item, err := q.getNextItem(ctx)
@@ -278,10 +278,20 @@ func checkConsistency(t *testing.T, q *Queue) {
 	q.lock.Lock()
 	defer q.lock.Unlock()
 
-	for next := q.items.Front(); next != nil && next.Next() != nil; next = next.Next() {
-		qi := next.Value.(*queueItem)
-		qiNext := next.Next().Value.(*queueItem)
-		assert.Assert(t, qi.plannedToStartWorkAt.Before(qiNext.plannedToStartWorkAt) || qi.plannedToStartWorkAt.Equal(qiNext.plannedToStartWorkAt))
+	for lane, l := range q.lanes {
+		for tenant, items := range l.tenants {
+			assert.Assert(t, items.Len() > 0)
+			for next := items.Front(); next != nil; next = next.Next() {
+				qi := next.Value.(*queueItem)
+				assert.Assert(t, is.Equal(qi.lane, lane))
+				assert.Assert(t, is.Equal(qi.tenant, tenant))
+				if next.Next() == nil {
+					continue
+				}
+				qiNext := next.Next().Value.(*queueItem)
+				assert.Assert(t, qi.plannedToStartWorkAt.Before(qiNext.plannedToStartWorkAt) || qi.plannedToStartWorkAt.Equal(qiNext.plannedToStartWorkAt))
+			}
+		}
 	}
 }
 
@@ -405,7 +415,7 @@ func TestRateLimiter(t *testing.T) {
 	defer q.lock.Unlock()
 	assert.Assert(t, len(q.itemsInQueue) == 0)
 	assert.Assert(t, len(q.itemsBeingProcessed) == 0)
-	assert.Assert(t, q.items.Len() == 0)
+	assert.Assert(t, q.lanes[0].len() == 0)
 
 }
 
@@ -455,21 +465,21 @@ func TestQueueMoveItem(t *testing.T) {
 	}, nil)
 	q.clock = nonmovingClock{}
 
-	q.insert(ctx, "foo", false, ptr.To(time.Duration(3000)))
-	q.insert(ctx, "bar", false, ptr.To(time.Duration(2000)))
-	q.insert(ctx, "baz", false, ptr.To(time.Duration(1000)))
+	q.insert(ctx, "foo", false, ptr.To(time.Duration(3000)), 0)
+	q.insert(ctx, "bar", false, ptr.To(time.Duration(2000)), 0)
+	q.insert(ctx, "baz", false, ptr.To(time.Duration(1000)), 0)
 	checkConsistency(t, q)
 	t.Log(q)
 
-	q.insert(ctx, "foo", false, ptr.To(time.Duration(2000)))
+	q.insert(ctx, "foo", false, ptr.To(time.Duration(2000)), 0)
 	checkConsistency(t, q)
 	t.Log(q)
 
-	q.insert(ctx, "foo", false, ptr.To(time.Duration(1999)))
+	q.insert(ctx, "foo", false, ptr.To(time.Duration(1999)), 0)
 	checkConsistency(t, q)
 	t.Log(q)
 
-	q.insert(ctx, "foo", false, ptr.To(time.Duration(999)))
+	q.insert(ctx, "foo", false, ptr.To(time.Duration(999)), 0)
 	checkConsistency(t, q)
 	t.Log(q)
 }
@@ -500,3 +510,171 @@ func (n nonmovingClock) Sleep(d time.Duration) {
 func (n nonmovingClock) Tick(d time.Duration) <-chan time.Time {
 	panic("implement me")
 }
+
+func newPriorityQueue(t *testing.T, cfg PriorityConfig) *Queue {
+	return NewWithPriorities(workqueue.DefaultTypedItemBasedRateLimiter[any](), t.Name(), func(ctx context.Context, key string) error {
+		return nil
+	}, nil, cfg)
+}
+
+func nextKeys(ctx context.Context, t *testing.T, q *Queue, n int) []string {
+	keys := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		item, err := q.getNextItem(ctx)
+		assert.NilError(t, err)
+		keys = append(keys, item.key)
+	}
+	return keys
+}
+
+func TestQueuePriorityWeights(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	q := newPriorityQueue(t, PriorityConfig{LaneWeights: []int{2, 1}, MaxWait: -1})
+	q.lock.Lock()
+	for i := 0; i < 4; i++ {
+		q.insert(ctx, "low"+strconv.Itoa(i), false, ptr.To(-1*time.Hour), 1)
+	}
+	for i := 0; i < 4; i++ {
+		q.insert(ctx, "high"+strconv.Itoa(i), false, ptr.To(-1*time.Minute), 0)
+	}
+	q.lock.Unlock()
+	checkConsistency(t, q)
+
+	// Although the low priority items have been ready for longer, the high priority lane gets two thirds of the
+	// items while both lanes have items ready.
+	assert.DeepEqual(t, nextKeys(ctx, t, q, 8), []string{"high0", "low0", "high1", "high2", "low1", "high3", "low2", "low3"})
+}
+
+func TestQueuePriorityNotReady(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	q := newPriorityQueue(t, PriorityConfig{LaneWeights: []int{100, 1}})
+	q.lock.Lock()
+	q.insert(ctx, "high", false, ptr.To(100*time.Millisecond), 0)
+	q.insert(ctx, "low", false, nil, 1)
+	q.lock.Unlock()
+
+	// Items of lower priority lanes are not held back by items which are not ready yet.
+	assert.DeepEqual(t, nextKeys(ctx, t, q, 2), []string{"low", "high"})
+}
+
+func TestQueuePriorityStarvation(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	q := newPriorityQueue(t, PriorityConfig{LaneWeights: []int{100, 1}, MaxWait: time.Minute})
+	q.lock.Lock()
+	q.insert(ctx, "low", false, ptr.To(-1*time.Hour), 1)
+	for i := 0; i < 3; i++ {
+		q.insert(ctx, "high"+strconv.Itoa(i), false, ptr.To(-1*time.Second), 0)
+	}
+	q.lock.Unlock()
+
+	// The low priority item has been ready for longer than MaxWait, so it goes first.
+	assert.DeepEqual(t, nextKeys(ctx, t, q, 4), []string{"low", "high0", "high1", "high2"})
+}
+
+func TestQueuePriorityPromotion(t *testing.T) {
+	ctx := t.Context()
+	q := newPriorityQueue(t, PriorityConfig{LaneWeights: []int{1, 1}})
+	q.clock = nonmovingClock{}
+
+	q.insert(ctx, "foo", false, ptr.To(time.Duration(1000)), 1)
+	q.insert(ctx, "bar", false, ptr.To(time.Duration(2000)), 0)
+	// Enqueueing with a higher priority moves the item, and enqueueing with a lower one does not.
+	q.insert(ctx, "foo", false, ptr.To(time.Duration(3000)), 0)
+	q.insert(ctx, "bar", false, nil, 1)
+	// Lanes beyond the last lane are treated as the last lane.
+	q.insert(ctx, "baz", false, nil, 5)
+	checkConsistency(t, q)
+
+	assert.Check(t, is.Equal(q.lanes[0].len(), 2))
+	assert.Check(t, is.Equal(q.lanes[1].len(), 1))
+	assert.Check(t, is.Equal(q.itemsInQueue["foo"].Value.(*queueItem).lane, 0))
+	assert.Check(t, is.Equal(q.itemsInQueue["baz"].Value.(*queueItem).lane, 1))
+
+	// Items being processed which are enqueued again keep the highest priority they were enqueued with.
+	q.lock.Lock()
+	q.remove(q.itemsInQueue["foo"])
+	qi := q.itemsInQueue["foo"].Value.(*queueItem)
+	delete(q.itemsInQueue, "foo")
+	q.itemsBeingProcessed["foo"] = qi
+	q.clock = clock.RealClock{}
+	q.insert(ctx, "foo", false, nil, 1)
+	q.insert(ctx, "foo", false, nil, 0)
+	q.insert(ctx, "foo", false, nil, 1)
+	q.lock.Unlock()
+	assert.Check(t, is.Equal(qi.redirtiedLane, 0))
+}
+
+func newFairQueue(t *testing.T, cfg Config) *Queue {
+	return NewWithConfig(workqueue.DefaultTypedItemBasedRateLimiter[any](), t.Name(), func(ctx context.Context, key string) error {
+		return nil
+	}, nil, cfg)
+}
+
+func TestNamespaceTenant(t *testing.T) {
+	assert.Check(t, is.Equal(NamespaceTenant("ns/pod"), "ns"))
+	assert.Check(t, is.Equal(NamespaceTenant("ns/pod/uid"), "ns"))
+	assert.Check(t, is.Equal(NamespaceTenant("node"), ""))
+}
+
+func TestQueueFairness(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// The items of all namespaces have been waiting for longer than MaxWait, which does not affect fairness.
+	q := newFairQueue(t, Config{Fairness: &FairnessConfig{
+		TenantWeight: func(tenant string) int {
+			if tenant == "b" {
+				return 2
+			}
+			return 1
+		},
+	}})
+	q.lock.Lock()
+	for i := 0; i < 4; i++ {
+		q.insert(ctx, "a/"+strconv.Itoa(i), false, ptr.To(-1*time.Hour), 0)
+	}
+	for i := 0; i < 4; i++ {
+		q.insert(ctx, "b/"+strconv.Itoa(i), false, ptr.To(-1*time.Second), 0)
+	}
+	q.insert(ctx, "c/0", false, ptr.To(-1*time.Second), 0)
+	q.lock.Unlock()
+	checkConsistency(t, q)
+
+	// The items of namespace a were queued first, but the namespaces are served by weight.
+	assert.DeepEqual(t, nextKeys(ctx, t, q, 9), []string{"b/0", "a/0", "c/0", "b/1", "b/2", "a/1", "b/3", "a/2", "a/3"})
+}
+
+func TestQueueFairnessMaxInFlight(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	q := newFairQueue(t, Config{Fairness: &FairnessConfig{MaxInFlightPerTenant: 1}})
+	q.lock.Lock()
+	q.insert(ctx, "a/0", false, ptr.To(-1*time.Hour), 0)
+	q.insert(ctx, "a/1", false, ptr.To(-1*time.Hour), 0)
+	q.insert(ctx, "b/0", false, nil, 0)
+	q.lock.Unlock()
+
+	first, err := q.getNextItem(ctx)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(first.key, "a/0"))
+	// a/1 is held back while a/0 is being processed.
+	assert.DeepEqual(t, nextKeys(ctx, t, q, 1), []string{"b/0"})
+	assert.DeepEqual(t, q.TenantStats(), map[string]TenantStats{
+		"a": {Queued: 1, InFlight: 1},
+		"b": {InFlight: 1},
+	})
+
+	time.AfterFunc(100*time.Millisecond, func() {
+		assert.Check(t, is.Nil(q.handleQueueItemObject(ctx, first)))
+	})
+	start := time.Now()
+	assert.DeepEqual(t, nextKeys(ctx, t, q, 1), []string{"a/1"})
+	assert.Assert(t, time.Since(start) > 100*time.Millisecond)
+}
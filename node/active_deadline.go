@@ -0,0 +1,152 @@
+// Copyright © 2017 The virtual-kubelet authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"context"
+	"time"
+
+	pkgerrors "github.com/pkg/errors"
+	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
+	"github.com/virtual-kubelet/virtual-kubelet/log"
+	"github.com/virtual-kubelet/virtual-kubelet/trace"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// The reason and message match the ones used by the kubelet's active deadline handler, see:
+// https://github.com/kubernetes/kubernetes/blob/v1.30.0/pkg/kubelet/active_deadline.go
+const (
+	podStatusReasonDeadlineExceeded  = "DeadlineExceeded"
+	podStatusMessageDeadlineExceeded = "Pod was active on the node longer than the specified deadline"
+)
+
+// activeDeadlineRemaining returns how long the pod has left before its active deadline expires. The second return value
+// is false if the pod does not have an active deadline that should be enforced (yet).
+func activeDeadlineRemaining(pod *corev1.Pod, now time.Time) (time.Duration, bool) {
+	if pod.Spec.ActiveDeadlineSeconds == nil || pod.Status.StartTime == nil {
+		return 0, false
+	}
+	if pod.DeletionTimestamp != nil || shouldSkipPodStatusUpdate(pod) {
+		return 0, false
+	}
+
+	allowed := time.Duration(*pod.Spec.ActiveDeadlineSeconds) * time.Second
+	return allowed - now.Sub(pod.Status.StartTime.Time), true
+}
+
+// enqueueActiveDeadline schedules the pod to be checked against its active deadline once the deadline has passed.
+// It is a no-op for pods without an active deadline, or pods which have not started yet.
+func (pc *PodController) enqueueActiveDeadline(ctx context.Context, pod *corev1.Pod, key string) {
+	remaining, ok := activeDeadlineRemaining(pod, time.Now())
+	if !ok {
+		return
+	}
+	if remaining < 0 {
+		remaining = 0
+	}
+	pc.enforceActiveDeadlines.EnqueueWithoutRateLimitWithDelay(ctx, key, remaining)
+}
+
+// enforceActiveDeadlineHandler fails the pod, and deletes it from the provider, if it has been active for longer than
+// spec.activeDeadlineSeconds.
+func (pc *PodController) enforceActiveDeadlineHandler(ctx context.Context, key string) error {
+	ctx, span := trace.StartSpan(ctx, "enforceActiveDeadlineHandler")
+	defer span.End()
+	ctx = span.WithField(ctx, "key", key)
+
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		// Log the error as a warning, but do not requeue the key as it is invalid.
+		log.G(ctx).Warn(pkgerrors.Wrapf(err, "invalid resource key: %q", key))
+		return nil
+	}
+
+	pod, err := pc.podsLister.Pods(namespace).Get(name)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		span.SetStatus(err)
+		return pkgerrors.Wrap(err, "error looking up pod")
+	}
+	ctx = addPodAttributes(ctx, span, pod)
+
+	// A previous attempt may have failed the pod, but not managed to delete it from the provider.
+	if pod.Status.Phase != corev1.PodFailed || pod.Status.Reason != podStatusReasonDeadlineExceeded {
+		failed, err := pc.failPodPastActiveDeadline(ctx, pod, key)
+		if err != nil {
+			span.SetStatus(err)
+			return err
+		}
+		if !failed {
+			return nil
+		}
+	}
+
+	if err := pc.deletePod(ctx, pod); err != nil && !errdefs.IsNotFound(err) {
+		err = pkgerrors.Wrapf(err, "failed to delete pod %q in the provider", loggablePodName(pod))
+		span.SetStatus(err)
+		return err
+	}
+
+	return nil
+}
+
+// failPodPastActiveDeadline sets the pod's phase to failed if it has exceeded its active deadline, and reports whether
+// it did so. If the deadline has not passed yet, the pod is rescheduled.
+func (pc *PodController) failPodPastActiveDeadline(ctx context.Context, pod *corev1.Pod, key string) (bool, error) {
+	remaining, ok := activeDeadlineRemaining(pod, time.Now())
+	if !ok {
+		return false, nil
+	}
+	if remaining > 0 {
+		// The deadline may have been changed since this item was scheduled, or the start time may have moved.
+		pc.enforceActiveDeadlines.EnqueueWithoutRateLimitWithDelay(ctx, key, remaining)
+		return false, nil
+	}
+
+	log.G(ctx).Info("Pod has exceeded its active deadline")
+	pc.recorder.Event(pod, corev1.EventTypeNormal, podStatusReasonDeadlineExceeded, podStatusMessageDeadlineExceeded)
+
+	// The status is updated before the pod is deleted in the provider, so that the terminal status reported by the
+	// provider upon deletion does not win over the reason the pod was killed.
+	updated := pod.DeepCopy()
+	updated.Status.Phase = corev1.PodFailed
+	updated.Status.Reason = podStatusReasonDeadlineExceeded
+	updated.Status.Message = podStatusMessageDeadlineExceeded
+	now := metav1.NewTime(time.Now())
+	for i, c := range updated.Status.ContainerStatuses {
+		if c.State.Running == nil {
+			continue
+		}
+		updated.Status.ContainerStatuses[i].Ready = false
+		updated.Status.ContainerStatuses[i].State.Terminated = &corev1.ContainerStateTerminated{
+			ExitCode:    containerStatusExitCodeNotFound,
+			Reason:      podStatusReasonDeadlineExceeded,
+			Message:     podStatusMessageDeadlineExceeded,
+			FinishedAt:  now,
+			StartedAt:   c.State.Running.StartedAt,
+			ContainerID: c.ContainerID,
+		}
+		updated.Status.ContainerStatuses[i].State.Running = nil
+	}
+	if _, err := pc.client.Pods(pod.Namespace).UpdateStatus(ctx, updated, metav1.UpdateOptions{}); err != nil {
+		return false, pkgerrors.Wrap(err, "error while updating pod status in kubernetes")
+	}
+	return true, nil
+}
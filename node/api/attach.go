@@ -18,7 +18,7 @@ import (
 	"context"
 	"io"
 	"net/http"
-	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -59,8 +59,6 @@ func HandleContainerAttach(h ContainerAttachHandlerFunc, opts ...ContainerExecHa
 		pod := vars["pod"]
 		container := vars["container"]
 
-		supportedStreamProtocols := strings.Split(req.Header.Get("X-Stream-Protocol-Version"), ",")
-
 		streamOpts, err := getExecOptions(req)
 		if err != nil {
 			return errdefs.AsInvalidInput(err)
@@ -69,7 +67,7 @@ func HandleContainerAttach(h ContainerAttachHandlerFunc, opts ...ContainerExecHa
 		ctx, cancel := context.WithCancel(req.Context())
 		defer cancel()
 
-		attach := &containerAttachContext{ctx: ctx, cancel: cancel, h: h, pod: pod, namespace: namespace, container: container}
+		attach := &containerAttachContext{ctx: ctx, cancel: cancel, h: h, pod: pod, namespace: namespace, container: container, recorder: cfg.SessionRecorder}
 		remotecommand.ServeAttach(
 			w,
 			req,
@@ -80,7 +78,7 @@ func HandleContainerAttach(h ContainerAttachHandlerFunc, opts ...ContainerExecHa
 			streamOpts,
 			cfg.StreamIdleTimeout,
 			cfg.StreamCreationTimeout,
-			supportedStreamProtocols,
+			remotecommand.SupportedStreamingProtocols,
 		)
 
 		return nil
@@ -92,6 +90,7 @@ type containerAttachContext struct {
 	namespace, pod, container string
 	ctx                       context.Context
 	cancel                    context.CancelFunc
+	recorder                  *SessionRecorder
 }
 
 // Cancel is the opt-in hook remotecommand.ServeAttach type-asserts to cancel the
@@ -122,11 +121,27 @@ func (c *containerAttachContext) AttachToContainer(
 		eio.chResize = make(chan TermSize)
 	}
 
+	var session *recordingSession
+	if c.recorder != nil {
+		var err error
+		session, err = c.recorder.start(c.ctx, SessionInfo{Namespace: c.namespace, Pod: c.pod, Container: c.container})
+		if err != nil {
+			return err
+		}
+		defer session.Close()
+		eio = session.wrap(eio)
+	}
+
 	ctx, cancel := context.WithCancel(c.ctx)
+	// The resizes are recorded by the session, so they are waited for before it is closed.
+	var wg sync.WaitGroup
+	defer wg.Wait()
 	defer cancel()
 
 	if tty {
+		wg.Add(1)
 		go func() {
+			defer wg.Done()
 			send := func(s remoteutils.TerminalSize) bool {
 				select {
 				case eio.chResize <- TermSize{Width: s.Width, Height: s.Height}:
@@ -139,6 +154,7 @@ func (c *containerAttachContext) AttachToContainer(
 			for {
 				select {
 				case s := <-resize:
+					session.resize(TermSize{Width: s.Width, Height: s.Height})
 					if send(s) {
 						return
 					}
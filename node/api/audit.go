@@ -0,0 +1,377 @@
+// Copyright © 2017 The virtual-kubelet authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/virtual-kubelet/virtual-kubelet/log"
+	utilnet "k8s.io/apimachinery/pkg/util/net"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/apiserver/pkg/authentication/user"
+)
+
+const (
+	// AuditDecisionAllow is the decision of requests which were authorized.
+	AuditDecisionAllow = "allow"
+	// AuditDecisionForbid is the decision of requests which were not authorized.
+	AuditDecisionForbid = "forbid"
+
+	// auditIDHeader is the header the API server sets on the requests it proxies to the kubelet, so that they can be
+	// correlated with the API server's audit events.
+	auditIDHeader = "Audit-ID"
+
+	// DefaultAuditAPIServerUser is the user the API server authenticates as to kubelets in clusters set up with
+	// kubeadm.
+	DefaultAuditAPIServerUser = "kube-apiserver-kubelet-client"
+)
+
+// AuditConfig is used to pass options to WithAudit.
+type AuditConfig struct {
+	// APIServerUsers are the names of the users the API server authenticates as. The Audit-ID header of requests is
+	// only trusted when they are authenticated as one of them. Defaults to DefaultAuditAPIServerUser.
+	APIServerUsers []string
+}
+
+// AuditOption configures an AuditConfig.
+// It is used as functional options passed to `WithAudit`
+type AuditOption func(*AuditConfig)
+
+// WithAuditAPIServerUsers sets the names of the users the API server authenticates as.
+func WithAuditAPIServerUsers(users ...string) AuditOption {
+	return func(cfg *AuditConfig) {
+		cfg.APIServerUsers = users
+	}
+}
+
+// AuditEvent is a record of a request to the kubelet API.
+type AuditEvent struct {
+	// AuditID is the ID of the request. It is taken from the Audit-ID header of requests authenticated as the API
+	// server, and generated otherwise.
+	AuditID string `json:"auditID"`
+	// RequestURI is the URI of the request.
+	RequestURI string `json:"requestURI"`
+	// Verb is the verb of the request, as used for its authorization (e.g. "get" or "create").
+	Verb string `json:"verb"`
+	// Subresource is the kind of request: "exec", "attach", "portforward", "log", "stats", "metrics", "pods" or
+	// "proxy".
+	Subresource string `json:"subresource"`
+	// SourceIPs are the IPs the request came from.
+	SourceIPs []string `json:"sourceIPs,omitempty"`
+	// UserAgent is the user agent of the client.
+	UserAgent string `json:"userAgent,omitempty"`
+
+	// User, UID and Groups identify the authenticated user, if the request was authenticated.
+	User   string   `json:"user,omitempty"`
+	UID    string   `json:"uid,omitempty"`
+	Groups []string `json:"groups,omitempty"`
+	// Decision is the authorization decision, AuditDecisionAllow or AuditDecisionForbid, if the request was authorized.
+	Decision string `json:"decision,omitempty"`
+	// Reason is the reason of the authorization decision.
+	Reason string `json:"reason,omitempty"`
+
+	// Namespace, Pod and Container are the target of the request, if any.
+	Namespace string `json:"namespace,omitempty"`
+	Pod       string `json:"pod,omitempty"`
+	Container string `json:"container,omitempty"`
+	// Command is the command of exec requests.
+	Command []string `json:"command,omitempty"`
+	// Ports are the ports forwarded by port-forward requests.
+	Ports []int32 `json:"ports,omitempty"`
+
+	// StatusCode is the HTTP status code of the response.
+	// It is 101 (Switching Protocols) for streaming requests.
+	StatusCode int `json:"statusCode"`
+	// StartTime is when the request was received.
+	StartTime time.Time `json:"startTime"`
+	// Duration is how long the request took, including any streams.
+	Duration time.Duration `json:"duration"`
+	// BytesReceived and BytesSent are the number of bytes received from and sent to the client, including the data
+	// of streams.
+	BytesReceived int64 `json:"bytesReceived"`
+	BytesSent     int64 `json:"bytesSent"`
+}
+
+// AuditSink receives the audit events of requests.
+type AuditSink interface {
+	// WriteAuditEvent is called with the event of each request once it completed.
+	// It is called on the request's goroutine, so it should not block.
+	WriteAuditEvent(ctx context.Context, e *AuditEvent) error
+}
+
+type auditKey struct{}
+
+// auditRecord holds the audit event of a request while it is handled.
+type auditRecord struct {
+	mu    sync.Mutex
+	event AuditEvent
+
+	// headerID is the Audit-ID header of the request, used once the request is authenticated as one of
+	// apiServerUsers.
+	headerID       string
+	apiServerUsers []string
+}
+
+func auditRecordFrom(ctx context.Context) *auditRecord {
+	r, _ := ctx.Value(auditKey{}).(*auditRecord)
+	return r
+}
+
+// SetAuditUser records the authenticated user of the request in its audit event, if the request is audited.
+// Requests authenticated as the API server keep the audit ID it set on them.
+func SetAuditUser(ctx context.Context, u user.Info) {
+	r := auditRecordFrom(ctx)
+	if r == nil || u == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.event.User = u.GetName()
+	r.event.UID = u.GetUID()
+	r.event.Groups = u.GetGroups()
+	if r.headerID != "" && slices.Contains(r.apiServerUsers, u.GetName()) {
+		r.event.AuditID = r.headerID
+	}
+}
+
+// SetAuditDecision records the authorization decision of the request in its audit event, if the request is audited.
+func SetAuditDecision(ctx context.Context, allowed bool, reason string) {
+	r := auditRecordFrom(ctx)
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.event.Decision = AuditDecisionForbid
+	if allowed {
+		r.event.Decision = AuditDecisionAllow
+	}
+	r.event.Reason = reason
+}
+
+func (r *auditRecord) addPort(port int32) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, p := range r.event.Ports {
+		if p == port {
+			return
+		}
+	}
+	r.event.Ports = append(r.event.Ports, port)
+}
+
+// WithAudit wraps the handler so that an audit event of each request is written to the sink.
+//
+// It should wrap the authentication and authorization of requests (see nodeutil.WithAuth), so that requests which are
+// denied are audited too, with the user and decision they record with SetAuditUser and SetAuditDecision.
+func WithAudit(sink AuditSink, h http.Handler, opts ...AuditOption) http.Handler {
+	cfg := AuditConfig{APIServerUsers: []string{DefaultAuditAPIServerUser}}
+	for _, o := range opts {
+		o(&cfg)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		rec := &auditRecord{
+			event:          newAuditEvent(req),
+			headerID:       req.Header.Get(auditIDHeader),
+			apiServerUsers: cfg.APIServerUsers,
+		}
+		ctx := context.WithValue(req.Context(), auditKey{}, rec)
+
+		aw := &auditResponseWriter{ResponseWriter: w}
+		if req.Body != nil {
+			req.Body = &countingReadCloser{ReadCloser: req.Body, n: &aw.received}
+		}
+		h.ServeHTTP(aw, req.WithContext(ctx))
+
+		rec.mu.Lock()
+		e := rec.event
+		rec.mu.Unlock()
+		e.Duration = time.Since(e.StartTime)
+		e.StatusCode = aw.statusCode()
+		e.BytesReceived = aw.received.Load()
+		e.BytesSent = aw.sent.Load()
+		if err := sink.WriteAuditEvent(ctx, &e); err != nil {
+			log.G(ctx).WithError(err).Error("Error writing audit event")
+		}
+	})
+}
+
+func newAuditEvent(req *http.Request) AuditEvent {
+	e := AuditEvent{
+		AuditID:    string(uuid.NewUUID()),
+		RequestURI: req.RequestURI,
+		Verb:       auditVerb(req),
+		UserAgent:  req.UserAgent(),
+		StartTime:  time.Now(),
+	}
+	for _, ip := range utilnet.SourceIPs(req) {
+		e.SourceIPs = append(e.SourceIPs, ip.String())
+	}
+
+	parts := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	target := func(withContainer bool) {
+		if len(parts) > 2 {
+			e.Namespace, e.Pod = parts[1], parts[2]
+		}
+		if withContainer && len(parts) > 3 {
+			e.Container = parts[3]
+		}
+	}
+	switch parts[0] {
+	case "exec":
+		e.Subresource = "exec"
+		e.Command = req.URL.Query()["command"]
+		target(true)
+	case "attach":
+		e.Subresource = "attach"
+		target(true)
+	case "portForward":
+		e.Subresource = "portforward"
+		target(false)
+	case "containerLogs":
+		e.Subresource = "log"
+		target(true)
+	case "stats":
+		e.Subresource = "stats"
+	case "metrics":
+		e.Subresource = "metrics"
+	case "pods", "runningpods":
+		e.Subresource = "pods"
+	default:
+		e.Subresource = "proxy"
+	}
+	return e
+}
+
+// auditVerb returns the verb of the request, as used for its authorization by nodeutil.NodeRequestAttr.
+func auditVerb(r *http.Request) string {
+	switch r.Method {
+	case http.MethodPost:
+		return "create"
+	case http.MethodGet:
+		return "get"
+	case http.MethodPut:
+		return "update"
+	case http.MethodPatch:
+		return "patch"
+	case http.MethodDelete:
+		return "delete"
+	}
+	return ""
+}
+
+// auditResponseWriter records the status and the number of bytes of the response, including the data of
+// connections which are hijacked for streams.
+type auditResponseWriter struct {
+	http.ResponseWriter
+	code     int
+	sent     atomic.Int64
+	received atomic.Int64
+}
+
+func (w *auditResponseWriter) statusCode() int {
+	if w.code == 0 {
+		return http.StatusOK
+	}
+	return w.code
+}
+
+func (w *auditResponseWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *auditResponseWriter) Write(p []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.sent.Add(int64(n))
+	return n, err
+}
+
+func (w *auditResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *auditResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	if w.code == 0 {
+		w.code = http.StatusSwitchingProtocols
+	}
+	cc := &countingConn{Conn: conn, sent: &w.sent, received: &w.received}
+	var r io.Reader = cc
+	if n := rw.Reader.Buffered(); n > 0 {
+		buffered, _ := rw.Reader.Peek(n)
+		w.received.Add(int64(n))
+		r = io.MultiReader(bytes.NewReader(buffered), cc)
+	}
+	return cc, bufio.NewReadWriter(bufio.NewReader(r), bufio.NewWriter(cc)), nil
+}
+
+// Unwrap allows http.ResponseController to reach the wrapped writer.
+func (w *auditResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+type countingConn struct {
+	net.Conn
+	sent     *atomic.Int64
+	received *atomic.Int64
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.received.Add(int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.sent.Add(int64(n))
+	return n, err
+}
+
+type countingReadCloser struct {
+	io.ReadCloser
+	n *atomic.Int64
+}
+
+func (r *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n.Add(int64(n))
+	return n, err
+}
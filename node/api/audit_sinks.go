@@ -0,0 +1,308 @@
+// Copyright © 2017 The virtual-kubelet authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/virtual-kubelet/virtual-kubelet/log"
+	"gopkg.in/natefinch/lumberjack.v2"
+	authnv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+)
+
+// AuditFileSinkConfig is used to configure an AuditFileSink.
+type AuditFileSinkConfig struct {
+	// Path is the path of the file to write the events to.
+	Path string
+	// MaxSize is the size in megabytes at which the file is rotated. It defaults to 100 megabytes.
+	MaxSize int
+	// MaxBackups is the number of rotated files to keep. If it is zero, all are kept.
+	MaxBackups int
+	// MaxAge is the number of days to keep rotated files for. If it is zero, they are kept regardless of their age.
+	MaxAge int
+	// Compress enables gzip compression of rotated files.
+	Compress bool
+}
+
+// AuditFileSink is an AuditSink which writes events to a file as JSON lines, rotating the file when it grows too
+// large.
+type AuditFileSink struct {
+	mu sync.Mutex
+	w  *lumberjack.Logger
+}
+
+// NewAuditFileSink creates an AuditFileSink.
+// The file is created when the first event is written.
+func NewAuditFileSink(cfg AuditFileSinkConfig) (*AuditFileSink, error) {
+	if cfg.Path == "" {
+		return nil, errors.New("no audit log path provided")
+	}
+	return &AuditFileSink{w: &lumberjack.Logger{
+		Filename:   cfg.Path,
+		MaxSize:    cfg.MaxSize,
+		MaxBackups: cfg.MaxBackups,
+		MaxAge:     cfg.MaxAge,
+		Compress:   cfg.Compress,
+	}}, nil
+}
+
+// WriteAuditEvent implements AuditSink.
+func (s *AuditFileSink) WriteAuditEvent(_ context.Context, e *AuditEvent) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return errors.Wrap(err, "error marshalling audit event")
+	}
+	b = append(b, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.w.Write(b)
+	return errors.Wrap(err, "error writing audit event")
+}
+
+// Close closes the file.
+func (s *AuditFileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Close()
+}
+
+// AuditWebhookSinkConfig is used to configure an AuditWebhookSink.
+type AuditWebhookSinkConfig struct {
+	// URL is the URL of the webhook.
+	URL string
+	// Client is used to send the events to the webhook.
+	// If it is nil, a client with a timeout of 30 seconds is used.
+	Client *http.Client
+	// BufferSize is the number of events which are buffered before new events are dropped. It defaults to 10000.
+	BufferSize int
+	// MaxBatchSize is the maximum number of events sent in one request. It defaults to 400.
+	MaxBatchSize int
+	// MaxBatchWait is how long to wait for a batch to fill before it is sent. It defaults to 5 seconds.
+	MaxBatchWait time.Duration
+}
+
+// AuditWebhookSink is an AuditSink which sends events in batches to a webhook, as the API server's audit webhook
+// backend does: the events are POSTed as an audit.k8s.io/v1 EventList.
+//
+// Events are sent asynchronously. If the webhook cannot keep up, events are dropped.
+type AuditWebhookSink struct {
+	cfg AuditWebhookSinkConfig
+
+	mu     sync.RWMutex
+	closed bool
+	events chan *AuditEvent
+	done   chan struct{}
+}
+
+// NewAuditWebhookSink creates an AuditWebhookSink, which starts sending events in the background until it is closed.
+func NewAuditWebhookSink(cfg AuditWebhookSinkConfig) (*AuditWebhookSink, error) {
+	if cfg.URL == "" {
+		return nil, errors.New("no audit webhook URL provided")
+	}
+	if cfg.Client == nil {
+		cfg.Client = &http.Client{Timeout: 30 * time.Second}
+	}
+	if cfg.BufferSize <= 0 {
+		cfg.BufferSize = 10000
+	}
+	if cfg.MaxBatchSize <= 0 {
+		cfg.MaxBatchSize = 400
+	}
+	if cfg.MaxBatchWait <= 0 {
+		cfg.MaxBatchWait = 5 * time.Second
+	}
+
+	s := &AuditWebhookSink{
+		cfg:    cfg,
+		events: make(chan *AuditEvent, cfg.BufferSize),
+		done:   make(chan struct{}),
+	}
+	go s.run()
+	return s, nil
+}
+
+// WriteAuditEvent implements AuditSink.
+func (s *AuditWebhookSink) WriteAuditEvent(_ context.Context, e *AuditEvent) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return errors.New("audit webhook sink is closed")
+	}
+	select {
+	case s.events <- e:
+		return nil
+	default:
+		return errors.New("audit webhook buffer is full, dropping event")
+	}
+}
+
+// Close sends the buffered events, and stops the sink.
+func (s *AuditWebhookSink) Close() error {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.events)
+	}
+	s.mu.Unlock()
+	<-s.done
+	return nil
+}
+
+func (s *AuditWebhookSink) run() {
+	defer close(s.done)
+
+	for {
+		e, ok := <-s.events
+		if !ok {
+			return
+		}
+		batch := []*AuditEvent{e}
+
+		timer := time.NewTimer(s.cfg.MaxBatchWait)
+	fill:
+		for len(batch) < s.cfg.MaxBatchSize {
+			select {
+			case e, ok := <-s.events:
+				if !ok {
+					break fill
+				}
+				batch = append(batch, e)
+			case <-timer.C:
+				break fill
+			}
+		}
+		timer.Stop()
+
+		if err := s.send(batch); err != nil {
+			log.L.WithError(err).WithField("events", len(batch)).Error("Error sending audit events to webhook")
+		}
+	}
+}
+
+func (s *AuditWebhookSink) send(batch []*AuditEvent) error {
+	list := auditv1.EventList{
+		TypeMeta: metav1.TypeMeta{APIVersion: auditv1.SchemeGroupVersion.String(), Kind: "EventList"},
+		Items:    make([]auditv1.Event, 0, len(batch)),
+	}
+	for _, e := range batch {
+		list.Items = append(list.Items, ToAuditV1Event(e))
+	}
+	b, err := json.Marshal(list)
+	if err != nil {
+		return errors.Wrap(err, "error marshalling audit events")
+	}
+
+	resp, err := s.cfg.Client.Post(s.cfg.URL, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body) //nolint:errcheck
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("audit webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Annotations of the details of requests to the kubelet API which are not part of the audit.k8s.io/v1 Event schema.
+const (
+	AuditAnnotationContainer     = "virtual-kubelet.io/container"
+	AuditAnnotationCommand       = "virtual-kubelet.io/command"
+	AuditAnnotationPorts         = "virtual-kubelet.io/ports"
+	AuditAnnotationDuration      = "virtual-kubelet.io/duration"
+	AuditAnnotationBytesReceived = "virtual-kubelet.io/bytes-received"
+	AuditAnnotationBytesSent     = "virtual-kubelet.io/bytes-sent"
+
+	auditAnnotationDecision = "authorization.k8s.io/decision"
+	auditAnnotationReason   = "authorization.k8s.io/reason"
+)
+
+// ToAuditV1Event converts the event to the Kubernetes audit.k8s.io/v1 Event schema, at the Metadata level.
+// Details which are not part of the schema are set as annotations.
+func ToAuditV1Event(e *AuditEvent) auditv1.Event {
+	ev := auditv1.Event{
+		TypeMeta:   metav1.TypeMeta{APIVersion: auditv1.SchemeGroupVersion.String(), Kind: "Event"},
+		Level:      auditv1.LevelMetadata,
+		AuditID:    types.UID(e.AuditID),
+		Stage:      auditv1.StageResponseComplete,
+		RequestURI: e.RequestURI,
+		Verb:       e.Verb,
+		User: authnv1.UserInfo{
+			Username: e.User,
+			UID:      e.UID,
+			Groups:   e.Groups,
+		},
+		SourceIPs:                e.SourceIPs,
+		UserAgent:                e.UserAgent,
+		ResponseStatus:           &metav1.Status{Code: int32(e.StatusCode)}, //nolint:gosec
+		RequestReceivedTimestamp: metav1.NewMicroTime(e.StartTime),
+		StageTimestamp:           metav1.NewMicroTime(e.StartTime.Add(e.Duration)),
+		Annotations: map[string]string{
+			AuditAnnotationDuration:      e.Duration.String(),
+			AuditAnnotationBytesReceived: strconv.FormatInt(e.BytesReceived, 10),
+			AuditAnnotationBytesSent:     strconv.FormatInt(e.BytesSent, 10),
+		},
+	}
+
+	if e.Pod != "" {
+		ev.ObjectRef = &auditv1.ObjectReference{
+			Resource:    "pods",
+			Namespace:   e.Namespace,
+			Name:        e.Pod,
+			APIVersion:  "v1",
+			Subresource: e.Subresource,
+		}
+	} else {
+		ev.ObjectRef = &auditv1.ObjectReference{
+			Resource:    "nodes",
+			APIVersion:  "v1",
+			Subresource: e.Subresource,
+		}
+	}
+
+	if e.Container != "" {
+		ev.Annotations[AuditAnnotationContainer] = e.Container
+	}
+	if len(e.Command) > 0 {
+		b, _ := json.Marshal(e.Command)
+		ev.Annotations[AuditAnnotationCommand] = string(b)
+	}
+	if len(e.Ports) > 0 {
+		ports := make([]string, 0, len(e.Ports))
+		for _, p := range e.Ports {
+			ports = append(ports, strconv.Itoa(int(p)))
+		}
+		ev.Annotations[AuditAnnotationPorts] = strings.Join(ports, ",")
+	}
+	if e.Decision != "" {
+		ev.Annotations[auditAnnotationDecision] = e.Decision
+		ev.Annotations[auditAnnotationReason] = e.Reason
+	}
+	return ev
+}
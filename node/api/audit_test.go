@@ -0,0 +1,164 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+	"k8s.io/apiserver/pkg/authentication/user"
+)
+
+type recordingAuditSink struct {
+	mu     sync.Mutex
+	events []*AuditEvent
+}
+
+func (s *recordingAuditSink) WriteAuditEvent(_ context.Context, e *AuditEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, e)
+	return nil
+}
+
+func TestWithAudit(t *testing.T) {
+	sink := &recordingAuditSink{}
+	h := WithAudit(sink, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		SetAuditUser(r.Context(), &user.DefaultInfo{Name: r.Header.Get("X-Test-User"), Groups: []string{"devs"}})
+		if r.URL.Query().Get("command") == "forbidden" {
+			SetAuditDecision(r.Context(), false, "not allowed")
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		SetAuditDecision(r.Context(), true, "")
+		io.Copy(io.Discard, r.Body) //nolint:errcheck
+		w.Write([]byte("hello"))    //nolint:errcheck
+	}))
+
+	r := httptest.NewRequest(http.MethodPost, "/exec/default/pod/container?command=ls&command=-l", strings.NewReader("input"))
+	r.Header.Set(auditIDHeader, "audit-1")
+	r.Header.Set("X-Test-User", DefaultAuditAPIServerUser)
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	r = httptest.NewRequest(http.MethodPost, "/exec/default/pod/container?command=forbidden", nil)
+	r.Header.Set(auditIDHeader, "audit-1")
+	r.Header.Set("X-Test-User", "alice")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	assert.Assert(t, is.Len(sink.events, 2))
+	e := sink.events[0]
+	assert.Check(t, is.Equal(e.AuditID, "audit-1"))
+	assert.Check(t, is.Equal(e.Verb, "create"))
+	assert.Check(t, is.Equal(e.Subresource, "exec"))
+	assert.Check(t, is.Equal(e.User, DefaultAuditAPIServerUser))
+	assert.Check(t, is.DeepEqual(e.Groups, []string{"devs"}))
+	assert.Check(t, is.Equal(e.Decision, AuditDecisionAllow))
+	assert.Check(t, is.Equal(e.Namespace, "default"))
+	assert.Check(t, is.Equal(e.Pod, "pod"))
+	assert.Check(t, is.Equal(e.Container, "container"))
+	assert.Check(t, is.DeepEqual(e.Command, []string{"ls", "-l"}))
+	assert.Check(t, is.Equal(e.StatusCode, http.StatusOK))
+	assert.Check(t, is.Equal(e.BytesReceived, int64(len("input"))))
+	assert.Check(t, is.Equal(e.BytesSent, int64(len("hello"))))
+
+	// The audit ID set by other users is not trusted.
+	e = sink.events[1]
+	assert.Check(t, e.AuditID != "" && e.AuditID != "audit-1", e.AuditID)
+	assert.Check(t, is.Equal(e.User, "alice"))
+	assert.Check(t, is.Equal(e.Decision, AuditDecisionForbid))
+	assert.Check(t, is.Equal(e.Reason, "not allowed"))
+	assert.Check(t, is.Equal(e.StatusCode, http.StatusForbidden))
+}
+
+func TestWithAuditAPIServerUsers(t *testing.T) {
+	sink := &recordingAuditSink{}
+	h := WithAudit(sink, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		SetAuditUser(r.Context(), &user.DefaultInfo{Name: r.Header.Get("X-Test-User")})
+	}), WithAuditAPIServerUsers("apiserver"))
+
+	for _, name := range []string{"apiserver", DefaultAuditAPIServerUser} {
+		r := httptest.NewRequest(http.MethodGet, "/containerLogs/default/pod/container", nil)
+		r.Header.Set(auditIDHeader, "audit-1")
+		r.Header.Set("X-Test-User", name)
+		h.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	assert.Assert(t, is.Len(sink.events, 2))
+	assert.Check(t, is.Equal(sink.events[0].AuditID, "audit-1"))
+	assert.Check(t, sink.events[1].AuditID != "audit-1")
+}
+
+func TestAuditFileSink(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "audit.log")
+	sink, err := NewAuditFileSink(AuditFileSinkConfig{Path: p})
+	assert.NilError(t, err)
+	for _, pod := range []string{"a", "b"} {
+		assert.NilError(t, sink.WriteAuditEvent(context.Background(), &AuditEvent{Subresource: "log", Pod: pod}))
+	}
+	assert.NilError(t, sink.Close())
+
+	f, err := os.Open(p)
+	assert.NilError(t, err)
+	defer f.Close()
+	var pods []string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		var e AuditEvent
+		assert.NilError(t, json.Unmarshal(s.Bytes(), &e))
+		pods = append(pods, e.Pod)
+	}
+	assert.Check(t, is.DeepEqual(pods, []string{"a", "b"}))
+}
+
+func TestAuditWebhookSink(t *testing.T) {
+	lists := make(chan auditv1.EventList, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var list auditv1.EventList
+		if err := json.NewDecoder(r.Body).Decode(&list); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		lists <- list
+	}))
+	defer srv.Close()
+
+	sink, err := NewAuditWebhookSink(AuditWebhookSinkConfig{URL: srv.URL, MaxBatchWait: time.Hour})
+	assert.NilError(t, err)
+	assert.NilError(t, sink.WriteAuditEvent(context.Background(), &AuditEvent{
+		Subresource: "portforward",
+		Namespace:   "default",
+		Pod:         "pod",
+		Ports:       []int32{80, 443},
+		Decision:    AuditDecisionAllow,
+	}))
+	assert.NilError(t, sink.WriteAuditEvent(context.Background(), &AuditEvent{Subresource: "stats"}))
+	// Close sends the partial batch.
+	assert.NilError(t, sink.Close())
+	assert.Check(t, sink.WriteAuditEvent(context.Background(), &AuditEvent{}) != nil)
+
+	var list auditv1.EventList
+	select {
+	case list = <-lists:
+	default:
+		t.Fatal("no events were sent to the webhook")
+	}
+	assert.Assert(t, is.Len(list.Items, 2))
+	ev := list.Items[0]
+	assert.Check(t, is.DeepEqual(ev.ObjectRef, &auditv1.ObjectReference{
+		Resource: "pods", Namespace: "default", Name: "pod", APIVersion: "v1", Subresource: "portforward",
+	}))
+	assert.Check(t, is.Equal(ev.Annotations[AuditAnnotationPorts], "80,443"))
+	assert.Check(t, is.Equal(ev.Annotations["authorization.k8s.io/decision"], AuditDecisionAllow))
+	assert.Check(t, is.Equal(list.Items[1].ObjectRef.Resource, "nodes"))
+}
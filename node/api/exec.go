@@ -18,7 +18,7 @@ import (
 	"context"
 	"io"
 	"net/http"
-	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -55,6 +55,8 @@ type ContainerExecHandlerConfig struct {
 	StreamIdleTimeout time.Duration
 	// StreamCreationTimeout is the maximum time for streaming connection
 	StreamCreationTimeout time.Duration
+	// SessionRecorder records the sessions, if set.
+	SessionRecorder *SessionRecorder
 }
 
 // ContainerExecHandlerOption configures a ContainerExecHandlerConfig
@@ -75,6 +77,14 @@ func WithExecStreamCreationTimeout(dur time.Duration) ContainerExecHandlerOption
 	}
 }
 
+// WithSessionRecorder sets the recorder of exec and attach sessions.
+// If a session cannot be recorded, it is not started.
+func WithSessionRecorder(r *SessionRecorder) ContainerExecHandlerOption {
+	return func(cfg *ContainerExecHandlerConfig) {
+		cfg.SessionRecorder = r
+	}
+}
+
 // HandleContainerExec makes an http handler func from a Provider which execs a command in a pod's container
 // Note that this handler currently depends on gorrilla/mux to get url parts as variables.
 // TODO(@cpuguy83): don't force gorilla/mux on consumers of this function
@@ -102,8 +112,6 @@ func HandleContainerExec(h ContainerExecHandlerFunc, opts ...ContainerExecHandle
 		pod := vars["pod"]
 		container := vars["container"]
 
-		supportedStreamProtocols := strings.Split(req.Header.Get("X-Stream-Protocol-Version"), ",")
-
 		q := req.URL.Query()
 		command := q["command"]
 
@@ -115,7 +123,7 @@ func HandleContainerExec(h ContainerExecHandlerFunc, opts ...ContainerExecHandle
 		ctx, cancel := context.WithCancel(req.Context())
 		defer cancel()
 
-		exec := &containerExecContext{ctx: ctx, cancel: cancel, h: h, pod: pod, namespace: namespace, container: container}
+		exec := &containerExecContext{ctx: ctx, cancel: cancel, h: h, pod: pod, namespace: namespace, container: container, recorder: cfg.SessionRecorder}
 		remotecommand.ServeExec(
 			w,
 			req,
@@ -127,7 +135,7 @@ func HandleContainerExec(h ContainerExecHandlerFunc, opts ...ContainerExecHandle
 			streamOpts,
 			cfg.StreamIdleTimeout,
 			cfg.StreamCreationTimeout,
-			supportedStreamProtocols,
+			remotecommand.SupportedStreamingProtocols,
 		)
 
 		return nil
@@ -167,6 +175,7 @@ type containerExecContext struct {
 	namespace, pod, container string
 	ctx                       context.Context
 	cancel                    context.CancelFunc
+	recorder                  *SessionRecorder
 }
 
 // Cancel is the opt-in hook remotecommand.ServeExec type-asserts to cancel the
@@ -198,11 +207,27 @@ func (c *containerExecContext) ExecInContainer(
 		eio.chResize = make(chan TermSize)
 	}
 
+	var session *recordingSession
+	if c.recorder != nil {
+		var err error
+		session, err = c.recorder.start(c.ctx, SessionInfo{Namespace: c.namespace, Pod: c.pod, Container: c.container, Command: cmd})
+		if err != nil {
+			return err
+		}
+		defer session.Close()
+		eio = session.wrap(eio)
+	}
+
 	ctx, cancel := context.WithCancel(c.ctx)
+	// The resizes are recorded by the session, so they are waited for before it is closed.
+	var wg sync.WaitGroup
+	defer wg.Wait()
 	defer cancel()
 
 	if tty {
+		wg.Add(1)
 		go func() {
+			defer wg.Done()
 			send := func(s remoteutils.TerminalSize) bool {
 				select {
 				case eio.chResize <- TermSize{Width: s.Width, Height: s.Height}:
@@ -215,6 +240,7 @@ func (c *containerExecContext) ExecInContainer(
 			for {
 				select {
 				case s := <-resize:
+					session.resize(TermSize{Width: s.Width, Height: s.Height})
 					if send(s) {
 						return
 					}
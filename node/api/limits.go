@@ -0,0 +1,209 @@
+// Copyright © 2017 The virtual-kubelet authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/virtual-kubelet/virtual-kubelet/log"
+	"golang.org/x/time/rate"
+	"k8s.io/apimachinery/pkg/util/cache"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/endpoints/request"
+)
+
+const (
+	// DefaultStreamRetryAfter is the default time clients are asked to wait before retrying streams which were
+	// rejected because too many are open.
+	DefaultStreamRetryAfter = 5 * time.Second
+
+	// Limits of the cache of per-user rate limiters. Limiters which are evicted start with a full burst again.
+	requestLimiterCacheSize = 4096
+	requestLimiterCacheTTL  = 10 * time.Minute
+)
+
+// RequestLimitsConfig configures the limits of requests to the pod routes.
+// Limits which are zero (or negative) are not enforced.
+//
+// Users are identified by the authenticated user of the request (see request.WithUser), or by its remote address if
+// it was not authenticated or was authenticated as the anonymous user.
+type RequestLimitsConfig struct {
+	// MaxStreamsPerUser is the maximum number of concurrent exec, attach, port-forward and followed log streams of
+	// a user.
+	MaxStreamsPerUser int
+	// MaxStreamsPerPod is the maximum number of concurrent exec, attach, port-forward and followed log streams to
+	// a pod.
+	MaxStreamsPerPod int
+	// StreamRetryAfter is the time clients are asked to wait before retrying streams which were rejected.
+	// It defaults to DefaultStreamRetryAfter.
+	StreamRetryAfter time.Duration
+
+	// RequestsPerSecond is the rate of other requests allowed per user.
+	RequestsPerSecond float64
+	// RequestBurst is the number of other requests a user may make at once. It defaults to RequestsPerSecond,
+	// rounded up.
+	RequestBurst int
+}
+
+func (c RequestLimitsConfig) enabled() bool {
+	return c.MaxStreamsPerUser > 0 || c.MaxStreamsPerPod > 0 || c.RequestsPerSecond > 0
+}
+
+// WithRequestLimits wraps the handler of pod routes so that requests exceeding the configured limits are rejected
+// with 429 (Too Many Requests) and a Retry-After header.
+//
+// It must be wrapped by the authentication of requests so that requests are limited by user.
+func WithRequestLimits(cfg RequestLimitsConfig, h http.Handler) http.Handler {
+	if cfg.StreamRetryAfter <= 0 {
+		cfg.StreamRetryAfter = DefaultStreamRetryAfter
+	}
+	if cfg.RequestBurst <= 0 {
+		cfg.RequestBurst = int(math.Ceil(cfg.RequestsPerSecond))
+	}
+	l := &requestLimiter{
+		cfg:         cfg,
+		userStreams: make(map[string]int),
+		podStreams:  make(map[string]int),
+		limiters:    cache.NewLRUExpireCache(requestLimiterCacheSize),
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		l.serveHTTP(w, req, h)
+	})
+}
+
+type requestLimiter struct {
+	cfg RequestLimitsConfig
+
+	mu          sync.Mutex
+	userStreams map[string]int
+	podStreams  map[string]int
+	limiters    *cache.LRUExpireCache
+}
+
+func (l *requestLimiter) serveHTTP(w http.ResponseWriter, req *http.Request, h http.Handler) {
+	user := limitUser(req)
+	pod, streaming := streamTarget(req)
+
+	if streaming {
+		if !l.acquireStream(user, pod) {
+			log.G(req.Context()).WithField("user", user).WithField("pod", pod).Warn("Rejecting stream: too many open streams")
+			tooManyRequests(w, l.cfg.StreamRetryAfter, "Too many open streams")
+			return
+		}
+		defer l.releaseStream(user, pod)
+	} else if l.cfg.RequestsPerSecond > 0 {
+		if delay, ok := l.allowRequest(user); !ok {
+			log.G(req.Context()).WithField("user", user).Warn("Rejecting request: rate limit exceeded")
+			tooManyRequests(w, delay, "Rate limit exceeded")
+			return
+		}
+	}
+
+	h.ServeHTTP(w, req)
+}
+
+func (l *requestLimiter) acquireStream(user, pod string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.cfg.MaxStreamsPerUser > 0 && l.userStreams[user] >= l.cfg.MaxStreamsPerUser {
+		return false
+	}
+	if l.cfg.MaxStreamsPerPod > 0 && l.podStreams[pod] >= l.cfg.MaxStreamsPerPod {
+		return false
+	}
+	l.userStreams[user]++
+	l.podStreams[pod]++
+	return true
+}
+
+func (l *requestLimiter) releaseStream(user, pod string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.userStreams[user]--; l.userStreams[user] <= 0 {
+		delete(l.userStreams, user)
+	}
+	if l.podStreams[pod]--; l.podStreams[pod] <= 0 {
+		delete(l.podStreams, pod)
+	}
+}
+
+// allowRequest reports whether the user may make a request now, or how long it has to wait otherwise.
+func (l *requestLimiter) allowRequest(user string) (time.Duration, bool) {
+	l.mu.Lock()
+	var limiter *rate.Limiter
+	if v, ok := l.limiters.Get(user); ok {
+		limiter = v.(*rate.Limiter)
+	} else {
+		limiter = rate.NewLimiter(rate.Limit(l.cfg.RequestsPerSecond), l.cfg.RequestBurst)
+	}
+	l.limiters.Add(user, limiter, requestLimiterCacheTTL)
+	l.mu.Unlock()
+
+	r := limiter.Reserve()
+	if !r.OK() {
+		return time.Second, false
+	}
+	if delay := r.Delay(); delay > 0 {
+		r.Cancel()
+		return delay, false
+	}
+	return 0, true
+}
+
+func tooManyRequests(w http.ResponseWriter, retryAfter time.Duration, msg string) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	http.Error(w, msg, http.StatusTooManyRequests)
+}
+
+// limitUser returns the key requests are limited by: the authenticated user, or the remote address of requests which
+// are not authenticated or authenticated as the anonymous user, so that anonymous clients do not share their limits.
+func limitUser(req *http.Request) string {
+	if u, ok := request.UserFrom(req.Context()); ok && u.GetName() != "" && u.GetName() != user.Anonymous {
+		return "user:" + u.GetName()
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	return "addr:" + host
+}
+
+// streamTarget returns the pod of requests for streams, and whether the request is for a stream.
+func streamTarget(req *http.Request) (string, bool) {
+	parts := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	if len(parts) < 3 {
+		return "", false
+	}
+	switch parts[0] {
+	case "exec", "attach", "portForward":
+	case "containerLogs":
+		if follow, _ := strconv.ParseBool(req.URL.Query().Get("follow")); !follow {
+			return "", false
+		}
+	default:
+		return "", false
+	}
+	return parts[1] + "/" + parts[2], true
+}
@@ -0,0 +1,113 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/endpoints/request"
+)
+
+func requestAs(name, method, target string) *http.Request {
+	r := httptest.NewRequest(method, target, nil)
+	return r.WithContext(request.WithUser(r.Context(), &user.DefaultInfo{Name: name}))
+}
+
+func TestRequestLimitsStreams(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	h := WithRequestLimits(RequestLimitsConfig{MaxStreamsPerUser: 1, MaxStreamsPerPod: 2}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("block") == "1" {
+			started <- struct{}{}
+			<-release
+		}
+	}))
+
+	serve := func(r *http.Request) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		return rec
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		serve(requestAs("alice", http.MethodPost, "/exec/ns/pod/c?block=1"))
+	}()
+	<-started
+
+	// alice has reached her limit, for other pods too.
+	rec := serve(requestAs("alice", http.MethodPost, "/attach/ns/other/c"))
+	assert.Check(t, is.Equal(rec.Code, http.StatusTooManyRequests))
+	assert.Check(t, is.Equal(rec.Header().Get("Retry-After"), "5"))
+	rec = serve(requestAs("alice", http.MethodGet, "/containerLogs/ns/other/c?follow=true"))
+	assert.Check(t, is.Equal(rec.Code, http.StatusTooManyRequests))
+
+	// Requests which are not streams are not limited by the number of streams.
+	rec = serve(requestAs("alice", http.MethodGet, "/containerLogs/ns/other/c"))
+	assert.Check(t, is.Equal(rec.Code, http.StatusOK))
+
+	// The pod allows one more stream, of another user.
+	go func() {
+		serve(requestAs("bob", http.MethodPost, "/portForward/ns/pod?block=1"))
+	}()
+	<-started
+	rec = serve(requestAs("carol", http.MethodPost, "/exec/ns/pod/c"))
+	assert.Check(t, is.Equal(rec.Code, http.StatusTooManyRequests))
+	rec = serve(requestAs("carol", http.MethodPost, "/exec/ns/other/c"))
+	assert.Check(t, is.Equal(rec.Code, http.StatusOK))
+
+	release <- struct{}{}
+	release <- struct{}{}
+	<-done
+	rec = serve(requestAs("alice", http.MethodPost, "/exec/ns/other/c"))
+	assert.Check(t, is.Equal(rec.Code, http.StatusOK))
+}
+
+func TestRequestLimitsRate(t *testing.T) {
+	h := WithRequestLimits(RequestLimitsConfig{RequestsPerSecond: 0.5, RequestBurst: 2}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	serve := func(r *http.Request) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		return rec
+	}
+
+	for i := 0; i < 2; i++ {
+		rec := serve(requestAs("alice", http.MethodGet, "/stats/summary"))
+		assert.Check(t, is.Equal(rec.Code, http.StatusOK))
+	}
+	rec := serve(requestAs("alice", http.MethodGet, "/stats/summary"))
+	assert.Check(t, is.Equal(rec.Code, http.StatusTooManyRequests))
+	assert.Check(t, is.Equal(rec.Header().Get("Retry-After"), "2"))
+
+	// Other users have their own limits, and unauthenticated requests are limited by their address.
+	rec = serve(requestAs("bob", http.MethodGet, "/stats/summary"))
+	assert.Check(t, is.Equal(rec.Code, http.StatusOK))
+	rec = serve(httptest.NewRequest(http.MethodGet, "/pods", nil))
+	assert.Check(t, is.Equal(rec.Code, http.StatusOK))
+
+	// Streams are not rate limited.
+	rec = serve(requestAs("alice", http.MethodPost, "/exec/ns/pod/c"))
+	assert.Check(t, is.Equal(rec.Code, http.StatusOK))
+}
+
+func TestRequestLimitsAnonymous(t *testing.T) {
+	h := WithRequestLimits(RequestLimitsConfig{RequestsPerSecond: 0.5, RequestBurst: 1}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	serve := func(addr string) int {
+		r := requestAs(user.Anonymous, http.MethodGet, "/stats/summary")
+		r.RemoteAddr = addr
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		return rec.Code
+	}
+
+	// Anonymous requests are limited by their address, rather than sharing the limit of the anonymous user.
+	assert.Check(t, is.Equal(serve("10.0.0.1:1234"), http.StatusOK))
+	assert.Check(t, is.Equal(serve("10.0.0.1:5678"), http.StatusTooManyRequests))
+	assert.Check(t, is.Equal(serve("10.0.0.2:1234"), http.StatusOK))
+}
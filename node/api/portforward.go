@@ -18,11 +18,12 @@ import (
 	"context"
 	"io"
 	"net/http"
-	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
 	"github.com/virtual-kubelet/virtual-kubelet/internal/kubernetes/portforward"
+	"github.com/virtual-kubelet/virtual-kubelet/internal/kubernetes/spdytunnel"
 	"k8s.io/apimachinery/pkg/types"
 )
 
@@ -83,19 +84,28 @@ func HandlePortForward(h PortForwardHandlerFunc, opts ...PortForwardHandlerOptio
 
 		pod := vars["pod"]
 
-		supportedStreamProtocols := strings.Split(req.Header.Get("X-Stream-Protocol-Version"), ",")
-
-		portfwd := &portForwardContext{h: h, pod: pod, namespace: namespace}
+		// The ports of websocket connections are passed as query parameters, except for SPDY tunneled through
+		// websockets, whose streams carry their ports like other SPDY connections.
+		portForwardOpts := &portforward.V4Options{}
+		if _, tunneled := spdytunnel.Protocol(req, portforward.SupportedProtocols); !tunneled {
+			var err error
+			portForwardOpts, err = portforward.NewV4Options(req)
+			if err != nil {
+				return errdefs.AsInvalidInput(err)
+			}
+		}
+
+		portfwd := &portForwardContext{h: h, pod: pod, namespace: namespace, audit: auditRecordFrom(req.Context())}
 		portforward.ServePortForward(
 			w,
 			req,
 			portfwd,
 			pod,
 			"",
-			&portforward.V4Options{}, // This is only used for websocket connection
+			portForwardOpts,
 			cfg.StreamIdleTimeout,
 			cfg.StreamCreationTimeout,
-			supportedStreamProtocols,
+			portforward.SupportedProtocols,
 		)
 
 		return nil
@@ -107,10 +117,12 @@ type portForwardContext struct {
 	h         PortForwardHandlerFunc
 	pod       string
 	namespace string
+	audit     *auditRecord
 }
 
 // PortForward Implements portforward.Portforwarder
 // This is called by portforward.ServePortForward
 func (p *portForwardContext) PortForward(ctx context.Context, name string, uid types.UID, port int32, stream io.ReadWriteCloser) error {
+	p.audit.addPort(port)
 	return p.h(ctx, p.namespace, p.pod, port, stream)
 }
@@ -0,0 +1,340 @@
+// Copyright © 2017 The virtual-kubelet authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+	"github.com/virtual-kubelet/virtual-kubelet/log"
+	"k8s.io/apiserver/pkg/endpoints/request"
+)
+
+const (
+	// DefaultSessionRecordingMaxSize is the default size cap of session recordings.
+	DefaultSessionRecordingMaxSize = 100 << 20
+
+	// The size recordings start with when the client does not report its terminal size.
+	defaultRecordingWidth  = 80
+	defaultRecordingHeight = 24
+)
+
+// SessionRecorderConfig is used to configure a SessionRecorder.
+type SessionRecorderConfig struct {
+	// Dir is the directory the recordings are stored in. It is created if it does not exist.
+	Dir string
+	// MaxSize is the size in bytes at which a recording is truncated. The session itself continues.
+	// It defaults to DefaultSessionRecordingMaxSize. If it is negative, recordings are not truncated.
+	MaxSize int64
+	// RedactStdin is called with the input of the session before it is recorded, and returns the data to record
+	// instead. It is called with each chunk of input as it is read, so secrets may be split across calls.
+	// If it returns nil, the input is not recorded.
+	RedactStdin func(session SessionInfo, data []byte) []byte
+}
+
+// SessionInfo describes an exec or attach session.
+type SessionInfo struct {
+	// User is the name of the user who started the session, if the request was authenticated.
+	User      string
+	Namespace string
+	Pod       string
+	Container string
+	// Command is the command of exec sessions. It is empty for attach sessions.
+	Command []string
+	// StartTime is when the session started.
+	StartTime time.Time
+}
+
+// SessionRecorder records exec and attach sessions as asciicast v2 files (https://docs.asciinema.org), which can be
+// replayed with asciinema. The output of the session, its input and the resizes of its terminal are recorded.
+//
+// Each session is recorded to its own file in the configured directory, named after the user, the pod, the container
+// and the start time of the session.
+type SessionRecorder struct {
+	cfg SessionRecorderConfig
+}
+
+// NewSessionRecorder creates a SessionRecorder.
+func NewSessionRecorder(cfg SessionRecorderConfig) (*SessionRecorder, error) {
+	if cfg.Dir == "" {
+		return nil, errors.New("no session recording directory provided")
+	}
+	if cfg.MaxSize == 0 {
+		cfg.MaxSize = DefaultSessionRecordingMaxSize
+	}
+	if err := os.MkdirAll(cfg.Dir, 0700); err != nil {
+		return nil, errors.Wrap(err, "error creating session recording directory")
+	}
+	return &SessionRecorder{cfg: cfg}, nil
+}
+
+// start starts the recording of a session.
+// The user of the session is taken from the context (see request.WithUser).
+func (r *SessionRecorder) start(ctx context.Context, info SessionInfo) (*recordingSession, error) {
+	if u, ok := request.UserFrom(ctx); ok {
+		info.User = u.GetName()
+	}
+	info.StartTime = time.Now()
+
+	user := info.User
+	if user == "" {
+		user = "unknown"
+	}
+	name := strings.Join([]string{
+		sanitizeRecordingName(user),
+		sanitizeRecordingName(info.Namespace),
+		sanitizeRecordingName(info.Pod),
+		sanitizeRecordingName(info.Container),
+		info.StartTime.UTC().Format("20060102T150405.000000000Z"),
+	}, "_") + ".cast"
+
+	f, err := os.OpenFile(filepath.Join(r.cfg.Dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating session recording")
+	}
+	log.G(ctx).WithField("recording", f.Name()).Debug("Recording session")
+
+	return &recordingSession{
+		ctx:    ctx,
+		info:   info,
+		f:      f,
+		max:    r.cfg.MaxSize,
+		redact: r.cfg.RedactStdin,
+	}, nil
+}
+
+func sanitizeRecordingName(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-':
+			return r
+		}
+		return '-'
+	}, s)
+}
+
+// recordingSession writes the events of a session to its recording.
+// All of its methods are safe to call on a nil session, so that callers do not need to check whether sessions are
+// recorded.
+type recordingSession struct {
+	ctx    context.Context
+	info   SessionInfo
+	max    int64
+	redact func(SessionInfo, []byte) []byte
+
+	mu        sync.Mutex
+	f         *os.File
+	started   bool
+	size      int64
+	truncated bool
+	// Incomplete UTF-8 sequences at the end of the last chunk of output and input, which are recorded with the next.
+	pendingOut []byte
+	pendingIn  []byte
+}
+
+type asciicastHeader struct {
+	Version   int    `json:"version"`
+	Width     uint16 `json:"width"`
+	Height    uint16 `json:"height"`
+	Timestamp int64  `json:"timestamp"`
+	Title     string `json:"title,omitempty"`
+}
+
+// wrap returns AttachIO which records the streams of the session.
+func (s *recordingSession) wrap(eio *execIO) *execIO {
+	if s == nil {
+		return eio
+	}
+	wrapped := *eio
+	if eio.stdin != nil {
+		wrapped.stdin = &recordingReader{r: eio.stdin, s: s}
+	}
+	if eio.stdout != nil {
+		wrapped.stdout = &recordingWriteCloser{WriteCloser: eio.stdout, s: s}
+	}
+	if eio.stderr != nil {
+		wrapped.stderr = &recordingWriteCloser{WriteCloser: eio.stderr, s: s}
+	}
+	return &wrapped
+}
+
+func (s *recordingSession) output(p []byte) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pendingOut = s.writeData("o", s.pendingOut, p)
+}
+
+func (s *recordingSession) input(p []byte) {
+	if s == nil {
+		return
+	}
+	if s.redact != nil {
+		p = s.redact(s.info, append([]byte(nil), p...))
+		if p == nil {
+			return
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pendingIn = s.writeData("i", s.pendingIn, p)
+}
+
+func (s *recordingSession) resize(size TermSize) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.started {
+		s.writeHeader(size)
+	}
+	s.writeEvent("r", fmtTermSize(size))
+}
+
+// Close ends the recording.
+func (s *recordingSession) Close() error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.started {
+		s.writeHeader(TermSize{})
+	}
+	// The incomplete UTF-8 sequences kept back will not be completed anymore, so they are recorded as they are.
+	if len(s.pendingOut) > 0 {
+		s.writeEvent("o", strings.ToValidUTF8(string(s.pendingOut), string(utf8.RuneError)))
+		s.pendingOut = nil
+	}
+	if len(s.pendingIn) > 0 {
+		s.writeEvent("i", strings.ToValidUTF8(string(s.pendingIn), string(utf8.RuneError)))
+		s.pendingIn = nil
+	}
+	return s.f.Close()
+}
+
+// writeData records the data as an event of the given type, keeping back any incomplete UTF-8 sequence at its end.
+// It returns the bytes kept back.
+func (s *recordingSession) writeData(typ string, pending, p []byte) []byte {
+	data := append(pending, p...)
+	end := len(data)
+	// Look for the start of an incomplete rune in the last few bytes.
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax+1; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				end = i
+			}
+			break
+		}
+	}
+	if end > 0 {
+		if !s.started {
+			s.writeHeader(TermSize{})
+		}
+		s.writeEvent(typ, string(data[:end]))
+	}
+	return append([]byte(nil), data[end:]...)
+}
+
+func (s *recordingSession) writeHeader(size TermSize) {
+	s.started = true
+	if size.Width == 0 || size.Height == 0 {
+		size = TermSize{Width: defaultRecordingWidth, Height: defaultRecordingHeight}
+	}
+	title := "attach to " + s.info.Namespace + "/" + s.info.Pod + "/" + s.info.Container
+	if len(s.info.Command) > 0 {
+		title = "exec " + strings.Join(s.info.Command, " ") + " in " + s.info.Namespace + "/" + s.info.Pod + "/" + s.info.Container
+	}
+	if s.info.User != "" {
+		title += " by " + s.info.User
+	}
+	s.writeLine(asciicastHeader{
+		Version:   2,
+		Width:     size.Width,
+		Height:    size.Height,
+		Timestamp: s.info.StartTime.Unix(),
+		Title:     title,
+	})
+}
+
+func (s *recordingSession) writeEvent(typ, data string) {
+	s.writeLine([]interface{}{time.Since(s.info.StartTime).Seconds(), typ, data})
+}
+
+func (s *recordingSession) writeLine(v interface{}) {
+	if s.truncated {
+		return
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		log.G(s.ctx).WithError(err).Error("Error marshalling session recording event")
+		return
+	}
+	b = append(b, '\n')
+
+	if s.max > 0 && s.size+int64(len(b)) > s.max {
+		s.truncated = true
+		log.G(s.ctx).WithField("recording", s.f.Name()).Warn("Session recording reached its size limit, truncating it")
+		return
+	}
+	n, err := s.f.Write(b)
+	s.size += int64(n)
+	if err != nil {
+		s.truncated = true
+		log.G(s.ctx).WithError(err).WithField("recording", s.f.Name()).Error("Error writing session recording, truncating it")
+	}
+}
+
+func fmtTermSize(size TermSize) string {
+	return strconv.Itoa(int(size.Width)) + "x" + strconv.Itoa(int(size.Height))
+}
+
+type recordingReader struct {
+	r io.Reader
+	s *recordingSession
+}
+
+func (r *recordingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.s.input(p[:n])
+	}
+	return n, err
+}
+
+type recordingWriteCloser struct {
+	io.WriteCloser
+	s *recordingSession
+}
+
+func (w *recordingWriteCloser) Write(p []byte) (int, error) {
+	n, err := w.WriteCloser.Write(p)
+	if n > 0 {
+		w.s.output(p[:n])
+	}
+	return n, err
+}
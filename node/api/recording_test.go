@@ -0,0 +1,175 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/endpoints/request"
+	remoteutils "k8s.io/client-go/tools/remotecommand"
+)
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// readRecording returns the header and the events of the only recording in the directory.
+func readRecording(t *testing.T, dir string) (string, asciicastHeader, [][]interface{}) {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(dir, "*.cast"))
+	assert.NilError(t, err)
+	assert.Assert(t, is.Len(files, 1))
+
+	f, err := os.Open(files[0])
+	assert.NilError(t, err)
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	assert.Assert(t, s.Scan())
+	var header asciicastHeader
+	assert.NilError(t, json.Unmarshal(s.Bytes(), &header))
+	var events [][]interface{}
+	for s.Scan() {
+		var e []interface{}
+		assert.NilError(t, json.Unmarshal(s.Bytes(), &e))
+		events = append(events, e)
+	}
+	return filepath.Base(files[0]), header, events
+}
+
+func TestSessionRecording(t *testing.T) {
+	dir := t.TempDir()
+	recorder, err := NewSessionRecorder(SessionRecorderConfig{
+		Dir: dir,
+		RedactStdin: func(_ SessionInfo, data []byte) []byte {
+			return bytes.ReplaceAll(data, []byte("hunter2"), []byte("*******"))
+		},
+	})
+	assert.NilError(t, err)
+
+	ctx, cancel := context.WithCancel(request.WithUser(context.Background(), &user.DefaultInfo{Name: "system:admin"}))
+	defer cancel()
+	c := &containerExecContext{
+		ctx:       ctx,
+		cancel:    cancel,
+		namespace: "ns",
+		pod:       "pod",
+		container: "c",
+		recorder:  recorder,
+		h: func(ctx context.Context, namespace, podName, containerName string, cmd []string, attach AttachIO) error {
+			<-attach.Resize()
+			in, err := io.ReadAll(attach.Stdin())
+			if err != nil {
+				return err
+			}
+			// Split a multi-byte character across writes.
+			out := []byte("héllo " + string(in))
+			attach.Stdout().Write(out[:2]) //nolint:errcheck
+			attach.Stdout().Write(out[2:]) //nolint:errcheck
+			return nil
+		},
+	}
+
+	resize := make(chan remoteutils.TerminalSize, 1)
+	resize <- remoteutils.TerminalSize{Width: 120, Height: 40}
+	var stdout bytes.Buffer
+	err = c.ExecInContainer("", "", "c", []string{"sh"}, strings.NewReader("hunter2"), nopWriteCloser{&stdout}, nil, true, resize, 0)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(stdout.String(), "héllo hunter2"))
+
+	name, header, events := readRecording(t, dir)
+	assert.Check(t, strings.HasPrefix(name, "system-admin_ns_pod_c_"), name)
+	assert.Check(t, is.Equal(header.Version, 2))
+	assert.Check(t, is.Equal(header.Width, uint16(120)))
+	assert.Check(t, is.Equal(header.Height, uint16(40)))
+	assert.Check(t, is.Equal(header.Title, "exec sh in ns/pod/c by system:admin"))
+
+	var got []string
+	for _, e := range events {
+		got = append(got, e[1].(string)+":"+e[2].(string))
+	}
+	assert.Check(t, is.DeepEqual(got, []string{"r:120x40", "i:*******", "o:h", "o:éllo hunter2"}))
+}
+
+func TestSessionRecordingIncompleteOutput(t *testing.T) {
+	dir := t.TempDir()
+	recorder, err := NewSessionRecorder(SessionRecorderConfig{Dir: dir})
+	assert.NilError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := &containerExecContext{
+		ctx:       ctx,
+		cancel:    cancel,
+		namespace: "ns",
+		pod:       "pod",
+		container: "c",
+		recorder:  recorder,
+		h: func(ctx context.Context, namespace, podName, containerName string, cmd []string, attach AttachIO) error {
+			// The output ends in the middle of a multi-byte character.
+			attach.Stdout().Write([]byte("bye " + "é"[:1])) //nolint:errcheck
+			return nil
+		},
+	}
+
+	resize := make(chan remoteutils.TerminalSize)
+	var stdout bytes.Buffer
+	err = c.ExecInContainer("", "", "c", []string{"sh"}, nil, nopWriteCloser{&stdout}, nil, true, resize, 0)
+	assert.NilError(t, err)
+
+	_, _, events := readRecording(t, dir)
+	var got []string
+	for _, e := range events {
+		got = append(got, e[1].(string)+":"+e[2].(string))
+	}
+	assert.Check(t, is.DeepEqual(got, []string{"o:bye ", "o:\uFFFD"}))
+}
+
+func TestSessionRecordingMaxSize(t *testing.T) {
+	dir := t.TempDir()
+	recorder, err := NewSessionRecorder(SessionRecorderConfig{Dir: dir, MaxSize: 200})
+	assert.NilError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := &containerAttachContext{
+		ctx:       ctx,
+		cancel:    cancel,
+		namespace: "ns",
+		pod:       "pod",
+		container: "c",
+		recorder:  recorder,
+		h: func(ctx context.Context, namespace, podName, containerName string, attach AttachIO) error {
+			for i := 0; i < 10; i++ {
+				if _, err := attach.Stdout().Write([]byte("0123456789")); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	}
+
+	var stdout bytes.Buffer
+	err = c.AttachToContainer("", "", "c", nil, nopWriteCloser{&stdout}, nil, false, nil, 0)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(stdout.Len(), 100), "the session should not be affected by the size limit")
+
+	name, header, events := readRecording(t, dir)
+	assert.Check(t, strings.HasPrefix(name, "unknown_ns_pod_c_"), name)
+	assert.Check(t, is.Equal(header.Width, uint16(defaultRecordingWidth)))
+	assert.Check(t, len(events) > 0 && len(events) < 10, "expected the recording to be truncated, got %d events", len(events))
+
+	info, err := os.Stat(filepath.Join(dir, name))
+	assert.NilError(t, err)
+	assert.Check(t, info.Size() <= 200)
+}
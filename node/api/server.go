@@ -46,6 +46,10 @@ type PodHandlerConfig struct { //nolint:golint
 	GetMetricsResource    PodMetricsResourceHandlerFunc
 	StreamIdleTimeout     time.Duration
 	StreamCreationTimeout time.Duration
+	// SessionRecorder records exec and attach sessions, if set.
+	SessionRecorder *SessionRecorder
+	// Limits are the limits of concurrent streams and of the rate of requests, if any.
+	Limits RequestLimitsConfig
 }
 
 const MetricsResourceRouteSuffix = "/metrics/resource"
@@ -67,6 +71,7 @@ func PodHandler(p PodHandlerConfig, debug bool) http.Handler {
 			p.RunInContainer,
 			WithExecStreamCreationTimeout(p.StreamCreationTimeout),
 			WithExecStreamIdleTimeout(p.StreamIdleTimeout),
+			WithSessionRecorder(p.SessionRecorder),
 		),
 	).Methods("POST", "GET")
 	r.HandleFunc(
@@ -75,6 +80,7 @@ func PodHandler(p PodHandlerConfig, debug bool) http.Handler {
 			p.AttachToContainer,
 			WithExecStreamCreationTimeout(p.StreamCreationTimeout),
 			WithExecStreamIdleTimeout(p.StreamIdleTimeout),
+			WithSessionRecorder(p.SessionRecorder),
 		),
 	).Methods("POST", "GET")
 	r.HandleFunc(
@@ -98,6 +104,9 @@ func PodHandler(p PodHandlerConfig, debug bool) http.Handler {
 		r.HandleFunc(MetricsResourceRouteSuffix+"/", f).Methods("GET")
 	}
 	r.NotFoundHandler = http.HandlerFunc(NotFound)
+	if p.Limits.enabled() {
+		return WithRequestLimits(p.Limits, r)
+	}
 	return r
 }
 
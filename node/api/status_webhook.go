@@ -0,0 +1,276 @@
+// Copyright © 2017 The virtual-kubelet authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
+	"github.com/virtual-kubelet/virtual-kubelet/log"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/cache"
+)
+
+const (
+	// PodStatusWebhookPath is the path pod status callbacks are posted to.
+	PodStatusWebhookPath = "/podStatusCallback"
+
+	// PodStatusWebhookTimestampHeader is the header holding the time a callback was signed at, in seconds since
+	// the Unix epoch.
+	PodStatusWebhookTimestampHeader = "X-Virtual-Kubelet-Timestamp"
+	// PodStatusWebhookSignatureHeader is the header holding the signature of a callback, see
+	// SignPodStatusCallback.
+	PodStatusWebhookSignatureHeader = "X-Virtual-Kubelet-Signature"
+
+	// DefaultPodStatusWebhookMaxClockSkew is the default maximum age of signed callbacks.
+	DefaultPodStatusWebhookMaxClockSkew = 5 * time.Minute
+
+	podStatusWebhookMaxBodySize = 1 << 20
+	// Limits of the cache of the last sequence numbers of pods. Its TTL outlives the maximum clock skew, so that
+	// signed callbacks cannot be replayed once their pod's sequence number has expired.
+	podStatusWebhookSequenceCacheSize = 1 << 16
+	podStatusWebhookSequenceTTL       = time.Hour
+)
+
+// PodStatusCallback is the payload of a pod status callback.
+type PodStatusCallback struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	// UID is the UID of the pod. If it is set, callbacks for other pods of the same name are rejected.
+	UID types.UID `json:"uid,omitempty"`
+	// Sequence orders the callbacks of a pod. It must be greater than the sequence of the previous callback
+	// accepted for the pod, so that callbacks which are replayed, or arrive out of order, are rejected.
+	Sequence uint64           `json:"sequence"`
+	Status   corev1.PodStatus `json:"status"`
+}
+
+// PodStatusWebhookConfig configures the receiver of pod status callbacks.
+//
+// Callbacks are authenticated either by a signature (see SignPodStatusCallback), or by a client certificate with
+// one of the ClientCertNames which was verified by the TLS configuration of the server.
+type PodStatusWebhookConfig struct {
+	// Secret is the key callbacks are signed with.
+	Secret []byte
+	// ClientCertNames are the common names of client certificates callbacks may be authenticated with instead of
+	// a signature.
+	ClientCertNames []string
+	// MaxClockSkew is the maximum age of signed callbacks. It defaults to DefaultPodStatusWebhookMaxClockSkew.
+	//
+	// Within the clock skew, replayed callbacks are only rejected by the last sequence number accepted for their pod,
+	// which is kept in memory. A callback captured within the clock skew is accepted again if that sequence number
+	// is lost, because the receiver restarted or many other pods posted callbacks since. Backends which need
+	// stronger guarantees should use client certificates and a short clock skew.
+	MaxClockSkew time.Duration
+
+	// GetPod gets the pod of a callback from Kubernetes, usually from an informer.
+	GetPod func(namespace, name string) (*corev1.Pod, error)
+	// NotifyPod is called with the pod and the status of an accepted callback.
+	NotifyPod func(ctx context.Context, pod *corev1.Pod)
+}
+
+// SignPodStatusCallback returns the signature of a callback signed at the given time: the hex encoded HMAC-SHA256
+// of the timestamp, a dot and the body, prefixed by "sha256=".
+func SignPodStatusCallback(secret []byte, timestamp time.Time, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%d.", timestamp.Unix())
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// PodStatusWebhookHandler creates an http handler which receives pod status callbacks.
+//
+// It must not be wrapped by the authentication of the kubelet API, since backends authenticate with the secret
+// or client certificates of the config instead. See WithPodStatusWebhook.
+func PodStatusWebhookHandler(cfg PodStatusWebhookConfig) http.Handler {
+	if cfg.MaxClockSkew <= 0 {
+		cfg.MaxClockSkew = DefaultPodStatusWebhookMaxClockSkew
+	}
+	return &podStatusWebhook{
+		cfg:       cfg,
+		sequences: cache.NewLRUExpireCache(podStatusWebhookSequenceCacheSize),
+		notifying: make(map[types.UID]*podStatusNotification),
+	}
+}
+
+// WithPodStatusWebhook routes the pod status callbacks posted to PodStatusWebhookPath to the receiver, and all other
+// requests to the handler.
+func WithPodStatusWebhook(cfg PodStatusWebhookConfig, h http.Handler) http.Handler {
+	webhook := PodStatusWebhookHandler(cfg)
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == PodStatusWebhookPath {
+			webhook.ServeHTTP(w, req)
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+type podStatusWebhook struct {
+	cfg PodStatusWebhookConfig
+
+	mu sync.Mutex
+	// sequences holds the last sequence number accepted for each pod UID.
+	sequences *cache.LRUExpireCache
+	// notifying holds the pods whose callbacks are being notified.
+	notifying map[types.UID]*podStatusNotification
+}
+
+// podStatusNotification serializes notifying the callbacks of a pod, so that the pod is notified in the order of
+// their sequence numbers without holding up the callbacks of other pods.
+type podStatusNotification struct {
+	mu sync.Mutex
+	// last is the sequence number of the last callback notified.
+	last uint64
+	// refs is the number of callbacks of the pod being notified, guarded by the mutex of the webhook.
+	refs int
+}
+
+func (h *podStatusWebhook) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(req.Body, podStatusWebhookMaxBodySize+1))
+	if err != nil {
+		http.Error(w, "Error reading body", http.StatusBadRequest)
+		return
+	}
+	if len(body) > podStatusWebhookMaxBodySize {
+		http.Error(w, "Body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if err := h.authenticate(req, body); err != nil {
+		log.G(ctx).WithError(err).Warn("Rejecting unauthenticated pod status callback")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var cb PodStatusCallback
+	if err := json.Unmarshal(body, &cb); err != nil {
+		http.Error(w, "Invalid pod status callback: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if cb.Namespace == "" || cb.Name == "" || cb.Sequence == 0 {
+		http.Error(w, "Invalid pod status callback: namespace, name and sequence are required", http.StatusBadRequest)
+		return
+	}
+	ctx = log.WithLogger(ctx, log.G(ctx).WithFields(log.Fields{
+		"namespace": cb.Namespace,
+		"pod":       cb.Name,
+		"sequence":  cb.Sequence,
+	}))
+
+	pod, err := h.cfg.GetPod(cb.Namespace, cb.Name)
+	if err != nil {
+		if errdefs.IsNotFound(err) {
+			http.Error(w, "Pod not found", http.StatusNotFound)
+			return
+		}
+		log.G(ctx).WithError(err).Error("Error getting pod of status callback")
+		http.Error(w, "Error getting pod", http.StatusInternalServerError)
+		return
+	}
+	if cb.UID != "" && cb.UID != pod.UID {
+		http.Error(w, "Pod UID does not match", http.StatusConflict)
+		return
+	}
+
+	h.mu.Lock()
+	if last, ok := h.sequences.Get(pod.UID); ok && cb.Sequence <= last.(uint64) {
+		h.mu.Unlock()
+		log.G(ctx).WithField("lastSequence", last).Debug("Rejecting stale pod status callback")
+		http.Error(w, "Stale or replayed sequence", http.StatusConflict)
+		return
+	}
+	h.sequences.Add(pod.UID, cb.Sequence, podStatusWebhookSequenceTTL)
+	n, ok := h.notifying[pod.UID]
+	if !ok {
+		n = &podStatusNotification{}
+		h.notifying[pod.UID] = n
+	}
+	n.refs++
+	h.mu.Unlock()
+
+	updated := pod.DeepCopy()
+	cb.Status.DeepCopyInto(&updated.Status)
+	h.notify(ctx, pod.UID, n, cb.Sequence, updated)
+	log.G(ctx).Debug("Accepted pod status callback")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// notify notifies the pod of an accepted callback, unless a callback with a greater sequence number was notified
+// while it waited for the callbacks of the pod before it.
+func (h *podStatusWebhook) notify(ctx context.Context, uid types.UID, n *podStatusNotification, sequence uint64, pod *corev1.Pod) {
+	n.mu.Lock()
+	if sequence > n.last {
+		h.cfg.NotifyPod(ctx, pod)
+		n.last = sequence
+	} else {
+		log.G(ctx).WithField("lastSequence", n.last).Debug("Skipping pod status callback superseded by a later one")
+	}
+	n.mu.Unlock()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if n.refs--; n.refs == 0 {
+		delete(h.notifying, uid)
+	}
+}
+
+// authenticate authenticates the callback by its client certificate or its signature.
+func (h *podStatusWebhook) authenticate(req *http.Request, body []byte) error {
+	if len(h.cfg.ClientCertNames) > 0 && req.TLS != nil && len(req.TLS.VerifiedChains) > 0 {
+		if slices.Contains(h.cfg.ClientCertNames, req.TLS.VerifiedChains[0][0].Subject.CommonName) {
+			return nil
+		}
+	}
+
+	if len(h.cfg.Secret) == 0 {
+		return errdefs.InvalidInput("no verified client certificate")
+	}
+	signature := req.Header.Get(PodStatusWebhookSignatureHeader)
+	if !strings.HasPrefix(signature, "sha256=") {
+		return errdefs.InvalidInput("missing signature")
+	}
+	seconds, err := strconv.ParseInt(req.Header.Get(PodStatusWebhookTimestampHeader), 10, 64)
+	if err != nil {
+		return errdefs.InvalidInput("missing or invalid timestamp")
+	}
+	timestamp := time.Unix(seconds, 0)
+	if skew := time.Since(timestamp); skew > h.cfg.MaxClockSkew || skew < -h.cfg.MaxClockSkew {
+		return errdefs.InvalidInputf("timestamp is outside the allowed clock skew of %s", h.cfg.MaxClockSkew)
+	}
+	if !hmac.Equal([]byte(signature), []byte(SignPodStatusCallback(h.cfg.Secret, timestamp, body))) {
+		return errdefs.InvalidInput("invalid signature")
+	}
+	return nil
+}
@@ -0,0 +1,226 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type fakeStatusWebhookBackend struct {
+	pods     map[string]*corev1.Pod
+	notified []*corev1.Pod
+}
+
+func newFakeStatusWebhookBackend() *fakeStatusWebhookBackend {
+	return &fakeStatusWebhookBackend{pods: map[string]*corev1.Pod{
+		"default/web": {
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web", UID: "uid-1"},
+			Status:     corev1.PodStatus{Phase: corev1.PodPending},
+		},
+	}}
+}
+
+func (b *fakeStatusWebhookBackend) config(secret string) PodStatusWebhookConfig {
+	return PodStatusWebhookConfig{
+		Secret: []byte(secret),
+		GetPod: func(namespace, name string) (*corev1.Pod, error) {
+			pod, ok := b.pods[namespace+"/"+name]
+			if !ok {
+				return nil, errdefs.NotFound("pod not found")
+			}
+			return pod, nil
+		},
+		NotifyPod: func(_ context.Context, pod *corev1.Pod) {
+			b.notified = append(b.notified, pod)
+		},
+	}
+}
+
+func newStatusCallbackRequest(t *testing.T, secret string, ts time.Time, cb PodStatusCallback) *http.Request {
+	t.Helper()
+	body, err := json.Marshal(cb)
+	assert.NilError(t, err)
+	req := httptest.NewRequest(http.MethodPost, PodStatusWebhookPath, bytes.NewReader(body))
+	req.Header.Set(PodStatusWebhookTimestampHeader, strconv.FormatInt(ts.Unix(), 10))
+	req.Header.Set(PodStatusWebhookSignatureHeader, SignPodStatusCallback([]byte(secret), ts, body))
+	return req
+}
+
+func serveStatusCallback(h http.Handler, req *http.Request) int {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w.Code
+}
+
+func runningCallback(seq uint64) PodStatusCallback {
+	return PodStatusCallback{
+		Namespace: "default",
+		Name:      "web",
+		UID:       "uid-1",
+		Sequence:  seq,
+		Status:    corev1.PodStatus{Phase: corev1.PodRunning},
+	}
+}
+
+func TestPodStatusWebhookAccepted(t *testing.T) {
+	b := newFakeStatusWebhookBackend()
+	h := PodStatusWebhookHandler(b.config("secret"))
+
+	code := serveStatusCallback(h, newStatusCallbackRequest(t, "secret", time.Now(), runningCallback(1)))
+	assert.Check(t, is.Equal(code, http.StatusNoContent))
+	assert.Assert(t, is.Len(b.notified, 1))
+	assert.Check(t, is.Equal(b.notified[0].Status.Phase, corev1.PodRunning))
+	assert.Check(t, is.Equal(b.notified[0].UID, b.pods["default/web"].UID))
+	// The pod returned by GetPod must not be modified.
+	assert.Check(t, is.Equal(b.pods["default/web"].Status.Phase, corev1.PodPending))
+}
+
+func TestPodStatusWebhookAuthentication(t *testing.T) {
+	b := newFakeStatusWebhookBackend()
+	h := PodStatusWebhookHandler(b.config("secret"))
+
+	t.Run("wrong secret", func(t *testing.T) {
+		code := serveStatusCallback(h, newStatusCallbackRequest(t, "other", time.Now(), runningCallback(1)))
+		assert.Check(t, is.Equal(code, http.StatusUnauthorized))
+	})
+	t.Run("old timestamp", func(t *testing.T) {
+		ts := time.Now().Add(-2 * DefaultPodStatusWebhookMaxClockSkew)
+		code := serveStatusCallback(h, newStatusCallbackRequest(t, "secret", ts, runningCallback(1)))
+		assert.Check(t, is.Equal(code, http.StatusUnauthorized))
+	})
+	t.Run("tampered body", func(t *testing.T) {
+		req := newStatusCallbackRequest(t, "secret", time.Now(), runningCallback(1))
+		body, err := json.Marshal(runningCallback(2))
+		assert.NilError(t, err)
+		req.Body = httptest.NewRequest(http.MethodPost, PodStatusWebhookPath, bytes.NewReader(body)).Body
+		assert.Check(t, is.Equal(serveStatusCallback(h, req), http.StatusUnauthorized))
+	})
+	t.Run("unsigned", func(t *testing.T) {
+		req := newStatusCallbackRequest(t, "secret", time.Now(), runningCallback(1))
+		req.Header.Del(PodStatusWebhookSignatureHeader)
+		assert.Check(t, is.Equal(serveStatusCallback(h, req), http.StatusUnauthorized))
+	})
+	assert.Check(t, is.Len(b.notified, 0))
+
+	t.Run("client certificate", func(t *testing.T) {
+		cfg := b.config("")
+		cfg.ClientCertNames = []string{"backend"}
+		h := PodStatusWebhookHandler(cfg)
+
+		req := newStatusCallbackRequest(t, "", time.Now(), runningCallback(1))
+		req.Header.Del(PodStatusWebhookSignatureHeader)
+		assert.Check(t, is.Equal(serveStatusCallback(h, req), http.StatusUnauthorized))
+
+		cert := &x509.Certificate{Subject: pkix.Name{CommonName: "other"}}
+		req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+		assert.Check(t, is.Equal(serveStatusCallback(h, req), http.StatusUnauthorized))
+
+		req = newStatusCallbackRequest(t, "", time.Now(), runningCallback(1))
+		cert = &x509.Certificate{Subject: pkix.Name{CommonName: "backend"}}
+		req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+		assert.Check(t, is.Equal(serveStatusCallback(h, req), http.StatusNoContent))
+		assert.Check(t, is.Len(b.notified, 1))
+	})
+}
+
+func TestPodStatusWebhookSequence(t *testing.T) {
+	b := newFakeStatusWebhookBackend()
+	h := PodStatusWebhookHandler(b.config("secret"))
+
+	assert.Check(t, is.Equal(serveStatusCallback(h, newStatusCallbackRequest(t, "secret", time.Now(), runningCallback(2))), http.StatusNoContent))
+	// Replays and callbacks which arrive out of order are rejected.
+	assert.Check(t, is.Equal(serveStatusCallback(h, newStatusCallbackRequest(t, "secret", time.Now(), runningCallback(2))), http.StatusConflict))
+	assert.Check(t, is.Equal(serveStatusCallback(h, newStatusCallbackRequest(t, "secret", time.Now(), runningCallback(1))), http.StatusConflict))
+	assert.Check(t, is.Equal(serveStatusCallback(h, newStatusCallbackRequest(t, "secret", time.Now(), runningCallback(3))), http.StatusNoContent))
+	assert.Check(t, is.Len(b.notified, 2))
+
+	// A new pod of the same name starts a new sequence.
+	b.pods["default/web"] = &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web", UID: "uid-2"}}
+	cb := runningCallback(1)
+	cb.UID = "uid-2"
+	assert.Check(t, is.Equal(serveStatusCallback(h, newStatusCallbackRequest(t, "secret", time.Now(), cb)), http.StatusNoContent))
+	assert.Check(t, is.Len(b.notified, 3))
+}
+
+func TestPodStatusWebhookSlowNotify(t *testing.T) {
+	b := newFakeStatusWebhookBackend()
+	b.pods["default/db"] = &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "db", UID: "uid-db"}}
+	cfg := b.config("secret")
+	blocked, release := make(chan struct{}), make(chan struct{})
+	notified := make(chan string, 2)
+	cfg.NotifyPod = func(_ context.Context, pod *corev1.Pod) {
+		if pod.Name == "web" {
+			close(blocked)
+			<-release
+		}
+		notified <- pod.Name
+	}
+	h := PodStatusWebhookHandler(cfg)
+
+	done := make(chan int)
+	go func() {
+		done <- serveStatusCallback(h, newStatusCallbackRequest(t, "secret", time.Now(), runningCallback(1)))
+	}()
+	<-blocked
+
+	// The callbacks of other pods are not held up by a pod which is being notified.
+	cb := runningCallback(1)
+	cb.Name, cb.UID = "db", "uid-db"
+	assert.Check(t, is.Equal(serveStatusCallback(h, newStatusCallbackRequest(t, "secret", time.Now(), cb)), http.StatusNoContent))
+	assert.Check(t, is.Equal(<-notified, "db"))
+
+	close(release)
+	assert.Check(t, is.Equal(<-done, http.StatusNoContent))
+	assert.Check(t, is.Equal(<-notified, "web"))
+	// Replays are still rejected once the pod was notified.
+	assert.Check(t, is.Equal(serveStatusCallback(h, newStatusCallbackRequest(t, "secret", time.Now(), runningCallback(1))), http.StatusConflict))
+	assert.Check(t, is.Len(h.(*podStatusWebhook).notifying, 0))
+}
+
+func TestPodStatusWebhookValidation(t *testing.T) {
+	b := newFakeStatusWebhookBackend()
+	h := PodStatusWebhookHandler(b.config("secret"))
+
+	unknown := runningCallback(1)
+	unknown.Name = "unknown"
+	assert.Check(t, is.Equal(serveStatusCallback(h, newStatusCallbackRequest(t, "secret", time.Now(), unknown)), http.StatusNotFound))
+
+	otherUID := runningCallback(1)
+	otherUID.UID = "uid-2"
+	assert.Check(t, is.Equal(serveStatusCallback(h, newStatusCallbackRequest(t, "secret", time.Now(), otherUID)), http.StatusConflict))
+
+	noSequence := runningCallback(0)
+	assert.Check(t, is.Equal(serveStatusCallback(h, newStatusCallbackRequest(t, "secret", time.Now(), noSequence)), http.StatusBadRequest))
+
+	req := httptest.NewRequest(http.MethodGet, PodStatusWebhookPath, nil)
+	assert.Check(t, is.Equal(serveStatusCallback(h, req), http.StatusMethodNotAllowed))
+	assert.Check(t, is.Len(b.notified, 0))
+}
+
+func TestWithPodStatusWebhook(t *testing.T) {
+	b := newFakeStatusWebhookBackend()
+	var passed []string
+	h := WithPodStatusWebhook(b.config("secret"), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		passed = append(passed, r.URL.Path)
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	assert.Check(t, is.Equal(serveStatusCallback(h, httptest.NewRequest(http.MethodGet, "/pods", nil)), http.StatusOK))
+	assert.Check(t, is.Equal(serveStatusCallback(h, newStatusCallbackRequest(t, "secret", time.Now(), runningCallback(1))), http.StatusNoContent))
+	assert.Check(t, is.DeepEqual(passed, []string{"/pods"}))
+	assert.Check(t, is.Len(b.notified, 1))
+}
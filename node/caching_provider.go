@@ -0,0 +1,322 @@
+// Copyright © 2017 The virtual-kubelet authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
+	"github.com/virtual-kubelet/virtual-kubelet/log"
+	"github.com/virtual-kubelet/virtual-kubelet/trace"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/utils/clock"
+)
+
+// DefaultCachingProviderResyncPeriod is the default interval the pods of a CachingProvider are relisted at.
+const DefaultCachingProviderResyncPeriod = time.Minute
+
+// CachingProviderConfig configures a CachingProvider.
+type CachingProviderConfig struct {
+	// ResyncPeriod is the interval all pods are relisted from the provider at. It defaults to
+	// DefaultCachingProviderResyncPeriod.
+	ResyncPeriod time.Duration
+	// MaxStaleness is the maximum age of cached pods, that is the time since they were last listed, fetched or
+	// notified by the provider. Reads of pods which are older are passed to the provider, as are reads of all pods
+	// if the last successful relist is older. It defaults to twice the ResyncPeriod, so that a single failed relist
+	// does not bypass the cache.
+	MaxStaleness time.Duration
+}
+
+func (c CachingProviderConfig) withDefaults() CachingProviderConfig {
+	if c.ResyncPeriod <= 0 {
+		c.ResyncPeriod = DefaultCachingProviderResyncPeriod
+	}
+	if c.MaxStaleness <= 0 {
+		c.MaxStaleness = 2 * c.ResyncPeriod
+	}
+	return c
+}
+
+// CachingProvider wraps a provider which implements PodNotifier with an in-memory cache of its pods, which serves
+// GetPod, GetPodStatus and GetPods.
+//
+// The cache is kept up to date by the pods the provider notifies, and by relisting all pods from the provider every
+// ResyncPeriod. Pods are evicted from the cache before and after they are created, updated or deleted through the
+// CachingProvider, so that they are read from the provider until they are notified or relisted. Pods missing from
+// the cache are read from the provider, as are pods which are older than MaxStaleness.
+//
+// The pods returned are deep copies, so they may be modified by the caller.
+//
+// Optional interfaces of the wrapped provider, such as PodNetworkPreparer or PodBatchCreator, are not exposed by
+// the CachingProvider.
+type CachingProvider struct {
+	provider PodLifecycleHandler
+	notifier PodNotifier
+	cfg      CachingProviderConfig
+	clock    clock.WithTicker
+
+	mu   sync.RWMutex
+	pods map[types.NamespacedName]*cachedPod
+	// rev is incremented on each change of the cache, so that relists and reads of pods from the provider do not
+	// overwrite the changes made while they were in flight. evicted holds the revision each pod was evicted at since
+	// the last relist, and listed the revision the last successful relist started at.
+	rev     uint64
+	evicted map[types.NamespacedName]uint64
+	listed  uint64
+	// synced is when the last successful relist started.
+	synced time.Time
+}
+
+type cachedPod struct {
+	pod     *corev1.Pod
+	rev     uint64
+	fetched time.Time
+}
+
+var (
+	_ PodLifecycleHandler = (*CachingProvider)(nil)
+	_ PodNotifier         = (*CachingProvider)(nil)
+)
+
+// NewCachingProvider creates a CachingProvider which wraps the provider. The provider must implement PodNotifier.
+//
+// The pods are relisted until the context passed to NotifyPods is done.
+func NewCachingProvider(p PodLifecycleHandler, cfg CachingProviderConfig) (*CachingProvider, error) {
+	n, ok := p.(PodNotifier)
+	if !ok {
+		return nil, errdefs.InvalidInput("caching provider requires a provider which implements PodNotifier")
+	}
+	return &CachingProvider{
+		provider: p,
+		notifier: n,
+		cfg:      cfg.withDefaults(),
+		clock:    clock.RealClock{},
+		pods:     make(map[types.NamespacedName]*cachedPod),
+		evicted:  make(map[types.NamespacedName]uint64),
+	}, nil
+}
+
+// NotifyPods registers the callback with the provider, and starts relisting the pods periodically. The pods the
+// provider notifies are stored in the cache before they are passed to the callback.
+func (p *CachingProvider) NotifyPods(ctx context.Context, f func(*corev1.Pod)) {
+	p.notifier.NotifyPods(ctx, func(pod *corev1.Pod) {
+		p.store(pod)
+		f(pod)
+	})
+	go p.run(ctx)
+}
+
+func (p *CachingProvider) run(ctx context.Context) {
+	ticker := p.clock.NewTicker(p.cfg.ResyncPeriod)
+	defer ticker.Stop()
+
+	for {
+		if _, err := p.relist(ctx); err != nil {
+			log.G(ctx).WithError(err).Warn("Error relisting pods from the provider")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+		}
+	}
+}
+
+// relist replaces the cached pods with the pods listed from the provider, except for the pods which were changed
+// while they were listed.
+func (p *CachingProvider) relist(ctx context.Context) ([]*corev1.Pod, error) {
+	ctx, span := trace.StartSpan(ctx, "CachingProvider.relist")
+	defer span.End()
+
+	p.mu.RLock()
+	startRev := p.rev
+	p.mu.RUnlock()
+	start := p.clock.Now()
+
+	pods, err := p.provider.GetPods(ctx)
+	if err != nil {
+		err = errors.Wrap(err, "error listing pods from the provider")
+		span.SetStatus(err)
+		return nil, err
+	}
+	ctx = span.WithField(ctx, "nPods", int64(len(pods)))
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rev++
+	next := make(map[types.NamespacedName]*cachedPod, len(pods))
+	for _, pod := range pods {
+		key := types.NamespacedName{Namespace: pod.Namespace, Name: pod.Name}
+		if rev, ok := p.evicted[key]; ok && rev > startRev {
+			continue
+		}
+		next[key] = &cachedPod{pod: pod.DeepCopy(), rev: p.rev, fetched: start}
+	}
+	for key, cached := range p.pods {
+		if cached.rev > startRev {
+			next[key] = cached
+		}
+	}
+	for key, rev := range p.evicted {
+		if rev <= startRev {
+			delete(p.evicted, key)
+		}
+	}
+	p.pods = next
+	p.synced = start
+	p.listed = startRev
+	log.G(ctx).Debug("Relisted pods from the provider")
+	return pods, nil
+}
+
+// store stores a copy of the pod in the cache.
+func (p *CachingProvider) store(pod *corev1.Pod) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.storeLocked(pod)
+}
+
+// storeIfUnchanged stores a copy of the pod read from the provider in the cache, unless the pod was changed in the
+// cache since startRev. The pod may have been read before the change, so it is dropped rather than replacing it.
+// The evictions since startRev may have been cleared by a relist which started later, so the pod is dropped then as
+// well.
+func (p *CachingProvider) storeIfUnchanged(pod *corev1.Pod, startRev uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key := types.NamespacedName{Namespace: pod.Namespace, Name: pod.Name}
+	if rev, ok := p.evicted[key]; ok && rev > startRev {
+		return
+	}
+	if cached, ok := p.pods[key]; ok && cached.rev > startRev {
+		return
+	}
+	if p.listed > startRev {
+		return
+	}
+	p.storeLocked(pod)
+}
+
+func (p *CachingProvider) storeLocked(pod *corev1.Pod) {
+	p.rev++
+	key := types.NamespacedName{Namespace: pod.Namespace, Name: pod.Name}
+	p.pods[key] = &cachedPod{pod: pod.DeepCopy(), rev: p.rev, fetched: p.clock.Now()}
+}
+
+// evict removes the pod from the cache.
+func (p *CachingProvider) evict(namespace, name string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rev++
+	key := types.NamespacedName{Namespace: namespace, Name: name}
+	delete(p.pods, key)
+	p.evicted[key] = p.rev
+}
+
+// get returns the cached pod, if it is not stale. The pod must not be modified.
+func (p *CachingProvider) get(namespace, name string) (*corev1.Pod, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	cached, ok := p.pods[types.NamespacedName{Namespace: namespace, Name: name}]
+	if !ok || p.clock.Since(cached.fetched) > p.cfg.MaxStaleness {
+		return nil, false
+	}
+	return cached.pod, true
+}
+
+// CreatePod creates the pod within the provider.
+func (p *CachingProvider) CreatePod(ctx context.Context, pod *corev1.Pod) error {
+	p.evict(pod.Namespace, pod.Name)
+	err := p.provider.CreatePod(ctx, pod)
+	p.evict(pod.Namespace, pod.Name)
+	return err
+}
+
+// UpdatePod updates the pod within the provider.
+func (p *CachingProvider) UpdatePod(ctx context.Context, pod *corev1.Pod) error {
+	p.evict(pod.Namespace, pod.Name)
+	err := p.provider.UpdatePod(ctx, pod)
+	p.evict(pod.Namespace, pod.Name)
+	return err
+}
+
+// DeletePod deletes the pod from the provider.
+func (p *CachingProvider) DeletePod(ctx context.Context, pod *corev1.Pod) error {
+	p.evict(pod.Namespace, pod.Name)
+	err := p.provider.DeletePod(ctx, pod)
+	p.evict(pod.Namespace, pod.Name)
+	return err
+}
+
+// GetPod returns the pod from the cache, or from the provider if it is not cached.
+func (p *CachingProvider) GetPod(ctx context.Context, namespace, name string) (*corev1.Pod, error) {
+	if pod, ok := p.get(namespace, name); ok {
+		return pod.DeepCopy(), nil
+	}
+
+	p.mu.RLock()
+	startRev := p.rev
+	p.mu.RUnlock()
+	pod, err := p.provider.GetPod(ctx, namespace, name)
+	if err != nil {
+		if errdefs.IsNotFound(err) {
+			p.evict(namespace, name)
+		}
+		return nil, err
+	}
+	if pod == nil {
+		return nil, nil
+	}
+	p.storeIfUnchanged(pod, startRev)
+	return pod.DeepCopy(), nil
+}
+
+// GetPodStatus returns the status of the pod from the cache, or from the provider if the pod is not cached.
+func (p *CachingProvider) GetPodStatus(ctx context.Context, namespace, name string) (*corev1.PodStatus, error) {
+	if pod, ok := p.get(namespace, name); ok {
+		return pod.Status.DeepCopy(), nil
+	}
+	return p.provider.GetPodStatus(ctx, namespace, name)
+}
+
+// GetPods returns all the pods from the cache, or relists them from the provider if the last successful relist is
+// older than MaxStaleness.
+func (p *CachingProvider) GetPods(ctx context.Context) ([]*corev1.Pod, error) {
+	p.mu.RLock()
+	stale := p.synced.IsZero() || p.clock.Since(p.synced) > p.cfg.MaxStaleness
+	p.mu.RUnlock()
+	if stale {
+		pods, err := p.relist(ctx)
+		if err != nil {
+			return nil, err
+		}
+		copies := make([]*corev1.Pod, 0, len(pods))
+		for _, pod := range pods {
+			copies = append(copies, pod.DeepCopy())
+		}
+		return copies, nil
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	pods := make([]*corev1.Pod, 0, len(p.pods))
+	for _, cached := range p.pods {
+		pods = append(pods, cached.pod.DeepCopy())
+	}
+	return pods, nil
+}
@@ -0,0 +1,289 @@
+package node
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	testclock "k8s.io/utils/clock/testing"
+)
+
+// countingProvider is a mockProviderAsync which counts the reads passed to it.
+type countingProvider struct {
+	*mockProviderAsync
+	getPod       atomic.Int32
+	getPodStatus atomic.Int32
+	getPods      atomic.Int32
+	// duringList is called while the pods are listed, and duringGet while a pod is read, if set.
+	duringList func()
+	duringGet  func()
+}
+
+func newCountingProvider() *countingProvider {
+	return &countingProvider{mockProviderAsync: newMockProvider()}
+}
+
+func (p *countingProvider) GetPod(ctx context.Context, namespace, name string) (*corev1.Pod, error) {
+	p.getPod.Add(1)
+	pod, err := p.mockProviderAsync.GetPod(ctx, namespace, name)
+	if p.duringGet != nil {
+		p.duringGet()
+	}
+	return pod, err
+}
+
+func (p *countingProvider) GetPodStatus(ctx context.Context, namespace, name string) (*corev1.PodStatus, error) {
+	p.getPodStatus.Add(1)
+	return p.mockProviderAsync.GetPodStatus(ctx, namespace, name)
+}
+
+func (p *countingProvider) GetPods(ctx context.Context) ([]*corev1.Pod, error) {
+	p.getPods.Add(1)
+	pods, err := p.mockProviderAsync.GetPods(ctx)
+	if p.duringList != nil {
+		p.duringList()
+	}
+	return pods, err
+}
+
+// setPod stores the pod in the provider without notifying it.
+func (p *countingProvider) setPod(pod *corev1.Pod) {
+	key, _ := buildKey(pod)
+	p.pods.Store(key, pod)
+}
+
+func newCachingTestPod(name string, phase corev1.PodPhase) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name},
+		Status:     corev1.PodStatus{Phase: phase},
+	}
+}
+
+func newTestCachingProvider(t *testing.T, p PodLifecycleHandler) (*CachingProvider, *testclock.FakeClock) {
+	t.Helper()
+	cp, err := NewCachingProvider(p, CachingProviderConfig{ResyncPeriod: time.Minute})
+	assert.NilError(t, err)
+	clock := testclock.NewFakeClock(time.Now())
+	cp.clock = clock
+	return cp, clock
+}
+
+func TestCachingProviderRequiresNotifier(t *testing.T) {
+	_, err := NewCachingProvider(newSyncMockProvider(), CachingProviderConfig{})
+	assert.Check(t, errdefs.IsInvalidInput(err))
+}
+
+func TestCachingProviderReads(t *testing.T) {
+	ctx := context.Background()
+	p := newCountingProvider()
+	p.setPod(newCachingTestPod("web", corev1.PodRunning))
+	cp, clock := newTestCachingProvider(t, p)
+
+	// The pods are listed from the provider until they are relisted.
+	pods, err := cp.GetPods(ctx)
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(pods, 1))
+	assert.Check(t, is.Equal(p.getPods.Load(), int32(1)))
+
+	p.setPod(newCachingTestPod("web", corev1.PodFailed))
+	pod, err := cp.GetPod(ctx, "default", "web")
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(pod.Status.Phase, corev1.PodRunning))
+	status, err := cp.GetPodStatus(ctx, "default", "web")
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(status.Phase, corev1.PodRunning))
+	pods, err = cp.GetPods(ctx)
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(pods, 1))
+	assert.Check(t, is.Equal(p.getPod.Load(), int32(0)))
+	assert.Check(t, is.Equal(p.getPodStatus.Load(), int32(0)))
+	assert.Check(t, is.Equal(p.getPods.Load(), int32(1)))
+
+	// The pods returned are copies.
+	pod.Status.Phase = corev1.PodUnknown
+	pods[0].Status.Phase = corev1.PodUnknown
+	pod, err = cp.GetPod(ctx, "default", "web")
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(pod.Status.Phase, corev1.PodRunning))
+
+	// Pods missing from the cache are read from the provider, and cached.
+	p.setPod(newCachingTestPod("db", corev1.PodPending))
+	_, err = cp.GetPod(ctx, "default", "db")
+	assert.NilError(t, err)
+	_, err = cp.GetPod(ctx, "default", "db")
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(p.getPod.Load(), int32(1)))
+	_, err = cp.GetPod(ctx, "default", "unknown")
+	assert.Check(t, errdefs.IsNotFound(err))
+
+	// Stale pods are read from the provider.
+	clock.Step(3 * time.Minute)
+	status, err = cp.GetPodStatus(ctx, "default", "web")
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(status.Phase, corev1.PodFailed))
+	assert.Check(t, is.Equal(p.getPodStatus.Load(), int32(1)))
+	_, err = cp.GetPods(ctx)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(p.getPods.Load(), int32(2)))
+	pod, err = cp.GetPod(ctx, "default", "web")
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(pod.Status.Phase, corev1.PodFailed))
+}
+
+func TestCachingProviderEviction(t *testing.T) {
+	ctx := context.Background()
+	p := newCountingProvider()
+	p.setPod(newCachingTestPod("web", corev1.PodRunning))
+	cp, _ := newTestCachingProvider(t, p)
+	_, err := cp.relist(ctx)
+	assert.NilError(t, err)
+
+	// No callback is registered, so the pod is read from the provider after it is updated.
+	updated := newCachingTestPod("web", corev1.PodSucceeded)
+	assert.NilError(t, cp.UpdatePod(ctx, updated))
+	pod, err := cp.GetPod(ctx, "default", "web")
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(pod.Status.Phase, corev1.PodSucceeded))
+	assert.Check(t, is.Equal(p.getPod.Load(), int32(1)))
+
+	assert.NilError(t, cp.DeletePod(ctx, pod))
+	_, err = cp.GetPod(ctx, "default", "web")
+	assert.Check(t, errdefs.IsNotFound(err))
+}
+
+func TestCachingProviderNotifications(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	p := newCountingProvider()
+	p.setPod(newCachingTestPod("web", corev1.PodPending))
+	cp, clock := newTestCachingProvider(t, p)
+
+	var mu sync.Mutex
+	var notified []*corev1.Pod
+	cp.NotifyPods(ctx, func(pod *corev1.Pod) {
+		mu.Lock()
+		defer mu.Unlock()
+		notified = append(notified, pod)
+	})
+	assert.Assert(t, waitFor(func() bool { return p.getPods.Load() == 1 && clock.HasWaiters() }))
+
+	// Pods which are notified are cached, and passed to the callback.
+	p.notifier(newCachingTestPod("web", corev1.PodRunning))
+	pod, err := cp.GetPod(ctx, "default", "web")
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(pod.Status.Phase, corev1.PodRunning))
+	assert.Check(t, is.Equal(p.getPod.Load(), int32(0)))
+	mu.Lock()
+	assert.Check(t, is.Len(notified, 1))
+	mu.Unlock()
+
+	// The pods are relisted every resync period.
+	p.setPod(newCachingTestPod("db", corev1.PodRunning))
+	clock.Step(time.Minute)
+	assert.Assert(t, waitFor(func() bool { return p.getPods.Load() == 2 }))
+	assert.Assert(t, waitFor(func() bool {
+		_, err := cp.GetPod(ctx, "default", "db")
+		return err == nil && p.getPod.Load() == 0
+	}))
+}
+
+func TestCachingProviderRelistRace(t *testing.T) {
+	ctx := context.Background()
+	p := newCountingProvider()
+	p.setPod(newCachingTestPod("web", corev1.PodPending))
+	p.setPod(newCachingTestPod("db", corev1.PodRunning))
+	cp, _ := newTestCachingProvider(t, p)
+
+	// The changes made to the cache while the pods are listed are kept.
+	p.duringList = func() {
+		cp.store(newCachingTestPod("web", corev1.PodRunning))
+		cp.evict("default", "db")
+	}
+	_, err := cp.relist(ctx)
+	assert.NilError(t, err)
+	p.duringList = nil
+
+	pod, err := cp.GetPod(ctx, "default", "web")
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(pod.Status.Phase, corev1.PodRunning))
+	cp.mu.RLock()
+	_, ok := cp.pods[newCachingTestKey("db")]
+	cp.mu.RUnlock()
+	assert.Check(t, !ok)
+
+	// The next relist caches the pods which were evicted again.
+	_, err = cp.relist(ctx)
+	assert.NilError(t, err)
+	cp.mu.RLock()
+	_, ok = cp.pods[newCachingTestKey("db")]
+	assert.Check(t, ok)
+	assert.Check(t, is.Len(cp.evicted, 0))
+	cp.mu.RUnlock()
+}
+
+func TestCachingProviderGetPodRace(t *testing.T) {
+	ctx := context.Background()
+	p := newCountingProvider()
+	p.setPod(newCachingTestPod("web", corev1.PodRunning))
+	cp, _ := newTestCachingProvider(t, p)
+
+	// getDuring reads the pod while the change is made to it, after the provider returned the pod.
+	getDuring := func(change func()) {
+		t.Helper()
+		started, release := make(chan struct{}), make(chan struct{})
+		p.duringGet = func() {
+			close(started)
+			<-release
+		}
+		done := make(chan error)
+		go func() {
+			_, err := cp.GetPod(ctx, "default", "web")
+			done <- err
+		}()
+		<-started
+		change()
+		close(release)
+		assert.NilError(t, <-done)
+		p.duringGet = nil
+	}
+
+	// The pod read before it was updated is not cached.
+	getDuring(func() {
+		assert.NilError(t, cp.UpdatePod(ctx, newCachingTestPod("web", corev1.PodSucceeded)))
+	})
+	pod, err := cp.GetPod(ctx, "default", "web")
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(pod.Status.Phase, corev1.PodSucceeded))
+	assert.Check(t, is.Equal(p.getPod.Load(), int32(2)))
+
+	// Nor is the pod read before it was deleted.
+	cp.evict("default", "web")
+	getDuring(func() {
+		assert.NilError(t, cp.DeletePod(ctx, pod))
+	})
+	_, err = cp.GetPod(ctx, "default", "web")
+	assert.Check(t, errdefs.IsNotFound(err))
+}
+
+func newCachingTestKey(name string) types.NamespacedName {
+	return types.NamespacedName{Namespace: "default", Name: name}
+}
+
+func waitFor(f func() bool) bool {
+	for range 500 {
+		if f() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
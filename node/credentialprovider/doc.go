@@ -0,0 +1,36 @@
+// Copyright © 2017 The virtual-kubelet authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+Package credentialprovider resolves the registry credentials to use to pull
+the images of a pod, following the same rules as the kubelet.
+
+Credentials come from the pod's image pull secrets, and optionally from
+kubelet credential provider exec plugins, so the plugins written for the
+kubelet (ECR, GCR, ACR, ...) can be reused as is.
+
+	plugins, err := credentialprovider.NewPluginProviderFromFile(configPath, binDir)
+	...
+	resolver := credentialprovider.NewResolver(credentialprovider.ResolverConfig{
+		Secrets: cfg.ResourceManager,
+		Plugins: plugins,
+	})
+
+	creds, err := resolver.Credentials(ctx, pod, container.Image)
+	...
+
+The credentials are returned in the order they should be tried, stopping at
+the first one the registry accepts.
+*/
+package credentialprovider
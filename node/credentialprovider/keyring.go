@@ -0,0 +1,349 @@
+// Copyright © 2017 The virtual-kubelet authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package credentialprovider
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	pkgerrors "github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const defaultRegistryHost = "index.docker.io"
+
+// AuthConfig contains the credentials to use to pull from a registry.
+type AuthConfig struct {
+	Username string
+	Password string
+	Auth     string
+	Email    string
+
+	// ServerAddress is the registry key these credentials were configured for.
+	ServerAddress string
+
+	// IdentityToken is used to authenticate the user and get
+	// an access token for the registry.
+	IdentityToken string
+	// RegistryToken is a bearer token to be sent to a registry.
+	RegistryToken string
+}
+
+// DockerConfig represents the config file used by the docker CLI.
+// This config represents the credentials that should be used when pulling images from specific image repositories.
+type DockerConfig map[string]DockerConfigEntry
+
+// DockerConfigEntry is an entry of a DockerConfig.
+type DockerConfigEntry struct {
+	Username string
+	Password string
+	Email    string
+}
+
+// DockerConfigJSON represents the content of a .dockerconfigjson secret.
+type DockerConfigJSON struct {
+	Auths DockerConfig `json:"auths"`
+}
+
+type dockerConfigEntryWithAuth struct {
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	Email    string `json:"email,omitempty"`
+	Auth     string `json:"auth,omitempty"`
+}
+
+// UnmarshalJSON implements json.Unmarshaler, decoding the base64 encoded auth field into the username and password.
+func (e *DockerConfigEntry) UnmarshalJSON(data []byte) error {
+	var tmp dockerConfigEntryWithAuth
+	if err := json.Unmarshal(data, &tmp); err != nil {
+		return err
+	}
+
+	e.Username = tmp.Username
+	e.Password = tmp.Password
+	e.Email = tmp.Email
+
+	if len(tmp.Auth) == 0 {
+		return nil
+	}
+	var err error
+	e.Username, e.Password, err = decodeDockerConfigFieldAuth(tmp.Auth)
+	return err
+}
+
+// MarshalJSON implements json.Marshaler, encoding the username and password into the auth field.
+func (e DockerConfigEntry) MarshalJSON() ([]byte, error) {
+	return json.Marshal(dockerConfigEntryWithAuth{
+		Username: e.Username,
+		Password: e.Password,
+		Email:    e.Email,
+		Auth:     base64.StdEncoding.EncodeToString([]byte(e.Username + ":" + e.Password)),
+	})
+}
+
+func decodeDockerConfigFieldAuth(field string) (username, password string, err error) {
+	var decoded []byte
+
+	// StdEncoding can only decode padded string
+	// RawStdEncoding can only decode unpadded string
+	if strings.HasSuffix(strings.TrimSpace(field), "=") {
+		decoded, err = base64.StdEncoding.DecodeString(field)
+	} else {
+		decoded, err = base64.RawStdEncoding.DecodeString(field)
+	}
+	if err != nil {
+		return "", "", pkgerrors.Wrap(err, "error decoding auth field")
+	}
+
+	user, pass, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return "", "", pkgerrors.New("error decoding auth field: expected username:password")
+	}
+	return user, strings.Trim(pass, "\x00"), nil
+}
+
+// DockerConfigFromSecret reads the registry credentials of a kubernetes.io/dockerconfigjson or kubernetes.io/dockercfg
+// secret.
+func DockerConfigFromSecret(secret *corev1.Secret) (DockerConfig, error) {
+	switch secret.Type {
+	case corev1.SecretTypeDockerConfigJson:
+		var cfg DockerConfigJSON
+		if err := json.Unmarshal(secret.Data[corev1.DockerConfigJsonKey], &cfg); err != nil {
+			return nil, pkgerrors.Wrapf(err, "error parsing %s of secret %s/%s", corev1.DockerConfigJsonKey, secret.Namespace, secret.Name)
+		}
+		return cfg.Auths, nil
+	case corev1.SecretTypeDockercfg:
+		var cfg DockerConfig
+		if err := json.Unmarshal(secret.Data[corev1.DockerConfigKey], &cfg); err != nil {
+			return nil, pkgerrors.Wrapf(err, "error parsing %s of secret %s/%s", corev1.DockerConfigKey, secret.Namespace, secret.Name)
+		}
+		return cfg, nil
+	}
+	return nil, pkgerrors.Errorf("secret %s/%s is of type %q, which does not hold registry credentials", secret.Namespace, secret.Name, secret.Type)
+}
+
+// Keyring holds registry credentials and looks up which of them apply to an image.
+// The zero value is an empty keyring, ready to use.
+// Based on BasicDockerKeyring in pkg/credentialprovider/keyring.go.
+type Keyring struct {
+	index []string
+	creds map[string][]AuthConfig
+}
+
+// Add adds the credentials of the docker config to the keyring.
+func (k *Keyring) Add(cfg DockerConfig) {
+	if k.creds == nil {
+		k.creds = make(map[string][]AuthConfig)
+	}
+
+	for loc, ident := range cfg {
+		creds := AuthConfig{
+			Username: ident.Username,
+			Password: ident.Password,
+			Email:    ident.Email,
+		}
+
+		value := loc
+		if !strings.HasPrefix(value, "https://") && !strings.HasPrefix(value, "http://") {
+			value = "https://" + value
+		}
+		parsed, err := url.Parse(value)
+		if err != nil {
+			continue
+		}
+
+		// The docker client allows exact matches:
+		//    foo.bar.com/namespace
+		// Or hostname matches:
+		//    foo.bar.com
+		// It also considers /v2/  and /v1/ equivalent to the hostname
+		// See ResolveAuthConfig in docker/registry/auth.go.
+		effectivePath := parsed.Path
+		if strings.HasPrefix(effectivePath, "/v2/") || strings.HasPrefix(effectivePath, "/v1/") {
+			effectivePath = effectivePath[3:]
+		}
+		var key string
+		if (len(effectivePath) > 0) && (effectivePath != "/") {
+			key = parsed.Host + effectivePath
+		} else {
+			key = parsed.Host
+		}
+		creds.ServerAddress = key
+
+		if _, ok := k.creds[key]; !ok {
+			k.index = append(k.index, key)
+		}
+		k.creds[key] = append(k.creds[key], creds)
+	}
+
+	// The index is reverse-sorted so more specific paths are matched first. For example, if for the given image
+	// "quay.io/coreos/etcd", credentials for "quay.io/coreos" should match before "quay.io".
+	sort.Sort(sort.Reverse(sort.StringSlice(k.index)))
+}
+
+// Lookup returns the credentials which apply to the image, most specific first.
+// The image may include a tag or digest.
+func (k *Keyring) Lookup(image string) ([]AuthConfig, bool) {
+	repo := ParseImageRepository(image)
+
+	var ret []AuthConfig
+	for _, key := range k.index {
+		if matched, _ := URLsMatchStr(key, repo); matched {
+			ret = append(ret, k.creds[key]...)
+		}
+	}
+	if len(ret) > 0 {
+		return ret, true
+	}
+
+	// Use credentials for the default registry if provided, and appropriate
+	if isDefaultRegistryMatch(repo) {
+		if auth, ok := k.creds[defaultRegistryHost]; ok {
+			return auth, true
+		}
+	}
+	return nil, false
+}
+
+// ParseImageRepository returns the repository of an image reference, without its tag or digest, and with the
+// registry and library namespace docker defaults to made explicit.
+// For example, "nginx:1.25" becomes "docker.io/library/nginx".
+func ParseImageRepository(image string) string {
+	if i := strings.Index(image, "@"); i >= 0 {
+		image = image[:i]
+	}
+	if i := strings.LastIndex(image, ":"); i >= 0 && !strings.Contains(image[i:], "/") {
+		image = image[:i]
+	}
+
+	domain, remainder, ok := strings.Cut(image, "/")
+	if !ok || (!strings.ContainsAny(domain, ".:") && domain != "localhost" && strings.ToLower(domain) == domain) {
+		domain, remainder = "docker.io", image
+	}
+	if domain == defaultRegistryHost {
+		domain = "docker.io"
+	}
+	if domain == "docker.io" && !strings.Contains(remainder, "/") {
+		remainder = "library/" + remainder
+	}
+	return domain + "/" + remainder
+}
+
+// isDefaultRegistryMatch determines whether the given image will
+// pull from the default registry (DockerHub) based on the
+// characteristics of its name.
+func isDefaultRegistryMatch(image string) bool {
+	parts := strings.SplitN(image, "/", 2)
+
+	if len(parts[0]) == 0 {
+		return false
+	}
+
+	if len(parts) == 1 {
+		// e.g. library/ubuntu
+		return true
+	}
+
+	if parts[0] == "docker.io" || parts[0] == defaultRegistryHost {
+		// resolve docker.io/image and index.docker.io/image as default registry
+		return true
+	}
+
+	// From: http://github.com/docker/docker/blob/master/registry/config.go
+	// Docker looks for either a "." or ":" in the first component of the name
+	// to determine if it's a hostname. If neither are present, the image is
+	// assumed to be on the default registry.
+	return !strings.ContainsAny(parts[0], ".:")
+}
+
+// ParseSchemelessURL parses a schemeless url and returns a url.URL
+// url.Parse require a scheme, but ours don't have schemes.  Adding a
+// scheme to make url.Parse happy, then clear out the resulting scheme.
+func ParseSchemelessURL(schemelessURL string) (*url.URL, error) {
+	parsed, err := url.Parse("https://" + schemelessURL)
+	if err != nil {
+		return nil, err
+	}
+	// clear out the resulting scheme
+	parsed.Scheme = ""
+	return parsed, nil
+}
+
+// SplitURL splits the host name into parts, as well as the port
+func SplitURL(url *url.URL) (parts []string, port string) {
+	host, port, err := net.SplitHostPort(url.Host)
+	if err != nil {
+		// could not parse port
+		host, port = url.Host, ""
+	}
+	return strings.Split(host, "."), port
+}
+
+// URLsMatchStr is wrapper for URLsMatch, operating on strings instead of URLs.
+func URLsMatchStr(glob string, target string) (bool, error) {
+	globURL, err := ParseSchemelessURL(glob)
+	if err != nil {
+		return false, err
+	}
+	targetURL, err := ParseSchemelessURL(target)
+	if err != nil {
+		return false, err
+	}
+	return URLsMatch(globURL, targetURL)
+}
+
+// URLsMatch checks whether the given target url matches the glob url, which may have
+// glob wild cards in the host name.
+//
+// Examples:
+//
+//	globURL=*.docker.io, targetURL=blah.docker.io => match
+//	globURL=*.docker.io, targetURL=not.right.io   => no match
+//
+// Note that we don't support wildcards in ports and paths yet.
+func URLsMatch(globURL *url.URL, targetURL *url.URL) (bool, error) {
+	globURLParts, globPort := SplitURL(globURL)
+	targetURLParts, targetPort := SplitURL(targetURL)
+	if globPort != targetPort {
+		// port doesn't match
+		return false, nil
+	}
+	if len(globURLParts) != len(targetURLParts) {
+		// host name does not have the same number of parts
+		return false, nil
+	}
+	if !strings.HasPrefix(targetURL.Path, globURL.Path) {
+		// the path of the credential must be a prefix
+		return false, nil
+	}
+	for k, globURLPart := range globURLParts {
+		targetURLPart := targetURLParts[k]
+		matched, err := filepath.Match(globURLPart, targetURLPart)
+		if err != nil {
+			return false, err
+		}
+		if !matched {
+			// glob mismatch for some part
+			return false, nil
+		}
+	}
+	// everything matches
+	return true, nil
+}
@@ -0,0 +1,81 @@
+package credentialprovider
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestParseImageRepository(t *testing.T) {
+	for image, expected := range map[string]string{
+		"nginx":                                "docker.io/library/nginx",
+		"nginx:1.25":                           "docker.io/library/nginx",
+		"library/nginx@sha256:abcd":            "docker.io/library/nginx",
+		"index.docker.io/foo/bar:latest":       "docker.io/foo/bar",
+		"quay.io/coreos/etcd:v3":               "quay.io/coreos/etcd",
+		"localhost/foo":                        "localhost/foo",
+		"localhost:5000/foo:tag":               "localhost:5000/foo",
+		"registry.example.com:5000/a/b/c@sha1": "registry.example.com:5000/a/b/c",
+	} {
+		assert.Check(t, is.Equal(ParseImageRepository(image), expected), image)
+	}
+}
+
+func TestKeyringLookup(t *testing.T) {
+	var k Keyring
+	k.Add(DockerConfig{
+		"https://index.docker.io/v1/": {Username: "hub"},
+		"quay.io":                     {Username: "quay"},
+		"quay.io/coreos":              {Username: "coreos"},
+		"*.example.com":               {Username: "wildcard"},
+		"registry.example.com:5000":   {Username: "port"},
+	})
+
+	for image, expected := range map[string][]string{
+		"nginx":                           {"hub"},
+		"someone/app:1.0":                 {"hub"},
+		"quay.io/coreos/etcd":             {"coreos", "quay"},
+		"quay.io/other/app":               {"quay"},
+		"registry.example.com/app":        {"wildcard"},
+		"registry.example.com:5000/app":   {"port"},
+		"a.b.example.com/app":             nil,
+		"gcr.io/project/app":              nil,
+		"registry.example.com:5001/other": nil,
+	} {
+		creds, ok := k.Lookup(image)
+		assert.Check(t, is.Equal(ok, len(expected) > 0), image)
+		var users []string
+		for _, c := range creds {
+			users = append(users, c.Username)
+		}
+		assert.Check(t, is.DeepEqual(users, expected), image)
+	}
+}
+
+func TestDockerConfigFromSecret(t *testing.T) {
+	auth := base64.StdEncoding.EncodeToString([]byte("user:pass"))
+
+	cfg, err := DockerConfigFromSecret(&corev1.Secret{
+		Type: corev1.SecretTypeDockerConfigJson,
+		Data: map[string][]byte{
+			corev1.DockerConfigJsonKey: []byte(`{"auths":{"quay.io":{"auth":"` + auth + `"}}}`),
+		},
+	})
+	assert.NilError(t, err)
+	assert.Check(t, is.DeepEqual(cfg, DockerConfig{"quay.io": {Username: "user", Password: "pass"}}))
+
+	cfg, err = DockerConfigFromSecret(&corev1.Secret{
+		Type: corev1.SecretTypeDockercfg,
+		Data: map[string][]byte{
+			corev1.DockerConfigKey: []byte(`{"quay.io":{"username":"user","password":"pass","email":"a@b.c"}}`),
+		},
+	})
+	assert.NilError(t, err)
+	assert.Check(t, is.DeepEqual(cfg, DockerConfig{"quay.io": {Username: "user", Password: "pass", Email: "a@b.c"}}))
+
+	_, err = DockerConfigFromSecret(&corev1.Secret{Type: corev1.SecretTypeOpaque})
+	assert.Check(t, is.ErrorContains(err, "does not hold registry credentials"))
+}
@@ -0,0 +1,331 @@
+// Copyright © 2017 The virtual-kubelet authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package credentialprovider
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	pkgerrors "github.com/pkg/errors"
+	"github.com/virtual-kubelet/virtual-kubelet/log"
+	"github.com/virtual-kubelet/virtual-kubelet/trace"
+	"golang.org/x/sync/singleflight"
+	kubeletconfigv1 "k8s.io/kubelet/config/v1"
+	credentialproviderv1 "k8s.io/kubelet/pkg/apis/credentialprovider/v1"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	globalCacheKey = "global"
+
+	// DefaultPluginTimeout is the time a plugin is given to respond before it is killed.
+	DefaultPluginTimeout = time.Minute
+)
+
+var (
+	supportedConfigAPIVersions = map[string]bool{
+		"kubelet.config.k8s.io/v1":       true,
+		"kubelet.config.k8s.io/v1beta1":  true,
+		"kubelet.config.k8s.io/v1alpha1": true,
+	}
+	supportedPluginAPIVersions = map[string]bool{
+		"credentialprovider.kubelet.k8s.io/v1":       true,
+		"credentialprovider.kubelet.k8s.io/v1beta1":  true,
+		"credentialprovider.kubelet.k8s.io/v1alpha1": true,
+	}
+)
+
+// PluginProvider provides registry credentials by running kubelet credential provider exec plugins.
+// See https://kubernetes.io/docs/tasks/administer-cluster/kubelet-credential-provider/.
+type PluginProvider struct {
+	plugins []*execPlugin
+}
+
+// ReadPluginConfig reads a kubelet CredentialProviderConfig file, in either YAML or JSON.
+func ReadPluginConfig(configPath string) (*kubeletconfigv1.CredentialProviderConfig, error) {
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, pkgerrors.Wrap(err, "error reading credential provider config")
+	}
+
+	var cfg kubeletconfigv1.CredentialProviderConfig
+	if err := yaml.UnmarshalStrict(data, &cfg); err != nil {
+		return nil, pkgerrors.Wrapf(err, "error parsing credential provider config %s", configPath)
+	}
+	if cfg.Kind != "CredentialProviderConfig" || !supportedConfigAPIVersions[cfg.APIVersion] {
+		return nil, pkgerrors.Errorf("unsupported credential provider config kind %q with apiVersion %q", cfg.Kind, cfg.APIVersion)
+	}
+	return &cfg, nil
+}
+
+// NewPluginProviderFromFile creates a PluginProvider from the config file at configPath.
+// The plugin executables are looked up in binDir.
+func NewPluginProviderFromFile(configPath, binDir string) (*PluginProvider, error) {
+	cfg, err := ReadPluginConfig(configPath)
+	if err != nil {
+		return nil, err
+	}
+	return NewPluginProvider(cfg, binDir)
+}
+
+// NewPluginProvider creates a PluginProvider running the plugins of the passed in config.
+// The plugin executables are looked up in binDir.
+func NewPluginProvider(cfg *kubeletconfigv1.CredentialProviderConfig, binDir string) (*PluginProvider, error) {
+	p := &PluginProvider{}
+	seen := make(map[string]bool)
+	for _, provider := range cfg.Providers {
+		if err := validatePluginProvider(provider); err != nil {
+			return nil, err
+		}
+		if seen[provider.Name] {
+			return nil, pkgerrors.Errorf("duplicate credential provider %q", provider.Name)
+		}
+		seen[provider.Name] = true
+
+		path := filepath.Join(binDir, provider.Name)
+		if _, err := os.Stat(path); err != nil {
+			return nil, pkgerrors.Wrapf(err, "error finding executable for credential provider %q", provider.Name)
+		}
+
+		env := make([]string, 0, len(provider.Env))
+		for _, e := range provider.Env {
+			env = append(env, e.Name+"="+e.Value)
+		}
+
+		p.plugins = append(p.plugins, &execPlugin{
+			name:                 provider.Name,
+			path:                 path,
+			args:                 provider.Args,
+			env:                  env,
+			apiVersion:           provider.APIVersion,
+			matchImages:          provider.MatchImages,
+			defaultCacheDuration: provider.DefaultCacheDuration.Duration,
+			timeout:              DefaultPluginTimeout,
+			cache:                make(map[string]cacheEntry),
+		})
+	}
+	return p, nil
+}
+
+func validatePluginProvider(provider kubeletconfigv1.CredentialProvider) error {
+	if provider.Name == "" {
+		return pkgerrors.New("credential provider name is required")
+	}
+	if strings.ContainsAny(provider.Name, `/\`) || provider.Name == "." || provider.Name == ".." {
+		return pkgerrors.Errorf("credential provider name %q must not be a path", provider.Name)
+	}
+	if len(provider.MatchImages) == 0 {
+		return pkgerrors.Errorf("credential provider %q must set at least one matchImages entry", provider.Name)
+	}
+	for _, matchImage := range provider.MatchImages {
+		if _, err := ParseSchemelessURL(matchImage); err != nil {
+			return pkgerrors.Wrapf(err, "invalid matchImages entry %q of credential provider %q", matchImage, provider.Name)
+		}
+	}
+	if provider.DefaultCacheDuration == nil || provider.DefaultCacheDuration.Duration < 0 {
+		return pkgerrors.Errorf("credential provider %q must set a non-negative defaultCacheDuration", provider.Name)
+	}
+	if !supportedPluginAPIVersions[provider.APIVersion] {
+		return pkgerrors.Errorf("credential provider %q uses unsupported apiVersion %q", provider.Name, provider.APIVersion)
+	}
+	if provider.TokenAttributes != nil {
+		return pkgerrors.Errorf("credential provider %q sets tokenAttributes, service account tokens are not supported", provider.Name)
+	}
+	return nil
+}
+
+// Provide returns the credentials the plugins matching the image return for it.
+// When several plugins return credentials for the same registry key, those of the plugin listed first are kept.
+// Plugins which fail are logged and skipped.
+func (p *PluginProvider) Provide(ctx context.Context, image string) DockerConfig {
+	ctx, span := trace.StartSpan(ctx, "credentialprovider.Provide")
+	defer span.End()
+
+	repo := ParseImageRepository(image)
+	ret := DockerConfig{}
+	for _, plugin := range p.plugins {
+		if !plugin.isImageAllowed(repo) {
+			continue
+		}
+		cfg, err := plugin.provide(ctx, repo)
+		if err != nil {
+			log.G(ctx).WithError(err).WithField("plugin", plugin.name).Warn("Failed to get credentials from credential provider plugin")
+			continue
+		}
+		for registry, entry := range cfg {
+			if _, ok := ret[registry]; !ok {
+				ret[registry] = entry
+			}
+		}
+	}
+	return ret
+}
+
+type cacheEntry struct {
+	credentials DockerConfig
+	expiresAt   time.Time
+}
+
+// execPlugin runs a single credential provider plugin and caches its responses.
+// Based on pluginProvider in pkg/credentialprovider/plugin/plugin.go.
+type execPlugin struct {
+	name                 string
+	path                 string
+	args                 []string
+	env                  []string
+	apiVersion           string
+	matchImages          []string
+	defaultCacheDuration time.Duration
+	timeout              time.Duration
+
+	group singleflight.Group
+
+	mu    sync.Mutex
+	cache map[string]cacheEntry
+}
+
+// isImageAllowed returns true if the image matches against the list of allowed matches by the plugin.
+func (e *execPlugin) isImageAllowed(image string) bool {
+	for _, matchImage := range e.matchImages {
+		if matched, _ := URLsMatchStr(matchImage, image); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *execPlugin) provide(ctx context.Context, image string) (DockerConfig, error) {
+	if cfg, ok := e.getCached(image); ok {
+		return cfg, nil
+	}
+
+	// Concurrent pulls of the same image only run the plugin once.
+	res, err, _ := e.group.Do(image, func() (any, error) {
+		return e.exec(ctx, image)
+	})
+	if err != nil {
+		return nil, err
+	}
+	resp := res.(*credentialproviderv1.CredentialProviderResponse)
+
+	cfg := DockerConfig{}
+	for registry, auth := range resp.Auth {
+		cfg[registry] = DockerConfigEntry{
+			Username: auth.Username,
+			Password: auth.Password,
+		}
+	}
+
+	cacheDuration := e.defaultCacheDuration
+	if resp.CacheDuration != nil {
+		cacheDuration = resp.CacheDuration.Duration
+	}
+	if cacheDuration > 0 {
+		var key string
+		switch resp.CacheKeyType {
+		case credentialproviderv1.ImagePluginCacheKeyType:
+			key = image
+		case credentialproviderv1.RegistryPluginCacheKeyType:
+			key = registryFromImage(image)
+		case credentialproviderv1.GlobalPluginCacheKeyType:
+			key = globalCacheKey
+		}
+		e.mu.Lock()
+		e.cache[key] = cacheEntry{credentials: cfg, expiresAt: time.Now().Add(cacheDuration)}
+		e.mu.Unlock()
+	}
+
+	return cfg, nil
+}
+
+// getCached looks up cached credentials for the image, by image, registry, then globally.
+func (e *execPlugin) getCached(image string) (DockerConfig, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	now := time.Now()
+	for _, key := range []string{image, registryFromImage(image), globalCacheKey} {
+		entry, ok := e.cache[key]
+		if !ok {
+			continue
+		}
+		if now.After(entry.expiresAt) {
+			delete(e.cache, key)
+			continue
+		}
+		return entry.credentials, true
+	}
+	return nil, false
+}
+
+// exec runs the plugin, passing the request on stdin and reading the response from stdout.
+func (e *execPlugin) exec(ctx context.Context, image string) (*credentialproviderv1.CredentialProviderResponse, error) {
+	ctx, span := trace.StartSpan(ctx, "credentialprovider.exec")
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, e.timeout)
+	defer cancel()
+
+	req := credentialproviderv1.CredentialProviderRequest{Image: image}
+	req.APIVersion = e.apiVersion
+	req.Kind = "CredentialProviderRequest"
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, e.path, e.args...) //nolint:gosec // The plugin comes from the node configuration.
+	cmd.Env = append(os.Environ(), e.env...)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		err = pkgerrors.Wrapf(err, "error running credential provider plugin %q: %s", e.name, strings.TrimSpace(stderr.String()))
+		span.SetStatus(err)
+		return nil, err
+	}
+
+	var resp credentialproviderv1.CredentialProviderResponse
+	if err := json.Unmarshal(stdout.Bytes(), &resp); err != nil {
+		return nil, pkgerrors.Wrapf(err, "error decoding response of credential provider plugin %q", e.name)
+	}
+	if resp.Kind != "CredentialProviderResponse" || resp.APIVersion != e.apiVersion {
+		return nil, pkgerrors.Errorf("credential provider plugin %q responded with kind %q and apiVersion %q, expected CredentialProviderResponse with apiVersion %q", e.name, resp.Kind, resp.APIVersion, e.apiVersion)
+	}
+	switch resp.CacheKeyType {
+	case credentialproviderv1.ImagePluginCacheKeyType, credentialproviderv1.RegistryPluginCacheKeyType, credentialproviderv1.GlobalPluginCacheKeyType:
+	default:
+		return nil, pkgerrors.Errorf("credential provider plugin %q responded with invalid cacheKeyType %q", e.name, resp.CacheKeyType)
+	}
+	return &resp, nil
+}
+
+// registryFromImage returns the registry host, and port if any, of the image.
+func registryFromImage(image string) string {
+	parsed, err := ParseSchemelessURL(image)
+	if err != nil {
+		return image
+	}
+	return parsed.Host
+}
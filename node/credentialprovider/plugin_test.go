@@ -0,0 +1,95 @@
+package credentialprovider
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+// stubPluginScript is a credential provider plugin which returns the requested image as the password, and records
+// each request it gets in the file named by $CALLS.
+const stubPluginScript = `#!/bin/sh
+read -r request
+echo "$request" >> "$CALLS"
+image=$(echo "$request" | sed -e 's/.*"image":"\([^"]*\)".*/\1/')
+cat <<EOF
+{"apiVersion":"credentialprovider.kubelet.k8s.io/v1","kind":"CredentialProviderResponse","cacheKeyType":"Registry","auth":{"*.registry.io":{"username":"$1","password":"$image"}}}
+EOF
+`
+
+// newStubPluginProvider installs the stub plugin and returns a provider running it, as well as the path of the file
+// its requests are recorded in.
+func newStubPluginProvider(t *testing.T) (*PluginProvider, string) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("the stub plugin is a shell script")
+	}
+
+	binDir := t.TempDir()
+	assert.NilError(t, os.WriteFile(filepath.Join(binDir, "stub"), []byte(stubPluginScript), 0700)) //nolint:gosec
+
+	configDir := t.TempDir()
+	calls := filepath.Join(configDir, "calls")
+	configPath := filepath.Join(configDir, "config.yaml")
+	assert.NilError(t, os.WriteFile(configPath, []byte(`apiVersion: kubelet.config.k8s.io/v1
+kind: CredentialProviderConfig
+providers:
+  - name: stub
+    apiVersion: credentialprovider.kubelet.k8s.io/v1
+    matchImages:
+      - "*.registry.io"
+    defaultCacheDuration: 1h
+    args:
+      - stub-user
+    env:
+      - name: CALLS
+        value: `+calls+`
+`), 0600))
+
+	p, err := NewPluginProviderFromFile(configPath, binDir)
+	assert.NilError(t, err)
+	return p, calls
+}
+
+func TestPluginProviderProvide(t *testing.T) {
+	p, calls := newStubPluginProvider(t)
+	ctx := context.Background()
+
+	cfg := p.Provide(ctx, "my.registry.io/app:1.0")
+	assert.Check(t, is.DeepEqual(cfg, DockerConfig{"*.registry.io": {Username: "stub-user", Password: "my.registry.io/app"}}))
+
+	// The response is cached per registry.
+	cfg = p.Provide(ctx, "my.registry.io/other")
+	assert.Check(t, is.DeepEqual(cfg, DockerConfig{"*.registry.io": {Username: "stub-user", Password: "my.registry.io/app"}}))
+
+	// Images the plugin does not match do not run it.
+	cfg = p.Provide(ctx, "quay.io/app")
+	assert.Check(t, is.Len(cfg, 0))
+
+	data, err := os.ReadFile(calls)
+	assert.NilError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	assert.Check(t, is.Len(lines, 1))
+	assert.Check(t, is.Contains(lines[0], `"kind":"CredentialProviderRequest"`))
+}
+
+func TestPluginProviderInvalidConfig(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	assert.NilError(t, os.WriteFile(configPath, []byte(`apiVersion: kubelet.config.k8s.io/v1
+kind: CredentialProviderConfig
+providers:
+  - name: stub
+    apiVersion: credentialprovider.kubelet.k8s.io/v1
+    matchImages:
+      - "*.registry.io"
+`), 0600))
+
+	_, err := NewPluginProviderFromFile(configPath, t.TempDir())
+	assert.Check(t, is.ErrorContains(err, "defaultCacheDuration"))
+}
@@ -0,0 +1,124 @@
+// Copyright © 2017 The virtual-kubelet authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package credentialprovider
+
+import (
+	"context"
+
+	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
+	"github.com/virtual-kubelet/virtual-kubelet/log"
+	"github.com/virtual-kubelet/virtual-kubelet/trace"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	corev1listers "k8s.io/client-go/listers/core/v1"
+)
+
+// SecretGetter gets secrets by name.
+// It is implemented by the resource manager passed to providers.
+type SecretGetter interface {
+	GetSecret(name, namespace string) (*corev1.Secret, error)
+}
+
+// ResolverConfig is used to configure a Resolver.
+type ResolverConfig struct {
+	// Secrets is used to get the pull secrets of pods.
+	// It is optional, but pull secrets are ignored without it.
+	Secrets SecretGetter
+	// ServiceAccounts is used to get the pull secrets of the service account of pods.
+	// It is optional, as the service account admission plugin normally copies those to the pod already.
+	ServiceAccounts corev1listers.ServiceAccountLister
+	// Plugins provides credentials from kubelet credential provider plugins.
+	// It is optional.
+	Plugins *PluginProvider
+}
+
+// Resolver resolves the registry credentials to use to pull the images of a pod.
+type Resolver struct {
+	cfg ResolverConfig
+}
+
+// NewResolver creates a Resolver from the passed in config.
+func NewResolver(cfg ResolverConfig) *Resolver {
+	return &Resolver{cfg: cfg}
+}
+
+// Credentials returns the credentials to try, in order, when pulling the image for the pod.
+// Credentials from the pod's pull secrets come first, most specific first, followed by those of the plugins.
+// An empty list means the image should be pulled anonymously.
+func (r *Resolver) Credentials(ctx context.Context, pod *corev1.Pod, image string) ([]AuthConfig, error) {
+	ctx, span := trace.StartSpan(ctx, "credentialprovider.Credentials")
+	defer span.End()
+
+	var keyring Keyring
+	var names []string
+	if r.cfg.Secrets != nil {
+		names = r.pullSecretNames(ctx, pod)
+	}
+	for _, name := range names {
+		secret, err := r.cfg.Secrets.GetSecret(name, pod.Namespace)
+		if err != nil {
+			if !apierrors.IsNotFound(err) && !errdefs.IsNotFound(err) {
+				span.SetStatus(err)
+				return nil, err
+			}
+			// Like the kubelet, try to pull without the missing secret.
+			log.G(ctx).WithField("secret", name).Warn("Unable to retrieve pull secret, the image pull may not succeed")
+			continue
+		}
+		if secret.Type != corev1.SecretTypeDockerConfigJson && secret.Type != corev1.SecretTypeDockercfg {
+			continue
+		}
+		cfg, err := DockerConfigFromSecret(secret)
+		if err != nil {
+			span.SetStatus(err)
+			return nil, err
+		}
+		keyring.Add(cfg)
+	}
+	creds, _ := keyring.Lookup(image)
+
+	if r.cfg.Plugins != nil {
+		var pluginKeyring Keyring
+		pluginKeyring.Add(r.cfg.Plugins.Provide(ctx, image))
+		pluginCreds, _ := pluginKeyring.Lookup(image)
+		creds = append(creds, pluginCreds...)
+	}
+	return creds, nil
+}
+
+// pullSecretNames returns the names of the pull secrets of the pod and its service account, without duplicates.
+func (r *Resolver) pullSecretNames(ctx context.Context, pod *corev1.Pod) []string {
+	seen := make(map[string]bool)
+	var names []string
+	add := func(refs []corev1.LocalObjectReference) {
+		for _, ref := range refs {
+			if ref.Name != "" && !seen[ref.Name] {
+				seen[ref.Name] = true
+				names = append(names, ref.Name)
+			}
+		}
+	}
+
+	add(pod.Spec.ImagePullSecrets)
+	if r.cfg.ServiceAccounts != nil && pod.Spec.ServiceAccountName != "" {
+		sa, err := r.cfg.ServiceAccounts.ServiceAccounts(pod.Namespace).Get(pod.Spec.ServiceAccountName)
+		if err != nil {
+			log.G(ctx).WithError(err).WithField("serviceAccount", pod.Spec.ServiceAccountName).Warn("Unable to retrieve service account, ignoring its pull secrets")
+		} else {
+			add(sa.ImagePullSecrets)
+		}
+	}
+	return names
+}
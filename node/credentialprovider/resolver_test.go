@@ -0,0 +1,65 @@
+package credentialprovider
+
+import (
+	"context"
+	"testing"
+
+	testutil "github.com/virtual-kubelet/virtual-kubelet/internal/test/util"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestResolverCredentials(t *testing.T) {
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "pull"},
+		Type:       corev1.SecretTypeDockerConfigJson,
+		Data: map[string][]byte{
+			corev1.DockerConfigJsonKey: []byte(`{"auths":{"my.registry.io":{"username":"secret-user","password":"secret-pass"}}}`),
+		},
+	}
+	opaque := testutil.FakeSecret("ns", "opaque", map[string]string{"foo": "bar"})
+
+	plugins, _ := newStubPluginProvider(t)
+	r := NewResolver(ResolverConfig{
+		Secrets: testutil.FakeResourceManager(secret, opaque),
+		Plugins: plugins,
+	})
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "pod"},
+		Spec: corev1.PodSpec{
+			ImagePullSecrets: []corev1.LocalObjectReference{{Name: "missing"}, {Name: "opaque"}, {Name: "pull"}},
+		},
+	}
+
+	creds, err := r.Credentials(context.Background(), pod, "my.registry.io/app:1.0")
+	assert.NilError(t, err)
+	assert.Assert(t, is.Len(creds, 2))
+	assert.Check(t, is.Equal(creds[0].Username, "secret-user"))
+	assert.Check(t, is.Equal(creds[0].ServerAddress, "my.registry.io"))
+	assert.Check(t, is.Equal(creds[1].Username, "stub-user"))
+
+	creds, err = r.Credentials(context.Background(), pod, "nginx")
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(creds, 0))
+}
+
+func TestResolverCredentialsWithoutSecrets(t *testing.T) {
+	plugins, _ := newStubPluginProvider(t)
+	r := NewResolver(ResolverConfig{Plugins: plugins})
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "pod"},
+		Spec: corev1.PodSpec{
+			ImagePullSecrets: []corev1.LocalObjectReference{{Name: "pull"}},
+		},
+	}
+
+	// The pull secrets are ignored, rather than failing the lookup.
+	creds, err := r.Credentials(context.Background(), pod, "my.registry.io/app:1.0")
+	assert.NilError(t, err)
+	assert.Assert(t, is.Len(creds, 1))
+	assert.Check(t, is.Equal(creds[0].Username, "stub-user"))
+}
@@ -0,0 +1,452 @@
+// Copyright © 2017 The virtual-kubelet authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	pkgerrors "github.com/pkg/errors"
+	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// PodDevicesAnnotation is the annotation on the pod passed to the provider which holds the devices allocated to it,
+// encoded as JSON PodDevices. Use GetPodDevices to read it.
+const PodDevicesAnnotation = "virtual-kubelet.io/allocated-devices"
+
+// Device is a single allocatable unit of an extended resource, like an accelerator or a software license seat.
+type Device struct {
+	// ID uniquely identifies the device within its resource.
+	ID string
+	// Healthy devices count towards the node's allocatable resources, and only healthy devices are allocated to pods.
+	Healthy bool
+}
+
+// ContainerDevices maps extended resource names to the IDs of the devices allocated to a container.
+type ContainerDevices map[corev1.ResourceName][]string
+
+// PodDevices maps container names to the devices allocated to them.
+type PodDevices map[string]ContainerDevices
+
+// GetPodDevices returns the devices allocated to a pod passed to the provider, or nil if none were.
+func GetPodDevices(pod *corev1.Pod) (PodDevices, error) {
+	v, ok := pod.Annotations[PodDevicesAnnotation]
+	if !ok {
+		return nil, nil
+	}
+	var devices PodDevices
+	if err := json.Unmarshal([]byte(v), &devices); err != nil {
+		return nil, pkgerrors.Wrapf(err, "error decoding %s annotation", PodDevicesAnnotation)
+	}
+	return devices, nil
+}
+
+// podDeviceAllocation is the checkpointed allocation of a pod.
+type podDeviceAllocation struct {
+	Namespace string     `json:"namespace"`
+	Name      string     `json:"name"`
+	Devices   PodDevices `json:"devices"`
+}
+
+// deviceCheckpoint is the format of the checkpoint file.
+type deviceCheckpoint struct {
+	Pods map[types.UID]*podDeviceAllocation `json:"pods"`
+}
+
+// ExtendedResourceManager keeps track of the extended resources of the node, and of which devices are allocated to
+// which pods.
+//
+// This follows the semantics of the kubelet device manager, without requiring device plugins: the provider
+// registers the devices of each resource and keeps their health up to date with SetDevices, the node controller
+// publishes their capacity and allocatable, and the pod controller allocates devices to each container which requests
+// the resource before the pod is created in the provider. Allocations are checkpointed to disk so that they survive
+// restarts, and released once the pod is deleted or has terminated.
+type ExtendedResourceManager struct {
+	checkpointPath string
+
+	mu          sync.Mutex
+	resources   map[corev1.ResourceName][]Device
+	removed     map[corev1.ResourceName]struct{}
+	allocations map[types.UID]*podDeviceAllocation
+
+	// chUpdate is signalled when the capacity or allocatable of a resource changes.
+	chUpdate chan struct{}
+}
+
+// NewExtendedResourceManager creates a new extended resource manager.
+//
+// Allocations are checkpointed to checkpointPath, and restored from it if it exists. If checkpointPath is empty,
+// allocations are only kept in memory.
+func NewExtendedResourceManager(checkpointPath string) (*ExtendedResourceManager, error) {
+	m := &ExtendedResourceManager{
+		checkpointPath: checkpointPath,
+		resources:      make(map[corev1.ResourceName][]Device),
+		removed:        make(map[corev1.ResourceName]struct{}),
+		allocations:    make(map[types.UID]*podDeviceAllocation),
+		chUpdate:       make(chan struct{}, 1),
+	}
+	if checkpointPath == "" {
+		return m, nil
+	}
+
+	data, err := os.ReadFile(checkpointPath)
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, pkgerrors.Wrap(err, "error reading device checkpoint")
+	}
+	var checkpoint deviceCheckpoint
+	if err := json.Unmarshal(data, &checkpoint); err != nil {
+		return nil, pkgerrors.Wrapf(err, "error decoding device checkpoint %s", checkpointPath)
+	}
+	if checkpoint.Pods != nil {
+		m.allocations = checkpoint.Pods
+	}
+	return m, nil
+}
+
+// isExtendedResourceName checks if the name is one of an extended resource, which is a fully qualified name outside
+// of the kubernetes.io domain.
+func isExtendedResourceName(name corev1.ResourceName) bool {
+	s := string(name)
+	if !strings.Contains(s, "/") || strings.Contains(s, corev1.ResourceDefaultNamespacePrefix) || strings.HasPrefix(s, corev1.DefaultResourceRequestsPrefix) {
+		return false
+	}
+	return len(validation.IsQualifiedName(s)) == 0
+}
+
+// SetDevices registers an extended resource, or replaces the devices of one which was registered before.
+//
+// Devices which are allocated to pods stay allocated, even if they are no longer healthy or registered.
+func (m *ExtendedResourceManager) SetDevices(name corev1.ResourceName, devices []Device) error {
+	if !isExtendedResourceName(name) {
+		return errdefs.InvalidInputf("%q is not a valid extended resource name", name)
+	}
+	seen := make(map[string]struct{}, len(devices))
+	for _, d := range devices {
+		if d.ID == "" {
+			return errdefs.InvalidInputf("device of resource %q has no ID", name)
+		}
+		if _, ok := seen[d.ID]; ok {
+			return errdefs.InvalidInputf("duplicate device %q of resource %q", d.ID, name)
+		}
+		seen[d.ID] = struct{}{}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	old, ok := m.resources[name]
+	m.resources[name] = slices.Clone(devices)
+	delete(m.removed, name)
+	if !ok || countHealthy(old) != countHealthy(devices) || len(old) != len(devices) {
+		m.notify()
+	}
+	return nil
+}
+
+// RemoveResource stops advertising an extended resource on the node.
+// Devices of the resource which are allocated to pods stay allocated until the pods are deleted.
+func (m *ExtendedResourceManager) RemoveResource(name corev1.ResourceName) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.resources[name]; !ok {
+		return
+	}
+	delete(m.resources, name)
+	m.removed[name] = struct{}{}
+	m.notify()
+}
+
+func (m *ExtendedResourceManager) notify() {
+	select {
+	case m.chUpdate <- struct{}{}:
+	default:
+	}
+}
+
+func countHealthy(devices []Device) int {
+	var n int
+	for _, d := range devices {
+		if d.Healthy {
+			n++
+		}
+	}
+	return n
+}
+
+// setNodeResources sets the capacity and allocatable of the registered resources on the node status.
+// The capacity is the number of devices, and allocatable the number of healthy ones.
+func (m *ExtendedResourceManager) setNodeResources(status *corev1.NodeStatus) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if status.Capacity == nil {
+		status.Capacity = make(corev1.ResourceList)
+	}
+	if status.Allocatable == nil {
+		status.Allocatable = make(corev1.ResourceList)
+	}
+	for name := range m.removed {
+		delete(status.Capacity, name)
+		delete(status.Allocatable, name)
+	}
+	for name, devices := range m.resources {
+		status.Capacity[name] = *resource.NewQuantity(int64(len(devices)), resource.DecimalSI)
+		status.Allocatable[name] = *resource.NewQuantity(int64(countHealthy(devices)), resource.DecimalSI)
+	}
+}
+
+// requestedDevices returns how many devices of each registered resource the container requests.
+// Extended resources cannot be overcommitted, so their requests, if set, are equal to their limits.
+func (m *ExtendedResourceManager) requestedDevices(c *corev1.Container) map[corev1.ResourceName]int {
+	requested := make(map[corev1.ResourceName]int)
+	for name := range m.resources {
+		q, ok := c.Resources.Limits[name]
+		if !ok {
+			q, ok = c.Resources.Requests[name]
+		}
+		if ok && q.Value() > 0 {
+			requested[name] = int(q.Value())
+		}
+	}
+	return requested
+}
+
+// allocate allocates devices to each container of the pod which requests a registered extended resource.
+// Allocating devices to a pod which already has an allocation returns the existing one.
+//
+// Based on the allocation of devices to init containers in pkg/kubelet/cm/devicemanager: init containers run one
+// after the other, so the devices of earlier init containers are reused by later ones, and then by the app
+// containers.
+func (m *ExtendedResourceManager) allocate(pod *corev1.Pod) (PodDevices, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if alloc, ok := m.allocations[pod.UID]; ok {
+		return alloc.Devices, nil
+	}
+
+	free := m.freeDevices()
+	devices := make(PodDevices)
+	reusable := make(map[corev1.ResourceName][]string)
+
+	take := func(c *corev1.Container, init bool) error {
+		for name, n := range m.requestedDevices(c) {
+			var ids []string
+			// Prefer the devices of init containers, so that the pod holds as few devices as possible.
+			k := min(n, len(reusable[name]))
+			ids = append(ids, reusable[name][:k]...)
+			if !init {
+				reusable[name] = reusable[name][k:]
+			}
+			if missing := n - len(ids); missing > 0 {
+				if len(free[name]) < missing {
+					return &insufficientDevicesError{resourceName: name, container: c.Name, requested: n, available: len(ids) + len(free[name])}
+				}
+				ids = append(ids, free[name][:missing]...)
+				free[name] = free[name][missing:]
+				if init {
+					reusable[name] = append(reusable[name], ids[k:]...)
+				}
+			}
+			if devices[c.Name] == nil {
+				devices[c.Name] = make(ContainerDevices)
+			}
+			devices[c.Name][name] = ids
+		}
+		return nil
+	}
+
+	for i := range pod.Spec.InitContainers {
+		if err := take(&pod.Spec.InitContainers[i], true); err != nil {
+			return nil, err
+		}
+	}
+	for i := range pod.Spec.Containers {
+		if err := take(&pod.Spec.Containers[i], false); err != nil {
+			return nil, err
+		}
+	}
+	if len(devices) == 0 {
+		return nil, nil
+	}
+
+	m.allocations[pod.UID] = &podDeviceAllocation{Namespace: pod.Namespace, Name: pod.Name, Devices: devices}
+	if err := m.writeCheckpoint(); err != nil {
+		delete(m.allocations, pod.UID)
+		return nil, err
+	}
+	return devices, nil
+}
+
+// allocated returns the devices allocated to the pod with the given UID, or nil if none were.
+func (m *ExtendedResourceManager) allocated(uid types.UID) PodDevices {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if alloc, ok := m.allocations[uid]; ok {
+		return alloc.Devices
+	}
+	return nil
+}
+
+// insufficientDevicesError is returned when there are not enough free devices to allocate to a container.
+type insufficientDevicesError struct {
+	resourceName corev1.ResourceName
+	container    string
+	requested    int
+	available    int
+}
+
+func (e *insufficientDevicesError) Error() string {
+	return fmt.Sprintf("insufficient %s for container %q: requested %d, available %d", e.resourceName, e.container, e.requested, e.available)
+}
+
+// freeDevices returns the sorted IDs of the healthy devices of each resource which are not allocated to any pod.
+// The caller must hold the lock.
+func (m *ExtendedResourceManager) freeDevices() map[corev1.ResourceName][]string {
+	used := make(map[corev1.ResourceName]map[string]struct{})
+	for _, alloc := range m.allocations {
+		for _, cd := range alloc.Devices {
+			for name, ids := range cd {
+				if used[name] == nil {
+					used[name] = make(map[string]struct{})
+				}
+				for _, id := range ids {
+					used[name][id] = struct{}{}
+				}
+			}
+		}
+	}
+
+	free := make(map[corev1.ResourceName][]string, len(m.resources))
+	for name, devices := range m.resources {
+		for _, d := range devices {
+			if _, ok := used[name][d.ID]; d.Healthy && !ok {
+				free[name] = append(free[name], d.ID)
+			}
+		}
+		slices.Sort(free[name])
+	}
+	return free
+}
+
+// release releases the devices allocated to the pod with the given UID.
+func (m *ExtendedResourceManager) release(uid types.UID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.allocations[uid]; !ok {
+		return nil
+	}
+	delete(m.allocations, uid)
+	return m.writeCheckpoint()
+}
+
+// releaseNamed releases the devices allocated to any pod with the given namespace and name.
+// This is used when the pod is gone from Kubernetes, and its UID is no longer known.
+func (m *ExtendedResourceManager) releaseNamed(namespace, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var changed bool
+	for uid, alloc := range m.allocations {
+		if alloc.Namespace == namespace && alloc.Name == name {
+			delete(m.allocations, uid)
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return m.writeCheckpoint()
+}
+
+// retainPods releases the devices allocated to pods for which keep returns false.
+// This is used on startup to release the devices of pods which were deleted while we were not running.
+func (m *ExtendedResourceManager) retainPods(keep func(uid types.UID) bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var changed bool
+	for uid := range m.allocations {
+		if !keep(uid) {
+			delete(m.allocations, uid)
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return m.writeCheckpoint()
+}
+
+// writeCheckpoint atomically replaces the checkpoint file with the current allocations.
+// The caller must hold the lock.
+func (m *ExtendedResourceManager) writeCheckpoint() error {
+	if m.checkpointPath == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(deviceCheckpoint{Pods: m.allocations})
+	if err != nil {
+		return pkgerrors.Wrap(err, "error encoding device checkpoint")
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(m.checkpointPath), "."+filepath.Base(m.checkpointPath))
+	if err != nil {
+		return pkgerrors.Wrap(err, "error creating device checkpoint")
+	}
+	defer os.Remove(f.Name()) //nolint:errcheck
+
+	if _, err := f.Write(data); err != nil {
+		f.Close() //nolint:errcheck
+		return pkgerrors.Wrap(err, "error writing device checkpoint")
+	}
+	if err := f.Sync(); err != nil {
+		f.Close() //nolint:errcheck
+		return pkgerrors.Wrap(err, "error writing device checkpoint")
+	}
+	if err := f.Close(); err != nil {
+		return pkgerrors.Wrap(err, "error writing device checkpoint")
+	}
+	return pkgerrors.Wrap(os.Rename(f.Name(), m.checkpointPath), "error replacing device checkpoint")
+}
+
+// WithNodeExtendedResources publishes the capacity and allocatable of the extended resources registered with the
+// manager on the node, and updates the node status whenever they change.
+//
+// The same manager should be passed to the pod controller, so that devices are allocated to pods.
+func WithNodeExtendedResources(m *ExtendedResourceManager) NodeControllerOpt {
+	return func(n *NodeController) error {
+		if m == nil {
+			return pkgerrors.New("extended resource manager is nil")
+		}
+		n.extendedResources = m
+		return nil
+	}
+}
@@ -0,0 +1,262 @@
+package node
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/virtual-kubelet/virtual-kubelet/internal/podutils"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	testclient "k8s.io/client-go/kubernetes/fake"
+)
+
+const testGPU corev1.ResourceName = "example.com/gpu"
+
+func gpuContainer(name string, n int64) corev1.Container {
+	return corev1.Container{
+		Name: name,
+		Resources: corev1.ResourceRequirements{
+			Limits: corev1.ResourceList{testGPU: *resource.NewQuantity(n, resource.DecimalSI)},
+		},
+	}
+}
+
+func gpuPod(uid, name string, containers ...corev1.Container) *corev1.Pod {
+	pod := &corev1.Pod{}
+	pod.UID = types.UID(uid)
+	pod.Namespace = "default"
+	pod.Name = name
+	pod.Spec.Containers = containers
+	return pod
+}
+
+func gpus(ids ...string) []Device {
+	devices := make([]Device, 0, len(ids))
+	for _, id := range ids {
+		devices = append(devices, Device{ID: id, Healthy: true})
+	}
+	return devices
+}
+
+func TestExtendedResourceManagerSetDevices(t *testing.T) {
+	m, err := NewExtendedResourceManager("")
+	assert.NilError(t, err)
+
+	assert.Check(t, is.ErrorContains(m.SetDevices("cpu", gpus("a")), "not a valid extended resource name"))
+	assert.Check(t, is.ErrorContains(m.SetDevices("kubernetes.io/gpu", gpus("a")), "not a valid extended resource name"))
+	assert.Check(t, is.ErrorContains(m.SetDevices(testGPU, gpus("a", "a")), "duplicate device"))
+
+	devices := gpus("gpu-0", "gpu-1", "gpu-2")
+	devices[2].Healthy = false
+	assert.NilError(t, m.SetDevices(testGPU, devices))
+	assert.NilError(t, m.SetDevices("example.com/seat", gpus("seat-0")))
+
+	status := corev1.NodeStatus{Capacity: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("2")}}
+	m.setNodeResources(&status)
+	assert.Check(t, is.Equal(status.Capacity.Name(testGPU, resource.DecimalSI).Value(), int64(3)))
+	assert.Check(t, is.Equal(status.Allocatable.Name(testGPU, resource.DecimalSI).Value(), int64(2)))
+	assert.Check(t, is.Equal(status.Capacity.Cpu().Value(), int64(2)))
+
+	m.RemoveResource("example.com/seat")
+	m.setNodeResources(&status)
+	_, ok := status.Capacity["example.com/seat"]
+	assert.Check(t, !ok)
+	_, ok = status.Allocatable["example.com/seat"]
+	assert.Check(t, !ok)
+}
+
+func TestExtendedResourceManagerAllocate(t *testing.T) {
+	m, err := NewExtendedResourceManager("")
+	assert.NilError(t, err)
+	devices := gpus("gpu-0", "gpu-1", "gpu-2", "gpu-3")
+	devices[0].Healthy = false
+	assert.NilError(t, m.SetDevices(testGPU, devices))
+
+	// Devices of the init container are reused by the app containers.
+	pod := gpuPod("uid-1", "pod-1", gpuContainer("app", 1), gpuContainer("sidecar", 1), corev1.Container{Name: "none"})
+	pod.Spec.InitContainers = []corev1.Container{gpuContainer("init", 2)}
+	allocated, err := m.allocate(pod)
+	assert.NilError(t, err)
+	assert.Check(t, is.DeepEqual(allocated, PodDevices{
+		"init":    {testGPU: {"gpu-1", "gpu-2"}},
+		"app":     {testGPU: {"gpu-1"}},
+		"sidecar": {testGPU: {"gpu-2"}},
+	}))
+
+	// Allocating again returns the existing allocation.
+	again, err := m.allocate(pod)
+	assert.NilError(t, err)
+	assert.Check(t, is.DeepEqual(again, allocated))
+
+	// Unhealthy and allocated devices are not handed out.
+	_, err = m.allocate(gpuPod("uid-2", "pod-2", gpuContainer("app", 2)))
+	assert.Check(t, is.ErrorContains(err, "insufficient example.com/gpu"))
+	allocated, err = m.allocate(gpuPod("uid-2", "pod-2", gpuContainer("app", 1)))
+	assert.NilError(t, err)
+	assert.Check(t, is.DeepEqual(allocated, PodDevices{"app": {testGPU: {"gpu-3"}}}))
+
+	// Pods which do not request extended resources get no allocation.
+	allocated, err = m.allocate(gpuPod("uid-3", "pod-3", corev1.Container{Name: "app"}))
+	assert.NilError(t, err)
+	assert.Check(t, is.Nil(allocated))
+
+	assert.NilError(t, m.release("uid-1"))
+	assert.NilError(t, m.releaseNamed("default", "pod-2"))
+	allocated, err = m.allocate(gpuPod("uid-4", "pod-4", gpuContainer("app", 3)))
+	assert.NilError(t, err)
+	assert.Check(t, is.DeepEqual(allocated, PodDevices{"app": {testGPU: {"gpu-1", "gpu-2", "gpu-3"}}}))
+}
+
+func TestExtendedResourceManagerCheckpoint(t *testing.T) {
+	checkpoint := filepath.Join(t.TempDir(), "checkpoint")
+	m, err := NewExtendedResourceManager(checkpoint)
+	assert.NilError(t, err)
+	assert.NilError(t, m.SetDevices(testGPU, gpus("gpu-0", "gpu-1")))
+
+	_, err = m.allocate(gpuPod("uid-1", "pod-1", gpuContainer("app", 1)))
+	assert.NilError(t, err)
+	_, err = m.allocate(gpuPod("uid-2", "pod-2", gpuContainer("app", 1)))
+	assert.NilError(t, err)
+
+	// The allocations survive a restart.
+	m, err = NewExtendedResourceManager(checkpoint)
+	assert.NilError(t, err)
+	assert.NilError(t, m.SetDevices(testGPU, gpus("gpu-0", "gpu-1")))
+	_, err = m.allocate(gpuPod("uid-3", "pod-3", gpuContainer("app", 1)))
+	assert.Check(t, is.ErrorContains(err, "insufficient example.com/gpu"))
+
+	// Pods which are gone release their devices.
+	assert.NilError(t, m.retainPods(func(uid types.UID) bool { return uid == "uid-2" }))
+	m, err = NewExtendedResourceManager(checkpoint)
+	assert.NilError(t, err)
+	assert.NilError(t, m.SetDevices(testGPU, gpus("gpu-0", "gpu-1")))
+	allocated, err := m.allocate(gpuPod("uid-3", "pod-3", gpuContainer("app", 1)))
+	assert.NilError(t, err)
+	assert.Check(t, is.DeepEqual(allocated, PodDevices{"app": {testGPU: {"gpu-0"}}}))
+}
+
+func TestPodCreateNewPodWithDevices(t *testing.T) {
+	svr := newTestController()
+	m, err := NewExtendedResourceManager("")
+	assert.NilError(t, err)
+	assert.NilError(t, m.SetDevices(testGPU, gpus("gpu-0")))
+	svr.extendedResources = m
+
+	pod := gpuPod("uid-1", "nginx", gpuContainer("app", 1))
+	pod.Spec.Containers[0].Image = "nginx"
+	assert.NilError(t, svr.createOrUpdatePod(context.Background(), pod.DeepCopy()))
+	assert.Check(t, is.Equal(svr.mock.creates.read(), 1))
+
+	key, err := buildKey(pod)
+	assert.NilError(t, err)
+	createdPod, ok := svr.mock.pods.Load(key)
+	assert.Assert(t, ok)
+	devices, err := GetPodDevices(createdPod.(*corev1.Pod))
+	assert.NilError(t, err)
+	assert.Check(t, is.DeepEqual(devices, PodDevices{"app": {testGPU: {"gpu-0"}}}))
+
+	// Syncing the pod again does not update it in the provider.
+	assert.NilError(t, svr.createOrUpdatePod(context.Background(), pod.DeepCopy()))
+	assert.Check(t, is.Equal(svr.mock.updates.read(), 0))
+
+	// Other pods are rejected while there are no devices left.
+	ctx := context.Background()
+	other := gpuPod("uid-2", "other", gpuContainer("app", 1))
+	_, err = svr.client.CoreV1().Pods(other.Namespace).Create(ctx, other, metav1.CreateOptions{})
+	assert.NilError(t, err)
+	assert.NilError(t, svr.createOrUpdatePod(ctx, other.DeepCopy()))
+	assert.Check(t, is.Equal(svr.mock.creates.read(), 1))
+	rejected, err := svr.client.CoreV1().Pods(other.Namespace).Get(ctx, other.Name, metav1.GetOptions{})
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(rejected.Status.Phase, corev1.PodFailed))
+	assert.Check(t, is.Equal(rejected.Status.Reason, "UnexpectedAdmissionError"))
+	assert.Check(t, is.Contains(rejected.Status.Message, "insufficient example.com/gpu"))
+
+	assert.NilError(t, svr.deletePod(ctx, pod.DeepCopy()))
+	assert.NilError(t, svr.createOrUpdatePod(ctx, other.DeepCopy()))
+	assert.Check(t, is.Equal(svr.mock.creates.read(), 2))
+}
+
+func TestPodDevicesAllocatedAfterAdmission(t *testing.T) {
+	svr := newTestController()
+	m, err := NewExtendedResourceManager("")
+	assert.NilError(t, err)
+	assert.NilError(t, m.SetDevices(testGPU, gpus("gpu-0")))
+	svr.extendedResources = m
+	a, err := NewResourceAccounting(NodeAllocatableConfig{})
+	assert.NilError(t, err)
+	a.setNodeAllocatable(&corev1.NodeStatus{Capacity: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("1")}})
+	svr.resourceAccounting = a
+
+	// Pods which are not admitted do not hold devices.
+	ctx := context.Background()
+	pod := gpuPod("uid-1", "nginx", gpuContainer("app", 1))
+	pod.Spec.Containers[0].Resources.Requests = corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("2")}
+	_, err = svr.client.CoreV1().Pods(pod.Namespace).Create(ctx, pod, metav1.CreateOptions{})
+	assert.NilError(t, err)
+	assert.NilError(t, svr.createOrUpdatePod(ctx, pod.DeepCopy()))
+	assert.Check(t, is.Equal(svr.mock.creates.read(), 0))
+	assert.Check(t, is.Nil(m.allocated(pod.UID)))
+
+	// Pods which already run in the provider are not allocated devices they were not created with.
+	existing := gpuPod("uid-2", "existing", gpuContainer("app", 1))
+	fromProvider := existing.DeepCopy()
+	assert.NilError(t, podutils.PopulateEnvironmentVariables(ctx, fromProvider, svr.resourceManager, svr.recorder, nil))
+	key, err := buildKey(existing)
+	assert.NilError(t, err)
+	svr.mock.pods.Store(key, fromProvider)
+	assert.NilError(t, svr.createOrUpdatePod(ctx, existing.DeepCopy()))
+	assert.Check(t, is.Equal(svr.mock.updates.read(), 0))
+	assert.Check(t, is.Nil(m.allocated(existing.UID)))
+}
+
+func TestNodeExtendedResources(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	c := testclient.NewClientset()
+	nodes := c.CoreV1().Nodes()
+
+	m, err := NewExtendedResourceManager("")
+	assert.NilError(t, err)
+	assert.NilError(t, m.SetDevices(testGPU, gpus("gpu-0", "gpu-1")))
+
+	testNode := testNode(t)
+	testNodeCopy := testNode.DeepCopy()
+	testP := &testNodeProvider{NodeProvider: &NaiveNodeProvider{}}
+	node, err := NewNodeController(testP, testNode, nodes, WithNodePingInterval(10*time.Millisecond), WithNodeExtendedResources(m))
+	assert.NilError(t, err)
+
+	defer func() {
+		cancel()
+		<-node.Done()
+		assert.NilError(t, node.Err())
+	}()
+
+	nw := makeWatch(ctx, t, nodes, testNodeCopy.Name)
+	defer nw.Stop()
+	nr := nw.ResultChan()
+
+	go node.Run(ctx) //nolint:errcheck
+
+	hasGPUs := func(capacity, allocatable int64) func(watch.Event) bool {
+		return func(e watch.Event) bool {
+			n := e.Object.(*corev1.Node)
+			return n.Status.Capacity.Name(testGPU, resource.DecimalSI).Value() == capacity &&
+				n.Status.Allocatable.Name(testGPU, resource.DecimalSI).Value() == allocatable
+		}
+	}
+	assert.NilError(t, <-waitForEvent(ctx, nr, hasGPUs(2, 2)))
+
+	devices := gpus("gpu-0", "gpu-1")
+	devices[1].Healthy = false
+	assert.NilError(t, m.SetDevices(testGPU, devices))
+	assert.NilError(t, <-waitForEvent(ctx, nr, hasGPUs(2, 1)))
+}
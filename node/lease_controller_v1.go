@@ -120,6 +120,12 @@ func (c *leaseController) sync(ctx context.Context) {
 		log.G(ctx).WithError(pingResult.error).Error("Ping result is not clean, not updating lease")
 		return
 	}
+	if hc := c.nodeController.healthCheckController; hc != nil {
+		if err := hc.criticalError(); err != nil {
+			log.G(ctx).WithError(err).Error("Critical health check is failing, not updating lease")
+			return
+		}
+	}
 
 	node, err := c.nodeController.getServerNode(ctx)
 	if err != nil {
@@ -41,6 +41,7 @@ const (
 	// the three-way patch
 	virtualKubeletLastNodeAppliedNodeStatus = "virtual-kubelet.io/last-applied-node-status"
 	virtualKubeletLastNodeAppliedObjectMeta = "virtual-kubelet.io/last-applied-object-meta"
+	virtualKubeletLastNodeAppliedNodeSpec   = "virtual-kubelet.io/last-applied-node-spec"
 )
 
 var (
@@ -70,6 +71,21 @@ type NodeProvider interface { //nolint:revive
 	NotifyNodeStatus(ctx context.Context, cb func(*corev1.Node))
 }
 
+// NodeSpecNotifier is an optional interface that a NodeProvider can implement to manage parts of the node's spec
+// after the node has been registered.
+//
+// The node controller owns the taints, unschedulable flag, pod CIDRs and provider ID the provider sets, and patches
+// them in Kubernetes at startup and any time the provider notifies it of a change. Taints set by others, such as the
+// node lifecycle controller, are left alone.
+type NodeSpecNotifier interface {
+	// NotifyNodeSpec is used to asynchronously monitor the node's spec.
+	// The passed in callback should be called any time there is a change to the
+	// spec fields owned by the provider.
+	//
+	// NotifyNodeSpec should not block callers.
+	NotifyNodeSpec(ctx context.Context, cb func(*corev1.Node))
+}
+
 // NewNodeController creates a new node controller.
 // This does not have any side-effects on the system or kubernetes.
 //
@@ -100,6 +116,13 @@ func NewNodeController(p NodeProvider, node *corev1.Node, nodes v1.NodeInterface
 	}
 
 	n.nodePingController = newNodePingController(n.p, n.pingInterval, n.pingTimeout)
+	if len(n.healthChecks) > 0 {
+		n.healthCheckController = newHealthCheckController(n.healthChecks)
+	}
+	if n.resourceAccounting != nil {
+		// Pods may be admitted before the node is registered, so start out with the capacity it is created with.
+		n.resourceAccounting.setNodeAllocatable(n.serverNode.Status.DeepCopy())
+	}
 
 	return n, nil
 }
@@ -221,6 +244,7 @@ type NodeController struct { //nolint:revive
 	pingInterval   time.Duration
 	statusInterval time.Duration
 	chStatusUpdate chan *corev1.Node
+	chSpecUpdate   chan *corev1.Node
 
 	nodeStatusUpdateErrorHandler ErrorHandler
 
@@ -234,6 +258,12 @@ type NodeController struct { //nolint:revive
 	nodePingController *nodePingController
 	pingTimeout        *time.Duration
 
+	healthChecks          []HealthCheck
+	healthCheckController *healthCheckController
+
+	extendedResources  *ExtendedResourceManager
+	resourceAccounting *ResourceAccounting
+
 	group wait.Group
 }
 
@@ -268,7 +298,18 @@ func (n *NodeController) Run(ctx context.Context) (retErr error) {
 		n.chStatusUpdate <- node
 	})
 
+	specNotifier, manageSpec := n.p.(NodeSpecNotifier)
+	if manageSpec {
+		n.chSpecUpdate = make(chan *corev1.Node, 1)
+		specNotifier.NotifyNodeSpec(ctx, func(node *corev1.Node) {
+			n.chSpecUpdate <- node
+		})
+	}
+
 	n.group.StartWithContext(ctx, n.nodePingController.Run)
+	if n.healthCheckController != nil {
+		n.group.StartWithContext(ctx, n.healthCheckController.Run)
+	}
 
 	n.serverNodeLock.Lock()
 	providerNode := n.serverNode.DeepCopy()
@@ -278,6 +319,13 @@ func (n *NodeController) Run(ctx context.Context) (retErr error) {
 		return err
 	}
 
+	if manageSpec {
+		// The node may have been registered before, with a different spec.
+		if err := n.updateSpec(ctx, providerNode); err != nil {
+			return err
+		}
+	}
+
 	if n.leaseController != nil {
 		log.G(ctx).WithField("leaseController", n.leaseController).Debug("Starting leasecontroller")
 		n.group.StartWithContext(ctx, n.leaseController.Run)
@@ -317,7 +365,7 @@ func (n *NodeController) ensureNode(ctx context.Context, providerNode *corev1.No
 	n.serverNodeLock.Lock()
 	serverNode := n.serverNode
 	n.serverNodeLock.Unlock()
-	node, err := n.nodes.Create(ctx, serverNode, metav1.CreateOptions{})
+	node, err := n.nodes.Create(ctx, n.withNodeResources(serverNode), metav1.CreateOptions{})
 	if err != nil {
 		return pkgerrors.Wrap(err, "error registering node with kubernetes")
 	}
@@ -355,6 +403,15 @@ func (n *NodeController) controlLoop(ctx context.Context, providerNode *corev1.N
 		sleepInterval = n.statusInterval
 	}
 
+	var chHealthUpdate <-chan struct{}
+	if n.healthCheckController != nil {
+		chHealthUpdate = n.healthCheckController.chUpdate
+	}
+	var chExtendedResourcesUpdate <-chan struct{}
+	if n.extendedResources != nil {
+		chExtendedResourcesUpdate = n.extendedResources.chUpdate
+	}
+
 	loop := func() bool {
 		ctx, span := trace.StartSpan(ctx, "node.controlLoop.loop")
 		defer span.End()
@@ -373,6 +430,25 @@ func (n *NodeController) controlLoop(ctx context.Context, providerNode *corev1.N
 			providerNode.Status = updated.Status
 			providerNode.Annotations = updated.Annotations
 			providerNode.Labels = updated.Labels
+			if err := n.updateStatus(ctx, providerNode, false); err != nil {
+				log.G(ctx).WithError(err).Error("Error handling node status update")
+			}
+		case updated := <-n.chSpecUpdate:
+			log.G(ctx).Debug("Received node spec update")
+
+			setOwnedNodeSpec(&providerNode.Spec, &updated.Spec)
+			if err := n.updateSpec(ctx, providerNode); err != nil {
+				log.G(ctx).WithError(err).Error("Error handling node spec update")
+			}
+		case <-chHealthUpdate:
+			log.G(ctx).Debug("Received node health check update")
+
+			if err := n.updateStatus(ctx, providerNode, false); err != nil {
+				log.G(ctx).WithError(err).Error("Error handling node status update")
+			}
+		case <-chExtendedResourcesUpdate:
+			log.G(ctx).Debug("Received extended resources update")
+
 			if err := n.updateStatus(ctx, providerNode, false); err != nil {
 				log.G(ctx).WithError(err).Error("Error handling node status update")
 			}
@@ -406,7 +482,14 @@ func (n *NodeController) updateStatus(ctx context.Context, providerNode *corev1.
 		return fmt.Errorf("not updating node status because node ping failed: %w", result.error)
 	}
 
+	if n.healthCheckController != nil {
+		// The conditions are set on a copy, so that the Ready condition of the provider is used again once critical
+		// checks pass.
+		providerNode = providerNode.DeepCopy()
+		n.healthCheckController.setConditions(&providerNode.Status)
+	}
 	updateNodeStatusHeartbeat(providerNode)
+	providerNode = n.withNodeResources(providerNode)
 
 	node, err := updateNodeStatus(ctx, n.nodes, providerNode)
 	if err != nil {
@@ -430,6 +513,23 @@ func (n *NodeController) updateStatus(ctx context.Context, providerNode *corev1.
 	return nil
 }
 
+// withNodeResources returns a copy of the node with the resources managed by the controller set on its status.
+// The node from the provider is not modified, so that the capacity and allocatable it reported are used as the base of
+// each update.
+func (n *NodeController) withNodeResources(providerNode *corev1.Node) *corev1.Node {
+	if n.extendedResources == nil && n.resourceAccounting == nil {
+		return providerNode
+	}
+	node := providerNode.DeepCopy()
+	if n.extendedResources != nil {
+		n.extendedResources.setNodeResources(&node.Status)
+	}
+	if n.resourceAccounting != nil {
+		n.resourceAccounting.setNodeAllocatable(&node.Status)
+	}
+	return node
+}
+
 // Returns a copy of the server node object
 func (n *NodeController) getServerNode(_ context.Context) (*corev1.Node, error) {
 	n.serverNodeLock.Lock()
@@ -440,6 +540,17 @@ func (n *NodeController) getServerNode(_ context.Context) (*corev1.Node, error)
 	return n.serverNode.DeepCopy(), nil
 }
 
+// Allocatable returns a copy of the node's allocatable resources, as last written to Kubernetes.
+// It returns nil if the node has not been registered yet.
+func (n *NodeController) Allocatable() corev1.ResourceList {
+	n.serverNodeLock.Lock()
+	defer n.serverNodeLock.Unlock()
+	if n.serverNode == nil {
+		return nil
+	}
+	return n.serverNode.Status.Allocatable.DeepCopy()
+}
+
 // just so we don't have to allocate this on every get request
 var emptyGetOptions = metav1.GetOptions{}
 
@@ -720,7 +831,7 @@ func simplestObjectMetadata(baseObjectMeta, objectMetaWithLabelsAndAnnotations *
 		if objectMetaWithLabelsAndAnnotations.Annotations != nil {
 			// We want to copy over all annotations except the special embedded ones.
 			for key := range objectMetaWithLabelsAndAnnotations.Annotations {
-				if key == virtualKubeletLastNodeAppliedNodeStatus || key == virtualKubeletLastNodeAppliedObjectMeta {
+				if key == virtualKubeletLastNodeAppliedNodeStatus || key == virtualKubeletLastNodeAppliedObjectMeta || key == virtualKubeletLastNodeAppliedNodeSpec {
 					continue
 				}
 				ret.Annotations[key] = objectMetaWithLabelsAndAnnotations.Annotations[key]
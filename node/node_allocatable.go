@@ -0,0 +1,372 @@
+// Copyright © 2017 The virtual-kubelet authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	pkgerrors "github.com/pkg/errors"
+	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// The hard eviction signals which are reserved from the node's allocatable resources.
+const (
+	EvictionSignalMemoryAvailable = "memory.available"
+	EvictionSignalNodeFsAvailable = "nodefs.available"
+)
+
+var evictionSignalResources = map[string]corev1.ResourceName{
+	EvictionSignalMemoryAvailable: corev1.ResourceMemory,
+	EvictionSignalNodeFsAvailable: corev1.ResourceEphemeralStorage,
+}
+
+// NodeAllocatableConfig configures the resources of the node which are held back from pods.
+type NodeAllocatableConfig struct {
+	// SystemReserved is reserved for the system the node runs on.
+	SystemReserved corev1.ResourceList
+	// ProviderReserved is reserved for the provider, like kube-reserved on a regular kubelet.
+	ProviderReserved corev1.ResourceList
+	// EvictionHard maps eviction signals to the amount of the resource which must stay available, as an absolute
+	// quantity like "100Mi", or as a percentage of the capacity like "10%".
+	// Only EvictionSignalMemoryAvailable and EvictionSignalNodeFsAvailable are supported.
+	EvictionHard map[string]string
+}
+
+// evictionThreshold is a parsed hard eviction threshold.
+type evictionThreshold struct {
+	quantity   *resource.Quantity
+	percentage float64
+}
+
+// value returns the threshold for the given capacity.
+func (t evictionThreshold) value(capacity resource.Quantity) resource.Quantity {
+	if t.quantity != nil {
+		return t.quantity.DeepCopy()
+	}
+	return *resource.NewQuantity(int64(float64(capacity.Value())*t.percentage), resource.BinarySI)
+}
+
+func parseEvictionThreshold(signal, value string) (evictionThreshold, error) {
+	if strings.HasSuffix(value, "%") {
+		p, err := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+		if err != nil || p < 0 || p > 100 {
+			return evictionThreshold{}, errdefs.InvalidInputf("invalid percentage %q for eviction signal %s", value, signal)
+		}
+		return evictionThreshold{percentage: p / 100}, nil
+	}
+	q, err := resource.ParseQuantity(value)
+	if err != nil {
+		return evictionThreshold{}, errdefs.AsInvalidInput(pkgerrors.Wrapf(err, "invalid quantity %q for eviction signal %s", value, signal))
+	}
+	if q.Sign() < 0 {
+		return evictionThreshold{}, errdefs.InvalidInputf("negative quantity %q for eviction signal %s", value, signal)
+	}
+	return evictionThreshold{quantity: &q}, nil
+}
+
+// NodeResourceUsage is a view of the resources requested by the pods admitted to the node, against what the node has
+// to offer.
+type NodeResourceUsage struct {
+	// Capacity is the capacity reported by the provider.
+	Capacity corev1.ResourceList
+	// Allocatable is the part of the capacity which is available to pods.
+	Allocatable corev1.ResourceList
+	// Requested is the sum of the requests of the admitted pods, and their number as the pods resource.
+	Requested corev1.ResourceList
+}
+
+// Available returns the allocatable resources which are not requested by any pod.
+func (u NodeResourceUsage) Available() corev1.ResourceList {
+	available := make(corev1.ResourceList, len(u.Allocatable))
+	for name, allocatable := range u.Allocatable {
+		v := allocatable.DeepCopy()
+		if requested, ok := u.Requested[name]; ok {
+			v.Sub(requested)
+		}
+		if v.Sign() < 0 {
+			v.Set(0)
+		}
+		available[name] = v
+	}
+	return available
+}
+
+// InsufficientResourceError is returned when a pod is not admitted because the node does not have enough of a
+// resource left.
+type InsufficientResourceError struct {
+	ResourceName corev1.ResourceName
+	Requested    resource.Quantity
+	Used         resource.Quantity
+	Capacity     resource.Quantity
+}
+
+func (e *InsufficientResourceError) Error() string {
+	return fmt.Sprintf("Node didn't have enough resource: %s, requested: %s, used: %s, capacity: %s",
+		e.ResourceName, e.Requested.String(), e.Used.String(), e.Capacity.String())
+}
+
+// Reason returns the reason pods are rejected with, like a regular kubelet.
+func (e *InsufficientResourceError) Reason() string {
+	return fmt.Sprintf("OutOf%s", e.ResourceName)
+}
+
+// admittedPod is a pod which was admitted to the node.
+type admittedPod struct {
+	namespace string
+	name      string
+	requests  corev1.ResourceList
+}
+
+// ResourceAccounting keeps track of the node's allocatable resources and of the resources requested by the pods
+// admitted to it.
+//
+// The node controller computes the allocatable resources it publishes from the capacity reported by the provider minus
+// the configured reservations. The pod controller admits pods against the same view before creating them in the
+// provider, and releases their resources once they are deleted or have terminated.
+type ResourceAccounting struct {
+	reserved  corev1.ResourceList
+	evictions map[corev1.ResourceName]evictionThreshold
+
+	mu          sync.Mutex
+	capacity    corev1.ResourceList
+	allocatable corev1.ResourceList
+	pods        map[types.UID]admittedPod
+}
+
+// NewResourceAccounting creates a new resource accounting with the given reservations.
+func NewResourceAccounting(cfg NodeAllocatableConfig) (*ResourceAccounting, error) {
+	a := &ResourceAccounting{
+		reserved:  make(corev1.ResourceList),
+		evictions: make(map[corev1.ResourceName]evictionThreshold),
+		pods:      make(map[types.UID]admittedPod),
+	}
+	for _, reserved := range []corev1.ResourceList{cfg.SystemReserved, cfg.ProviderReserved} {
+		for name, q := range reserved {
+			if q.Sign() < 0 {
+				return nil, errdefs.InvalidInputf("reserved %s must not be negative", name)
+			}
+			addResource(a.reserved, name, q)
+		}
+	}
+	for signal, value := range cfg.EvictionHard {
+		name, ok := evictionSignalResources[signal]
+		if !ok {
+			return nil, errdefs.InvalidInputf("unsupported eviction signal %q", signal)
+		}
+		t, err := parseEvictionThreshold(signal, value)
+		if err != nil {
+			return nil, err
+		}
+		a.evictions[name] = t
+	}
+	return a, nil
+}
+
+func addResource(list corev1.ResourceList, name corev1.ResourceName, q resource.Quantity) {
+	v := list[name]
+	v.Add(q)
+	list[name] = v
+}
+
+// setNodeAllocatable sets the allocatable resources on the node status to its capacity minus the reservations, and
+// records them for admitting pods.
+//
+// Based on getNodeAllocatableAbsolute in pkg/kubelet/cm/node_container_manager_linux.go. Allocatable resources the
+// provider reported lower than that, like unhealthy devices, are kept.
+func (a *ResourceAccounting) setNodeAllocatable(status *corev1.NodeStatus) {
+	allocatable := make(corev1.ResourceList, len(status.Capacity))
+	for name, capacity := range status.Capacity {
+		v := capacity.DeepCopy()
+		if reserved, ok := a.reserved[name]; ok {
+			v.Sub(reserved)
+		}
+		if t, ok := a.evictions[name]; ok {
+			v.Sub(t.value(capacity))
+		}
+		if v.Sign() < 0 {
+			v.Set(0)
+		}
+		if reported, ok := status.Allocatable[name]; ok && reported.Cmp(v) < 0 {
+			v = reported.DeepCopy()
+		}
+		allocatable[name] = v
+	}
+	status.Allocatable = allocatable
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.capacity = status.Capacity.DeepCopy()
+	a.allocatable = allocatable.DeepCopy()
+}
+
+// Usage returns the current view of the requested and allocatable resources of the node.
+func (a *ResourceAccounting) Usage() NodeResourceUsage {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return NodeResourceUsage{
+		Capacity:    a.capacity.DeepCopy(),
+		Allocatable: a.allocatable.DeepCopy(),
+		Requested:   a.requested(),
+	}
+}
+
+// requested sums the requests of the admitted pods. The caller must hold the lock.
+func (a *ResourceAccounting) requested() corev1.ResourceList {
+	requested := corev1.ResourceList{
+		corev1.ResourcePods: *resource.NewQuantity(int64(len(a.pods)), resource.DecimalSI),
+	}
+	for _, pod := range a.pods {
+		for name, q := range pod.requests {
+			addResource(requested, name, q)
+		}
+	}
+	return requested
+}
+
+// admit checks that the node has enough allocatable resources left for the pod, and accounts for its requests if so.
+// Only the resources the node reports as allocatable are checked. Pods are admitted without any checks until the node
+// has reported its capacity.
+//
+// Based on the resource fit check of the kubelet's predicate admit handler.
+func (a *ResourceAccounting) admit(pod *corev1.Pod) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, ok := a.pods[pod.UID]; ok {
+		return nil
+	}
+
+	requests := podRequests(pod)
+	if a.allocatable != nil {
+		used := a.requested()
+		check := requests.DeepCopy()
+		check[corev1.ResourcePods] = *resource.NewQuantity(1, resource.DecimalSI)
+
+		names := make([]string, 0, len(check))
+		for name := range check {
+			names = append(names, string(name))
+		}
+		sort.Strings(names)
+		for _, n := range names {
+			name := corev1.ResourceName(n)
+			req := check[name]
+			allocatable, ok := a.allocatable[name]
+			if !ok || req.Sign() <= 0 {
+				continue
+			}
+			total := used[name].DeepCopy()
+			total.Add(req)
+			if total.Cmp(allocatable) > 0 {
+				return &InsufficientResourceError{ResourceName: name, Requested: req, Used: used[name], Capacity: allocatable}
+			}
+		}
+	}
+
+	a.pods[pod.UID] = admittedPod{namespace: pod.Namespace, name: pod.Name, requests: requests}
+	return nil
+}
+
+// setAdmitted accounts for the requests of a pod without checking them, for pods which already exist in the provider.
+func (a *ResourceAccounting) setAdmitted(pod *corev1.Pod) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.pods[pod.UID] = admittedPod{namespace: pod.Namespace, name: pod.Name, requests: podRequests(pod)}
+}
+
+// release stops accounting for the requests of the pod with the given UID.
+func (a *ResourceAccounting) release(uid types.UID) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.pods, uid)
+}
+
+// releaseNamed stops accounting for the requests of any pod with the given namespace and name.
+func (a *ResourceAccounting) releaseNamed(namespace, name string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for uid, pod := range a.pods {
+		if pod.namespace == namespace && pod.name == name {
+			delete(a.pods, uid)
+		}
+	}
+}
+
+// podRequests returns the effective resource requests of the pod.
+//
+// Based on PodRequests in k8s.io/component-helpers/resource: init containers run one after the other before the app
+// containers, except for restartable (sidecar) init containers which keep running alongside the containers started
+// after them.
+func podRequests(pod *corev1.Pod) corev1.ResourceList {
+	reqs := make(corev1.ResourceList)
+	for _, c := range pod.Spec.Containers {
+		for name, q := range c.Resources.Requests {
+			addResource(reqs, name, q)
+		}
+	}
+
+	restartableInitReqs := make(corev1.ResourceList)
+	initReqs := make(corev1.ResourceList)
+	for _, c := range pod.Spec.InitContainers {
+		containerReqs := c.Resources.Requests.DeepCopy()
+		if c.RestartPolicy != nil && *c.RestartPolicy == corev1.ContainerRestartPolicyAlways {
+			for name, q := range containerReqs {
+				addResource(reqs, name, q)
+				addResource(restartableInitReqs, name, q)
+			}
+			containerReqs = restartableInitReqs.DeepCopy()
+		} else {
+			for name, q := range restartableInitReqs {
+				addResource(containerReqs, name, q)
+			}
+		}
+		maxResourceList(initReqs, containerReqs)
+	}
+	maxResourceList(reqs, initReqs)
+
+	for name, q := range pod.Spec.Overhead {
+		addResource(reqs, name, q)
+	}
+	return reqs
+}
+
+// maxResourceList sets each resource in list to the greater of its value in list and in other.
+func maxResourceList(list, other corev1.ResourceList) {
+	for name, q := range other {
+		if v, ok := list[name]; !ok || q.Cmp(v) > 0 {
+			list[name] = q.DeepCopy()
+		}
+	}
+}
+
+// WithNodeResourceAccounting publishes the node's capacity minus the reservations of the accounting as its
+// allocatable resources.
+//
+// The same accounting should be passed to the pod controller, so that pods are admitted against it.
+func WithNodeResourceAccounting(a *ResourceAccounting) NodeControllerOpt {
+	return func(n *NodeController) error {
+		if a == nil {
+			return pkgerrors.New("resource accounting is nil")
+		}
+		n.resourceAccounting = a
+		return nil
+	}
+}
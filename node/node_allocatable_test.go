@@ -0,0 +1,217 @@
+package node
+
+import (
+	"context"
+	"testing"
+
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/utils/ptr"
+)
+
+func requests(cpu, memory string) corev1.ResourceRequirements {
+	return corev1.ResourceRequirements{Requests: corev1.ResourceList{
+		corev1.ResourceCPU:    resource.MustParse(cpu),
+		corev1.ResourceMemory: resource.MustParse(memory),
+	}}
+}
+
+func resourcesEqual(t *testing.T, got, want corev1.ResourceList) {
+	t.Helper()
+	assert.Check(t, is.Len(got, len(want)), "got %v", got)
+	for name, q := range want {
+		v := got[name]
+		assert.Check(t, v.Cmp(q) == 0, "%s: got %s, want %s", name, v.String(), q.String())
+	}
+}
+
+func TestNewResourceAccountingInvalid(t *testing.T) {
+	_, err := NewResourceAccounting(NodeAllocatableConfig{EvictionHard: map[string]string{"pid.available": "10%"}})
+	assert.Check(t, is.ErrorContains(err, "unsupported eviction signal"))
+	_, err = NewResourceAccounting(NodeAllocatableConfig{EvictionHard: map[string]string{EvictionSignalMemoryAvailable: "150%"}})
+	assert.Check(t, is.ErrorContains(err, "invalid percentage"))
+	_, err = NewResourceAccounting(NodeAllocatableConfig{SystemReserved: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("-1")}})
+	assert.Check(t, is.ErrorContains(err, "must not be negative"))
+}
+
+func TestResourceAccountingNodeAllocatable(t *testing.T) {
+	a, err := NewResourceAccounting(NodeAllocatableConfig{
+		SystemReserved:   corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("500m"), corev1.ResourceMemory: resource.MustParse("1Gi")},
+		ProviderReserved: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("500m"), corev1.ResourcePods: resource.MustParse("20")},
+		EvictionHard: map[string]string{
+			EvictionSignalMemoryAvailable: "1Gi",
+			EvictionSignalNodeFsAvailable: "10%",
+		},
+	})
+	assert.NilError(t, err)
+
+	status := corev1.NodeStatus{
+		Capacity: corev1.ResourceList{
+			corev1.ResourceCPU:              resource.MustParse("4"),
+			corev1.ResourceMemory:           resource.MustParse("8Gi"),
+			corev1.ResourceEphemeralStorage: resource.MustParse("100Gi"),
+			corev1.ResourcePods:             resource.MustParse("10"),
+			testGPU:                         resource.MustParse("2"),
+		},
+		Allocatable: corev1.ResourceList{
+			corev1.ResourceCPU: resource.MustParse("4"),
+			testGPU:            resource.MustParse("1"),
+		},
+	}
+	a.setNodeAllocatable(&status)
+	want := corev1.ResourceList{
+		corev1.ResourceCPU:              resource.MustParse("3"),
+		corev1.ResourceMemory:           resource.MustParse("6Gi"),
+		corev1.ResourceEphemeralStorage: resource.MustParse("90Gi"),
+		corev1.ResourcePods:             resource.MustParse("0"),
+		testGPU:                         resource.MustParse("1"),
+	}
+	resourcesEqual(t, status.Allocatable, want)
+	resourcesEqual(t, a.Usage().Allocatable, want)
+}
+
+func TestPodRequests(t *testing.T) {
+	pod := &corev1.Pod{Spec: corev1.PodSpec{
+		InitContainers: []corev1.Container{
+			{Name: "init", Resources: requests("2", "100Mi")},
+			{Name: "sidecar", Resources: requests("100m", "1Gi"), RestartPolicy: ptr.To(corev1.ContainerRestartPolicyAlways)},
+			{Name: "init-after-sidecar", Resources: requests("1", "1Gi")},
+		},
+		Containers: []corev1.Container{
+			{Name: "app", Resources: requests("500m", "256Mi")},
+			{Name: "other", Resources: requests("500m", "256Mi")},
+		},
+		Overhead: corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("64Mi")},
+	}}
+
+	resourcesEqual(t, podRequests(pod), corev1.ResourceList{
+		// The first init container runs on its own.
+		corev1.ResourceCPU: resource.MustParse("2"),
+		// The last init container runs alongside the sidecar.
+		corev1.ResourceMemory: resource.MustParse("2112Mi"),
+	})
+}
+
+func TestResourceAccountingAdmit(t *testing.T) {
+	a, err := NewResourceAccounting(NodeAllocatableConfig{})
+	assert.NilError(t, err)
+
+	pod := func(uid, cpu string) *corev1.Pod {
+		p := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{UID: types.UID(uid), Namespace: "default", Name: uid}}
+		p.Spec.Containers = []corev1.Container{{Name: "app", Resources: requests(cpu, "1Gi")}}
+		return p
+	}
+
+	// Pods are admitted without checks until the capacity of the node is known.
+	a.setAdmitted(pod("existing", "1"))
+
+	a.setNodeAllocatable(&corev1.NodeStatus{Capacity: corev1.ResourceList{
+		corev1.ResourceCPU:  resource.MustParse("2"),
+		corev1.ResourcePods: resource.MustParse("3"),
+	}})
+	assert.NilError(t, a.admit(pod("a", "500m")))
+	err = a.admit(pod("b", "1"))
+	var insufficient *InsufficientResourceError
+	assert.Assert(t, is.ErrorType(err, insufficient))
+	insufficient = err.(*InsufficientResourceError)
+	assert.Check(t, is.Equal(insufficient.Reason(), "OutOfcpu"))
+	assert.Check(t, is.Equal(err.Error(), "Node didn't have enough resource: cpu, requested: 1, used: 1500m, capacity: 2"))
+
+	assert.NilError(t, a.admit(pod("c", "500m")))
+	assert.Check(t, is.ErrorContains(a.admit(pod("d", "0")), "resource: pods"))
+
+	usage := a.Usage()
+	resourcesEqual(t, usage.Requested, corev1.ResourceList{
+		corev1.ResourceCPU:    resource.MustParse("2"),
+		corev1.ResourceMemory: resource.MustParse("3Gi"),
+		corev1.ResourcePods:   resource.MustParse("3"),
+	})
+	resourcesEqual(t, usage.Available(), corev1.ResourceList{
+		corev1.ResourceCPU:  resource.MustParse("0"),
+		corev1.ResourcePods: resource.MustParse("0"),
+	})
+
+	a.release("a")
+	a.releaseNamed("default", "existing")
+	assert.NilError(t, a.admit(pod("b", "1")))
+}
+
+func TestPodRejectedOutOfResources(t *testing.T) {
+	svr := newTestController()
+	a, err := NewResourceAccounting(NodeAllocatableConfig{})
+	assert.NilError(t, err)
+	a.setNodeAllocatable(&corev1.NodeStatus{Capacity: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("1")}})
+	svr.resourceAccounting = a
+
+	ctx := context.Background()
+	pod := &corev1.Pod{}
+	pod.Namespace = "default"
+	pod.Name = "nginx"
+	pod.UID = "uid-1"
+	pod.Spec = newPodSpec()
+	pod.Spec.Containers[0].Resources = requests("2", "1Gi")
+	_, err = svr.client.CoreV1().Pods(pod.Namespace).Create(ctx, pod, metav1.CreateOptions{})
+	assert.NilError(t, err)
+
+	assert.NilError(t, svr.createOrUpdatePod(ctx, pod.DeepCopy()))
+	assert.Check(t, is.Equal(svr.mock.creates.read(), 0))
+
+	rejected, err := svr.client.CoreV1().Pods(pod.Namespace).Get(ctx, pod.Name, metav1.GetOptions{})
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(rejected.Status.Phase, corev1.PodFailed))
+	assert.Check(t, is.Equal(rejected.Status.Reason, "OutOfcpu"))
+
+	// Once the pod fits, it is created and its requests are accounted for until it is deleted.
+	pod.Spec.Containers[0].Resources = requests("1", "1Gi")
+	assert.NilError(t, svr.createOrUpdatePod(ctx, pod.DeepCopy()))
+	assert.Check(t, is.Equal(svr.mock.creates.read(), 1))
+	resourcesEqual(t, a.Usage().Available(), corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("0")})
+
+	assert.NilError(t, svr.deletePod(ctx, pod.DeepCopy()))
+	resourcesEqual(t, a.Usage().Available(), corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("1")})
+}
+
+func TestAdmitProviderPods(t *testing.T) {
+	svr := newTestController()
+	a, err := NewResourceAccounting(NodeAllocatableConfig{})
+	assert.NilError(t, err)
+	a.setNodeAllocatable(&corev1.NodeStatus{Capacity: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("1")}})
+	svr.resourceAccounting = a
+
+	ctx := context.Background()
+	newPod := func(uid, name string) *corev1.Pod {
+		pod := &corev1.Pod{}
+		pod.Namespace = "default"
+		pod.Name = name
+		pod.UID = types.UID(uid)
+		pod.Spec = newPodSpec()
+		pod.Spec.Containers[0].Resources = requests("1", "1Gi")
+		return pod
+	}
+
+	// A pod runs in the provider since a previous run, along with a dangling pod which no longer exists in Kubernetes.
+	running := newPod("uid-1", "running")
+	assert.NilError(t, svr.podsInformer.Informer().GetStore().Add(running))
+	for _, pod := range []*corev1.Pod{running, newPod("uid-2", "dangling")} {
+		key, err := buildKey(pod)
+		assert.NilError(t, err)
+		svr.mock.pods.Store(key, pod.DeepCopy())
+	}
+
+	assert.NilError(t, svr.admitProviderPods(ctx))
+	resourcesEqual(t, a.Usage().Available(), corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("0")})
+
+	// New pods are admitted against the resources of the running pod, even before it is synced.
+	pod := newPod("uid-3", "new")
+	_, err = svr.client.CoreV1().Pods(pod.Namespace).Create(ctx, pod, metav1.CreateOptions{})
+	assert.NilError(t, err)
+	assert.NilError(t, svr.createOrUpdatePod(ctx, pod.DeepCopy()))
+	assert.Check(t, is.Equal(svr.mock.creates.read(), 0))
+	rejected, err := svr.client.CoreV1().Pods(pod.Namespace).Get(ctx, pod.Name, metav1.GetOptions{})
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(rejected.Status.Reason, "OutOfcpu"))
+}
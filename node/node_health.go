@@ -0,0 +1,243 @@
+// Copyright © 2017 The virtual-kubelet authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	pkgerrors "github.com/pkg/errors"
+	"github.com/virtual-kubelet/virtual-kubelet/log"
+	"github.com/virtual-kubelet/virtual-kubelet/trace"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// The defaults used for health checks which do not set them.
+const (
+	DefaultHealthCheckInterval = 30 * time.Second
+	DefaultHealthCheckTimeout  = 10 * time.Second
+
+	DefaultHealthCheckFailedReason = "HealthCheckFailed"
+	DefaultHealthCheckPassedReason = "HealthCheckPassed"
+)
+
+var errHealthCheckPending = pkgerrors.New("health check has not completed yet")
+
+// HealthCheck is a named check of an aspect of the node's health, such as whether the backend API is reachable.
+//
+// The result of each check is reported as its own node condition. Like the conditions set by node-problem-detector,
+// the condition is True when the check fails, and False when it passes.
+type HealthCheck struct {
+	// Name identifies the check in logs and traces.
+	Name string
+	// ConditionType is the type of the node condition the result of the check is reported as.
+	ConditionType corev1.NodeConditionType
+	// Check performs the check. It returns an error, used as the condition's message, when the check fails.
+	Check func(context.Context) error
+
+	// Interval is how often the check is performed. Defaults to DefaultHealthCheckInterval.
+	Interval time.Duration
+	// Timeout is how long the check may take before it is considered failed. Defaults to DefaultHealthCheckTimeout.
+	Timeout time.Duration
+
+	// Critical checks set the node's Ready condition to False, with the check's FailedReason, and stop the node
+	// lease from being renewed while they are failing. Other checks only report their condition.
+	Critical bool
+
+	// FailedReason is the reason of the condition when the check fails. Defaults to DefaultHealthCheckFailedReason.
+	FailedReason string
+	// PassedReason is the reason of the condition when the check passes. Defaults to DefaultHealthCheckPassedReason.
+	PassedReason string
+}
+
+// WithNodeHealthChecks registers health checks on the node controller.
+// Their results are reported as node conditions, and failing critical checks make the node NotReady.
+func WithNodeHealthChecks(checks ...HealthCheck) NodeControllerOpt {
+	return func(n *NodeController) error {
+		for _, check := range checks {
+			if check.Name == "" {
+				return pkgerrors.New("health check name is required")
+			}
+			if check.ConditionType == "" {
+				return pkgerrors.Errorf("health check %q must set a condition type", check.Name)
+			}
+			if check.Check == nil {
+				return pkgerrors.Errorf("health check %q must set a check function", check.Name)
+			}
+			if check.Interval == 0 {
+				check.Interval = DefaultHealthCheckInterval
+			}
+			if check.Timeout == 0 {
+				check.Timeout = DefaultHealthCheckTimeout
+			}
+			if check.FailedReason == "" {
+				check.FailedReason = DefaultHealthCheckFailedReason
+			}
+			if check.PassedReason == "" {
+				check.PassedReason = DefaultHealthCheckPassedReason
+			}
+			n.healthChecks = append(n.healthChecks, check)
+		}
+		return nil
+	}
+}
+
+// healthCheckController runs the health checks of the node and keeps track of their results.
+type healthCheckController struct {
+	checks []HealthCheck
+
+	mu         sync.Mutex
+	conditions map[corev1.NodeConditionType]corev1.NodeCondition
+	errors     map[string]error
+
+	// chUpdate is signalled when a condition changes status.
+	chUpdate chan struct{}
+}
+
+func newHealthCheckController(checks []HealthCheck) *healthCheckController {
+	hc := &healthCheckController{
+		checks:     checks,
+		conditions: make(map[corev1.NodeConditionType]corev1.NodeCondition),
+		errors:     make(map[string]error),
+		chUpdate:   make(chan struct{}, 1),
+	}
+	for _, check := range checks {
+		hc.errors[check.Name] = errHealthCheckPending
+	}
+	return hc
+}
+
+// Run runs each check on its own interval until the context is cancelled.
+func (hc *healthCheckController) Run(ctx context.Context) {
+	var group wait.Group
+	for _, check := range hc.checks {
+		group.StartWithContext(ctx, func(ctx context.Context) {
+			wait.UntilWithContext(ctx, func(ctx context.Context) {
+				hc.runCheck(ctx, check)
+			}, check.Interval)
+		})
+	}
+	group.Wait()
+}
+
+func (hc *healthCheckController) runCheck(ctx context.Context, check HealthCheck) {
+	ctx, cancel := context.WithTimeout(ctx, check.Timeout)
+	defer cancel()
+	ctx, span := trace.StartSpan(ctx, "node.healthCheck")
+	defer span.End()
+	ctx = span.WithField(ctx, "healthCheck", check.Name)
+
+	err := check.Check(ctx)
+	if err == nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	span.SetStatus(err)
+	if err != nil {
+		log.G(ctx).WithError(err).Warn("Node health check failed")
+	}
+
+	condition := corev1.NodeCondition{
+		Type:   check.ConditionType,
+		Status: corev1.ConditionFalse,
+		Reason: check.PassedReason,
+	}
+	if err != nil {
+		condition.Status = corev1.ConditionTrue
+		condition.Reason = check.FailedReason
+		condition.Message = err.Error()
+	} else {
+		condition.Message = fmt.Sprintf("health check %s passed", check.Name)
+	}
+
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+
+	now := metav1.Now()
+	condition.LastHeartbeatTime = now
+	condition.LastTransitionTime = now
+	old, ok := hc.conditions[check.ConditionType]
+	changed := !ok || old.Status != condition.Status || old.Reason != condition.Reason || old.Message != condition.Message
+	if ok && old.Status == condition.Status {
+		condition.LastTransitionTime = old.LastTransitionTime
+	}
+	hc.conditions[check.ConditionType] = condition
+	hc.errors[check.Name] = err
+
+	if changed {
+		select {
+		case hc.chUpdate <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// criticalError returns the error of a failing, or not yet completed, critical check.
+func (hc *healthCheckController) criticalError() error {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	for _, check := range hc.checks {
+		if !check.Critical {
+			continue
+		}
+		if err := hc.errors[check.Name]; err != nil {
+			return pkgerrors.Wrapf(err, "critical health check %s failed", check.Name)
+		}
+	}
+	return nil
+}
+
+// setConditions sets the conditions of the completed checks on the node status, replacing conditions of the same
+// type. While a critical check fails, the Ready condition is set to False with the reason of the check.
+func (hc *healthCheckController) setConditions(status *corev1.NodeStatus) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+
+	var notReady *corev1.NodeCondition
+	for _, check := range hc.checks {
+		condition, ok := hc.conditions[check.ConditionType]
+		if !ok {
+			continue
+		}
+		setNodeCondition(status, condition)
+		if check.Critical && condition.Status == corev1.ConditionTrue && notReady == nil {
+			notReady = &corev1.NodeCondition{
+				Type:               corev1.NodeReady,
+				Status:             corev1.ConditionFalse,
+				Reason:             check.FailedReason,
+				Message:            fmt.Sprintf("critical health check %s failed: %s", check.Name, condition.Message),
+				LastHeartbeatTime:  condition.LastHeartbeatTime,
+				LastTransitionTime: condition.LastTransitionTime,
+			}
+		}
+	}
+	if notReady != nil {
+		setNodeCondition(status, *notReady)
+	}
+}
+
+// setNodeCondition sets the condition on the node status, replacing the condition of the same type if any.
+func setNodeCondition(status *corev1.NodeStatus, condition corev1.NodeCondition) {
+	for i := range status.Conditions {
+		if status.Conditions[i].Type == condition.Type {
+			status.Conditions[i] = condition
+			return
+		}
+	}
+	status.Conditions = append(status.Conditions, condition)
+}
@@ -0,0 +1,210 @@
+// Copyright © 2017 The virtual-kubelet authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"context"
+	"encoding/json"
+
+	pkgerrors "github.com/pkg/errors"
+	"github.com/virtual-kubelet/virtual-kubelet/log"
+	"github.com/virtual-kubelet/virtual-kubelet/trace"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	v1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/util/retry"
+)
+
+// setOwnedNodeSpec copies the spec fields owned by the provider from src to dst.
+func setOwnedNodeSpec(dst, src *corev1.NodeSpec) {
+	dst.Taints = src.Taints
+	dst.Unschedulable = src.Unschedulable
+	dst.PodCIDR = src.PodCIDR
+	dst.PodCIDRs = src.PodCIDRs
+	dst.ProviderID = src.ProviderID
+}
+
+func (n *NodeController) updateSpec(ctx context.Context, providerNode *corev1.Node) (err error) {
+	ctx, span := trace.StartSpan(ctx, "node.updateSpec")
+	defer span.End()
+	defer func() {
+		span.SetStatus(err)
+	}()
+
+	node, err := updateNodeSpec(ctx, n.nodes, providerNode)
+	if err != nil {
+		return err
+	}
+
+	n.serverNodeLock.Lock()
+	n.serverNode = node
+	n.serverNodeLock.Unlock()
+	return nil
+}
+
+// taintsMatch checks if two taints are the same taint, which is identified by its key and effect.
+func taintsMatch(a, b *corev1.Taint) bool {
+	return a.Key == b.Key && a.Effect == b.Effect
+}
+
+// mergeTaints returns the taints of the api server node, minus the taints we last applied, plus the ones we want now.
+// Taints added by others are kept.
+func mergeTaints(apiServerTaints, oldTaints, newTaints []corev1.Taint) []corev1.Taint {
+	merged := make([]corev1.Taint, 0, len(apiServerTaints)+len(newTaints))
+OUTER:
+	for i := range apiServerTaints {
+		for j := range oldTaints {
+			if taintsMatch(&apiServerTaints[i], &oldTaints[j]) {
+				continue OUTER
+			}
+		}
+		for j := range newTaints {
+			if taintsMatch(&apiServerTaints[i], &newTaints[j]) {
+				continue OUTER
+			}
+		}
+		merged = append(merged, apiServerTaints[i])
+	}
+	return append(merged, newTaints...)
+}
+
+// prepareThreewayPatchBytesForNodeSpec generates a patch of the spec fields owned by the provider.
+// Like prepareThreewayPatchBytesForNodeStatus, the spec we last applied is kept in an annotation, so that fields which
+// were changed by others since are not reverted unless the provider changes them too.
+//
+// Taints are a list which is replaced as a whole when patched, so they are merged here instead: the ones we last
+// applied are replaced by the ones the provider wants now, and those added by others are kept.
+func prepareThreewayPatchBytesForNodeSpec(nodeFromProvider, apiServerNode *corev1.Node) ([]byte, error) {
+	// If we never applied a spec before, someone else created the node or this is an upgrade. Either way, oldNode is
+	// left empty, and the fields set by the provider will overwrite the ones in the api server.
+	oldNode := corev1.Node{}
+	if oldVKSpec, ok := apiServerNode.Annotations[virtualKubeletLastNodeAppliedNodeSpec]; ok {
+		if err := json.Unmarshal([]byte(oldVKSpec), &oldNode.Spec); err != nil {
+			return nil, pkgerrors.Wrapf(err, "Cannot unmarshal old node spec (key: %q): %q", virtualKubeletLastNodeAppliedNodeSpec, oldVKSpec)
+		}
+	}
+	oldTaints := oldNode.Spec.Taints
+
+	// newNode is the representation of the node the provider "wants"
+	newNode := corev1.Node{}
+	newNode.ObjectMeta = metav1.ObjectMeta{
+		Name:        apiServerNode.Name,
+		Namespace:   apiServerNode.Namespace,
+		UID:         apiServerNode.UID,
+		Annotations: make(map[string]string),
+	}
+	setOwnedNodeSpec(&newNode.Spec, nodeFromProvider.Spec.DeepCopy())
+
+	virtualKubeletLastNodeAppliedNodeSpecBytes, err := json.Marshal(newNode.Spec)
+	if err != nil {
+		return nil, pkgerrors.Wrap(err, "Cannot marshal node spec from provider")
+	}
+	newNode.Annotations[virtualKubeletLastNodeAppliedNodeSpec] = string(virtualKubeletLastNodeAppliedNodeSpecBytes)
+
+	// The old taints are set to the current ones, so that the patch only touches taints when the merged list differs
+	// from the one in the api server.
+	oldNode.ObjectMeta = metav1.ObjectMeta{Name: apiServerNode.Name, Namespace: apiServerNode.Namespace, UID: apiServerNode.UID}
+	oldNode.Spec.Taints = apiServerNode.Spec.Taints
+	newNode.Spec.Taints = mergeTaints(apiServerNode.Spec.Taints, oldTaints, newNode.Spec.Taints)
+
+	oldNodeBytes, err := json.Marshal(oldNode)
+	if err != nil {
+		return nil, pkgerrors.Wrap(err, "Cannot marshal old node bytes")
+	}
+	newNodeBytes, err := json.Marshal(newNode)
+	if err != nil {
+		return nil, pkgerrors.Wrap(err, "Cannot marshal new node bytes")
+	}
+	apiServerNodeBytes, err := json.Marshal(apiServerNode)
+	if err != nil {
+		return nil, pkgerrors.Wrap(err, "Cannot marshal api server node")
+	}
+	schema, err := strategicpatch.NewPatchMetaFromStruct(&corev1.Node{})
+	if err != nil {
+		return nil, pkgerrors.Wrap(err, "Cannot get patch schema from node")
+	}
+	patchBytes, err := strategicpatch.CreateThreeWayMergePatch(oldNodeBytes, newNodeBytes, apiServerNodeBytes, schema, true)
+	if err != nil {
+		return nil, err
+	}
+
+	// The merged taints are based on the api server node, so make sure it has not changed in the meantime.
+	var patch map[string]any
+	if err := json.Unmarshal(patchBytes, &patch); err != nil {
+		return nil, pkgerrors.Wrap(err, "Cannot unmarshal patch")
+	}
+	if len(patch) == 0 {
+		return nil, nil
+	}
+	metadata, _ := patch["metadata"].(map[string]any)
+	if metadata == nil {
+		metadata = make(map[string]any)
+		patch["metadata"] = metadata
+	}
+	metadata["resourceVersion"] = apiServerNode.ResourceVersion
+	return json.Marshal(patch)
+}
+
+// updateNodeSpec patches the spec fields owned by the provider in Kubernetes.
+// It returns the node as found in the api server if there is nothing to update.
+func updateNodeSpec(ctx context.Context, nodes v1.NodeInterface, nodeFromProvider *corev1.Node) (_ *corev1.Node, retErr error) {
+	ctx, span := trace.StartSpan(ctx, "UpdateNodeSpec")
+	defer func() {
+		span.End()
+		span.SetStatus(retErr)
+	}()
+
+	var updatedNode *corev1.Node
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		apiServerNode, err := nodes.Get(ctx, nodeFromProvider.Name, emptyGetOptions)
+		if err != nil {
+			return err
+		}
+		ctx = addNodeAttributes(ctx, span, apiServerNode)
+
+		patchBytes, err := prepareThreewayPatchBytesForNodeSpec(nodeFromProvider, apiServerNode)
+		if err != nil {
+			return pkgerrors.Wrap(err, "Cannot generate patch")
+		}
+		if patchBytes == nil {
+			updatedNode = apiServerNode
+			return nil
+		}
+		log.G(ctx).WithField("patch", string(patchBytes)).Debug("Generated three way patch for node spec")
+
+		updatedNode, err = nodes.Patch(ctx, nodeFromProvider.Name, types.StrategicMergePatchType, patchBytes, metav1.PatchOptions{})
+		if err != nil {
+			// We cannot wrap this error because the kubernetes error module doesn't understand wrapping
+			log.G(ctx).WithField("patch", string(patchBytes)).WithError(err).Warn("Failed to patch node spec")
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// if ctx exceeded, RetryOnConflict returns nil error and can cause panic.
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	log.G(ctx).WithField("node.resourceVersion", updatedNode.ResourceVersion).
+		WithField("node.Spec.Taints", taintsStringer(updatedNode.Spec.Taints)).
+		Debug("updated node spec in api server")
+	return updatedNode, nil
+}
@@ -18,16 +18,19 @@ import (
 	"context"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	coordinationv1 "k8s.io/api/coordination/v1"
 
+	pkgerrors "github.com/pkg/errors"
 	"gotest.tools/assert"
 	"gotest.tools/assert/cmp"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
 	watch "k8s.io/apimachinery/pkg/watch"
 	testclient "k8s.io/client-go/kubernetes/fake"
 	"k8s.io/client-go/util/retry"
@@ -735,3 +738,205 @@ func failTemplate(op string) string {
 				{{- printf "%T" .Data.y -}}
 			)`
 }
+
+type testNodeSpecProvider struct {
+	testNodeProvider
+	notifyNodeSpec func(*corev1.Node)
+}
+
+func (p *testNodeSpecProvider) NotifyNodeSpec(ctx context.Context, h func(*corev1.Node)) {
+	p.notifyNodeSpec = h
+}
+
+// Are taints set by systems outside of VK preserved when the provider updates the node spec?
+func TestNodeSpecUpdate(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	c := testclient.NewClientset()
+	nodes := c.CoreV1().Nodes()
+
+	externalTaint := corev1.Taint{Key: "node.kubernetes.io/unreachable", Effect: corev1.TaintEffectNoExecute}
+	providerTaint := corev1.Taint{Key: "virtual-kubelet.io/provider", Value: "mock", Effect: corev1.TaintEffectNoSchedule}
+	maintenanceTaint := corev1.Taint{Key: "example.com/maintenance", Effect: corev1.TaintEffectNoSchedule}
+
+	testNode := testNode(t)
+	testNode.Spec.Taints = []corev1.Taint{providerTaint}
+	testNodeCopy := testNode.DeepCopy()
+
+	testP := &testNodeSpecProvider{testNodeProvider: testNodeProvider{NodeProvider: &NaiveNodeProvider{}}}
+	node, err := NewNodeController(testP, testNode, nodes, WithNodePingInterval(10*time.Millisecond))
+	assert.NilError(t, err)
+
+	defer func() {
+		cancel()
+		<-node.Done()
+		assert.NilError(t, node.Err())
+	}()
+
+	go node.Run(ctx) //nolint:errcheck
+
+	select {
+	case <-node.Ready():
+	case <-node.Done():
+		t.Fatal(node.Err())
+	case <-ctx.Done():
+		t.Fatal(ctx.Err())
+	}
+
+	// Simulate the node lifecycle controller tainting the node.
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		n, err := nodes.Get(ctx, testNodeCopy.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		n.Spec.Taints = append(n.Spec.Taints, externalTaint)
+		_, err = nodes.Update(ctx, n, metav1.UpdateOptions{})
+		return err
+	})
+	assert.NilError(t, err)
+
+	nw := makeWatch(ctx, t, nodes, testNodeCopy.Name)
+	defer nw.Stop()
+	nr := nw.ResultChan()
+
+	// The provider enters a maintenance window.
+	maintenance := testNodeCopy.DeepCopy()
+	maintenance.Spec.Taints = []corev1.Taint{providerTaint, maintenanceTaint}
+	maintenance.Spec.Unschedulable = true
+	maintenance.Spec.ProviderID = "mock://node"
+	testP.notifyNodeSpec(maintenance)
+
+	assert.NilError(t, <-waitForEvent(ctx, nr, func(e watch.Event) bool {
+		n := e.Object.(*corev1.Node)
+		return n.Spec.Unschedulable && len(n.Spec.Taints) == 3
+	}))
+
+	n, err := nodes.Get(ctx, testNodeCopy.Name, metav1.GetOptions{})
+	assert.NilError(t, err)
+	assert.Check(t, cmp.DeepEqual(n.Spec.Taints, []corev1.Taint{externalTaint, providerTaint, maintenanceTaint}))
+	assert.Check(t, cmp.Equal(n.Spec.ProviderID, "mock://node"))
+
+	// The maintenance window is over.
+	done := testNodeCopy.DeepCopy()
+	done.Spec.Taints = []corev1.Taint{providerTaint}
+	done.Spec.ProviderID = "mock://node"
+	testP.notifyNodeSpec(done)
+
+	assert.NilError(t, <-waitForEvent(ctx, nr, func(e watch.Event) bool {
+		n := e.Object.(*corev1.Node)
+		return !n.Spec.Unschedulable && len(n.Spec.Taints) == 2
+	}))
+
+	n, err = nodes.Get(ctx, testNodeCopy.Name, metav1.GetOptions{})
+	assert.NilError(t, err)
+	assert.Check(t, cmp.DeepEqual(n.Spec.Taints, []corev1.Taint{externalTaint, providerTaint}))
+	assert.Check(t, cmp.Equal(n.Spec.ProviderID, "mock://node"))
+}
+
+func TestMergeTaints(t *testing.T) {
+	a := corev1.Taint{Key: "a", Effect: corev1.TaintEffectNoSchedule}
+	b := corev1.Taint{Key: "b", Effect: corev1.TaintEffectNoSchedule}
+	bNew := corev1.Taint{Key: "b", Value: "new", Effect: corev1.TaintEffectNoSchedule}
+	c := corev1.Taint{Key: "c", Effect: corev1.TaintEffectNoExecute}
+
+	assert.Check(t, cmp.DeepEqual(mergeTaints([]corev1.Taint{a, b, c}, []corev1.Taint{b, c}, []corev1.Taint{bNew}), []corev1.Taint{a, bNew}))
+	assert.Check(t, cmp.DeepEqual(mergeTaints([]corev1.Taint{a}, nil, []corev1.Taint{c}), []corev1.Taint{a, c}))
+	assert.Check(t, cmp.DeepEqual(mergeTaints([]corev1.Taint{a, b}, []corev1.Taint{b}, nil), []corev1.Taint{a}))
+}
+
+func TestNodeHealthChecks(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	c := testclient.NewClientset()
+	nodes := c.CoreV1().Nodes()
+	leases := c.CoordinationV1().Leases(corev1.NamespaceNodeLease)
+
+	var backendReachable atomic.Bool
+	interval := 10 * time.Millisecond
+	opts := []NodeControllerOpt{
+		WithNodePingInterval(interval),
+		WithNodeEnableLeaseV1WithRenewInterval(leases, 40, interval),
+		WithNodeHealthChecks(
+			HealthCheck{
+				Name:          "backend",
+				ConditionType: "BackendUnreachable",
+				Critical:      true,
+				Interval:      interval,
+				FailedReason:  "BackendUnreachable",
+				Check: func(context.Context) error {
+					if !backendReachable.Load() {
+						return pkgerrors.New("backend is unreachable")
+					}
+					return nil
+				},
+			},
+			HealthCheck{
+				Name:          "quota",
+				ConditionType: "QuotaExhausted",
+				Interval:      interval,
+				Check: func(context.Context) error {
+					return pkgerrors.New("no quota left")
+				},
+			},
+		),
+	}
+
+	testNode := testNode(t)
+	testNode.Status.Conditions = []corev1.NodeCondition{{Type: corev1.NodeReady, Status: corev1.ConditionTrue, Reason: "KubeletReady"}}
+	testNodeCopy := testNode.DeepCopy()
+	testP := &testNodeProvider{NodeProvider: &NaiveNodeProvider{}}
+	node, err := NewNodeController(testP, testNode, nodes, opts...)
+	assert.NilError(t, err)
+
+	defer func() {
+		cancel()
+		<-node.Done()
+		assert.NilError(t, node.Err())
+	}()
+
+	nw := makeWatch(ctx, t, nodes, testNodeCopy.Name)
+	defer nw.Stop()
+	nr := nw.ResultChan()
+
+	go node.Run(ctx) //nolint:errcheck
+
+	hasCondition := func(n *corev1.Node, conditionType corev1.NodeConditionType, status corev1.ConditionStatus) bool {
+		for _, c := range n.Status.Conditions {
+			if c.Type == conditionType {
+				return c.Status == status
+			}
+		}
+		return false
+	}
+
+	// Both failing checks are reported, but only the critical one makes the node NotReady and stops the lease from
+	// being renewed.
+	var notReady *corev1.Node
+	assert.NilError(t, <-waitForEvent(ctx, nr, func(e watch.Event) bool {
+		notReady = e.Object.(*corev1.Node)
+		return hasCondition(notReady, "BackendUnreachable", corev1.ConditionTrue) && hasCondition(notReady, "QuotaExhausted", corev1.ConditionTrue)
+	}))
+	assert.Check(t, hasCondition(notReady, corev1.NodeReady, corev1.ConditionFalse))
+	for _, c := range notReady.Status.Conditions {
+		if c.Type == corev1.NodeReady {
+			assert.Check(t, c.Reason == "BackendUnreachable", c.Reason)
+		}
+	}
+	time.Sleep(10 * interval)
+	_, err = leases.Get(ctx, testNodeCopy.Name, metav1.GetOptions{})
+	assert.Assert(t, errors.IsNotFound(err), "the lease should not be created while a critical check fails")
+
+	backendReachable.Store(true)
+
+	assert.NilError(t, <-waitForEvent(ctx, nr, func(e watch.Event) bool {
+		n := e.Object.(*corev1.Node)
+		return hasCondition(n, "BackendUnreachable", corev1.ConditionFalse) && hasCondition(n, "QuotaExhausted", corev1.ConditionTrue) &&
+			hasCondition(n, corev1.NodeReady, corev1.ConditionTrue)
+	}))
+	assert.NilError(t, wait.PollUntilContextCancel(ctx, interval, true, func(ctx context.Context) (bool, error) {
+		_, err := leases.Get(ctx, testNodeCopy.Name, metav1.GetOptions{})
+		return err == nil, nil
+	}))
+}
@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/virtual-kubelet/virtual-kubelet/log"
+	"github.com/virtual-kubelet/virtual-kubelet/node/api"
 	"github.com/virtual-kubelet/virtual-kubelet/trace"
 	"k8s.io/apiserver/pkg/authentication/authenticator"
 	"k8s.io/apiserver/pkg/authentication/authenticatorfactory"
@@ -14,6 +15,7 @@ import (
 	"k8s.io/apiserver/pkg/authentication/user"
 	"k8s.io/apiserver/pkg/authorization/authorizer"
 	"k8s.io/apiserver/pkg/authorization/authorizerfactory"
+	"k8s.io/apiserver/pkg/endpoints/request"
 	"k8s.io/apiserver/pkg/server/options"
 	"k8s.io/client-go/kubernetes"
 )
@@ -82,16 +84,19 @@ func handleAuth(auth Auth, w http.ResponseWriter, r *http.Request, next http.Han
 	})
 
 	ctx = log.WithLogger(ctx, logger)
+	ctx = request.WithUser(ctx, info.User)
 	r = r.WithContext(ctx)
+	api.SetAuditUser(ctx, info.User)
 
 	attrs := auth.GetRequestAttributes(info.User, r)
 
-	decision, _, err := auth.Authorize(ctx, attrs)
+	decision, reason, err := auth.Authorize(ctx, attrs)
 	if err != nil {
 		log.G(r.Context()).WithError(err).Error("Authorization error")
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	api.SetAuditDecision(ctx, decision == authorizer.DecisionAllow, reason)
 
 	if decision != authorizer.DecisionAllow {
 		http.Error(w, "Forbidden", http.StatusForbidden)
@@ -0,0 +1,169 @@
+package nodeutil
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/cache"
+	"k8s.io/apiserver/pkg/authentication/authenticator"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+)
+
+// AuthCacheConfig is used to configure the caches of CachedAuth.
+// Zero values are replaced with defaults, which are the same as the cache TTLs of WebhookAuth.
+// Negative TTLs disable caching of the respective results.
+type AuthCacheConfig struct {
+	// AuthenticationTTL is how long successful authentications are cached.
+	AuthenticationTTL time.Duration
+	// AllowTTL is how long requests which are allowed are cached.
+	AllowTTL time.Duration
+	// DenyTTL is how long requests which are not allowed are cached.
+	DenyTTL time.Duration
+	// Size is the maximum number of authentications, and of authorization decisions, that are cached.
+	Size int
+}
+
+// CachedAuth wraps the Auth with caches of authentication results and authorization decisions, so that repeated
+// requests (such as from `kubectl logs -f` or monitoring) do not cost a round-trip to the API server each time.
+//
+// Authentications are cached by the request's credentials: its Authorization header and TLS client certificate.
+// Requests without credentials and errors are never cached.
+func CachedAuth(auth Auth, cfg AuthCacheConfig) Auth {
+	if cfg.AuthenticationTTL == 0 {
+		cfg.AuthenticationTTL = 2 * time.Minute
+	}
+	if cfg.AllowTTL == 0 {
+		cfg.AllowTTL = 5 * time.Minute
+	}
+	if cfg.DenyTTL == 0 {
+		cfg.DenyTTL = 30 * time.Second
+	}
+	if cfg.Size <= 0 {
+		cfg.Size = 1024
+	}
+	return &authWrapper{
+		Request:                 &cachedAuthenticator{next: auth, ttl: cfg.AuthenticationTTL, cache: cache.NewLRUExpireCache(cfg.Size)},
+		RequestAttributesGetter: auth,
+		Authorizer:              &cachedAuthorizer{next: auth, allowTTL: cfg.AllowTTL, denyTTL: cfg.DenyTTL, cache: cache.NewLRUExpireCache(cfg.Size)},
+	}
+}
+
+type cachedAuthenticator struct {
+	next  authenticator.Request
+	ttl   time.Duration
+	cache *cache.LRUExpireCache
+}
+
+func (a *cachedAuthenticator) AuthenticateRequest(r *http.Request) (*authenticator.Response, bool, error) {
+	key, ok := credentialsKey(r)
+	if !ok || a.ttl < 0 {
+		return a.next.AuthenticateRequest(r)
+	}
+	if v, ok := a.cache.Get(key); ok {
+		return v.(*authenticator.Response), true, nil
+	}
+
+	resp, ok, err := a.next.AuthenticateRequest(r)
+	if err == nil && ok {
+		a.cache.Add(key, resp, a.ttl)
+	}
+	return resp, ok, err
+}
+
+// credentialsKey returns a hash of the credentials of the request, if it has any.
+func credentialsKey(r *http.Request) (string, bool) {
+	h := sha256.New()
+	var found bool
+	if v := r.Header.Get("Authorization"); v != "" {
+		h.Write([]byte(v))
+		found = true
+	}
+	h.Write([]byte{0})
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		h.Write(r.TLS.PeerCertificates[0].Raw)
+		found = true
+	}
+	return hex.EncodeToString(h.Sum(nil)), found
+}
+
+type cachedAuthorizer struct {
+	next     authorizer.Authorizer
+	allowTTL time.Duration
+	denyTTL  time.Duration
+	cache    *cache.LRUExpireCache
+}
+
+type authorizerResult struct {
+	decision authorizer.Decision
+	reason   string
+}
+
+func (a *cachedAuthorizer) Authorize(ctx context.Context, attrs authorizer.Attributes) (authorizer.Decision, string, error) {
+	key := attributesKey(attrs)
+	if v, ok := a.cache.Get(key); ok {
+		res := v.(authorizerResult)
+		return res.decision, res.reason, nil
+	}
+
+	decision, reason, err := a.next.Authorize(ctx, attrs)
+	if err != nil {
+		return decision, reason, err
+	}
+	ttl := a.denyTTL
+	if decision == authorizer.DecisionAllow {
+		ttl = a.allowTTL
+	}
+	if ttl > 0 {
+		a.cache.Add(key, authorizerResult{decision: decision, reason: reason}, ttl)
+	}
+	return decision, reason, nil
+}
+
+// attributesKey returns a key identifying the user and the request of the attributes.
+func attributesKey(attrs authorizer.Attributes) string {
+	var b strings.Builder
+	add := func(s string) {
+		b.WriteString(s)
+		b.WriteByte(0)
+	}
+
+	if u := attrs.GetUser(); u != nil {
+		add(u.GetName())
+		add(u.GetUID())
+		groups := append([]string{}, u.GetGroups()...)
+		sort.Strings(groups)
+		add(strconv.Itoa(len(groups)))
+		for _, g := range groups {
+			add(g)
+		}
+		extra := u.GetExtra()
+		keys := make([]string, 0, len(extra))
+		for k := range extra {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		add(strconv.Itoa(len(keys)))
+		for _, k := range keys {
+			add(k)
+			add(strconv.Itoa(len(extra[k])))
+			for _, v := range extra[k] {
+				add(v)
+			}
+		}
+	}
+	add(attrs.GetVerb())
+	add(attrs.GetNamespace())
+	add(attrs.GetAPIGroup())
+	add(attrs.GetAPIVersion())
+	add(attrs.GetResource())
+	add(attrs.GetSubresource())
+	add(attrs.GetName())
+	add(attrs.GetPath())
+	return b.String()
+}
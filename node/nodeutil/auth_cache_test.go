@@ -0,0 +1,66 @@
+package nodeutil
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestCachedAuth(t *testing.T) {
+	remote := &countingAuth{NodeRequestAttr: NodeRequestAttr{NodeName: "vk"}}
+	h := WithAuth(CachedAuth(remote, AuthCacheConfig{}), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	serve := func(token, path string) int {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		return rec.Code
+	}
+
+	for i := 0; i < 3; i++ {
+		assert.Check(t, is.Equal(serve("remote", "/stats/summary"), http.StatusOK))
+	}
+	assert.Check(t, is.Equal(remote.authns, 1))
+	assert.Check(t, is.Equal(remote.authzs, 1))
+
+	// Other requests of the same user are authorized separately.
+	assert.Check(t, is.Equal(serve("remote", "/containerLogs/default/pod/container"), http.StatusOK))
+	assert.Check(t, is.Equal(remote.authns, 1))
+	assert.Check(t, is.Equal(remote.authzs, 2))
+
+	// Failed authentications and requests without credentials are not cached.
+	assert.Check(t, is.Equal(serve("unknown", "/stats/summary"), http.StatusUnauthorized))
+	assert.Check(t, is.Equal(serve("unknown", "/stats/summary"), http.StatusUnauthorized))
+	assert.Check(t, is.Equal(serve("", "/stats/summary"), http.StatusUnauthorized))
+	assert.Check(t, is.Equal(serve("", "/stats/summary"), http.StatusUnauthorized))
+	assert.Check(t, is.Equal(remote.authns, 5))
+}
+
+func TestCachedAuthExpiry(t *testing.T) {
+	remote := &countingAuth{NodeRequestAttr: NodeRequestAttr{NodeName: "vk"}}
+	auth := CachedAuth(remote, AuthCacheConfig{AuthenticationTTL: 50 * time.Millisecond, AllowTTL: -1})
+
+	r := httptest.NewRequest(http.MethodGet, "/stats/summary", nil)
+	r.Header.Set("Authorization", "Bearer remote")
+	for i := 0; i < 2; i++ {
+		info, ok, err := auth.AuthenticateRequest(r)
+		assert.NilError(t, err)
+		assert.Assert(t, ok)
+		_, _, err = auth.Authorize(r.Context(), auth.GetRequestAttributes(info.User, r))
+		assert.NilError(t, err)
+	}
+	assert.Check(t, is.Equal(remote.authns, 1))
+	assert.Check(t, is.Equal(remote.authzs, 2), "allowed requests should not be cached with a negative TTL")
+
+	time.Sleep(100 * time.Millisecond)
+	_, _, err := auth.AuthenticateRequest(r)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(remote.authns, 2))
+}
@@ -0,0 +1,169 @@
+package nodeutil
+
+import (
+	"context"
+	"os"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"k8s.io/apiserver/pkg/authentication/authenticator"
+	"k8s.io/apiserver/pkg/authentication/request/bearertoken"
+	authnunion "k8s.io/apiserver/pkg/authentication/request/union"
+	"k8s.io/apiserver/pkg/authentication/request/x509"
+	"k8s.io/apiserver/pkg/authentication/token/tokenfile"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+	authzunion "k8s.io/apiserver/pkg/authorization/union"
+	"k8s.io/apiserver/pkg/server/dynamiccertificates"
+	"sigs.k8s.io/yaml"
+)
+
+// NewAuth creates an Auth from an authenticator and an authorizer, which are usually combined from the
+// authenticators and authorizers in this package.
+//
+// The returned Auth is instrumented.
+func NewAuth(authn authenticator.Request, attrs authorizer.RequestAttributesGetter, authz authorizer.Authorizer) Auth {
+	return &authWrapper{
+		Request:                 authn,
+		RequestAttributesGetter: attrs,
+		Authorizer:              authz,
+	}
+}
+
+// ChainAuth creates an Auth which authenticates requests with the first of the provided Auths that authenticates them,
+// and authorizes them with the first that has an opinion about them. The request attributes are taken from the first
+// Auth, so at least one Auth must be provided.
+//
+// This can be used to handle requests locally, and only fall back to an API server round-trip (such as with
+// WebhookAuth) for requests which cannot be handled locally:
+//
+//	auth := ChainAuth(NewAuth(X509Authenticator(ca), NodeRequestAttr{nodeName}, policy), webhookAuth)
+func ChainAuth(auths ...Auth) Auth {
+	authns := make([]authenticator.Request, 0, len(auths))
+	authzs := make([]authorizer.Authorizer, 0, len(auths))
+	for _, a := range auths {
+		authns = append(authns, a)
+		authzs = append(authzs, a)
+	}
+	return &authWrapper{
+		Request:                 authnunion.New(authns...),
+		RequestAttributesGetter: auths[0],
+		Authorizer:              authzunion.New(authzs...),
+	}
+}
+
+// X509Authenticator creates an authenticator which authenticates requests by their TLS client certificate, verified
+// against the CA bundle of the provider.
+// The common name of the certificate is the user name, and its organizations are the user's groups, as in Kubernetes.
+//
+// The CA provider can be a TLSFileReloader, so that the CA bundle is reloaded when it changes.
+func X509Authenticator(ca dynamiccertificates.CAContentProvider) authenticator.Request {
+	return x509.NewDynamic(ca.VerifyOptions, x509.CommonNameUserConversion)
+}
+
+// TokenFileAuthenticator creates an authenticator which authenticates requests by a bearer token from a static token
+// file. The file is in the format of the API server's --token-auth-file: a CSV file with lines of the form
+// `token,user,uid,"group1,group2"`.
+func TokenFileAuthenticator(p string) (authenticator.Request, error) {
+	tokens, err := tokenfile.NewCSV(p)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading token file")
+	}
+	return bearertoken.New(tokens), nil
+}
+
+// StaticPolicy is a set of rules which allow users to access the node's API.
+type StaticPolicy struct {
+	Rules []StaticPolicyRule `json:"rules"`
+}
+
+// StaticPolicyRule allows the users and groups it lists to make requests with the verbs to the subresources it lists.
+type StaticPolicyRule struct {
+	// Users and Groups are the users and groups the rule applies to.
+	// "*" matches all users.
+	Users  []string `json:"users,omitempty"`
+	Groups []string `json:"groups,omitempty"`
+	// Verbs are the verbs that are allowed, such as "get" or "create". "*" matches all verbs.
+	Verbs []string `json:"verbs"`
+	// Subresources are the node subresources that are allowed: "proxy", "log", "stats" or "metrics".
+	// "*" matches all subresources.
+	Subresources []string `json:"subresources"`
+}
+
+// StaticPolicyAuthorizerFromFile creates an authorizer from a StaticPolicy in a YAML or JSON file.
+//
+// For example, this policy allows the API server to access all subresources, and monitoring to get stats and metrics:
+//
+//	rules:
+//	- users: ["system:kube-apiserver"]
+//	  verbs: ["*"]
+//	  subresources: ["*"]
+//	- groups: ["monitoring"]
+//	  verbs: ["get"]
+//	  subresources: ["stats", "metrics"]
+func StaticPolicyAuthorizerFromFile(p string) (authorizer.Authorizer, error) {
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading policy file")
+	}
+	var policy StaticPolicy
+	if err := yaml.UnmarshalStrict(data, &policy); err != nil {
+		return nil, errors.Wrap(err, "error parsing policy file")
+	}
+	return NewStaticPolicyAuthorizer(policy)
+}
+
+// NewStaticPolicyAuthorizer creates an authorizer which allows the requests matching any rule of the policy.
+// It has no opinion about other requests, so that they can be authorized by another authorizer in a chain.
+func NewStaticPolicyAuthorizer(policy StaticPolicy) (authorizer.Authorizer, error) {
+	for i, r := range policy.Rules {
+		if len(r.Users) == 0 && len(r.Groups) == 0 {
+			return nil, errors.Errorf("rule %d: no users or groups specified", i)
+		}
+		if len(r.Verbs) == 0 {
+			return nil, errors.Errorf("rule %d: no verbs specified", i)
+		}
+		if len(r.Subresources) == 0 {
+			return nil, errors.Errorf("rule %d: no subresources specified", i)
+		}
+	}
+	return &staticPolicyAuthorizer{policy: policy}, nil
+}
+
+type staticPolicyAuthorizer struct {
+	policy StaticPolicy
+}
+
+func (a *staticPolicyAuthorizer) Authorize(ctx context.Context, attrs authorizer.Attributes) (authorizer.Decision, string, error) {
+	u := attrs.GetUser()
+	if u == nil {
+		return authorizer.DecisionNoOpinion, "", nil
+	}
+	for i, r := range a.policy.Rules {
+		if r.appliesTo(u) && matchesPolicyValue(r.Verbs, attrs.GetVerb()) && matchesPolicyValue(r.Subresources, attrs.GetSubresource()) {
+			return authorizer.DecisionAllow, "allowed by static policy rule " + strconv.Itoa(i), nil
+		}
+	}
+	return authorizer.DecisionNoOpinion, "", nil
+}
+
+func (r StaticPolicyRule) appliesTo(u user.Info) bool {
+	if matchesPolicyValue(r.Users, u.GetName()) {
+		return true
+	}
+	for _, g := range u.GetGroups() {
+		if matchesPolicyValue(r.Groups, g) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesPolicyValue(values []string, v string) bool {
+	for _, value := range values {
+		if value == "*" || value == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,188 @@
+package nodeutil
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+	"k8s.io/apiserver/pkg/authentication/authenticator"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+	"k8s.io/apiserver/pkg/server/dynamiccertificates"
+)
+
+// countingAuth authenticates requests with a "Bearer remote" token as "remote-user", and allows all requests,
+// counting the calls like the round-trips of WebhookAuth.
+type countingAuth struct {
+	NodeRequestAttr
+	authns int
+	authzs int
+}
+
+func (a *countingAuth) AuthenticateRequest(r *http.Request) (*authenticator.Response, bool, error) {
+	a.authns++
+	if r.Header.Get("Authorization") != "Bearer remote" {
+		return nil, false, nil
+	}
+	return &authenticator.Response{User: &user.DefaultInfo{Name: "remote-user"}}, true, nil
+}
+
+func (a *countingAuth) Authorize(context.Context, authorizer.Attributes) (authorizer.Decision, string, error) {
+	a.authzs++
+	return authorizer.DecisionAllow, "", nil
+}
+
+func (ca *testCA) clientCert(t *testing.T, name string, groups ...string) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NilError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(ca.serial.Add(1)),
+		Subject:      pkix.Name{CommonName: name, Organization: groups},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, key.Public(), ca.key)
+	assert.NilError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NilError(t, err)
+	return cert
+}
+
+func requestWithCert(cert *x509.Certificate) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/containerLogs/default/pod/container", nil)
+	r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	return r
+}
+
+func TestX509Authenticator(t *testing.T) {
+	ca := newTestCA(t, time.Hour)
+	caContent, err := dynamiccertificates.NewStaticCAContent("test", ca.pem())
+	assert.NilError(t, err)
+	authn := X509Authenticator(caContent)
+
+	resp, ok, err := authn.AuthenticateRequest(requestWithCert(ca.clientCert(t, "alice", "admins", "devs")))
+	assert.NilError(t, err)
+	assert.Assert(t, ok)
+	assert.Check(t, is.Equal(resp.User.GetName(), "alice"))
+	assert.Check(t, is.Len(resp.User.GetGroups(), 2))
+	assert.Check(t, is.Contains(resp.User.GetGroups(), "admins"))
+	assert.Check(t, is.Contains(resp.User.GetGroups(), "devs"))
+
+	other := newTestCA(t, time.Hour)
+	_, ok, err = authn.AuthenticateRequest(requestWithCert(other.clientCert(t, "mallory")))
+	assert.Check(t, !ok)
+	assert.Check(t, err != nil)
+}
+
+func TestTokenFileAuthenticator(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "tokens.csv")
+	assert.NilError(t, os.WriteFile(p, []byte("secret-token,bob,uid-1,\"monitoring,devs\"\n"), 0600))
+	authn, err := TokenFileAuthenticator(p)
+	assert.NilError(t, err)
+
+	r := httptest.NewRequest(http.MethodGet, "/stats/summary", nil)
+	r.Header.Set("Authorization", "Bearer secret-token")
+	resp, ok, err := authn.AuthenticateRequest(r)
+	assert.NilError(t, err)
+	assert.Assert(t, ok)
+	assert.Check(t, is.Equal(resp.User.GetName(), "bob"))
+	assert.Check(t, is.DeepEqual(resp.User.GetGroups(), []string{"monitoring", "devs"}))
+
+	r.Header.Set("Authorization", "Bearer wrong-token")
+	_, ok, _ = authn.AuthenticateRequest(r)
+	assert.Check(t, !ok)
+
+	_, err = TokenFileAuthenticator(filepath.Join(t.TempDir(), "missing.csv"))
+	assert.Check(t, is.ErrorContains(err, "error reading token file"))
+}
+
+func TestStaticPolicyAuthorizer(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "policy.yaml")
+	assert.NilError(t, os.WriteFile(p, []byte(`
+rules:
+- users: ["system:kube-apiserver"]
+  verbs: ["*"]
+  subresources: ["*"]
+- groups: ["monitoring"]
+  verbs: ["get"]
+  subresources: ["stats", "metrics"]
+`), 0600))
+	authz, err := StaticPolicyAuthorizerFromFile(p)
+	assert.NilError(t, err)
+
+	decide := func(u user.Info, verb, subresource string) authorizer.Decision {
+		d, _, err := authz.Authorize(context.Background(), authorizer.AttributesRecord{User: u, Verb: verb, Subresource: subresource})
+		assert.NilError(t, err)
+		return d
+	}
+	apiServer := &user.DefaultInfo{Name: "system:kube-apiserver"}
+	monitoring := &user.DefaultInfo{Name: "prometheus", Groups: []string{"monitoring"}}
+	assert.Check(t, is.Equal(decide(apiServer, "create", "proxy"), authorizer.DecisionAllow))
+	assert.Check(t, is.Equal(decide(monitoring, "get", "metrics"), authorizer.DecisionAllow))
+	assert.Check(t, is.Equal(decide(monitoring, "create", "proxy"), authorizer.DecisionNoOpinion))
+	assert.Check(t, is.Equal(decide(&user.DefaultInfo{Name: "alice"}, "get", "log"), authorizer.DecisionNoOpinion))
+
+	assert.NilError(t, os.WriteFile(p, []byte("rules:\n- users: [alice]\n  verbs: [get]\n"), 0600))
+	_, err = StaticPolicyAuthorizerFromFile(p)
+	assert.Check(t, is.ErrorContains(err, "rule 0: no subresources specified"))
+	assert.NilError(t, os.WriteFile(p, []byte("rules:\n- user: alice\n"), 0600))
+	_, err = StaticPolicyAuthorizerFromFile(p)
+	assert.Check(t, is.ErrorContains(err, "error parsing policy file"))
+}
+
+func TestChainAuth(t *testing.T) {
+	ca := newTestCA(t, time.Hour)
+	caContent, err := dynamiccertificates.NewStaticCAContent("test", ca.pem())
+	assert.NilError(t, err)
+	policy, err := NewStaticPolicyAuthorizer(StaticPolicy{Rules: []StaticPolicyRule{
+		{Groups: []string{"admins"}, Verbs: []string{"*"}, Subresources: []string{"*"}},
+	}})
+	assert.NilError(t, err)
+
+	remote := &countingAuth{NodeRequestAttr: NodeRequestAttr{NodeName: "vk"}}
+	local := NewAuth(X509Authenticator(caContent), NodeRequestAttr{NodeName: "vk"}, policy)
+	h := WithAuth(ChainAuth(local, remote), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	// Requests which can be handled locally do not fall back to the remote auth.
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, requestWithCert(ca.clientCert(t, "alice", "admins")))
+	assert.Check(t, is.Equal(rec.Code, http.StatusOK))
+	assert.Check(t, is.Equal(remote.authns, 0))
+	assert.Check(t, is.Equal(remote.authzs, 0))
+
+	// Users which are not allowed by the policy are authorized remotely.
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, requestWithCert(ca.clientCert(t, "bob", "devs")))
+	assert.Check(t, is.Equal(rec.Code, http.StatusOK))
+	assert.Check(t, is.Equal(remote.authns, 0))
+	assert.Check(t, is.Equal(remote.authzs, 1))
+
+	// Requests without a client certificate are authenticated remotely.
+	r := httptest.NewRequest(http.MethodGet, "/stats/summary", nil)
+	r.Header.Set("Authorization", "Bearer remote")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	assert.Check(t, is.Equal(rec.Code, http.StatusOK))
+	assert.Check(t, is.Equal(remote.authns, 1))
+
+	r.Header.Set("Authorization", "Bearer unknown")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	assert.Check(t, is.Equal(rec.Code, http.StatusUnauthorized))
+}
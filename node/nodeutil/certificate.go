@@ -0,0 +1,178 @@
+package nodeutil
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	certificatesv1 "k8s.io/api/certificates/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/certificate"
+)
+
+// CertificateManagerConfig is used to configure a certificate manager for the node.
+type CertificateManagerConfig struct {
+	// Client is used to request certificates through the CertificateSigningRequest API.
+	// This field is required.
+	Client kubernetes.Interface
+	// NodeName is the name of the node the certificate is for.
+	// This field is required.
+	NodeName string
+
+	// IPAddresses and DNSNames are the addresses the serving certificate is valid for.
+	// At least one is required for serving certificates, and they are ignored for client certificates.
+	IPAddresses []net.IP
+	DNSNames    []string
+
+	// CertDirectory is the directory the issued certificates and their keys are stored in, so that they are kept
+	// across restarts. If it is empty, certificates are only kept in memory, and requested again on every start.
+	CertDirectory string
+
+	// RequestedLifetime is the lifetime to request for the certificates. The signer may choose to ignore it.
+	// If it is zero, the default lifetime of the signer is used.
+	RequestedLifetime time.Duration
+
+	// BootstrapCertificatePEM and BootstrapKeyPEM are used until a certificate is issued, if no certificate is stored
+	// in CertDirectory.
+	BootstrapCertificatePEM []byte
+	BootstrapKeyPEM         []byte
+}
+
+// NewServingCertificateManager creates a manager of the node's serving certificate, like the kubelet does with
+// --rotate-server-certificates.
+//
+// The certificate is requested from the kubernetes.io/kubelet-serving signer, and requested again before it
+// expires. Certificates of this signer are not approved automatically by Kubernetes, so an approver must be deployed
+// in the cluster.
+//
+// The manager must be started before it issues any certificates. Use WithCertificateManager to serve them.
+func NewServingCertificateManager(cfg CertificateManagerConfig) (certificate.Manager, error) {
+	if len(cfg.IPAddresses) == 0 && len(cfg.DNSNames) == 0 {
+		return nil, errors.New("serving certificates require at least one IP address or DNS name")
+	}
+	return newCertificateManager(cfg, "kubelet-server", certificatesv1.KubeletServingSignerName, &x509.CertificateRequest{
+		Subject: pkix.Name{
+			CommonName:   "system:node:" + cfg.NodeName,
+			Organization: []string{"system:nodes"},
+		},
+		IPAddresses: cfg.IPAddresses,
+		DNSNames:    cfg.DNSNames,
+	}, []certificatesv1.KeyUsage{
+		certificatesv1.UsageDigitalSignature,
+		certificatesv1.UsageServerAuth,
+	})
+}
+
+// NewClientCertificateManager creates a manager of the node's client certificate for the API server, like the kubelet
+// does with --rotate-certificates.
+//
+// The certificate is requested from the kubernetes.io/kube-apiserver-client-kubelet signer, and requested again
+// before it expires. Use the manager's Current certificate in the transport of the clients of the node.
+func NewClientCertificateManager(cfg CertificateManagerConfig) (certificate.Manager, error) {
+	return newCertificateManager(cfg, "kubelet-client", certificatesv1.KubeAPIServerClientKubeletSignerName, &x509.CertificateRequest{
+		Subject: pkix.Name{
+			CommonName:   "system:node:" + cfg.NodeName,
+			Organization: []string{"system:nodes"},
+		},
+	}, []certificatesv1.KeyUsage{
+		certificatesv1.UsageDigitalSignature,
+		certificatesv1.UsageClientAuth,
+	})
+}
+
+// newCertificateManager creates a certificate manager.
+//
+// Based on NewKubeletServerCertificateManager and NewKubeletClientCertificateManager in pkg/kubelet/certificate.
+func newCertificateManager(cfg CertificateManagerConfig, pairNamePrefix, signerName string, template *x509.CertificateRequest, usages []certificatesv1.KeyUsage) (certificate.Manager, error) {
+	if cfg.Client == nil {
+		return nil, errors.New("no client provided")
+	}
+	if cfg.NodeName == "" {
+		return nil, errors.New("no node name provided")
+	}
+
+	var store certificate.Store = &memoryCertificateStore{}
+	if cfg.CertDirectory != "" {
+		var err error
+		store, err = certificate.NewFileStore(pairNamePrefix, cfg.CertDirectory, cfg.CertDirectory, "", "")
+		if err != nil {
+			return nil, errors.Wrap(err, "error creating certificate store")
+		}
+	}
+
+	var lifetime *time.Duration
+	if cfg.RequestedLifetime > 0 {
+		lifetime = &cfg.RequestedLifetime
+	}
+
+	m, err := certificate.NewManager(&certificate.Config{
+		ClientsetFn: func(*tls.Certificate) (kubernetes.Interface, error) {
+			return cfg.Client, nil
+		},
+		Template:                     template,
+		SignerName:                   signerName,
+		Usages:                       usages,
+		RequestedCertificateLifetime: lifetime,
+		CertificateStore:             store,
+		BootstrapCertificatePEM:      cfg.BootstrapCertificatePEM,
+		BootstrapKeyPEM:              cfg.BootstrapKeyPEM,
+		Name:                         pairNamePrefix,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating certificate manager")
+	}
+	return m, nil
+}
+
+// WithCertificateManager makes a TLS config option which serves the current certificate of the manager, so that
+// rotated certificates are used without restarting the server.
+// Handshakes fail until the manager has a certificate.
+func WithCertificateManager(m certificate.Manager) func(*tls.Config) error {
+	return func(cfg *tls.Config) error {
+		cfg.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert := m.Current()
+			if cert == nil {
+				return nil, fmt.Errorf("no serving certificate available")
+			}
+			return cert, nil
+		}
+		return nil
+	}
+}
+
+// memoryCertificateStore is a certificate.Store which only keeps the certificate in memory.
+type memoryCertificateStore struct {
+	mu   sync.Mutex
+	cert *tls.Certificate
+}
+
+func (s *memoryCertificateStore) Current() (*tls.Certificate, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cert == nil {
+		noKeyErr := certificate.NoCertKeyError("no certificate has been issued yet")
+		return nil, &noKeyErr
+	}
+	return s.cert, nil
+}
+
+func (s *memoryCertificateStore) Update(certData, keyData []byte) (*tls.Certificate, error) {
+	cert, err := tls.X509KeyPair(certData, keyData)
+	if err != nil {
+		return nil, err
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cert = &cert
+	return s.cert, nil
+}
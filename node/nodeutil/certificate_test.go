@@ -0,0 +1,272 @@
+package nodeutil
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+	certificatesv1 "k8s.io/api/certificates/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes/fake"
+	core "k8s.io/client-go/testing"
+)
+
+// testCA signs the certificate signing requests created in a fake clientset.
+type testCA struct {
+	cert     *x509.Certificate
+	key      *ecdsa.PrivateKey
+	lifetime time.Duration
+	serial   atomic.Int64
+}
+
+func newTestCA(t *testing.T, lifetime time.Duration) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NilError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	assert.NilError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NilError(t, err)
+	ca := &testCA{cert: cert, key: key, lifetime: lifetime}
+	ca.serial.Store(1)
+	return ca
+}
+
+func (ca *testCA) sign(csr *certificatesv1.CertificateSigningRequest) ([]byte, error) {
+	block, _ := pem.Decode(csr.Spec.Request)
+	if block == nil {
+		return nil, fmt.Errorf("invalid csr pem")
+	}
+	req, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().Truncate(time.Second)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(ca.serial.Add(1)),
+		Subject:      req.Subject,
+		IPAddresses:  req.IPAddresses,
+		DNSNames:     req.DNSNames,
+		NotBefore:    now,
+		NotAfter:     now.Add(ca.lifetime),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, req.PublicKey, ca.key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), nil
+}
+
+// approveAndSign approves and signs all pending certificate signing requests until the context is cancelled.
+func (ca *testCA) approveAndSign(ctx context.Context, t *testing.T, client *fake.Clientset) {
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		csrs, err := client.CertificatesV1().CertificateSigningRequests().List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return
+		}
+		for _, csr := range csrs.Items {
+			if len(csr.Status.Certificate) > 0 {
+				continue
+			}
+			cert, err := ca.sign(&csr)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			csr.Status.Conditions = append(csr.Status.Conditions, certificatesv1.CertificateSigningRequestCondition{
+				Type:   certificatesv1.CertificateApproved,
+				Status: "True",
+			})
+			csr.Status.Certificate = cert
+			if _, err := client.CertificatesV1().CertificateSigningRequests().UpdateStatus(ctx, &csr, metav1.UpdateOptions{}); err != nil {
+				t.Error(err)
+			}
+		}
+	}, 10*time.Millisecond)
+}
+
+// newCSRClientset returns a fake clientset which, like the API server, generates the names of certificate signing
+// requests and filters them by name in lists and watches.
+func newCSRClientset() *fake.Clientset {
+	client := fake.NewClientset()
+	gvr := certificatesv1.SchemeGroupVersion.WithResource("certificatesigningrequests")
+	gvk := certificatesv1.SchemeGroupVersion.WithKind("CertificateSigningRequest")
+
+	var n atomic.Int64
+	client.PrependReactor("create", "certificatesigningrequests", func(action core.Action) (bool, runtime.Object, error) {
+		csr := action.(core.CreateAction).GetObject().(*certificatesv1.CertificateSigningRequest)
+		if csr.Name == "" {
+			csr.Name = fmt.Sprintf("%s%d", csr.GenerateName, n.Add(1))
+		}
+		csr.UID = types.UID(csr.Name)
+		return false, nil, nil
+	})
+	client.PrependReactor("list", "certificatesigningrequests", func(action core.Action) (bool, runtime.Object, error) {
+		name, ok := action.(core.ListAction).GetListRestrictions().Fields.RequiresExactMatch("metadata.name")
+		if !ok {
+			return false, nil, nil
+		}
+		obj, err := client.Tracker().List(gvr, gvk, "")
+		if err != nil {
+			return true, nil, err
+		}
+		list := obj.(*certificatesv1.CertificateSigningRequestList)
+		filtered := list.DeepCopy()
+		filtered.Items = nil
+		for _, csr := range list.Items {
+			if csr.Name == name {
+				filtered.Items = append(filtered.Items, csr)
+			}
+		}
+		return true, filtered, nil
+	})
+	client.PrependWatchReactor("certificatesigningrequests", func(action core.Action) (bool, watch.Interface, error) {
+		name, _ := action.(core.WatchAction).GetWatchRestrictions().Fields.RequiresExactMatch("metadata.name")
+		matches := func(obj runtime.Object) bool {
+			csr, ok := obj.(*certificatesv1.CertificateSigningRequest)
+			return name == "" || (ok && csr.Name == name)
+		}
+		w, err := client.Tracker().Watch(gvr, "")
+		if err != nil {
+			return true, nil, err
+		}
+		// The tracker does not replay changes made between a list and a watch, so start with the current objects.
+		obj, err := client.Tracker().List(gvr, gvk, "")
+		if err != nil {
+			w.Stop()
+			return true, nil, err
+		}
+		ch := make(chan watch.Event)
+		proxy := watch.NewProxyWatcher(ch)
+		send := func(e watch.Event) bool {
+			if !matches(e.Object) {
+				return true
+			}
+			select {
+			case ch <- e:
+				return true
+			case <-proxy.StopChan():
+				return false
+			}
+		}
+		go func() {
+			defer close(ch)
+			defer w.Stop()
+			for i := range obj.(*certificatesv1.CertificateSigningRequestList).Items {
+				if !send(watch.Event{Type: watch.Modified, Object: &obj.(*certificatesv1.CertificateSigningRequestList).Items[i]}) {
+					return
+				}
+			}
+			for e := range w.ResultChan() {
+				if !send(e) {
+					return
+				}
+			}
+		}()
+		return true, proxy, nil
+	})
+	return client
+}
+
+func TestServingCertificateManager(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	client := newCSRClientset()
+	ca := newTestCA(t, 3*time.Second)
+	go ca.approveAndSign(ctx, t, client)
+
+	m, err := NewServingCertificateManager(CertificateManagerConfig{
+		Client:      client,
+		NodeName:    "vk",
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		DNSNames:    []string{"vk.example.com"},
+	})
+	assert.NilError(t, err)
+	assert.Check(t, is.Nil(m.Current()))
+	m.Start()
+	defer m.Stop()
+
+	var first *tls.Certificate
+	assert.NilError(t, wait.PollUntilContextCancel(ctx, 10*time.Millisecond, true, func(context.Context) (bool, error) {
+		first = m.Current()
+		return first != nil, nil
+	}))
+	assert.Check(t, is.Equal(first.Leaf.Subject.CommonName, "system:node:vk"))
+	assert.Check(t, is.DeepEqual(first.Leaf.DNSNames, []string{"vk.example.com"}))
+
+	csrs, err := client.CertificatesV1().CertificateSigningRequests().List(ctx, metav1.ListOptions{})
+	assert.NilError(t, err)
+	assert.Assert(t, is.Len(csrs.Items, 1))
+	assert.Check(t, is.Equal(csrs.Items[0].Spec.SignerName, certificatesv1.KubeletServingSignerName))
+
+	// The certificate is served by servers using the manager.
+	tlsCfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	assert.NilError(t, WithCertificateManager(m)(tlsCfg))
+	l, err := tls.Listen("tcp", "127.0.0.1:0", tlsCfg)
+	assert.NilError(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake() //nolint:errcheck
+			conn.Close()
+		}
+	}()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	peerSerial := func() *big.Int {
+		conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{RootCAs: pool, ServerName: "vk.example.com", MinVersion: tls.VersionTLS12})
+		assert.NilError(t, err)
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].SerialNumber
+	}
+	assert.Check(t, is.Equal(peerSerial().Cmp(first.Leaf.SerialNumber), 0))
+
+	// The certificate is rotated before it expires, and the new one is served without restarting the server.
+	var rotated *tls.Certificate
+	assert.NilError(t, wait.PollUntilContextCancel(ctx, 10*time.Millisecond, true, func(context.Context) (bool, error) {
+		rotated = m.Current()
+		return rotated.Leaf.SerialNumber.Cmp(first.Leaf.SerialNumber) != 0, nil
+	}))
+	assert.Check(t, rotated.Leaf.NotAfter.After(first.Leaf.NotAfter))
+	assert.Check(t, time.Now().Before(first.Leaf.NotAfter))
+	assert.Check(t, is.Equal(peerSerial().Cmp(rotated.Leaf.SerialNumber), 0))
+}
+
+func TestNewServingCertificateManagerRequiresAddresses(t *testing.T) {
+	_, err := NewServingCertificateManager(CertificateManagerConfig{Client: fake.NewClientset(), NodeName: "vk"})
+	assert.Check(t, is.ErrorContains(err, "at least one IP address or DNS name"))
+}
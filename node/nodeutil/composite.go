@@ -0,0 +1,616 @@
+package nodeutil
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"github.com/pkg/errors"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
+	"github.com/virtual-kubelet/virtual-kubelet/log"
+	"github.com/virtual-kubelet/virtual-kubelet/node"
+	"github.com/virtual-kubelet/virtual-kubelet/node/api"
+	"github.com/virtual-kubelet/virtual-kubelet/trace"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	klog "k8s.io/klog/v2"
+	statsv1alpha1 "k8s.io/kubelet/pkg/apis/stats/v1alpha1"
+)
+
+// CompositeBackend is a backend of a composite provider.
+type CompositeBackend struct {
+	// Name identifies the backend to the routing policy.
+	Name string
+	// NewProvider creates the provider of the backend. It is passed a copy of the node, so that the capacity and
+	// conditions of the backends can be aggregated.
+	NewProvider NewProviderFunc
+}
+
+// PodRouteFunc returns the names of the backends a pod may be created on, in order of preference.
+// If it returns no backends, the pod may be created on any backend, in the order they are configured in.
+type PodRouteFunc func(ctx context.Context, pod *v1.Pod) ([]string, error)
+
+// CompositeConfig configures a composite provider.
+type CompositeConfig struct {
+	// Backends are the backends pods are routed to. The first backend configures the node, except for its
+	// capacity, allocatable resources and conditions, which are aggregated from all backends.
+	Backends []CompositeBackend
+	// Route routes pods to backends. If it is nil, pods are routed to all backends, in the order they are configured
+	// in.
+	Route PodRouteFunc
+	// ShouldFailover decides whether a pod which the backend failed to create is created on the next backend it is
+	// routed to instead. It should only return true for errors after which the pod does not exist in the backend.
+	// If it is nil, pods are not failed over.
+	ShouldFailover func(backend string, err error) bool
+}
+
+// NewCompositeProvider creates a provider which fronts several backends, such as spot and on-demand capacity.
+//
+// Pods are created on the backends they are routed to. Backends whose node provider failed its last ping are tried
+// after the healthy ones. All other calls for a pod, including the streaming endpoints, are delegated to the backend
+// which owns it. The owner of a pod is remembered when the pod is created, listed or notified, and looked up with
+// GetPod on each backend otherwise.
+//
+// The pods and stats of all backends are merged. The node's capacity and allocatable resources are the sum of those
+// of the backends, and it is considered healthy for a condition, such as being ready or not having memory pressure,
+// as long as any backend is. Backends which do not return a node provider are always considered ready.
+//
+// The composite provider implements node.PodNotifier only if all the providers of the backends do. Other optional
+// interfaces of the providers are not exposed.
+func NewCompositeProvider(cfg CompositeConfig) NewProviderFunc {
+	return func(pcfg ProviderConfig) (Provider, node.NodeProvider, error) {
+		if len(cfg.Backends) == 0 {
+			return nil, nil, errdefs.InvalidInput("composite provider requires at least one backend")
+		}
+
+		c := &compositeProvider{
+			route:          cfg.Route,
+			shouldFailover: cfg.ShouldFailover,
+			byName:         make(map[string]*compositeBackend, len(cfg.Backends)),
+			owners:         make(map[types.NamespacedName]*compositeBackend),
+		}
+		notifiers := true
+		nodeProviders := false
+		for _, b := range cfg.Backends {
+			if _, ok := c.byName[b.Name]; ok {
+				return nil, nil, errdefs.InvalidInputf("duplicate composite provider backend %q", b.Name)
+			}
+			backendNode := pcfg.Node.DeepCopy()
+			bcfg := pcfg
+			bcfg.Node = backendNode
+			p, np, err := b.NewProvider(bcfg)
+			if err != nil {
+				return nil, nil, errors.Wrapf(err, "error creating provider of backend %q", b.Name)
+			}
+			if np == nil {
+				setNodeReady(backendNode)
+			} else {
+				nodeProviders = true
+			}
+			_, ok := p.(node.PodNotifier)
+			notifiers = notifiers && ok
+
+			backend := &compositeBackend{name: b.Name, provider: p, nodeProvider: np, node: backendNode}
+			c.backends = append(c.backends, backend)
+			c.byName[b.Name] = backend
+		}
+
+		*pcfg.Node = *c.aggregateNode()
+
+		var np node.NodeProvider
+		if nodeProviders {
+			np = &compositeNodeProvider{c: c}
+		}
+		if notifiers {
+			return &compositeNotifierProvider{c}, np, nil
+		}
+		return c, np, nil
+	}
+}
+
+type compositeBackend struct {
+	name         string
+	provider     Provider
+	nodeProvider node.NodeProvider
+
+	// node and unhealthy are guarded by the lock of the compositeProvider.
+	node      *v1.Node
+	unhealthy bool
+}
+
+type compositeProvider struct {
+	backends       []*compositeBackend
+	byName         map[string]*compositeBackend
+	route          PodRouteFunc
+	shouldFailover func(string, error) bool
+
+	mu     sync.Mutex
+	owners map[types.NamespacedName]*compositeBackend
+}
+
+// compositeNotifierProvider is a compositeProvider whose backends are all node.PodNotifiers.
+type compositeNotifierProvider struct {
+	*compositeProvider
+}
+
+func (c *compositeNotifierProvider) NotifyPods(ctx context.Context, f func(*v1.Pod)) {
+	for _, b := range c.backends {
+		b.provider.(node.PodNotifier).NotifyPods(ctx, func(pod *v1.Pod) {
+			c.setOwner(pod.Namespace, pod.Name, b)
+			f(pod)
+		})
+	}
+}
+
+func (c *compositeProvider) setOwner(namespace, name string, b *compositeBackend) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.owners[types.NamespacedName{Namespace: namespace, Name: name}] = b
+}
+
+func (c *compositeProvider) forgetOwner(namespace, name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.owners, types.NamespacedName{Namespace: namespace, Name: name})
+}
+
+// owner returns the backend which owns the pod, looking it up on each backend if it is not known.
+func (c *compositeProvider) owner(ctx context.Context, namespace, name string) (*compositeBackend, error) {
+	c.mu.Lock()
+	b, ok := c.owners[types.NamespacedName{Namespace: namespace, Name: name}]
+	c.mu.Unlock()
+	if ok {
+		return b, nil
+	}
+
+	for _, b := range c.backends {
+		pod, err := b.provider.GetPod(ctx, namespace, name)
+		if err != nil {
+			if errdefs.IsNotFound(err) {
+				continue
+			}
+			return nil, errors.Wrapf(err, "error looking up pod on backend %q", b.name)
+		}
+		if pod != nil {
+			c.setOwner(namespace, name, b)
+			return b, nil
+		}
+	}
+	return nil, errdefs.NotFoundf("pod %s/%s not found on any backend", namespace, name)
+}
+
+// candidates returns the backends the pod is routed to, with the unhealthy ones last.
+func (c *compositeProvider) candidates(ctx context.Context, pod *v1.Pod) ([]*compositeBackend, error) {
+	var names []string
+	if c.route != nil {
+		var err error
+		names, err = c.route(ctx, pod)
+		if err != nil {
+			return nil, errors.Wrap(err, "error routing pod")
+		}
+	}
+
+	var routed []*compositeBackend
+	if len(names) == 0 {
+		routed = c.backends
+	} else {
+		for _, name := range names {
+			b, ok := c.byName[name]
+			if !ok {
+				return nil, errdefs.InvalidInputf("pod routed to unknown backend %q", name)
+			}
+			routed = append(routed, b)
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	candidates := make([]*compositeBackend, 0, len(routed))
+	for _, b := range routed {
+		if !b.unhealthy {
+			candidates = append(candidates, b)
+		}
+	}
+	for _, b := range routed {
+		if b.unhealthy {
+			candidates = append(candidates, b)
+		}
+	}
+	return candidates, nil
+}
+
+// CreatePod creates the pod on the backends it is routed to, failing over to the next backend when allowed.
+func (c *compositeProvider) CreatePod(ctx context.Context, pod *v1.Pod) error {
+	ctx, span := trace.StartSpan(ctx, "compositeProvider.CreatePod")
+	defer span.End()
+
+	c.mu.Lock()
+	b, ok := c.owners[types.NamespacedName{Namespace: pod.Namespace, Name: pod.Name}]
+	c.mu.Unlock()
+	if ok {
+		return b.provider.CreatePod(ctx, pod)
+	}
+
+	candidates, err := c.candidates(ctx, pod)
+	if err != nil {
+		span.SetStatus(err)
+		return err
+	}
+	for i, b := range candidates {
+		attempt := pod
+		if i < len(candidates)-1 && c.shouldFailover != nil {
+			// The pod may be modified by the backend, and must be passed unmodified to the next one.
+			attempt = pod.DeepCopy()
+		}
+		err = b.provider.CreatePod(ctx, attempt)
+		if err == nil {
+			c.setOwner(pod.Namespace, pod.Name, b)
+			return nil
+		}
+		if i == len(candidates)-1 || c.shouldFailover == nil || !c.shouldFailover(b.name, err) {
+			break
+		}
+		log.G(ctx).WithError(err).WithField("backend", b.name).Warn("Failing over pod to the next backend")
+	}
+	span.SetStatus(err)
+	return err
+}
+
+// UpdatePod updates the pod on the backend which owns it.
+func (c *compositeProvider) UpdatePod(ctx context.Context, pod *v1.Pod) error {
+	b, err := c.owner(ctx, pod.Namespace, pod.Name)
+	if err != nil {
+		return err
+	}
+	return b.provider.UpdatePod(ctx, pod)
+}
+
+// DeletePod deletes the pod from the backend which owns it.
+func (c *compositeProvider) DeletePod(ctx context.Context, pod *v1.Pod) error {
+	b, err := c.owner(ctx, pod.Namespace, pod.Name)
+	if err != nil {
+		return err
+	}
+	if err := b.provider.DeletePod(ctx, pod); err != nil {
+		return err
+	}
+	c.forgetOwner(pod.Namespace, pod.Name)
+	return nil
+}
+
+// GetPod gets the pod from the backend which owns it.
+func (c *compositeProvider) GetPod(ctx context.Context, namespace, name string) (*v1.Pod, error) {
+	b, err := c.owner(ctx, namespace, name)
+	if err != nil {
+		return nil, err
+	}
+	pod, err := b.provider.GetPod(ctx, namespace, name)
+	if errdefs.IsNotFound(err) {
+		c.forgetOwner(namespace, name)
+	}
+	return pod, err
+}
+
+// GetPodStatus gets the status of the pod from the backend which owns it.
+func (c *compositeProvider) GetPodStatus(ctx context.Context, namespace, name string) (*v1.PodStatus, error) {
+	b, err := c.owner(ctx, namespace, name)
+	if err != nil {
+		return nil, err
+	}
+	status, err := b.provider.GetPodStatus(ctx, namespace, name)
+	if errdefs.IsNotFound(err) {
+		c.forgetOwner(namespace, name)
+	}
+	return status, err
+}
+
+// GetPods merges the pods of all backends. It fails if any backend fails, so that the pods of a backend are not
+// mistaken for missing.
+func (c *compositeProvider) GetPods(ctx context.Context) ([]*v1.Pod, error) {
+	var pods []*v1.Pod
+	for _, b := range c.backends {
+		bpods, err := b.provider.GetPods(ctx)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error listing pods of backend %q", b.name)
+		}
+		for _, pod := range bpods {
+			c.setOwner(pod.Namespace, pod.Name, b)
+		}
+		pods = append(pods, bpods...)
+	}
+	return pods, nil
+}
+
+// GetContainerLogs gets the logs from the backend which owns the pod.
+func (c *compositeProvider) GetContainerLogs(ctx context.Context, namespace, podName, containerName string, opts api.ContainerLogOpts) (io.ReadCloser, error) {
+	b, err := c.owner(ctx, namespace, podName)
+	if err != nil {
+		return nil, err
+	}
+	return b.provider.GetContainerLogs(ctx, namespace, podName, containerName, opts)
+}
+
+// RunInContainer executes the command on the backend which owns the pod.
+func (c *compositeProvider) RunInContainer(ctx context.Context, namespace, podName, containerName string, cmd []string, attach api.AttachIO) error {
+	b, err := c.owner(ctx, namespace, podName)
+	if err != nil {
+		return err
+	}
+	return b.provider.RunInContainer(ctx, namespace, podName, containerName, cmd, attach)
+}
+
+// AttachToContainer attaches to the container on the backend which owns the pod.
+func (c *compositeProvider) AttachToContainer(ctx context.Context, namespace, podName, containerName string, attach api.AttachIO) error {
+	b, err := c.owner(ctx, namespace, podName)
+	if err != nil {
+		return err
+	}
+	return b.provider.AttachToContainer(ctx, namespace, podName, containerName, attach)
+}
+
+// PortForward forwards the port on the backend which owns the pod.
+func (c *compositeProvider) PortForward(ctx context.Context, namespace, pod string, port int32, stream io.ReadWriteCloser) error {
+	b, err := c.owner(ctx, namespace, pod)
+	if err != nil {
+		return err
+	}
+	return b.provider.PortForward(ctx, namespace, pod, port, stream)
+}
+
+// GetStatsSummary merges the stats summaries of the backends. The usage of the node is the sum of the usage of the
+// backends. Backends which fail are left out, unless all of them fail.
+func (c *compositeProvider) GetStatsSummary(ctx context.Context) (*statsv1alpha1.Summary, error) {
+	var summary *statsv1alpha1.Summary
+	var errs []error
+	for _, b := range c.backends {
+		s, err := b.provider.GetStatsSummary(ctx)
+		if err != nil {
+			log.G(ctx).WithError(err).WithField("backend", b.name).Warn("Error getting stats summary of backend")
+			errs = append(errs, errors.Wrapf(err, "error getting stats summary of backend %q", b.name))
+			continue
+		}
+		if summary == nil {
+			merged := *s
+			merged.Pods = append([]statsv1alpha1.PodStats(nil), s.Pods...)
+			summary = &merged
+			continue
+		}
+		summary.Node.CPU = addCPUStats(summary.Node.CPU, s.Node.CPU)
+		summary.Node.Memory = addMemoryStats(summary.Node.Memory, s.Node.Memory)
+		summary.Pods = append(summary.Pods, s.Pods...)
+	}
+	if summary == nil {
+		return nil, utilerrors.NewAggregate(errs)
+	}
+	return summary, nil
+}
+
+// GetMetricsResource merges the metric families of the backends. Backends which fail are left out, unless all of
+// them fail.
+func (c *compositeProvider) GetMetricsResource(ctx context.Context) ([]*dto.MetricFamily, error) {
+	var families []*dto.MetricFamily
+	byName := make(map[string]*dto.MetricFamily)
+	var errs []error
+	for _, b := range c.backends {
+		bfamilies, err := b.provider.GetMetricsResource(ctx)
+		if err != nil {
+			log.G(ctx).WithError(err).WithField("backend", b.name).Warn("Error getting metrics of backend")
+			errs = append(errs, errors.Wrapf(err, "error getting metrics of backend %q", b.name))
+			continue
+		}
+		for _, f := range bfamilies {
+			if merged, ok := byName[f.GetName()]; ok {
+				merged.Metric = append(merged.Metric, f.Metric...)
+				continue
+			}
+			merged := &dto.MetricFamily{Name: f.Name, Help: f.Help, Type: f.Type, Unit: f.Unit}
+			merged.Metric = append(merged.Metric, f.Metric...)
+			byName[f.GetName()] = merged
+			families = append(families, merged)
+		}
+	}
+	if len(errs) == len(c.backends) {
+		return nil, utilerrors.NewAggregate(errs)
+	}
+	return families, nil
+}
+
+func addUint64(a, b *uint64) *uint64 {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+	sum := *a + *b
+	return &sum
+}
+
+func addCPUStats(a, b *statsv1alpha1.CPUStats) *statsv1alpha1.CPUStats {
+	if a == nil || b == nil {
+		if a == nil {
+			return b
+		}
+		return a
+	}
+	sum := *a
+	sum.UsageNanoCores = addUint64(a.UsageNanoCores, b.UsageNanoCores)
+	sum.UsageCoreNanoSeconds = addUint64(a.UsageCoreNanoSeconds, b.UsageCoreNanoSeconds)
+	return &sum
+}
+
+func addMemoryStats(a, b *statsv1alpha1.MemoryStats) *statsv1alpha1.MemoryStats {
+	if a == nil || b == nil {
+		if a == nil {
+			return b
+		}
+		return a
+	}
+	sum := *a
+	sum.AvailableBytes = addUint64(a.AvailableBytes, b.AvailableBytes)
+	sum.UsageBytes = addUint64(a.UsageBytes, b.UsageBytes)
+	sum.WorkingSetBytes = addUint64(a.WorkingSetBytes, b.WorkingSetBytes)
+	sum.RSSBytes = addUint64(a.RSSBytes, b.RSSBytes)
+	sum.PageFaults = addUint64(a.PageFaults, b.PageFaults)
+	sum.MajorPageFaults = addUint64(a.MajorPageFaults, b.MajorPageFaults)
+	return &sum
+}
+
+// aggregateNode returns the node of the first backend, with the capacity, allocatable resources and conditions
+// aggregated from all backends.
+func (c *compositeProvider) aggregateNode() *v1.Node {
+	n := c.backends[0].node.DeepCopy()
+	n.Status.Capacity = v1.ResourceList{}
+	n.Status.Allocatable = v1.ResourceList{}
+	for _, b := range c.backends {
+		addResources(n.Status.Capacity, b.node.Status.Capacity)
+		addResources(n.Status.Allocatable, b.node.Status.Allocatable)
+	}
+
+	n.Status.Conditions = nil
+	seen := make(map[v1.NodeConditionType]bool)
+	for _, b := range c.backends {
+		for _, cond := range b.node.Status.Conditions {
+			if seen[cond.Type] {
+				continue
+			}
+			seen[cond.Type] = true
+			n.Status.Conditions = append(n.Status.Conditions, c.aggregateCondition(cond.Type))
+		}
+	}
+	return n
+}
+
+// aggregateCondition returns the condition of the first backend which is healthy for it, or of the first backend
+// which reports it if none are.
+func (c *compositeProvider) aggregateCondition(t v1.NodeConditionType) v1.NodeCondition {
+	healthy := v1.ConditionFalse
+	if t == v1.NodeReady {
+		healthy = v1.ConditionTrue
+	}
+
+	var first *v1.NodeCondition
+	for _, b := range c.backends {
+		for i := range b.node.Status.Conditions {
+			cond := &b.node.Status.Conditions[i]
+			if cond.Type != t {
+				continue
+			}
+			if cond.Status == healthy {
+				return *cond
+			}
+			if first == nil {
+				first = cond
+			}
+		}
+	}
+	return *first
+}
+
+func addResources(sum, add v1.ResourceList) {
+	for name, q := range add {
+		total := sum[name]
+		total.Add(q)
+		sum[name] = total
+	}
+}
+
+// compositeNodeProvider pings the node providers of the backends, and aggregates their nodes.
+type compositeNodeProvider struct {
+	c *compositeProvider
+}
+
+// Ping pings the node providers of the backends, and marks those which fail as unhealthy. It only fails if all of
+// them fail.
+func (p *compositeNodeProvider) Ping(ctx context.Context) error {
+	var errs []error
+	for _, b := range p.c.backends {
+		var err error
+		if b.nodeProvider != nil {
+			err = b.nodeProvider.Ping(ctx)
+		} else {
+			err = ctx.Err()
+		}
+		p.c.mu.Lock()
+		b.unhealthy = err != nil
+		p.c.mu.Unlock()
+		if err != nil {
+			log.G(ctx).WithError(err).WithField("backend", b.name).Warn("Backend failed ping")
+			errs = append(errs, errors.Wrapf(err, "backend %q failed ping", b.name))
+		}
+	}
+	if len(errs) == len(p.c.backends) {
+		return utilerrors.NewAggregate(errs)
+	}
+	return nil
+}
+
+// NotifyNodeStatus calls the callback with the aggregated node any time the node of a backend changes.
+func (p *compositeNodeProvider) NotifyNodeStatus(ctx context.Context, cb func(*v1.Node)) {
+	for _, b := range p.c.backends {
+		if b.nodeProvider == nil {
+			continue
+		}
+		b.nodeProvider.NotifyNodeStatus(ctx, func(n *v1.Node) {
+			p.c.mu.Lock()
+			b.node = n.DeepCopy()
+			aggregated := p.c.aggregateNode()
+			p.c.mu.Unlock()
+			cb(aggregated)
+		})
+	}
+}
+
+// RouteByAnnotation routes pods to the backend named by the value of the annotation.
+func RouteByAnnotation(key string) PodRouteFunc {
+	return func(_ context.Context, pod *v1.Pod) ([]string, error) {
+		if name, ok := pod.Annotations[key]; ok && name != "" {
+			return []string{name}, nil
+		}
+		return nil, nil
+	}
+}
+
+// RouteByNodeSelector routes pods to the backend named by the value of the node selector.
+func RouteByNodeSelector(key string) PodRouteFunc {
+	return func(_ context.Context, pod *v1.Pod) ([]string, error) {
+		if name, ok := pod.Spec.NodeSelector[key]; ok && name != "" {
+			return []string{name}, nil
+		}
+		return nil, nil
+	}
+}
+
+// RouteByToleration routes pods to those of the backends whose taint the pod tolerates, in order. The taint of a
+// backend has the key, the name of the backend as its value, and the NoSchedule effect.
+func RouteByToleration(key string, backends ...string) PodRouteFunc {
+	return func(_ context.Context, pod *v1.Pod) ([]string, error) {
+		var names []string
+		for _, name := range backends {
+			taint := v1.Taint{Key: key, Value: name, Effect: v1.TaintEffectNoSchedule}
+			for i := range pod.Spec.Tolerations {
+				if pod.Spec.Tolerations[i].ToleratesTaint(klog.Background(), &taint, false) {
+					names = append(names, name)
+					break
+				}
+			}
+		}
+		return names, nil
+	}
+}
+
+// PodRoutes turns a list of routes into a single route, which returns the backends of the first route which routes
+// the pod to any.
+func PodRoutes(routes ...PodRouteFunc) PodRouteFunc {
+	return func(ctx context.Context, pod *v1.Pod) ([]string, error) {
+		for _, route := range routes {
+			names, err := route(ctx, pod)
+			if err != nil || len(names) > 0 {
+				return names, err
+			}
+		}
+		return nil, nil
+	}
+}
@@ -0,0 +1,366 @@
+package nodeutil
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
+	"github.com/virtual-kubelet/virtual-kubelet/node"
+	"github.com/virtual-kubelet/virtual-kubelet/node/api"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	statsv1alpha1 "k8s.io/kubelet/pkg/apis/stats/v1alpha1"
+)
+
+// fakeBackend is a Provider which stores pods in memory.
+type fakeBackend struct {
+	name      string
+	createErr error
+
+	mu   sync.Mutex
+	pods map[string]*v1.Pod
+}
+
+func newFakeBackend(name string) *fakeBackend {
+	return &fakeBackend{name: name, pods: make(map[string]*v1.Pod)}
+}
+
+func (b *fakeBackend) CreatePod(_ context.Context, pod *v1.Pod) error {
+	if b.createErr != nil {
+		return b.createErr
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.pods[pod.Namespace+"/"+pod.Name] = pod.DeepCopy()
+	return nil
+}
+
+func (b *fakeBackend) UpdatePod(ctx context.Context, pod *v1.Pod) error {
+	return b.CreatePod(ctx, pod)
+}
+
+func (b *fakeBackend) DeletePod(_ context.Context, pod *v1.Pod) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.pods, pod.Namespace+"/"+pod.Name)
+	return nil
+}
+
+func (b *fakeBackend) GetPod(_ context.Context, namespace, name string) (*v1.Pod, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	pod, ok := b.pods[namespace+"/"+name]
+	if !ok {
+		return nil, errdefs.NotFound("pod not found")
+	}
+	return pod.DeepCopy(), nil
+}
+
+func (b *fakeBackend) GetPodStatus(ctx context.Context, namespace, name string) (*v1.PodStatus, error) {
+	pod, err := b.GetPod(ctx, namespace, name)
+	if err != nil {
+		return nil, err
+	}
+	return &pod.Status, nil
+}
+
+func (b *fakeBackend) GetPods(context.Context) ([]*v1.Pod, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var pods []*v1.Pod
+	for _, pod := range b.pods {
+		pods = append(pods, pod.DeepCopy())
+	}
+	return pods, nil
+}
+
+func (b *fakeBackend) GetContainerLogs(context.Context, string, string, string, api.ContainerLogOpts) (io.ReadCloser, error) {
+	return io.NopCloser(strings.NewReader(b.name)), nil
+}
+
+func (b *fakeBackend) RunInContainer(context.Context, string, string, string, []string, api.AttachIO) error {
+	return nil
+}
+
+func (b *fakeBackend) AttachToContainer(context.Context, string, string, string, api.AttachIO) error {
+	return nil
+}
+
+func (b *fakeBackend) GetStatsSummary(context.Context) (*statsv1alpha1.Summary, error) {
+	usage := uint64(100)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	summary := &statsv1alpha1.Summary{Node: statsv1alpha1.NodeStats{CPU: &statsv1alpha1.CPUStats{UsageNanoCores: &usage}}}
+	for _, pod := range b.pods {
+		summary.Pods = append(summary.Pods, statsv1alpha1.PodStats{PodRef: statsv1alpha1.PodReference{Name: pod.Name}})
+	}
+	return summary, nil
+}
+
+func (b *fakeBackend) GetMetricsResource(context.Context) ([]*dto.MetricFamily, error) {
+	name := "up"
+	return []*dto.MetricFamily{{Name: &name, Metric: []*dto.Metric{{}}}}, nil
+}
+
+func (b *fakeBackend) PortForward(context.Context, string, string, int32, io.ReadWriteCloser) error {
+	return nil
+}
+
+type fakeNotifierBackend struct {
+	*fakeBackend
+}
+
+func (b *fakeNotifierBackend) NotifyPods(context.Context, func(*v1.Pod)) {}
+
+type fakeNodeProvider struct {
+	pingErr error
+	notify  func(*v1.Node)
+}
+
+func (p *fakeNodeProvider) Ping(context.Context) error {
+	return p.pingErr
+}
+
+func (p *fakeNodeProvider) NotifyNodeStatus(_ context.Context, cb func(*v1.Node)) {
+	p.notify = cb
+}
+
+func newFakeBackendFunc(p Provider, np node.NodeProvider, cpu string, ready v1.ConditionStatus) NewProviderFunc {
+	return func(cfg ProviderConfig) (Provider, node.NodeProvider, error) {
+		cfg.Node.Status.Capacity = v1.ResourceList{v1.ResourceCPU: resource.MustParse(cpu)}
+		cfg.Node.Status.Allocatable = v1.ResourceList{v1.ResourceCPU: resource.MustParse(cpu)}
+		cfg.Node.Status.Conditions = []v1.NodeCondition{
+			{Type: v1.NodeReady, Status: ready},
+			{Type: v1.NodeMemoryPressure, Status: v1.ConditionFalse},
+		}
+		if np == nil {
+			// The condition is set by the composite provider.
+			cfg.Node.Status.Conditions[0].Status = v1.ConditionUnknown
+		}
+		return p, np, nil
+	}
+}
+
+func newTestComposite(t *testing.T, cfg CompositeConfig) (Provider, node.NodeProvider, *v1.Node) {
+	t.Helper()
+	n := &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "composite"},
+		Status:     v1.NodeStatus{Conditions: []v1.NodeCondition{{Type: v1.NodeReady}}},
+	}
+	p, np, err := NewCompositeProvider(cfg)(ProviderConfig{Node: n})
+	assert.NilError(t, err)
+	return p, np, n
+}
+
+func newCompositeTestPod(name string, annotations map[string]string) *v1.Pod {
+	return &v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name, Annotations: annotations}}
+}
+
+func podNames(pods []*v1.Pod) []string {
+	var names []string
+	for _, pod := range pods {
+		names = append(names, pod.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestCompositeProviderRouting(t *testing.T) {
+	ctx := context.Background()
+	spot, onDemand := newFakeBackend("spot"), newFakeBackend("on-demand")
+	p, _, _ := newTestComposite(t, CompositeConfig{
+		Backends: []CompositeBackend{
+			{Name: "on-demand", NewProvider: newFakeBackendFunc(onDemand, nil, "1", "")},
+			{Name: "spot", NewProvider: newFakeBackendFunc(spot, nil, "1", "")},
+		},
+		Route: RouteByAnnotation("example.com/backend"),
+	})
+
+	assert.NilError(t, p.CreatePod(ctx, newCompositeTestPod("cheap", map[string]string{"example.com/backend": "spot"})))
+	assert.NilError(t, p.CreatePod(ctx, newCompositeTestPod("default", nil)))
+	assert.Check(t, errdefs.IsInvalidInput(p.CreatePod(ctx, newCompositeTestPod("bad", map[string]string{"example.com/backend": "other"}))))
+
+	spotPods, _ := spot.GetPods(ctx)
+	assert.Check(t, is.DeepEqual(podNames(spotPods), []string{"cheap"}))
+	onDemandPods, _ := onDemand.GetPods(ctx)
+	assert.Check(t, is.DeepEqual(podNames(onDemandPods), []string{"default"}))
+
+	pods, err := p.GetPods(ctx)
+	assert.NilError(t, err)
+	assert.Check(t, is.DeepEqual(podNames(pods), []string{"cheap", "default"}))
+
+	logs, err := p.GetContainerLogs(ctx, "default", "cheap", "c", api.ContainerLogOpts{})
+	assert.NilError(t, err)
+	b, _ := io.ReadAll(logs)
+	assert.Check(t, is.Equal(string(b), "spot"))
+
+	summary, err := p.GetStatsSummary(ctx)
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(summary.Pods, 2))
+	assert.Check(t, is.Equal(*summary.Node.CPU.UsageNanoCores, uint64(200)))
+
+	metrics, err := p.GetMetricsResource(ctx)
+	assert.NilError(t, err)
+	assert.Assert(t, is.Len(metrics, 1))
+	assert.Check(t, is.Len(metrics[0].Metric, 2))
+
+	assert.NilError(t, p.DeletePod(ctx, newCompositeTestPod("cheap", nil)))
+	_, err = p.GetPod(ctx, "default", "cheap")
+	assert.Check(t, errdefs.IsNotFound(err))
+}
+
+func TestCompositeProviderOwnerLookup(t *testing.T) {
+	ctx := context.Background()
+	a, b := newFakeBackend("a"), newFakeBackend("b")
+	assert.NilError(t, b.CreatePod(ctx, newCompositeTestPod("existing", nil)))
+	p, _, _ := newTestComposite(t, CompositeConfig{
+		Backends: []CompositeBackend{
+			{Name: "a", NewProvider: newFakeBackendFunc(a, nil, "1", "")},
+			{Name: "b", NewProvider: newFakeBackendFunc(b, nil, "1", "")},
+		},
+	})
+
+	// Pods created before the composite provider are found on their backend.
+	pod := newCompositeTestPod("existing", nil)
+	pod.Status.Phase = v1.PodRunning
+	assert.NilError(t, p.UpdatePod(ctx, pod))
+	status, err := b.GetPodStatus(ctx, "default", "existing")
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(status.Phase, v1.PodRunning))
+	_, err = a.GetPod(ctx, "default", "existing")
+	assert.Check(t, errdefs.IsNotFound(err))
+
+	assert.Check(t, errdefs.IsNotFound(p.UpdatePod(ctx, newCompositeTestPod("unknown", nil))))
+}
+
+func TestCompositeProviderFailover(t *testing.T) {
+	ctx := context.Background()
+	errFull := errors.New("no capacity")
+
+	for _, failover := range []bool{false, true} {
+		spot, onDemand := newFakeBackend("spot"), newFakeBackend("on-demand")
+		spot.createErr = errFull
+		cfg := CompositeConfig{
+			Backends: []CompositeBackend{
+				{Name: "on-demand", NewProvider: newFakeBackendFunc(onDemand, nil, "1", "")},
+				{Name: "spot", NewProvider: newFakeBackendFunc(spot, nil, "1", "")},
+			},
+			Route: func(context.Context, *v1.Pod) ([]string, error) {
+				return []string{"spot", "on-demand"}, nil
+			},
+		}
+		if failover {
+			cfg.ShouldFailover = func(backend string, err error) bool {
+				return backend == "spot" && errors.Is(err, errFull)
+			}
+		}
+		p, _, _ := newTestComposite(t, cfg)
+
+		err := p.CreatePod(ctx, newCompositeTestPod("web", nil))
+		if !failover {
+			assert.Check(t, is.ErrorContains(err, "no capacity"))
+			continue
+		}
+		assert.NilError(t, err)
+		_, err = onDemand.GetPod(ctx, "default", "web")
+		assert.NilError(t, err)
+	}
+}
+
+func TestCompositeProviderNode(t *testing.T) {
+	ctx := context.Background()
+	anp, bnp := &fakeNodeProvider{}, &fakeNodeProvider{}
+	a, b := newFakeBackend("a"), newFakeBackend("b")
+	p, np, n := newTestComposite(t, CompositeConfig{
+		Backends: []CompositeBackend{
+			{Name: "a", NewProvider: newFakeBackendFunc(a, anp, "2", v1.ConditionFalse)},
+			{Name: "b", NewProvider: newFakeBackendFunc(&fakeNotifierBackend{b}, bnp, "3", v1.ConditionTrue)},
+		},
+	})
+	_, ok := p.(node.PodNotifier)
+	assert.Check(t, !ok, "not all backends are notifiers")
+
+	cpu := n.Status.Capacity[v1.ResourceCPU]
+	assert.Check(t, is.Equal(cpu.String(), "5"))
+	assert.Check(t, is.Equal(conditionStatus(n, v1.NodeReady), v1.ConditionTrue))
+	assert.Check(t, is.Equal(conditionStatus(n, v1.NodeMemoryPressure), v1.ConditionFalse))
+
+	var notified *v1.Node
+	np.NotifyNodeStatus(ctx, func(n *v1.Node) { notified = n })
+	bNode := n.DeepCopy()
+	bNode.Status.Capacity = v1.ResourceList{v1.ResourceCPU: resource.MustParse("1")}
+	bNode.Status.Conditions = []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionFalse}}
+	bnp.notify(bNode)
+	assert.Assert(t, notified != nil)
+	cpu = notified.Status.Capacity[v1.ResourceCPU]
+	assert.Check(t, is.Equal(cpu.String(), "3"))
+	assert.Check(t, is.Equal(conditionStatus(notified, v1.NodeReady), v1.ConditionFalse))
+
+	// Pods are created on the healthy backends first, and the node only fails its ping if all backends do.
+	anp.pingErr = errors.New("unreachable")
+	assert.NilError(t, np.Ping(ctx))
+	assert.NilError(t, p.CreatePod(ctx, newCompositeTestPod("web", nil)))
+	_, err := b.GetPod(ctx, "default", "web")
+	assert.NilError(t, err)
+	bnp.pingErr = errors.New("unreachable")
+	assert.Check(t, np.Ping(ctx) != nil)
+}
+
+func TestCompositeProviderNotifier(t *testing.T) {
+	p, np, n := newTestComposite(t, CompositeConfig{
+		Backends: []CompositeBackend{
+			{Name: "a", NewProvider: newFakeBackendFunc(&fakeNotifierBackend{newFakeBackend("a")}, nil, "1", "")},
+		},
+	})
+	_, ok := p.(node.PodNotifier)
+	assert.Check(t, ok)
+	// Without node providers, the node is managed by the node's default node provider.
+	assert.Check(t, np == nil)
+	assert.Check(t, is.Equal(conditionStatus(n, v1.NodeReady), v1.ConditionTrue))
+}
+
+func TestPodRoutes(t *testing.T) {
+	ctx := context.Background()
+	route := PodRoutes(
+		RouteByNodeSelector("example.com/backend"),
+		RouteByToleration("example.com/backend", "spot", "on-demand"),
+	)
+
+	pod := newCompositeTestPod("web", nil)
+	names, err := route(ctx, pod)
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(names, 0))
+
+	pod.Spec.Tolerations = []v1.Toleration{{Key: "example.com/backend", Operator: v1.TolerationOpExists}}
+	names, err = route(ctx, pod)
+	assert.NilError(t, err)
+	assert.Check(t, is.DeepEqual(names, []string{"spot", "on-demand"}))
+
+	pod.Spec.Tolerations = []v1.Toleration{{Key: "example.com/backend", Operator: v1.TolerationOpEqual, Value: "on-demand"}}
+	names, err = route(ctx, pod)
+	assert.NilError(t, err)
+	assert.Check(t, is.DeepEqual(names, []string{"on-demand"}))
+
+	pod.Spec.NodeSelector = map[string]string{"example.com/backend": "spot"}
+	names, err = route(ctx, pod)
+	assert.NilError(t, err)
+	assert.Check(t, is.DeepEqual(names, []string{"spot"}))
+}
+
+func conditionStatus(n *v1.Node, t v1.NodeConditionType) v1.ConditionStatus {
+	for _, c := range n.Status.Conditions {
+		if c.Type == t {
+			return c.Status
+		}
+	}
+	return ""
+}
@@ -12,10 +12,15 @@ import (
 	"time"
 
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
 	"github.com/virtual-kubelet/virtual-kubelet/log"
 	"github.com/virtual-kubelet/virtual-kubelet/node"
+	"github.com/virtual-kubelet/virtual-kubelet/node/api"
 	v1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/scheme"
@@ -31,6 +36,7 @@ import (
 type Node struct {
 	nc *node.NodeController
 	pc *node.PodController
+	ra *node.ResourceAccounting
 
 	readyCb func(context.Context) error
 
@@ -46,6 +52,8 @@ type Node struct {
 	h          http.Handler
 	tlsConfig  *tls.Config
 
+	tlsReloader *TLSFileReloader
+
 	workers int
 
 	eb record.EventBroadcaster
@@ -61,6 +69,15 @@ func (n *Node) PodController() *node.PodController {
 	return n.pc
 }
 
+// ResourceUsage returns the resources requested by the pods admitted to the node, against its allocatable resources.
+// It is empty unless pod admission is enabled.
+func (n *Node) ResourceUsage() node.NodeResourceUsage {
+	if n.ra == nil {
+		return node.NodeResourceUsage{}
+	}
+	return n.ra.Usage()
+}
+
 func (n *Node) runHTTP(ctx context.Context) (func(), error) {
 	if n.tlsConfig == nil {
 		log.G(ctx).Warn("TLS config not provided, not starting up http service")
@@ -107,6 +124,10 @@ func (n *Node) Run(ctx context.Context) (retErr error) {
 		log.G(ctx).Debug("Started event broadcaster")
 	}
 
+	if n.tlsReloader != nil {
+		go n.tlsReloader.Run(ctx)
+	}
+
 	cancelHTTP, err := n.runHTTP(ctx)
 	if err != nil {
 		return err
@@ -240,8 +261,29 @@ type NodeConfig struct {
 	StreamCreationTimeout time.Duration
 	// Enable http debugging routes
 	DebugHTTP bool
+	// Set the sink to write audit events of requests to the http API to.
+	// The handler, including its authentication and authorization, is wrapped with api.WithAudit.
+	AuditSink api.AuditSink
+	// Set the names of the users the API server authenticates as, whose Audit-ID header is recorded in audit
+	// events. Defaults to api.DefaultAuditAPIServerUser.
+	AuditAPIServerUsers []string
+	// Set the recorder of exec and attach sessions.
+	// It is used by the routes attached with AttachProviderRoutes.
+	SessionRecorder *api.SessionRecorder
+	// Set the receiver of pod status callbacks posted by the provider's backend.
+	// Callbacks posted to api.PodStatusWebhookPath are authenticated by the receiver instead of the handler's
+	// authentication, validated against the pods of the node, and passed to the pod controller.
+	// The GetPod and NotifyPod functions of the config are set by the node.
+	PodStatusWebhook *api.PodStatusWebhookConfig
+	// Set the limits of concurrent streams and of the rate of requests per user and per pod.
+	// They are enforced by the routes attached with AttachProviderRoutes.
+	RequestLimits api.RequestLimitsConfig
 	// Set the tls config to use for the http server
 	TLSConfig *tls.Config
+	// Set a reloader of TLS material from disk to run alongside the node.
+	// Failed reloads are recorded as events on the node.
+	// The reloader must also be set in the TLS config, with WithTLSFileReloader.
+	TLSReloader *TLSFileReloader
 
 	// Specify the event recorder to use
 	// If this is not provided, a default one will be used.
@@ -254,11 +296,42 @@ type NodeConfig struct {
 	// Set the error handler for node status update failures
 	NodeStatusUpdateErrorHandler node.ErrorHandler
 
+	// Set health checks whose results are reported as node conditions.
+	// Failing critical checks make the node NotReady and stop the node lease from being renewed.
+	HealthChecks []node.HealthCheck
+
+	// Set the manager of the node's extended resources.
+	// Their capacity is published on the node, and their devices are allocated to the pods which request them.
+	ExtendedResources *node.ExtendedResourceManager
+
+	// Set the resources reserved for the system and for the provider, and the hard eviction thresholds.
+	// The node's allocatable resources are its capacity minus these reservations, and pods are admitted against them.
+	SystemReserved   v1.ResourceList
+	ProviderReserved v1.ResourceList
+	EvictionHard     map[string]string
+	// EnablePodAdmission admits pods against the node's allocatable resources even without reservations or eviction
+	// thresholds. Pods are admitted against their requests if any of these are set, and never rejected otherwise.
+	EnablePodAdmission bool
+
 	// SkipDownwardAPIResolution can be used to skip any attempts at resolving downward API references
 	// in pods before calling CreatePod on the provider.
 	// Providers need this if they need to do their own custom resolving
 	SkipDownwardAPIResolution bool
 
+	// Set the priority lanes of the queues pods are synced on.
+	// If this is not provided, pods are synced in the order they are queued.
+	PodQueuePriorities *node.PodQueuePriorities
+	// Set fair queuing of pods between tenants, by default namespaces.
+	// If this is not provided, the pods of all namespaces share the queues.
+	PodQueueFairness *node.PodQueueFairness
+	// Set the registry the metrics of the pod queues are registered with.
+	// If this is not provided, they are not exported.
+	MetricsRegisterer prometheus.Registerer
+
+	// Set how the statuses of pods are polled from providers which do not implement node.PodNotifier.
+	// By default, the status of each pod is polled every 5 seconds.
+	PodStatusPolling node.PodStatusPollingConfig
+
 	routeAttacher func(Provider, NodeConfig, corev1listers.PodLister)
 }
 
@@ -373,13 +446,34 @@ func NewNode(name string, newProvider NewProviderFunc, opts ...NodeOpt) (*Node,
 		}
 	}
 
+	var ra *node.ResourceAccounting
+	if cfg.EnablePodAdmission || len(cfg.SystemReserved) > 0 || len(cfg.ProviderReserved) > 0 || len(cfg.EvictionHard) > 0 {
+		ra, err = node.NewResourceAccounting(node.NodeAllocatableConfig{
+			SystemReserved:   cfg.SystemReserved,
+			ProviderReserved: cfg.ProviderReserved,
+			EvictionHard:     cfg.EvictionHard,
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "error creating resource accounting")
+		}
+	}
+
 	nodeControllerOpts := []node.NodeControllerOpt{
 		node.WithNodeEnableLeaseV1(NodeLeaseV1Client(cfg.Client), node.DefaultLeaseDuration),
 	}
+	if ra != nil {
+		nodeControllerOpts = append(nodeControllerOpts, node.WithNodeResourceAccounting(ra))
+	}
 
 	if cfg.NodeStatusUpdateErrorHandler != nil {
 		nodeControllerOpts = append(nodeControllerOpts, node.WithNodeStatusUpdateErrorHandler(cfg.NodeStatusUpdateErrorHandler))
 	}
+	if len(cfg.HealthChecks) > 0 {
+		nodeControllerOpts = append(nodeControllerOpts, node.WithNodeHealthChecks(cfg.HealthChecks...))
+	}
+	if cfg.ExtendedResources != nil {
+		nodeControllerOpts = append(nodeControllerOpts, node.WithNodeExtendedResources(cfg.ExtendedResources))
+	}
 
 	nc, err := node.NewNodeController(
 		np,
@@ -397,6 +491,14 @@ func NewNode(name string, newProvider NewProviderFunc, opts ...NodeOpt) (*Node,
 		cfg.EventRecorder = eb.NewRecorder(scheme.Scheme, v1.EventSource{Component: path.Join(name, "pod-controller")})
 	}
 
+	if cfg.TLSReloader != nil {
+		recorder := cfg.EventRecorder
+		nodeRef := &v1.ObjectReference{Kind: "Node", Name: name, UID: types.UID(name)}
+		cfg.TLSReloader.OnReloadError(func(err error) {
+			recorder.Eventf(nodeRef, v1.EventTypeWarning, "TLSReloadFailed", "Error reloading TLS material, keeping the previous TLS material: %v", err)
+		})
+	}
+
 	pc, err := node.NewPodController(node.PodControllerConfig{
 		PodClient:                 cfg.Client.CoreV1(),
 		EventRecorder:             cfg.EventRecorder,
@@ -406,14 +508,47 @@ func NewNode(name string, newProvider NewProviderFunc, opts ...NodeOpt) (*Node,
 		ConfigMapInformer:         configMapInformer,
 		ServiceInformer:           serviceInformer,
 		SkipDownwardAPIResolution: cfg.SkipDownwardAPIResolution,
+		NodeAllocatable:           nc.Allocatable,
+		ExtendedResources:         cfg.ExtendedResources,
+		ResourceAccounting:        ra,
+		QueuePriorities:           cfg.PodQueuePriorities,
+		QueueFairness:             cfg.PodQueueFairness,
+		StatusPolling:             cfg.PodStatusPolling,
 	})
 	if err != nil {
 		return nil, errors.Wrap(err, "error creating pod controller")
 	}
+	if cfg.MetricsRegisterer != nil {
+		if err := cfg.MetricsRegisterer.Register(pc.QueueCollector()); err != nil {
+			return nil, errors.Wrap(err, "error registering pod queue metrics")
+		}
+	}
+
+	h := cfg.Handler
+	if h != nil && cfg.PodStatusWebhook != nil {
+		webhookCfg := *cfg.PodStatusWebhook
+		webhookCfg.GetPod = func(namespace, name string) (*v1.Pod, error) {
+			pod, err := podInformer.Lister().Pods(namespace).Get(name)
+			if k8serrors.IsNotFound(err) {
+				return nil, errdefs.AsNotFound(err)
+			}
+			return pod, err
+		}
+		webhookCfg.NotifyPod = pc.NotifyPodStatus
+		h = api.WithPodStatusWebhook(webhookCfg, h)
+	}
+	if h != nil && cfg.AuditSink != nil {
+		var opts []api.AuditOption
+		if len(cfg.AuditAPIServerUsers) > 0 {
+			opts = append(opts, api.WithAuditAPIServerUsers(cfg.AuditAPIServerUsers...))
+		}
+		h = api.WithAudit(cfg.AuditSink, h, opts...)
+	}
 
 	return &Node{
 		nc:                 nc,
 		pc:                 pc,
+		ra:                 ra,
 		readyCb:            readyCb,
 		ready:              make(chan struct{}),
 		done:               make(chan struct{}),
@@ -422,7 +557,8 @@ func NewNode(name string, newProvider NewProviderFunc, opts ...NodeOpt) (*Node,
 		scmInformerFactory: scmInformerFactory,
 		client:             cfg.Client,
 		tlsConfig:          cfg.TLSConfig,
-		h:                  cfg.Handler,
+		tlsReloader:        cfg.TLSReloader,
+		h:                  h,
 		listenAddr:         cfg.HTTPListenAddr,
 		workers:            cfg.NumWorkers,
 	}, nil
@@ -77,6 +77,8 @@ func AttachProviderRoutes(mux api.ServeMux) NodeOpt {
 				StreamIdleTimeout:     cfg.StreamIdleTimeout,
 				StreamCreationTimeout: cfg.StreamCreationTimeout,
 				PortForward:           p.PortForward,
+				SessionRecorder:       cfg.SessionRecorder,
+				Limits:                cfg.RequestLimits,
 			}, true))
 		}
 		return nil
@@ -0,0 +1,377 @@
+package nodeutil
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+	"github.com/virtual-kubelet/virtual-kubelet/log"
+	"k8s.io/apiserver/pkg/server/dynamiccertificates"
+	"k8s.io/client-go/util/cert"
+)
+
+const (
+	// DefaultTLSReloadResyncPeriod is the default period at which TLS files are reloaded, in addition to being
+	// reloaded when they are changed.
+	DefaultTLSReloadResyncPeriod = time.Minute
+
+	// tlsReloadDelay is how long to wait for changes to settle after a file changed, so that the key pair is not
+	// loaded while only one of its files has been written.
+	tlsReloadDelay = 200 * time.Millisecond
+)
+
+// TLSFileReloaderConfig is used to configure a TLSFileReloader.
+type TLSFileReloaderConfig struct {
+	// CertPath and KeyPath are the paths to the PEM encoded serving certificate and its key.
+	// Both must be set to serve the key pair.
+	CertPath string
+	KeyPath  string
+	// CACertPath is the path to the PEM encoded bundle of CA certificates that client certificates are verified with.
+	CACertPath string
+
+	// ResyncPeriod is the period at which the files are reloaded even if no change was noticed.
+	// If it is zero, DefaultTLSReloadResyncPeriod is used.
+	ResyncPeriod time.Duration
+}
+
+// TLSReloadStats holds statistics about the reloads of a TLSFileReloader.
+type TLSReloadStats struct {
+	// Reloads is the number of times new TLS material was loaded.
+	Reloads int
+	// Failures is the number of times changed TLS material was rejected.
+	Failures int
+	// LastError is the error of the last failed reload, or nil if the last reload succeeded.
+	LastError error
+}
+
+// TLSFileReloader serves TLS material from files on disk, and reloads it when the files change.
+// This allows certificates managed by tools such as cert-manager to be rotated without restarting the node.
+//
+// New material is validated before it is swapped in; invalid material is rejected and the previous material is kept.
+// Since only new TLS handshakes use the new material, open connections (such as exec or port-forward streams)
+// are not affected by a reload.
+//
+// Use WithTLSFileReloader to serve the material, and run the reloader to watch the files. When set in
+// NodeConfig.TLSReloader, the node runs the reloader and records failed reloads as events on the node.
+//
+// TLSFileReloader also implements dynamiccertificates.CAContentProvider, so that it can be used to verify
+// client certificates in authenticators, such as through WebhookAuthConfig.
+type TLSFileReloader struct {
+	cfg TLSFileReloaderConfig
+
+	mu        sync.Mutex
+	certPEM   []byte
+	keyPEM    []byte
+	cert      *tls.Certificate
+	caPEM     []byte
+	ca        *x509.CertPool
+	failedErr error
+	failedPEM [][]byte
+	stats     TLSReloadStats
+
+	listeners     []dynamiccertificates.Listener
+	errorHandlers []func(error)
+}
+
+// NewTLSFileReloader creates a TLSFileReloader, loading the TLS material from the configured files.
+// An error is returned if the files cannot be loaded.
+func NewTLSFileReloader(cfg TLSFileReloaderConfig) (*TLSFileReloader, error) {
+	if (cfg.CertPath == "") != (cfg.KeyPath == "") {
+		return nil, errors.New("both or neither of the certificate and key paths must be set")
+	}
+	if cfg.CertPath == "" && cfg.CACertPath == "" {
+		return nil, errors.New("no certificate or CA certificate paths provided")
+	}
+	if cfg.ResyncPeriod == 0 {
+		cfg.ResyncPeriod = DefaultTLSReloadResyncPeriod
+	}
+
+	r := &TLSFileReloader{cfg: cfg}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// OnReloadError adds a handler which is called with the error when changed TLS material is rejected.
+// Handlers are called once for each change that is rejected.
+func (r *TLSFileReloader) OnReloadError(h func(error)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.errorHandlers = append(r.errorHandlers, h)
+}
+
+// Stats returns statistics about the reloads.
+func (r *TLSFileReloader) Stats() TLSReloadStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stats
+}
+
+// Reload loads the TLS material from the files if it changed.
+// If the changed material is invalid, an error is returned and the previous material is kept.
+func (r *TLSFileReloader) Reload() error {
+	certPEM, keyPEM, caPEM, err := r.readFiles()
+
+	r.mu.Lock()
+	if err == nil && bytes.Equal(certPEM, r.certPEM) && bytes.Equal(keyPEM, r.keyPEM) && bytes.Equal(caPEM, r.caPEM) {
+		r.mu.Unlock()
+		return nil
+	}
+	r.mu.Unlock()
+
+	var (
+		keyPair *tls.Certificate
+		ca      *x509.CertPool
+	)
+	if err == nil {
+		keyPair, ca, err = r.validate(certPEM, keyPEM, caPEM)
+	}
+
+	r.mu.Lock()
+	if err != nil {
+		attempt := [][]byte{certPEM, keyPEM, caPEM, []byte(err.Error())}
+		if r.failedErr != nil && equalPEMs(attempt, r.failedPEM) {
+			// This change has already been rejected, don't report it again.
+			err = r.failedErr
+			r.mu.Unlock()
+			return err
+		}
+		r.failedErr = err
+		r.failedPEM = attempt
+		r.stats.Failures++
+		r.stats.LastError = err
+		handlers := append([]func(error){}, r.errorHandlers...)
+		r.mu.Unlock()
+
+		for _, h := range handlers {
+			h(err)
+		}
+		return err
+	}
+
+	caChanged := !bytes.Equal(caPEM, r.caPEM)
+	r.certPEM, r.keyPEM, r.cert = certPEM, keyPEM, keyPair
+	r.caPEM, r.ca = caPEM, ca
+	r.failedErr, r.failedPEM = nil, nil
+	r.stats.Reloads++
+	r.stats.LastError = nil
+	listeners := append([]dynamiccertificates.Listener{}, r.listeners...)
+	r.mu.Unlock()
+
+	if caChanged {
+		for _, l := range listeners {
+			l.Enqueue()
+		}
+	}
+	return nil
+}
+
+func equalPEMs(a, b [][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *TLSFileReloader) readFiles() (certPEM, keyPEM, caPEM []byte, err error) {
+	if r.cfg.CertPath != "" {
+		certPEM, err = os.ReadFile(r.cfg.CertPath)
+		if err != nil {
+			return nil, nil, nil, errors.Wrap(err, "error reading certificate")
+		}
+		keyPEM, err = os.ReadFile(r.cfg.KeyPath)
+		if err != nil {
+			return nil, nil, nil, errors.Wrap(err, "error reading key")
+		}
+	}
+	if r.cfg.CACertPath != "" {
+		caPEM, err = os.ReadFile(r.cfg.CACertPath)
+		if err != nil {
+			return nil, nil, nil, errors.Wrap(err, "error reading ca cert pem")
+		}
+	}
+	return certPEM, keyPEM, caPEM, nil
+}
+
+// validate parses the TLS material, checking that the key matches the certificate and that the certificate
+// has not expired.
+func (r *TLSFileReloader) validate(certPEM, keyPEM, caPEM []byte) (*tls.Certificate, *x509.CertPool, error) {
+	var (
+		keyPair *tls.Certificate
+		pool    *x509.CertPool
+	)
+	if r.cfg.CertPath != "" {
+		kp, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "invalid key pair")
+		}
+		kp.Leaf, err = x509.ParseCertificate(kp.Certificate[0])
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "invalid certificate")
+		}
+		if time.Now().After(kp.Leaf.NotAfter) {
+			return nil, nil, fmt.Errorf("certificate expired at %s", kp.Leaf.NotAfter.Format(time.RFC3339))
+		}
+		keyPair = &kp
+	}
+	if r.cfg.CACertPath != "" {
+		var err error
+		pool, err = cert.NewPoolFromBytes(caPEM)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "invalid ca cert bundle")
+		}
+	}
+	return keyPair, pool, nil
+}
+
+// Run watches the files for changes and reloads them until the context is cancelled.
+// The files are also reloaded periodically, in case a change was missed.
+func (r *TLSFileReloader) Run(ctx context.Context) {
+	logger := log.G(ctx).WithField("component", "tls-reloader")
+
+	var events <-chan fsnotify.Event
+	w, err := r.watch()
+	if err != nil {
+		logger.WithError(err).Warn("Error watching TLS files, falling back to periodic reloads")
+	} else {
+		defer w.Close()
+		events = w.Events
+		go func() {
+			for err := range w.Errors {
+				logger.WithError(err).Debug("Error watching TLS files")
+			}
+		}()
+	}
+
+	resync := time.NewTicker(r.cfg.ResyncPeriod)
+	defer resync.Stop()
+
+	delay := time.NewTimer(tlsReloadDelay)
+	delay.Stop()
+	defer delay.Stop()
+
+	reload := func() {
+		if err := r.Reload(); err != nil {
+			logger.WithError(err).Error("Error reloading TLS files, keeping the previous TLS material")
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case _, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			delay.Reset(tlsReloadDelay)
+		case <-delay.C:
+			reload()
+		case <-resync.C:
+			reload()
+		}
+	}
+}
+
+// watch watches the directories of the files, so that files which are replaced (such as files in Secret volumes,
+// which are updated by swapping a symlink) are noticed.
+func (r *TLSFileReloader) watch() (*fsnotify.Watcher, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	dirs := make(map[string]bool)
+	for _, p := range []string{r.cfg.CertPath, r.cfg.KeyPath, r.cfg.CACertPath} {
+		if p == "" || dirs[filepath.Dir(p)] {
+			continue
+		}
+		dirs[filepath.Dir(p)] = true
+		if err := w.Add(filepath.Dir(p)); err != nil {
+			w.Close()
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+func (r *TLSFileReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.cert, nil
+}
+
+func (r *TLSFileReloader) clientCAs() *x509.CertPool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.ca
+}
+
+// Name implements dynamiccertificates.CAContentProvider.
+func (r *TLSFileReloader) Name() string {
+	return r.cfg.CACertPath
+}
+
+// CurrentCABundleContent implements dynamiccertificates.CAContentProvider.
+func (r *TLSFileReloader) CurrentCABundleContent() []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.caPEM
+}
+
+// VerifyOptions implements dynamiccertificates.CAContentProvider.
+func (r *TLSFileReloader) VerifyOptions() (x509.VerifyOptions, bool) {
+	pool := r.clientCAs()
+	if pool == nil {
+		return x509.VerifyOptions{}, false
+	}
+	return x509.VerifyOptions{
+		Roots:     pool,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, true
+}
+
+// AddListener implements dynamiccertificates.CAContentProvider.
+// Listeners are notified when the CA bundle is reloaded.
+func (r *TLSFileReloader) AddListener(l dynamiccertificates.Listener) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.listeners = append(r.listeners, l)
+}
+
+// WithTLSFileReloader makes a TLS config option which serves the TLS material of the reloader.
+// The key pair is served through GetCertificate, and the client CA bundle through GetConfigForClient, so that
+// reloaded material is used for new connections without restarting the server.
+//
+// Like WithCAFromPath, client certificates are required and verified if the reloader has a CA bundle.
+func WithTLSFileReloader(r *TLSFileReloader) func(*tls.Config) error {
+	return func(cfg *tls.Config) error {
+		if r.cfg.CertPath != "" {
+			cfg.GetCertificate = r.getCertificate
+		}
+		if r.cfg.CACertPath != "" {
+			cfg.ClientAuth = tls.RequireAndVerifyClientCert
+			cfg.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+				clientCfg := cfg.Clone()
+				clientCfg.GetConfigForClient = nil
+				clientCfg.ClientCAs = r.clientCAs()
+				return clientCfg, nil
+			}
+		}
+		return nil
+	}
+}
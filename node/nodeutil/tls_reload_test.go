@@ -0,0 +1,219 @@
+package nodeutil
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+func (ca *testCA) pem() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})
+}
+
+// issue issues a certificate for the name, returning the PEM encoded certificate and key.
+func (ca *testCA) issue(t *testing.T, name string, usage x509.ExtKeyUsage) ([]byte, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NilError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(ca.serial.Add(1)),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(ca.lifetime),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, key.Public(), ca.key)
+	assert.NilError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.NilError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// writeFile replaces the file atomically, like updates of Secret volumes.
+func writeFile(t *testing.T, p string, data []byte) {
+	t.Helper()
+	tmp := p + ".tmp"
+	assert.NilError(t, os.WriteFile(tmp, data, 0600))
+	assert.NilError(t, os.Rename(tmp, p))
+}
+
+func TestTLSFileReloader(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	dir := t.TempDir()
+	certPath, keyPath, caPath := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key"), filepath.Join(dir, "ca.crt")
+
+	serverCA := newTestCA(t, time.Hour)
+	clientCA := newTestCA(t, time.Hour)
+	certPEM, keyPEM := serverCA.issue(t, "vk.example.com", x509.ExtKeyUsageServerAuth)
+	writeFile(t, certPath, certPEM)
+	writeFile(t, keyPath, keyPEM)
+	writeFile(t, caPath, clientCA.pem())
+
+	r, err := NewTLSFileReloader(TLSFileReloaderConfig{CertPath: certPath, KeyPath: keyPath, CACertPath: caPath})
+	assert.NilError(t, err)
+	var reloadErrs atomic.Int32
+	r.OnReloadError(func(error) { reloadErrs.Add(1) })
+	go r.Run(ctx)
+
+	tlsCfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	assert.NilError(t, WithTLSFileReloader(r)(tlsCfg))
+	l, err := tls.Listen("tcp", "127.0.0.1:0", tlsCfg)
+	assert.NilError(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn) //nolint:errcheck
+			}()
+		}
+	}()
+
+	serverPool := x509.NewCertPool()
+	serverPool.AddCert(serverCA.cert)
+	dial := func(clientCert tls.Certificate) (*tls.Conn, error) {
+		conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{
+			RootCAs:      serverPool,
+			ServerName:   "vk.example.com",
+			Certificates: []tls.Certificate{clientCert},
+			MinVersion:   tls.VersionTLS12,
+		})
+		if err != nil {
+			return nil, err
+		}
+		// Client certificates are verified after the client's handshake completes in TLS 1.3, so roundtrip a message
+		// to get the result.
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+	keyPair := func(certPEM, keyPEM []byte) tls.Certificate {
+		kp, err := tls.X509KeyPair(certPEM, keyPEM)
+		assert.NilError(t, err)
+		return kp
+	}
+	client := keyPair(clientCA.issue(t, "client", x509.ExtKeyUsageClientAuth))
+
+	conn, err := dial(client)
+	assert.NilError(t, err)
+	defer conn.Close()
+	servedCert := conn.ConnectionState().PeerCertificates[0]
+
+	// Rotate the key pair and the client CA.
+	newClientCA := newTestCA(t, time.Hour)
+	newClient := keyPair(newClientCA.issue(t, "client", x509.ExtKeyUsageClientAuth))
+	certPEM, keyPEM = serverCA.issue(t, "vk.example.com", x509.ExtKeyUsageServerAuth)
+	writeFile(t, certPath, certPEM)
+	writeFile(t, keyPath, keyPEM)
+	writeFile(t, caPath, newClientCA.pem())
+
+	assert.NilError(t, wait.PollUntilContextCancel(ctx, 10*time.Millisecond, true, func(context.Context) (bool, error) {
+		c, err := dial(newClient)
+		if err != nil {
+			return false, nil
+		}
+		defer c.Close()
+		return !c.ConnectionState().PeerCertificates[0].Equal(servedCert), nil
+	}))
+	_, err = dial(client)
+	assert.Check(t, err != nil, "client certificates of the previous CA should be rejected")
+
+	// Connections opened before the reload are not dropped.
+	_, err = conn.Write([]byte("pong"))
+	assert.NilError(t, err)
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(conn, buf)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(string(buf), "pong"))
+
+	assert.Check(t, is.Equal(reloadErrs.Load(), int32(0)))
+	assert.Check(t, is.Equal(r.Stats().Reloads, 2))
+
+	opts, ok := r.VerifyOptions()
+	assert.Assert(t, ok)
+	_, err = newClient.Leaf.Verify(opts)
+	assert.Check(t, err)
+}
+
+func TestTLSFileReloaderRejectsInvalidMaterial(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+
+	ca := newTestCA(t, time.Hour)
+	certPEM, keyPEM := ca.issue(t, "vk.example.com", x509.ExtKeyUsageServerAuth)
+	writeFile(t, certPath, certPEM)
+	writeFile(t, keyPath, keyPEM)
+
+	r, err := NewTLSFileReloader(TLSFileReloaderConfig{CertPath: certPath, KeyPath: keyPath})
+	assert.NilError(t, err)
+	var reloadErrs []error
+	r.OnReloadError(func(err error) { reloadErrs = append(reloadErrs, err) })
+	served, err := r.getCertificate(nil)
+	assert.NilError(t, err)
+
+	// Only the certificate has been written so far, so it does not match the key.
+	newCertPEM, newKeyPEM := ca.issue(t, "vk.example.com", x509.ExtKeyUsageServerAuth)
+	writeFile(t, certPath, newCertPEM)
+	assert.Check(t, is.ErrorContains(r.Reload(), "invalid key pair"))
+	assert.Check(t, is.ErrorContains(r.Reload(), "invalid key pair"))
+	assert.Check(t, is.Len(reloadErrs, 1), "errors should be reported once per change")
+	current, err := r.getCertificate(nil)
+	assert.NilError(t, err)
+	assert.Check(t, current == served, "previous key pair should be kept")
+
+	writeFile(t, keyPath, newKeyPEM)
+	assert.NilError(t, r.Reload())
+	current, err = r.getCertificate(nil)
+	assert.NilError(t, err)
+	assert.Check(t, current != served)
+
+	// Expired certificates are rejected.
+	expired := newTestCA(t, -time.Second)
+	certPEM, keyPEM = expired.issue(t, "vk.example.com", x509.ExtKeyUsageServerAuth)
+	writeFile(t, certPath, certPEM)
+	writeFile(t, keyPath, keyPEM)
+	assert.Check(t, is.ErrorContains(r.Reload(), "certificate expired"))
+
+	stats := r.Stats()
+	assert.Check(t, is.Equal(stats.Reloads, 2))
+	assert.Check(t, is.Equal(stats.Failures, 2))
+	assert.Check(t, is.ErrorContains(stats.LastError, "certificate expired"))
+	assert.Check(t, is.Len(reloadErrs, 2))
+
+	_, err = NewTLSFileReloader(TLSFileReloaderConfig{CertPath: certPath, KeyPath: keyPath})
+	assert.Check(t, is.ErrorContains(err, "certificate expired"))
+	_, err = NewTLSFileReloader(TLSFileReloaderConfig{CertPath: certPath})
+	assert.Check(t, is.ErrorContains(err, "both or neither"))
+}
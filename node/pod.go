@@ -16,6 +16,7 @@ package node
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"sort"
 	"strings"
@@ -25,24 +26,32 @@ import (
 
 	"github.com/google/go-cmp/cmp"
 	pkgerrors "github.com/pkg/errors"
+	"github.com/virtual-kubelet/virtual-kubelet/internal/expansion"
 	"github.com/virtual-kubelet/virtual-kubelet/internal/podutils"
 	"github.com/virtual-kubelet/virtual-kubelet/log"
 	"github.com/virtual-kubelet/virtual-kubelet/trace"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/tools/cache"
 )
 
 const (
 	podStatusReasonProviderFailed = "ProviderFailed"
-	podEventCreateFailed          = "ProviderCreateFailed"
-	podEventCreateSuccess         = "ProviderCreateSuccess"
-	podEventDeleteFailed          = "ProviderDeleteFailed"
-	podEventDeleteSuccess         = "ProviderDeleteSuccess"
-	podEventUpdateFailed          = "ProviderUpdateFailed"
-	podEventUpdateSuccess         = "ProviderUpdateSuccess"
+	// podStatusReasonUnexpectedAdmissionError is the reason of pods rejected because devices could not be allocated
+	// to them, like on a regular kubelet.
+	podStatusReasonUnexpectedAdmissionError = "UnexpectedAdmissionError"
+	podEventCreateFailed                    = "ProviderCreateFailed"
+	podEventCreateSuccess                   = "ProviderCreateSuccess"
+	podEventDeleteFailed                    = "ProviderDeleteFailed"
+	podEventDeleteSuccess                   = "ProviderDeleteSuccess"
+	podEventUpdateFailed                    = "ProviderUpdateFailed"
+	podEventUpdateSuccess                   = "ProviderUpdateSuccess"
+	podEventPrepareNetworkFailed            = "ProviderPrepareNetworkFailed"
+	podEventAllocateDevicesFailed           = "FailedToAllocateDevices"
 
 	// 151 milliseconds is just chosen as a small prime number to retry between
 	// attempts to get a notification from the provider to VK
@@ -73,7 +82,15 @@ func (pc *PodController) createOrUpdatePod(ctx context.Context, pod *corev1.Pod)
 	if !pc.skipDownwardAPIResolution {
 		// We do this so we don't mutate the pod from the informer cache
 		pod = pod.DeepCopy()
-		if err := podutils.PopulateEnvironmentVariables(ctx, pod, pc.resourceManager, pc.recorder); err != nil {
+		if err := pc.preparePodNetwork(ctx, pod); err != nil {
+			span.SetStatus(err)
+			return err
+		}
+		var allocatable corev1.ResourceList
+		if pc.nodeAllocatable != nil {
+			allocatable = pc.nodeAllocatable()
+		}
+		if err := podutils.PopulateEnvironmentVariables(ctx, pod, pc.resourceManager, pc.recorder, allocatable); err != nil {
 			span.SetStatus(err)
 			return err
 		}
@@ -87,6 +104,17 @@ func (pc *PodController) createOrUpdatePod(ctx context.Context, pod *corev1.Pod)
 	// NOTE: Some providers return a non-nil error in their GetPod implementation when the pod is not found while some other don't.
 	// Hence, we ignore the error and just act upon the pod if it is non-nil (meaning that the provider still knows about the pod).
 	if podFromProvider, _ := pc.provider.GetPod(ctx, pod.Namespace, pod.Name); podFromProvider != nil {
+		// Pods which already exist in the provider were admitted before, possibly by a previous run.
+		if pc.resourceAccounting != nil {
+			pc.resourceAccounting.setAdmitted(pod)
+		}
+		// They keep the devices they were created with, if any.
+		if pc.extendedResources != nil {
+			if err := setPodDevices(podForProvider, pc.extendedResources.allocated(pod.UID)); err != nil {
+				span.SetStatus(err)
+				return err
+			}
+		}
 		podsEqualForProvider := podsEqual
 		if !pc.skipDownwardAPIResolution {
 			podsEqualForProvider = podsEqualWithResolvedEnvs
@@ -104,6 +132,14 @@ func (pc *PodController) createOrUpdatePod(ctx context.Context, pod *corev1.Pod)
 
 		}
 	} else {
+		if admitted, err := pc.admitPod(ctx, pod); !admitted {
+			span.SetStatus(err)
+			return err
+		}
+		if allocated, err := pc.allocateDevices(ctx, pod, podForProvider); !allocated {
+			span.SetStatus(err)
+			return err
+		}
 		if origErr := pc.provider.CreatePod(ctx, podForProvider); origErr != nil {
 			pc.handleProviderError(ctx, span, origErr, pod)
 			pc.recorder.Event(pod, corev1.EventTypeWarning, podEventCreateFailed, origErr.Error())
@@ -115,6 +151,182 @@ func (pc *PodController) createOrUpdatePod(ctx context.Context, pod *corev1.Pod)
 	return nil
 }
 
+// preparePodNetwork asks the provider to set up the pod's network if it supports doing so, and the pod does not have
+// an IP yet. The IPs are copied into the pod's status, so that downward API references to them can be resolved.
+func (pc *PodController) preparePodNetwork(ctx context.Context, pod *corev1.Pod) error {
+	if pc.networkPreparer == nil || pod.Status.PodIP != "" {
+		return nil
+	}
+
+	ctx, span := trace.StartSpan(ctx, "preparePodNetwork")
+	defer span.End()
+
+	status, err := pc.networkPreparer.PreparePodNetwork(ctx, pod.DeepCopy())
+	if err != nil {
+		span.SetStatus(err)
+		pc.recorder.Event(pod, corev1.EventTypeWarning, podEventPrepareNetworkFailed, err.Error())
+		return pkgerrors.Wrap(err, "error preparing pod network")
+	}
+	if status == nil {
+		return nil
+	}
+
+	pod.Status.PodIP = status.PodIP
+	pod.Status.PodIPs = status.PodIPs
+	pod.Status.HostIP = status.HostIP
+	pod.Status.HostIPs = status.HostIPs
+	log.G(ctx).WithField("podIP", status.PodIP).Debug("Prepared pod network")
+	return nil
+}
+
+// allocateDevices allocates devices to the containers of the admitted pod which request extended resources, and
+// records them in the PodDevicesAnnotation annotation of podForProvider.
+// Like on a regular kubelet, the pod is rejected if there are not enough devices left. The returned bool indicates
+// whether the devices were allocated, and the error is nil if the pod was rejected successfully.
+func (pc *PodController) allocateDevices(ctx context.Context, pod, podForProvider *corev1.Pod) (bool, error) {
+	if pc.extendedResources == nil {
+		return true, nil
+	}
+
+	ctx, span := trace.StartSpan(ctx, "allocateDevices")
+	defer span.End()
+
+	devices, err := pc.extendedResources.allocate(pod)
+	if err != nil {
+		span.SetStatus(err)
+		insufficient, ok := err.(*insufficientDevicesError)
+		if !ok {
+			pc.recorder.Event(pod, corev1.EventTypeWarning, podEventAllocateDevicesFailed, err.Error())
+			return false, pkgerrors.Wrap(err, "error allocating devices")
+		}
+		message := fmt.Sprintf("Allocate failed due to %v, which is unexpected", insufficient)
+		return false, pc.rejectPod(ctx, pod, podStatusReasonUnexpectedAdmissionError, message)
+	}
+	if err := setPodDevices(podForProvider, devices); err != nil {
+		return false, err
+	}
+	if devices != nil {
+		log.G(ctx).WithField("devices", podForProvider.Annotations[PodDevicesAnnotation]).Debug("Allocated devices to pod")
+	}
+	return true, nil
+}
+
+// setPodDevices records the devices in the pod's PodDevicesAnnotation annotation, if there are any.
+func setPodDevices(pod *corev1.Pod, devices PodDevices) error {
+	if devices == nil {
+		return nil
+	}
+	b, err := json.Marshal(devices)
+	if err != nil {
+		return pkgerrors.Wrap(err, "error encoding allocated devices")
+	}
+	if pod.Annotations == nil {
+		pod.Annotations = make(map[string]string)
+	}
+	pod.Annotations[PodDevicesAnnotation] = string(b)
+	return nil
+}
+
+// admitPod checks that the node has enough resources left for the pod, and reports whether it does.
+// Pods which do not fit are rejected like on a regular kubelet: they are failed, and not created in the provider.
+func (pc *PodController) admitPod(ctx context.Context, pod *corev1.Pod) (bool, error) {
+	if pc.resourceAccounting == nil {
+		return true, nil
+	}
+
+	err := pc.resourceAccounting.admit(pod)
+	if err == nil {
+		return true, nil
+	}
+	insufficient, ok := err.(*InsufficientResourceError)
+	if !ok {
+		return false, err
+	}
+
+	return false, pc.rejectPod(ctx, pod, insufficient.Reason(), err.Error())
+}
+
+// rejectPod fails the pod in Kubernetes with the reason and message, like a regular kubelet does with pods it does not
+// admit, and releases the resources it was admitted with.
+func (pc *PodController) rejectPod(ctx context.Context, pod *corev1.Pod, reason, message string) error {
+	log.G(ctx).WithField("reason", reason).WithField("message", message).Warn("Rejecting pod")
+	pc.recorder.Event(pod, corev1.EventTypeWarning, reason, message)
+
+	updated := pod.DeepCopy()
+	updated.Status.Phase = corev1.PodFailed
+	updated.Status.Reason = reason
+	updated.Status.Message = "Pod was rejected: " + message
+	if _, err := pc.client.Pods(pod.Namespace).UpdateStatus(ctx, updated, metav1.UpdateOptions{}); err != nil {
+		return pkgerrors.Wrap(err, "error while updating pod status in kubernetes")
+	}
+	pc.releasePodResources(ctx, pod)
+	return nil
+}
+
+// releasePodResources releases the devices allocated to the pod and the resources it was admitted with, if any.
+func (pc *PodController) releasePodResources(ctx context.Context, pod *corev1.Pod) {
+	if pc.resourceAccounting != nil {
+		pc.resourceAccounting.release(pod.UID)
+	}
+	if pc.extendedResources == nil {
+		return
+	}
+	if err := pc.extendedResources.release(pod.UID); err != nil {
+		log.G(ctx).WithError(err).Error("Failed to release devices of pod")
+	}
+}
+
+// releasePodResourcesNamed releases the devices allocated to the pod with the given namespace and name, and the
+// resources it was admitted with, if any.
+func (pc *PodController) releasePodResourcesNamed(ctx context.Context, namespace, name string) {
+	if pc.resourceAccounting != nil {
+		pc.resourceAccounting.releaseNamed(namespace, name)
+	}
+	if pc.extendedResources == nil {
+		return
+	}
+	if err := pc.extendedResources.releaseNamed(namespace, name); err != nil {
+		log.G(ctx).WithError(err).Error("Failed to release devices of pod")
+	}
+}
+
+// admitProviderPods accounts for the requests of the pods which already exist in the provider, possibly since a
+// previous run, so that the pods synced on startup are admitted against the resources those use.
+func (pc *PodController) admitProviderPods(ctx context.Context) error {
+	pps, err := pc.provider.GetPods(ctx)
+	if err != nil {
+		return pkgerrors.Wrap(err, "failed to fetch the list of pods from the provider")
+	}
+	for _, pp := range pps {
+		pod, err := pc.podsLister.Pods(pp.Namespace).Get(pp.Name)
+		if err != nil {
+			if errors.IsNotFound(err) {
+				// The pod is dangling, and is being deleted from the provider.
+				continue
+			}
+			return pkgerrors.Wrap(err, "failed to fetch pod from the lister")
+		}
+		pc.resourceAccounting.setAdmitted(pod)
+	}
+	return nil
+}
+
+// releaseDevicesOfDeletedPods releases the devices allocated to pods which no longer exist in Kubernetes.
+func (pc *PodController) releaseDevicesOfDeletedPods() error {
+	pods, err := pc.podsLister.List(labels.Everything())
+	if err != nil {
+		return pkgerrors.Wrap(err, "failed to list pods")
+	}
+	uids := make(map[types.UID]struct{}, len(pods))
+	for _, pod := range pods {
+		uids[pod.UID] = struct{}{}
+	}
+	return pc.extendedResources.retainPods(func(uid types.UID) bool {
+		_, ok := uids[uid]
+		return ok
+	})
+}
+
 // podsEqual checks if two pods are equal according to the fields we know that are allowed
 // to be modified after startup time.
 func podsEqual(pod1, pod2 *corev1.Pod) bool {
@@ -137,24 +349,39 @@ func podsEqual(pod1, pod2 *corev1.Pod) bool {
 
 }
 
+// podsEqualWithResolvedEnvs compares the pod returned by the provider (pod1) with the pod passed to it (pod2), after
+// resolution of their environment. Resolved variables may be listed in any order, and the provider may return the
+// command, args and subPathExpr of containers as they were before expansion of their $(VAR) references.
 func podsEqualWithResolvedEnvs(pod1, pod2 *corev1.Pod) bool {
 	pod1 = pod1.DeepCopy()
 	pod2 = pod2.DeepCopy()
 
 	for i := range pod1.Spec.Containers {
 		sortResolvedEnvVars(pod1.Spec.Containers[i].Env)
+		if i < len(pod2.Spec.Containers) {
+			c1, c2 := &pod1.Spec.Containers[i], &pod2.Spec.Containers[i]
+			normalizeExpandedReferences(&c1.Command, &c1.Args, c1.VolumeMounts, c1.Env, c2.Command, c2.Args, c2.VolumeMounts)
+		}
 	}
 	for i := range pod2.Spec.Containers {
 		sortResolvedEnvVars(pod2.Spec.Containers[i].Env)
 	}
 	for i := range pod1.Spec.InitContainers {
 		sortResolvedEnvVars(pod1.Spec.InitContainers[i].Env)
+		if i < len(pod2.Spec.InitContainers) {
+			c1, c2 := &pod1.Spec.InitContainers[i], &pod2.Spec.InitContainers[i]
+			normalizeExpandedReferences(&c1.Command, &c1.Args, c1.VolumeMounts, c1.Env, c2.Command, c2.Args, c2.VolumeMounts)
+		}
 	}
 	for i := range pod2.Spec.InitContainers {
 		sortResolvedEnvVars(pod2.Spec.InitContainers[i].Env)
 	}
 	for i := range pod1.Spec.EphemeralContainers {
 		sortResolvedEnvVars(pod1.Spec.EphemeralContainers[i].Env)
+		if i < len(pod2.Spec.EphemeralContainers) {
+			c1, c2 := &pod1.Spec.EphemeralContainers[i], &pod2.Spec.EphemeralContainers[i]
+			normalizeExpandedReferences(&c1.Command, &c1.Args, c1.VolumeMounts, c1.Env, c2.Command, c2.Args, c2.VolumeMounts)
+		}
 	}
 	for i := range pod2.Spec.EphemeralContainers {
 		sortResolvedEnvVars(pod2.Spec.EphemeralContainers[i].Env)
@@ -163,6 +390,43 @@ func podsEqualWithResolvedEnvs(pod1, pod2 *corev1.Pod) bool {
 	return podsEqual(pod1, pod2)
 }
 
+// normalizeExpandedReferences replaces the command, args and subPathExpr of a container returned by the provider with
+// the expanded ones passed to it, when expanding their $(VAR) references with the container's resolved environment
+// gives the same result.
+func normalizeExpandedReferences(command, args *[]string, mounts []corev1.VolumeMount, env []corev1.EnvVar, expandedCommand, expandedArgs []string, expandedMounts []corev1.VolumeMount) {
+	vars := make(map[string]string, len(env))
+	for _, e := range env {
+		vars[e.Name] = e.Value
+	}
+	mapping := expansion.MappingFuncFor(vars)
+	expandAll := func(values []string) []string {
+		if values == nil {
+			return nil
+		}
+		expanded := make([]string, len(values))
+		for i, v := range values {
+			expanded[i] = expansion.Expand(v, mapping)
+		}
+		return expanded
+	}
+
+	if !cmp.Equal(*command, expandedCommand) && cmp.Equal(expandAll(*command), expandedCommand) {
+		*command = expandedCommand
+	}
+	if !cmp.Equal(*args, expandedArgs) && cmp.Equal(expandAll(*args), expandedArgs) {
+		*args = expandedArgs
+	}
+	for i := range mounts {
+		if i >= len(expandedMounts) || mounts[i].SubPathExpr == "" || expandedMounts[i].SubPathExpr != "" {
+			continue
+		}
+		if expansion.Expand(mounts[i].SubPathExpr, mapping) == expandedMounts[i].SubPath {
+			mounts[i].SubPath = expandedMounts[i].SubPath
+			mounts[i].SubPathExpr = ""
+		}
+	}
+}
+
 func sortResolvedEnvVars(envs []corev1.EnvVar) {
 	sort.Slice(envs, func(i, j int) bool {
 		if envs[i].Name != envs[j].Name {
@@ -234,6 +498,7 @@ func (pc *PodController) deletePod(ctx context.Context, pod *corev1.Pod) error {
 	}
 	pc.recorder.Event(pod, corev1.EventTypeNormal, podEventDeleteSuccess, "Delete pod in provider successfully")
 	log.G(ctx).Debug("Deleted pod from provider")
+	pc.releasePodResources(ctx, pod)
 
 	return nil
 }
@@ -295,6 +560,11 @@ func (pc *PodController) updatePodStatus(ctx context.Context, podFromKubernetes
 		return pkgerrors.Wrap(err, "error while updating pod status in kubernetes")
 	}
 
+	// Terminated pods no longer hold on to their devices and resources.
+	if podFromProvider.Status.Phase == corev1.PodSucceeded || podFromProvider.Status.Phase == corev1.PodFailed {
+		pc.releasePodResources(ctx, podFromKubernetes)
+	}
+
 	log.G(ctx).WithFields(log.Fields{
 		"new phase":  string(podFromProvider.Status.Phase),
 		"new reason": podFromProvider.Status.Reason,
@@ -305,6 +575,13 @@ func (pc *PodController) updatePodStatus(ctx context.Context, podFromKubernetes
 	return nil
 }
 
+// NotifyPodStatus updates the status of the pod in Kubernetes with the status of the passed in pod, like the
+// callback of a PodNotifier. It can be used to feed statuses the provider receives by other means, such as the
+// callbacks of api.PodStatusWebhookHandler, to the pod controller.
+func (pc *PodController) NotifyPodStatus(ctx context.Context, pod *corev1.Pod) {
+	pc.enqueuePodStatusUpdate(ctx, pod.DeepCopy())
+}
+
 // enqueuePodStatusUpdate updates our pod status map, and marks the pod as dirty in the workqueue. The pod must be DeepCopy'd
 // prior to enqueuePodStatusUpdate.
 func (pc *PodController) enqueuePodStatusUpdate(ctx context.Context, pod *corev1.Pod) {
@@ -375,7 +652,7 @@ func (pc *PodController) enqueuePodStatusUpdate(ctx context.Context, pod *corev1
 	kpod.lastPodStatusUpdateSkipped = false
 	kpod.lastPodStatusReceivedFromProvider = pod
 	kpod.Unlock()
-	pc.syncPodStatusFromProvider.Enqueue(ctx, key)
+	pc.syncPodStatusFromProvider.EnqueueWithPriority(ctx, key, pc.podQueueLane(pod, PodQueueLaneStatus))
 }
 
 func (pc *PodController) syncPodStatusFromProviderHandler(ctx context.Context, key string) (retErr error) {
@@ -0,0 +1,241 @@
+// Copyright © 2017 The virtual-kubelet authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/virtual-kubelet/virtual-kubelet/log"
+	"github.com/virtual-kubelet/virtual-kubelet/trace"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// DefaultPodBatchSize is the default maximum number of pods in a batch.
+	DefaultPodBatchSize = 100
+	// DefaultPodBatchLinger is the default time a batch waits for more pods before it is sent to the provider.
+	DefaultPodBatchLinger = 10 * time.Millisecond
+)
+
+// PodBatchCreator is an optional extension to PodLifecycleHandler for providers which can create many pods at once.
+//
+// When the provider implements this interface, the pods the PodController's workers create at the same time are
+// coalesced into batches, and CreatePod is not called.
+type PodBatchCreator interface {
+	// CreatePods deploys the pods within the provider. It returns the error of each pod, in the order of the pods,
+	// which is nil for pods which were created. If the returned error is not nil, it is the error of all pods.
+	CreatePods(ctx context.Context, pods []*corev1.Pod) ([]error, error)
+}
+
+// PodBatchDeleter is an optional extension to PodLifecycleHandler for providers which can delete many pods at once.
+//
+// When the provider implements this interface, the pods the PodController's workers delete at the same time are
+// coalesced into batches, and DeletePod is not called. The expectations of DeletePod apply to each of the pods.
+type PodBatchDeleter interface {
+	// DeletePods deletes the pods from the provider. It returns the error of each pod, in the order of the pods,
+	// which is nil for pods which were deleted. If the returned error is not nil, it is the error of all pods.
+	DeletePods(ctx context.Context, pods []*corev1.Pod) ([]error, error)
+}
+
+// PodStatusBatchGetter is an optional extension to PodLifecycleHandler for providers which can retrieve the statuses
+// of many pods at once.
+//
+// It is only used for providers which do not implement PodNotifier, whose pod statuses are polled. When the provider
+// implements this interface, the statuses are retrieved in batches, and GetPodStatus is not called.
+type PodStatusBatchGetter interface {
+	// GetPodStatuses retrieves the statuses of the pods from the provider. Pods which are not found are left out of
+	// the returned map. The same expectations as for GetPodStatus apply to the returned statuses.
+	GetPodStatuses(ctx context.Context, pods []types.NamespacedName) (map[types.NamespacedName]*corev1.PodStatus, error)
+}
+
+// PodBatchConfig configures the batches of pods passed to providers which implement PodBatchCreator,
+// PodBatchDeleter or PodStatusBatchGetter.
+type PodBatchConfig struct {
+	// MaxSize is the maximum number of pods in a batch. It defaults to DefaultPodBatchSize.
+	MaxSize int
+	// Linger is how long a batch of pods to create or delete waits for more pods before it is sent to the provider.
+	// It defaults to DefaultPodBatchLinger.
+	//
+	// Since each worker waits for the result of its pod, batches hold at most as many pods as there are workers.
+	Linger time.Duration
+}
+
+func (c PodBatchConfig) withDefaults() PodBatchConfig {
+	if c.MaxSize <= 0 {
+		c.MaxSize = DefaultPodBatchSize
+	}
+	if c.Linger <= 0 {
+		c.Linger = DefaultPodBatchLinger
+	}
+	return c
+}
+
+// batchingProvider coalesces the calls to CreatePod and DeletePod of a provider which implements the batch
+// interfaces into batches.
+type batchingProvider struct {
+	PodLifecycleHandler
+	create *podBatcher
+	delete *podBatcher
+}
+
+// batchingNotifierProvider is a batchingProvider for a provider which is a PodNotifier.
+type batchingNotifierProvider struct {
+	*batchingProvider
+	notifier PodNotifier
+}
+
+func (p *batchingNotifierProvider) NotifyPods(ctx context.Context, f func(*corev1.Pod)) {
+	p.notifier.NotifyPods(ctx, f)
+}
+
+// wrapBatchingProvider wraps the provider with a batchingProvider if it implements PodBatchCreator or
+// PodBatchDeleter.
+func wrapBatchingProvider(p PodLifecycleHandler, cfg PodBatchConfig) PodLifecycleHandler {
+	creator, _ := p.(PodBatchCreator)
+	deleter, _ := p.(PodBatchDeleter)
+	if creator == nil && deleter == nil {
+		return p
+	}
+
+	cfg = cfg.withDefaults()
+	b := &batchingProvider{PodLifecycleHandler: p}
+	if creator != nil {
+		b.create = newPodBatcher("CreatePods", creator.CreatePods, cfg)
+	}
+	if deleter != nil {
+		b.delete = newPodBatcher("DeletePods", deleter.DeletePods, cfg)
+	}
+	if n, ok := p.(PodNotifier); ok {
+		return &batchingNotifierProvider{batchingProvider: b, notifier: n}
+	}
+	return b
+}
+
+func (p *batchingProvider) CreatePod(ctx context.Context, pod *corev1.Pod) error {
+	if p.create == nil {
+		return p.PodLifecycleHandler.CreatePod(ctx, pod)
+	}
+	return p.create.do(ctx, pod)
+}
+
+func (p *batchingProvider) DeletePod(ctx context.Context, pod *corev1.Pod) error {
+	if p.delete == nil {
+		return p.PodLifecycleHandler.DeletePod(ctx, pod)
+	}
+	return p.delete.do(ctx, pod)
+}
+
+type podBatchFunc func(ctx context.Context, pods []*corev1.Pod) ([]error, error)
+
+// podBatcher coalesces pods into batches, which are sent once they are full or have lingered.
+type podBatcher struct {
+	name string
+	f    podBatchFunc
+	cfg  PodBatchConfig
+
+	mu      sync.Mutex
+	pending []*podBatchItem
+	timer   *time.Timer
+}
+
+type podBatchItem struct {
+	ctx  context.Context
+	pod  *corev1.Pod
+	done chan error
+}
+
+func newPodBatcher(name string, f podBatchFunc, cfg PodBatchConfig) *podBatcher {
+	return &podBatcher{name: name, f: f, cfg: cfg}
+}
+
+// do adds the pod to the pending batch, and waits for the result of the pod.
+func (b *podBatcher) do(ctx context.Context, pod *corev1.Pod) error {
+	item := &podBatchItem{ctx: ctx, pod: pod, done: make(chan error, 1)}
+
+	b.mu.Lock()
+	b.pending = append(b.pending, item)
+	var batch []*podBatchItem
+	if len(b.pending) >= b.cfg.MaxSize {
+		batch = b.take()
+	} else if len(b.pending) == 1 {
+		b.timer = time.AfterFunc(b.cfg.Linger, b.flushPending)
+	}
+	b.mu.Unlock()
+
+	if batch != nil {
+		b.send(batch)
+	}
+
+	select {
+	case err := <-item.done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// take returns the pending batch. It must be called with the lock held.
+func (b *podBatcher) take() []*podBatchItem {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	batch := b.pending
+	b.pending = nil
+	return batch
+}
+
+func (b *podBatcher) flushPending() {
+	b.mu.Lock()
+	batch := b.take()
+	b.mu.Unlock()
+
+	if len(batch) > 0 {
+		b.send(batch)
+	}
+}
+
+// send sends the batch to the provider, and passes each pod its result.
+func (b *podBatcher) send(batch []*podBatchItem) {
+	// The batch must not be cancelled with the context of any one of its pods.
+	ctx, span := trace.StartSpan(context.WithoutCancel(batch[0].ctx), "podBatcher."+b.name)
+	defer span.End()
+	ctx = span.WithField(ctx, "nPods", int64(len(batch)))
+
+	pods := make([]*corev1.Pod, 0, len(batch))
+	for _, item := range batch {
+		pods = append(pods, item.pod)
+	}
+
+	errs, err := b.f(ctx, pods)
+	if err == nil && len(errs) != len(pods) {
+		err = fmt.Errorf("provider returned %d results for a batch of %d pods", len(errs), len(pods))
+	}
+	if err != nil {
+		span.SetStatus(err)
+		log.G(ctx).WithError(err).Warnf("Error calling %s on the provider", b.name)
+		for _, item := range batch {
+			item.done <- err
+		}
+		return
+	}
+	for i, item := range batch {
+		item.done <- errs[i]
+	}
+}
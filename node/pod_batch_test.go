@@ -0,0 +1,172 @@
+package node
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	corev1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// mockBatchProvider is a mockProvider which also implements the batch interfaces.
+type mockBatchProvider struct {
+	*mockProvider
+
+	mu          sync.Mutex
+	batches     [][]string
+	statusCalls [][]types.NamespacedName
+	statuses    map[types.NamespacedName]*corev1.PodStatus
+}
+
+func (p *mockBatchProvider) record(pods []*corev1.Pod) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	names := make([]string, 0, len(pods))
+	for _, pod := range pods {
+		names = append(names, pod.Name)
+	}
+	p.batches = append(p.batches, names)
+}
+
+func (p *mockBatchProvider) CreatePods(ctx context.Context, pods []*corev1.Pod) ([]error, error) {
+	p.record(pods)
+	errs := make([]error, len(pods))
+	for i, pod := range pods {
+		if pod.Name == "bad" {
+			errs[i] = errors.New("bad pod")
+		}
+	}
+	return errs, nil
+}
+
+func (p *mockBatchProvider) DeletePods(ctx context.Context, pods []*corev1.Pod) ([]error, error) {
+	p.record(pods)
+	return nil, errors.New("backend unavailable")
+}
+
+func (p *mockBatchProvider) GetPodStatuses(ctx context.Context, pods []types.NamespacedName) (map[types.NamespacedName]*corev1.PodStatus, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.statusCalls = append(p.statusCalls, pods)
+	statuses := make(map[types.NamespacedName]*corev1.PodStatus)
+	for _, key := range pods {
+		if status, ok := p.statuses[key]; ok {
+			statuses[key] = status.DeepCopy()
+		}
+	}
+	return statuses, nil
+}
+
+func batchTestPod(name string) *corev1.Pod {
+	return &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name}}
+}
+
+func TestBatchingProviderCreate(t *testing.T) {
+	p := &mockBatchProvider{mockProvider: newSyncMockProvider()}
+	wrapped := wrapBatchingProvider(p, PodBatchConfig{MaxSize: 3, Linger: 200 * time.Millisecond})
+	_, isNotifier := wrapped.(PodNotifier)
+	assert.Check(t, !isNotifier)
+
+	ctx := context.Background()
+	errs := make(map[string]error)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, name := range []string{"a", "bad", "b", "c"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := wrapped.CreatePod(ctx, batchTestPod(name))
+			mu.Lock()
+			errs[name] = err
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	// A full batch is sent at once, and the remaining pod once it has lingered.
+	assert.Check(t, is.Len(p.batches, 2))
+	assert.Check(t, is.Len(p.batches[0], 3))
+	assert.Check(t, is.Len(p.batches[1], 1))
+	assert.Check(t, is.Equal(p.creates.read(), 0))
+
+	// Each pod gets its own result.
+	for name, err := range errs {
+		if name == "bad" {
+			assert.Check(t, is.Error(err, "bad pod"))
+		} else {
+			assert.Check(t, is.Nil(err), name)
+		}
+	}
+}
+
+func TestBatchingProviderDelete(t *testing.T) {
+	p := &mockBatchProvider{mockProvider: newSyncMockProvider()}
+	async := &mockProviderAsync{p.mockProvider}
+	wrapped := wrapBatchingProvider(&struct {
+		*mockBatchProvider
+		PodNotifier
+	}{p, async}, PodBatchConfig{})
+	_, isAsync := wrapped.(asyncProvider)
+	assert.Check(t, isAsync)
+
+	// The error of the batch is the error of each pod.
+	err := wrapped.DeletePod(context.Background(), batchTestPod("a"))
+	assert.Check(t, is.Error(err, "backend unavailable"))
+	assert.Check(t, is.DeepEqual(p.batches, [][]string{{"a"}}))
+
+	// Providers without batch interfaces are not wrapped.
+	assert.Check(t, wrapBatchingProvider(p.mockProvider, PodBatchConfig{}) == PodLifecycleHandler(p.mockProvider))
+}
+
+func TestSyncProviderWrapperBatchedStatuses(t *testing.T) {
+	created := metav1.NewTime(time.Now().Add(-time.Hour))
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, name := range []string{"a", "b", "c"} {
+		pod := batchTestPod(name)
+		pod.CreationTimestamp = created
+		pod.Status.Phase = corev1.PodRunning
+		assert.NilError(t, indexer.Add(pod))
+	}
+
+	p := &mockBatchProvider{
+		mockProvider: newSyncMockProvider(),
+		statuses: map[types.NamespacedName]*corev1.PodStatus{
+			{Namespace: "default", Name: "a"}: {Phase: corev1.PodRunning, Message: "from provider"},
+			{Namespace: "default", Name: "b"}: {Phase: corev1.PodRunning, Message: "from provider"},
+		},
+	}
+	notified := make(map[string]*corev1.Pod)
+	wrapper := &syncProviderWrapper{
+		PodLifecycleHandler: p,
+		l:                   corev1listers.NewPodLister(indexer),
+		statusBatchGetter:   p,
+		statusBatchSize:     2,
+		notify: func(pod *corev1.Pod) {
+			notified[pod.Name] = pod
+		},
+	}
+	wrapper.syncPodStatuses(context.Background())
+
+	assert.Check(t, is.Len(p.statusCalls, 2))
+	assert.Check(t, is.Len(p.statusCalls[0], 2))
+	assert.Check(t, is.Len(p.statusCalls[1], 1))
+
+	assert.Check(t, is.Len(notified, 3))
+	for name, pod := range notified {
+		if p.statuses[types.NamespacedName{Namespace: "default", Name: name}] != nil {
+			assert.Check(t, is.Equal(pod.Status.Message, "from provider"))
+		} else {
+			// Running pods which are missing from the provider are failed.
+			assert.Check(t, is.Equal(pod.Status.Phase, corev1.PodFailed))
+			assert.Check(t, is.Equal(pod.Status.Reason, podStatusReasonNotFound))
+		}
+	}
+}
@@ -0,0 +1,190 @@
+// Copyright © 2017 The virtual-kubelet authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/virtual-kubelet/virtual-kubelet/internal/queue"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// PodQueueLane is a priority lane of the queues pods are synced on.
+type PodQueueLane int
+
+const (
+	// PodQueueLaneCritical is the lane of critical pods, whose priority is at least the critical priority.
+	PodQueueLaneCritical PodQueueLane = iota
+	// PodQueueLaneLifecycle is the lane of pods which are created or deleted.
+	PodQueueLaneLifecycle
+	// PodQueueLaneUpdate is the lane of pods whose metadata or spec was updated.
+	PodQueueLaneUpdate
+	// PodQueueLaneStatus is the lane of pods whose status was updated by the provider.
+	PodQueueLaneStatus
+
+	numPodQueueLanes = int(PodQueueLaneStatus) + 1
+)
+
+// DefaultCriticalPodPriority is the default priority at or above which pods are critical.
+// It is the priority of the system-cluster-critical priority class.
+const DefaultCriticalPodPriority int32 = 2000000000
+
+// DefaultPodQueueLaneWeights are the default weights of the pod queue lanes.
+var DefaultPodQueueLaneWeights = map[PodQueueLane]int{
+	PodQueueLaneCritical:  8,
+	PodQueueLaneLifecycle: 4,
+	PodQueueLaneUpdate:    2,
+	PodQueueLaneStatus:    1,
+}
+
+// PodQueuePriorities configures the priority lanes of the queues pods are synced from Kubernetes and their status is
+// synced from the provider on, so that pods which are created or deleted are not held up by a churn of updates.
+//
+// When the pods of several lanes are ready to be synced, each lane gets a share of the workers proportional to its
+// weight. Pods which have been waiting for longer than MaxWait are synced first, so that no lane is starved.
+type PodQueuePriorities struct {
+	// LaneWeights are the weights of the lanes. Lanes which are not set use DefaultPodQueueLaneWeights.
+	LaneWeights map[PodQueueLane]int
+	// CriticalPriority is the pod priority at or above which pods are queued on PodQueueLaneCritical.
+	// It defaults to DefaultCriticalPodPriority.
+	CriticalPriority *int32
+	// MaxWait is how long a pod may be ready to be synced before it is synced ahead of pods in other lanes.
+	// It defaults to 10 seconds. If it is negative, pods are only synced according to the weights of their lanes.
+	MaxWait time.Duration
+}
+
+// PodQueueFairness configures fair queuing of pods between tenants in the pod queues, so that a tenant with many pods
+// cannot hold up the pods of other tenants. By default, each namespace is a tenant.
+//
+// Each tenant gets a share of the workers proportional to its weight (within each priority lane, if they are
+// configured). The number of pods of each tenant in the queues is reported by PodController.QueueStats, and exported
+// to Prometheus by PodController.QueueCollector.
+type PodQueueFairness struct {
+	// TenantFunc returns the tenant of the pods of a namespace. It defaults to the namespace itself.
+	TenantFunc func(namespace string) string
+	// TenantWeights are the weights of tenants. Tenants which are not set have a weight of 1.
+	TenantWeights map[string]int
+	// MaxInFlightPerTenant is the maximum number of pods of a tenant each queue syncs at the same time.
+	// If it is zero, it is not limited.
+	MaxInFlightPerTenant int
+}
+
+func (f *PodQueueFairness) queueConfig() *queue.FairnessConfig {
+	tenantFunc := queue.NamespaceTenant
+	if f.TenantFunc != nil {
+		tenantFunc = func(key string) string {
+			return f.TenantFunc(queue.NamespaceTenant(key))
+		}
+	}
+	return &queue.FairnessConfig{
+		TenantFunc: tenantFunc,
+		TenantWeight: func(tenant string) int {
+			if w, ok := f.TenantWeights[tenant]; ok {
+				return w
+			}
+			return 1
+		},
+		MaxInFlightPerTenant: f.MaxInFlightPerTenant,
+	}
+}
+
+func (p *PodQueuePriorities) queueConfig() queue.PriorityConfig {
+	weights := make([]int, numPodQueueLanes)
+	for lane := range weights {
+		w, ok := p.LaneWeights[PodQueueLane(lane)]
+		if !ok {
+			w = DefaultPodQueueLaneWeights[PodQueueLane(lane)]
+		}
+		weights[lane] = w
+	}
+	return queue.PriorityConfig{LaneWeights: weights, MaxWait: p.MaxWait}
+}
+
+// newPodQueue creates a queue for pods, with priority lanes and fair queuing if they are configured.
+func newPodQueue(priorities *PodQueuePriorities, fairness *PodQueueFairness, ratelimiter workqueue.TypedRateLimiter[any], name string, handler queue.ItemHandler, retryFunc ShouldRetryFunc) *queue.Queue {
+	var cfg queue.Config
+	if priorities != nil {
+		cfg.Priorities = priorities.queueConfig()
+	}
+	if fairness != nil {
+		cfg.Fairness = fairness.queueConfig()
+	}
+	return queue.NewWithConfig(ratelimiter, name, handler, retryFunc, cfg)
+}
+
+// QueueStats returns the number of pods queued and being synced by each tenant, for each of the pod queues.
+// If fair queuing is not configured, all pods belong to the tenant "".
+func (pc *PodController) QueueStats() map[string]map[string]QueueTenantStats {
+	return map[string]map[string]QueueTenantStats{
+		"syncPodsFromKubernetes":    pc.syncPodsFromKubernetes.TenantStats(),
+		"deletePodsFromKubernetes":  pc.deletePodsFromKubernetes.TenantStats(),
+		"syncPodStatusFromProvider": pc.syncPodStatusFromProvider.TenantStats(),
+	}
+}
+
+var (
+	podQueueTenantDepthDesc = prometheus.NewDesc(
+		"virtual_kubelet_pod_queue_tenant_depth",
+		"Number of pods of a tenant waiting to be synced in a pod queue.",
+		[]string{"queue", "tenant"}, nil,
+	)
+	podQueueTenantInFlightDesc = prometheus.NewDesc(
+		"virtual_kubelet_pod_queue_tenant_in_flight",
+		"Number of pods of a tenant being synced by a pod queue.",
+		[]string{"queue", "tenant"}, nil,
+	)
+)
+
+// QueueCollector returns a Prometheus collector of the statistics returned by QueueStats. Tenants which have no pods
+// queued or being synced are not reported.
+func (pc *PodController) QueueCollector() prometheus.Collector {
+	return podQueueCollector{pc: pc}
+}
+
+type podQueueCollector struct {
+	pc *PodController
+}
+
+func (c podQueueCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- podQueueTenantDepthDesc
+	ch <- podQueueTenantInFlightDesc
+}
+
+func (c podQueueCollector) Collect(ch chan<- prometheus.Metric) {
+	for name, tenants := range c.pc.QueueStats() {
+		for tenant, stats := range tenants {
+			ch <- prometheus.MustNewConstMetric(podQueueTenantDepthDesc, prometheus.GaugeValue, float64(stats.Queued), name, tenant)
+			ch <- prometheus.MustNewConstMetric(podQueueTenantInFlightDesc, prometheus.GaugeValue, float64(stats.InFlight), name, tenant)
+		}
+	}
+}
+
+// podQueueLane returns the lane the pod is queued on for the reason given by lane: critical pods are always queued
+// on PodQueueLaneCritical. If the queues have no priority lanes, it returns 0.
+func (pc *PodController) podQueueLane(pod *corev1.Pod, lane PodQueueLane) int {
+	if pc.queuePriorities == nil {
+		return 0
+	}
+	critical := DefaultCriticalPodPriority
+	if pc.queuePriorities.CriticalPriority != nil {
+		critical = *pc.queuePriorities.CriticalPriority
+	}
+	if pod != nil && pod.Spec.Priority != nil && *pod.Spec.Priority >= critical {
+		return int(PodQueueLaneCritical)
+	}
+	return int(lane)
+}
@@ -0,0 +1,103 @@
+package node
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/virtual-kubelet/virtual-kubelet/internal/queue"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/utils/ptr"
+)
+
+func TestPodQueueLane(t *testing.T) {
+	pod := &corev1.Pod{}
+	critical := &corev1.Pod{Spec: corev1.PodSpec{Priority: ptr.To(DefaultCriticalPodPriority)}}
+
+	pc := &PodController{}
+	assert.Check(t, is.Equal(pc.podQueueLane(pod, PodQueueLaneStatus), 0))
+	assert.Check(t, is.Equal(pc.podQueueLane(critical, PodQueueLaneStatus), 0))
+
+	pc.queuePriorities = &PodQueuePriorities{}
+	assert.Check(t, is.Equal(pc.podQueueLane(pod, PodQueueLaneStatus), int(PodQueueLaneStatus)))
+	assert.Check(t, is.Equal(pc.podQueueLane(pod, PodQueueLaneLifecycle), int(PodQueueLaneLifecycle)))
+	assert.Check(t, is.Equal(pc.podQueueLane(critical, PodQueueLaneStatus), int(PodQueueLaneCritical)))
+
+	pc.queuePriorities.CriticalPriority = ptr.To[int32](1000)
+	pod.Spec.Priority = ptr.To[int32](1000)
+	assert.Check(t, is.Equal(pc.podQueueLane(pod, PodQueueLaneUpdate), int(PodQueueLaneCritical)))
+}
+
+func TestPodQueuePrioritiesQueueConfig(t *testing.T) {
+	p := &PodQueuePriorities{LaneWeights: map[PodQueueLane]int{PodQueueLaneStatus: 3}}
+	cfg := p.queueConfig()
+	assert.DeepEqual(t, cfg.LaneWeights, []int{8, 4, 2, 3})
+}
+
+func TestPodQueueFairnessQueueConfig(t *testing.T) {
+	f := &PodQueueFairness{
+		TenantFunc:    func(namespace string) string { return strings.TrimSuffix(namespace, "-dev") },
+		TenantWeights: map[string]int{"team-a": 3},
+	}
+	cfg := f.queueConfig()
+	assert.Check(t, is.Equal(cfg.TenantFunc("team-a-dev/pod"), "team-a"))
+	assert.Check(t, is.Equal(cfg.TenantFunc("team-a/pod/uid"), "team-a"))
+	assert.Check(t, is.Equal(cfg.TenantWeight("team-a"), 3))
+	assert.Check(t, is.Equal(cfg.TenantWeight("team-b"), 1))
+
+	cfg = (&PodQueueFairness{}).queueConfig()
+	assert.Check(t, is.Equal(cfg.TenantFunc("team-a-dev/pod"), "team-a-dev"))
+}
+
+func TestPodQueueCollector(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	started, release := make(chan string, 3), make(chan struct{})
+	handler := func(ctx context.Context, key string) error {
+		started <- key
+		<-release
+		return nil
+	}
+	newQueue := func(name string) *queue.Queue {
+		return newPodQueue(nil, &PodQueueFairness{}, workqueue.DefaultTypedControllerRateLimiter[any](), name, handler, nil)
+	}
+	pc := &PodController{
+		syncPodsFromKubernetes:    newQueue("syncPodsFromKubernetes"),
+		deletePodsFromKubernetes:  newQueue("deletePodsFromKubernetes"),
+		syncPodStatusFromProvider: newQueue("syncPodStatusFromProvider"),
+	}
+	defer close(release)
+	go pc.syncPodsFromKubernetes.Run(ctx, 1)
+
+	pc.syncPodsFromKubernetes.EnqueueWithoutRateLimit(ctx, "team-a/pod-1")
+	assert.Check(t, is.Equal(<-started, "team-a/pod-1"))
+	pc.syncPodsFromKubernetes.EnqueueWithoutRateLimit(ctx, "team-a/pod-2")
+	pc.syncPodsFromKubernetes.EnqueueWithoutRateLimit(ctx, "team-b/pod-3")
+
+	registry := prometheus.NewRegistry()
+	assert.NilError(t, registry.Register(pc.QueueCollector()))
+	families, err := registry.Gather()
+	assert.NilError(t, err)
+
+	values := make(map[string]float64)
+	for _, family := range families {
+		for _, m := range family.GetMetric() {
+			labels := make(map[string]string)
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			values[family.GetName()+"/"+labels["queue"]+"/"+labels["tenant"]] = m.GetGauge().GetValue()
+		}
+	}
+	assert.Check(t, is.DeepEqual(values, map[string]float64{
+		"virtual_kubelet_pod_queue_tenant_depth/syncPodsFromKubernetes/team-a":     1,
+		"virtual_kubelet_pod_queue_tenant_in_flight/syncPodsFromKubernetes/team-a": 1,
+		"virtual_kubelet_pod_queue_tenant_depth/syncPodsFromKubernetes/team-b":     1,
+		"virtual_kubelet_pod_queue_tenant_in_flight/syncPodsFromKubernetes/team-b": 0,
+	}))
+}
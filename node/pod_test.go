@@ -262,6 +262,55 @@ func TestPodCreateNewPodWithNoDownwardAPIResolution(t *testing.T) {
 	assert.Check(t, is.DeepEqual(createdPod.(*corev1.Pod).Spec.Containers[0].Env, pod.Spec.Containers[0].Env))
 }
 
+type fakeNetworkPreparer struct {
+	prepares int
+}
+
+func (p *fakeNetworkPreparer) PreparePodNetwork(_ context.Context, _ *corev1.Pod) (*corev1.PodStatus, error) {
+	p.prepares++
+	return &corev1.PodStatus{
+		PodIP:  "10.0.0.1",
+		PodIPs: []corev1.PodIP{{IP: "10.0.0.1"}},
+		HostIP: "192.168.0.1",
+	}, nil
+}
+
+func TestPodCreateNewPodWithPreparedNetwork(t *testing.T) {
+	svr := newTestController()
+	preparer := &fakeNetworkPreparer{}
+	svr.networkPreparer = preparer
+
+	pod := &corev1.Pod{}
+	pod.Namespace = "default" //nolint:goconst
+	pod.Name = "nginx"        //nolint:goconst
+	pod.Spec = newPodSpec()
+	pod.Spec.Containers[0].Env = []corev1.EnvVar{
+		{
+			Name: "MY_POD_IP",
+			ValueFrom: &corev1.EnvVarSource{
+				FieldRef: &corev1.ObjectFieldSelector{
+					APIVersion: "v1",
+					FieldPath:  "status.podIP",
+				},
+			},
+		},
+	}
+
+	err := svr.createOrUpdatePod(context.Background(), pod.DeepCopy())
+	assert.Check(t, is.Nil(err))
+	assert.Check(t, is.Equal(preparer.prepares, 1))
+	assert.Check(t, is.Equal(svr.mock.creates.read(), 1))
+
+	key, err := buildKey(pod)
+	assert.Check(t, is.Nil(err))
+	createdPod, ok := svr.mock.pods.Load(key)
+	assert.Check(t, ok)
+
+	// The IP prepared by the provider must have been used to resolve the downward API reference.
+	env := createdPod.(*corev1.Pod).Spec.Containers[0].Env
+	assert.Check(t, is.DeepEqual(env, []corev1.EnvVar{{Name: "MY_POD_IP", Value: "10.0.0.1"}}))
+}
+
 func TestPodUpdateExisting(t *testing.T) {
 	svr := newTestController()
 
@@ -349,6 +398,56 @@ func TestPodNoSpecChangeWithResolvedEnvOrderDifference(t *testing.T) {
 	assert.Check(t, is.Equal(svr.mock.updates.read(), 0))
 }
 
+func TestPodNoSpecChangeWithUnexpandedReferences(t *testing.T) {
+	svr := newTestController()
+
+	pod := &corev1.Pod{}
+	pod.Namespace = "default"
+	pod.Name = "nginx"
+	pod.Spec = newPodSpec()
+	pod.Spec.EnableServiceLinks = ptr.To(false)
+	pod.Spec.Containers[0].Env = []corev1.EnvVar{{Name: "GREETING", Value: "hello"}}
+	pod.Spec.Containers[0].Command = []string{"echo", "$(GREETING)"}
+	pod.Spec.Containers[0].Args = []string{"$(GREETING) $(POD_NAME)", "$$(GREETING)"}
+	pod.Spec.Containers[0].VolumeMounts = []corev1.VolumeMount{{Name: "logs", MountPath: "/var/log", SubPathExpr: "$(GREETING)"}}
+
+	err := svr.createOrUpdatePod(context.Background(), pod.DeepCopy())
+	assert.Check(t, is.Nil(err))
+	assert.Check(t, is.Equal(svr.mock.creates.read(), 1))
+
+	key, err := buildKey(pod)
+	assert.Check(t, is.Nil(err))
+	createdPod, ok := svr.mock.pods.Load(key)
+	assert.Check(t, ok)
+	c := createdPod.(*corev1.Pod).Spec.Containers[0]
+	assert.Check(t, is.DeepEqual(c.Command, []string{"echo", "hello"}))
+	assert.Check(t, is.DeepEqual(c.Args, []string{"hello $(POD_NAME)", "$(GREETING)"}))
+	assert.Check(t, is.Equal(c.VolumeMounts[0].SubPath, "hello"))
+
+	// Re-syncing the pod expands the references the same way.
+	err = svr.createOrUpdatePod(context.Background(), pod.DeepCopy())
+	assert.Check(t, is.Nil(err))
+	assert.Check(t, is.Equal(svr.mock.updates.read(), 0))
+
+	// The provider may also return the references as they were before expansion.
+	storedPod := createdPod.(*corev1.Pod).DeepCopy()
+	storedPod.Spec.Containers[0].Command = pod.Spec.Containers[0].Command
+	storedPod.Spec.Containers[0].Args = pod.Spec.Containers[0].Args
+	storedPod.Spec.Containers[0].VolumeMounts = pod.Spec.Containers[0].VolumeMounts
+	svr.mock.pods.Store(key, storedPod)
+
+	err = svr.createOrUpdatePod(context.Background(), pod.DeepCopy())
+	assert.Check(t, is.Nil(err))
+	assert.Check(t, is.Equal(svr.mock.creates.read(), 1))
+	assert.Check(t, is.Equal(svr.mock.updates.read(), 0))
+
+	// A change of the references is still an update.
+	pod.Spec.Containers[0].Args = []string{"$(GREETING)"}
+	err = svr.createOrUpdatePod(context.Background(), pod.DeepCopy())
+	assert.Check(t, is.Nil(err))
+	assert.Check(t, is.Equal(svr.mock.updates.read(), 1))
+}
+
 func TestPodStatusDelete(t *testing.T) {
 	ctx := context.Background()
 	c := newTestController()
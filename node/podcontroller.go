@@ -27,6 +27,7 @@ import (
 	"github.com/virtual-kubelet/virtual-kubelet/internal/queue"
 	"github.com/virtual-kubelet/virtual-kubelet/log"
 	"github.com/virtual-kubelet/virtual-kubelet/trace"
+	"golang.org/x/time/rate"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/util/wait"
@@ -89,6 +90,20 @@ type PodNotifier interface {
 	NotifyPods(context.Context, func(*corev1.Pod))
 }
 
+// PodNetworkPreparer is an optional extension to PodLifecycleHandler for providers that can set up a pod's network
+// before its containers are created.
+//
+// Downward API references to status.podIP, status.podIPs, status.hostIP and status.hostIPs can only be resolved once
+// the pod has an IP. When the provider implements this interface, PreparePodNetwork is called before CreatePod,
+// and the returned status is used to resolve those references. The IPs are also set on the status of the pod which
+// is subsequently passed to CreatePod, so the provider can start the pod with the network it prepared.
+type PodNetworkPreparer interface {
+	// PreparePodNetwork allocates the pod's network and returns a PodStatus with (at least) the PodIP(s) and
+	// HostIP(s) set. PreparePodNetwork may be called multiple times for the same pod, for example if CreatePod fails
+	// and is retried, so it must be idempotent.
+	PreparePodNetwork(ctx context.Context, pod *corev1.Pod) (*corev1.PodStatus, error)
+}
+
 // PodEventFilterFunc is used to filter pod events received from Kubernetes.
 //
 // Filters that return true means the event handler will be run
@@ -119,6 +134,10 @@ type PodController struct {
 
 	syncPodStatusFromProvider *queue.Queue
 
+	// enforceActiveDeadlines is a queue on which pods with spec.activeDeadlineSeconds are scheduled to be checked
+	// once their deadline has passed
+	enforceActiveDeadlines *queue.Queue
+
 	// From the time of creation, to termination the knownPods map will contain the pods key
 	// (derived from Kubernetes' cache library) -> a *knownPod struct.
 	knownPods sync.Map
@@ -145,6 +164,29 @@ type PodController struct {
 	// in pods before calling CreatePod on the provider.
 	// Providers need this if they need to do their own custom resolving
 	skipDownwardAPIResolution bool
+
+	// networkPreparer is set if the provider supports preparing pod networks ahead of creating pods.
+	networkPreparer PodNetworkPreparer
+
+	// nodeAllocatable returns the allocatable resources of the node, used for resolving resource field references.
+	nodeAllocatable func() corev1.ResourceList
+
+	// extendedResources is used to allocate devices to pods, if set.
+	extendedResources *ExtendedResourceManager
+
+	// resourceAccounting is used to admit pods, if set.
+	resourceAccounting *ResourceAccounting
+
+	// queuePriorities configures the priority lanes of the pod queues, if set.
+	queuePriorities *PodQueuePriorities
+
+	// statusBatchGetter is set if the provider supports retrieving pod statuses in batches, and statusBatchSize is
+	// the maximum size of the batches.
+	statusBatchGetter PodStatusBatchGetter
+	statusBatchSize   int
+
+	// statusPolling configures the polling of pod statuses from providers which are not PodNotifiers.
+	statusPolling PodStatusPollingConfig
 }
 
 type knownPod struct {
@@ -195,6 +237,11 @@ type PodControllerConfig struct {
 	// SyncPodStatusFromProviderShouldRetryFunc allows for a custom retry policy for the SyncPodStatusFromProvider queue
 	SyncPodStatusFromProviderShouldRetryFunc ShouldRetryFunc
 
+	// EnforceActiveDeadlinesRateLimiter defines the rate limit for the EnforceActiveDeadlines queue
+	EnforceActiveDeadlinesRateLimiter workqueue.TypedRateLimiter[any]
+	// EnforceActiveDeadlinesShouldRetryFunc allows for a custom retry policy for the EnforceActiveDeadlines queue
+	EnforceActiveDeadlinesShouldRetryFunc ShouldRetryFunc
+
 	// Add custom filtering for pod informer event handlers
 	// Use this for cases where the pod informer handles more than pods assigned to this node
 	//
@@ -206,6 +253,41 @@ type PodControllerConfig struct {
 	// in pods before calling CreatePod on the provider.
 	// Providers need this if they need to do their own custom resolving
 	SkipDownwardAPIResolution bool
+
+	// NodeAllocatable returns the node's allocatable resources.
+	// Downward API resource field references to limits that are not set on a container resolve to these values,
+	// like they would on a regular kubelet. If this is not set, such references resolve to 0.
+	NodeAllocatable func() corev1.ResourceList
+
+	// ExtendedResources is used to allocate devices of extended resources to the containers which request them
+	// before pods are created in the provider. The allocated devices are passed to the provider in the
+	// PodDevicesAnnotation annotation of the pod.
+	// This should be the same manager the node controller publishes the extended resources of.
+	ExtendedResources *ExtendedResourceManager
+
+	// ResourceAccounting is used to admit pods before they are created in the provider. Pods which request more
+	// resources than the node has left are rejected, like on a regular kubelet.
+	// This should be the same accounting the node controller computes the node's allocatable resources with.
+	ResourceAccounting *ResourceAccounting
+
+	// QueuePriorities configures priority lanes for the SyncPodsFromKubernetes and SyncPodStatusFromProvider queues,
+	// so that critical pods, and pods which are created or deleted, are synced ahead of updates and status changes.
+	// If this is not set, pods are synced in the order they are queued.
+	QueuePriorities *PodQueuePriorities
+
+	// QueueFairness configures fair queuing between tenants, by default namespaces, for the SyncPodsFromKubernetes,
+	// DeletePodsFromKubernetes and SyncPodStatusFromProvider queues.
+	// If this is not set, the pods of all namespaces share the queues.
+	QueueFairness *PodQueueFairness
+
+	// PodBatching configures the batches of pods passed to providers which implement PodBatchCreator,
+	// PodBatchDeleter or PodStatusBatchGetter. The calls to create and delete pods of concurrent workers are
+	// coalesced into batches, and errors are still handled, and retried, for each pod.
+	PodBatching PodBatchConfig
+
+	// StatusPolling configures how the statuses of pods are polled from providers which do not implement
+	// PodNotifier. By default, the status of each pod is polled every 5 seconds.
+	StatusPolling PodStatusPollingConfig
 }
 
 // NewPodController creates a new pod controller with the provided config.
@@ -240,6 +322,9 @@ func NewPodController(cfg PodControllerConfig) (*PodController, error) {
 	if cfg.SyncPodStatusFromProviderRateLimiter == nil {
 		cfg.SyncPodStatusFromProviderRateLimiter = workqueue.DefaultTypedControllerRateLimiter[any]()
 	}
+	if cfg.EnforceActiveDeadlinesRateLimiter == nil {
+		cfg.EnforceActiveDeadlinesRateLimiter = workqueue.DefaultTypedControllerRateLimiter[any]()
+	}
 	rm, err := manager.NewResourceManager(cfg.PodInformer.Lister(), cfg.SecretInformer.Lister(), cfg.ConfigMapInformer.Lister(), cfg.ServiceInformer.Lister())
 	if err != nil {
 		return nil, pkgerrors.Wrap(err, "could not create resource manager")
@@ -256,11 +341,23 @@ func NewPodController(cfg PodControllerConfig) (*PodController, error) {
 		recorder:                  cfg.EventRecorder,
 		podEventFilterFunc:        cfg.PodEventFilterFunc,
 		skipDownwardAPIResolution: cfg.SkipDownwardAPIResolution,
+		nodeAllocatable:           cfg.NodeAllocatable,
+		extendedResources:         cfg.ExtendedResources,
+		resourceAccounting:        cfg.ResourceAccounting,
+		queuePriorities:           cfg.QueuePriorities,
+		statusPolling:             cfg.StatusPolling,
 	}
-
-	pc.syncPodsFromKubernetes = queue.New(cfg.SyncPodsFromKubernetesRateLimiter, "syncPodsFromKubernetes", pc.syncPodFromKubernetesHandler, cfg.SyncPodsFromKubernetesShouldRetryFunc)
-	pc.deletePodsFromKubernetes = queue.New(cfg.DeletePodsFromKubernetesRateLimiter, "deletePodsFromKubernetes", pc.deletePodsFromKubernetesHandler, cfg.DeletePodsFromKubernetesShouldRetryFunc)
-	pc.syncPodStatusFromProvider = queue.New(cfg.SyncPodStatusFromProviderRateLimiter, "syncPodStatusFromProvider", pc.syncPodStatusFromProviderHandler, cfg.SyncPodStatusFromProviderShouldRetryFunc)
+	// The provider is wrapped when the controller is run if it is not a PodNotifier, so this needs to be checked
+	// before that happens.
+	pc.networkPreparer, _ = cfg.Provider.(PodNetworkPreparer)
+	pc.statusBatchGetter, _ = cfg.Provider.(PodStatusBatchGetter)
+	pc.statusBatchSize = cfg.PodBatching.withDefaults().MaxSize
+	pc.provider = wrapBatchingProvider(cfg.Provider, cfg.PodBatching)
+
+	pc.syncPodsFromKubernetes = newPodQueue(cfg.QueuePriorities, cfg.QueueFairness, cfg.SyncPodsFromKubernetesRateLimiter, "syncPodsFromKubernetes", pc.syncPodFromKubernetesHandler, cfg.SyncPodsFromKubernetesShouldRetryFunc)
+	pc.deletePodsFromKubernetes = newPodQueue(nil, cfg.QueueFairness, cfg.DeletePodsFromKubernetesRateLimiter, "deletePodsFromKubernetes", pc.deletePodsFromKubernetesHandler, cfg.DeletePodsFromKubernetesShouldRetryFunc)
+	pc.syncPodStatusFromProvider = newPodQueue(cfg.QueuePriorities, cfg.QueueFairness, cfg.SyncPodStatusFromProviderRateLimiter, "syncPodStatusFromProvider", pc.syncPodStatusFromProviderHandler, cfg.SyncPodStatusFromProviderShouldRetryFunc)
+	pc.enforceActiveDeadlines = queue.New(cfg.EnforceActiveDeadlinesRateLimiter, "enforceActiveDeadlines", pc.enforceActiveDeadlineHandler, cfg.EnforceActiveDeadlinesShouldRetryFunc)
 
 	return pc, nil
 }
@@ -296,7 +393,16 @@ func (pc *PodController) Run(ctx context.Context, podSyncWorkers int) (retErr er
 	if p, ok := pc.provider.(asyncProvider); ok {
 		provider = p
 	} else {
-		wrapped := &syncProviderWrapper{PodLifecycleHandler: pc.provider, l: pc.podsLister}
+		wrapped := &syncProviderWrapper{
+			PodLifecycleHandler: pc.provider,
+			l:                   pc.podsLister,
+			statusBatchGetter:   pc.statusBatchGetter,
+			statusBatchSize:     pc.statusBatchSize,
+			polling:             pc.statusPolling.withDefaults(),
+		}
+		if wrapped.polling.RequestsPerSecond > 0 {
+			wrapped.limiter = rate.NewLimiter(rate.Limit(wrapped.polling.RequestsPerSecond), wrapped.polling.Burst)
+		}
 		runProvider = wrapped.run
 		provider = wrapped
 		log.G(ctx).Debug("Wrapped non-async provider with async")
@@ -330,7 +436,8 @@ func (pc *PodController) Run(ctx context.Context, podSyncWorkers int) (retErr er
 			} else {
 				ctx = span.WithField(ctx, "key", key)
 				pc.knownPods.Store(key, &knownPod{})
-				pc.syncPodsFromKubernetes.Enqueue(ctx, key)
+				pc.syncPodsFromKubernetes.EnqueueWithPriority(ctx, key, pc.podQueueLane(pod.(*corev1.Pod), PodQueueLaneLifecycle))
+				pc.enqueueActiveDeadline(ctx, pod.(*corev1.Pod), key)
 			}
 		},
 		UpdateFunc: func(oldObj, newObj any) {
@@ -366,15 +473,22 @@ func (pc *PodController) Run(ctx context.Context, podSyncWorkers int) (retErr er
 					// This means that the pod in API server was changed by someone else [this can be okay], but we skipped
 					// a status update on our side because we compared the status received from the provider to the status
 					// received from the k8s api server based on outdated information.
-					pc.syncPodStatusFromProvider.Enqueue(ctx, key)
+					pc.syncPodStatusFromProvider.EnqueueWithPriority(ctx, key, pc.podQueueLane(newPod, PodQueueLaneStatus))
 					// Reset this to avoid re-adding it continuously
 					kPod.lastPodStatusUpdateSkipped = false
 				}
 				kPod.Unlock()
 
 				if podShouldEnqueue(oldPod, newPod) {
-					pc.syncPodsFromKubernetes.Enqueue(ctx, key)
+					lane := PodQueueLaneUpdate
+					if oldPod.DeletionTimestamp == nil && newPod.DeletionTimestamp != nil {
+						lane = PodQueueLaneLifecycle
+					}
+					pc.syncPodsFromKubernetes.EnqueueWithPriority(ctx, key, pc.podQueueLane(newPod, lane))
 				}
+				// The start time is set by the provider, so the deadline can only be scheduled once it has been
+				// reported back through a status update.
+				pc.enqueueActiveDeadline(ctx, newPod, key)
 			}
 		},
 		DeleteFunc: func(pod any) {
@@ -392,7 +506,8 @@ func (pc *PodController) Run(ctx context.Context, podSyncWorkers int) (retErr er
 				}
 				ctx = span.WithField(ctx, "key", key)
 				pc.knownPods.Delete(key)
-				pc.syncPodsFromKubernetes.Enqueue(ctx, key)
+				pc.syncPodsFromKubernetes.EnqueueWithPriority(ctx, key, pc.podQueueLane(k8sPod, PodQueueLaneLifecycle))
+				pc.enforceActiveDeadlines.Forget(ctx, key)
 				// If this pod was in the deletion queue, forget about it
 				key = fmt.Sprintf("%v/%v", key, k8sPod.UID)
 				pc.deletePodsFromKubernetes.Forget(ctx, key)
@@ -423,6 +538,20 @@ func (pc *PodController) Run(ctx context.Context, podSyncWorkers int) (retErr er
 	// If by any reason the provider fails to delete a dangling pod, it will stay in the provider and deletion won't be retried.
 	pc.deleteDanglingPods(ctx, podSyncWorkers)
 
+	// Account for the pods which already run in the provider before admitting any new pod.
+	if pc.resourceAccounting != nil {
+		if err := pc.admitProviderPods(ctx); err != nil {
+			log.G(ctx).WithError(err).Error("Failed to account for the resources of the pods in the provider")
+		}
+	}
+
+	// Release the devices of pods which were deleted while we were not running.
+	if pc.extendedResources != nil {
+		if err := pc.releaseDevicesOfDeletedPods(); err != nil {
+			log.G(ctx).WithError(err).Error("Failed to release devices of deleted pods")
+		}
+	}
+
 	log.G(ctx).Info("starting workers")
 	group := &wait.Group{}
 	group.StartWithContext(ctx, func(ctx context.Context) {
@@ -434,6 +563,9 @@ func (pc *PodController) Run(ctx context.Context, podSyncWorkers int) (retErr er
 	group.StartWithContext(ctx, func(ctx context.Context) {
 		pc.syncPodStatusFromProvider.Run(ctx, podSyncWorkers)
 	})
+	group.StartWithContext(ctx, func(ctx context.Context) {
+		pc.enforceActiveDeadlines.Run(ctx, podSyncWorkers)
+	})
 	defer group.Wait()
 	log.G(ctx).Info("started workers")
 	close(pc.ready)
@@ -544,18 +676,22 @@ func (pc *PodController) syncPodFromKubernetesHandler(ctx context.Context, key s
 			return err
 		}
 		if errdefs.IsNotFound(err) || pod == nil {
+			pc.releasePodResourcesNamed(ctx, namespace, name)
 			return nil
 		}
 
 		err = pc.provider.DeletePod(ctx, pod)
 		if errdefs.IsNotFound(err) {
+			pc.releasePodResourcesNamed(ctx, namespace, name)
 			return nil
 		}
 		if err != nil {
 			err = pkgerrors.Wrapf(err, "failed to delete pod %q in the provider", loggablePodNameFromCoordinates(namespace, name))
 			span.SetStatus(err)
+			return err
 		}
-		return err
+		pc.releasePodResourcesNamed(ctx, namespace, name)
+		return nil
 
 	}
 
@@ -575,6 +711,7 @@ func (pc *PodController) syncPodInProvider(ctx context.Context, pod *corev1.Pod,
 	// more context is here: https://github.com/virtual-kubelet/virtual-kubelet/pull/760
 	if pod.DeletionTimestamp != nil && !running(&pod.Status) {
 		log.G(ctx).Debug("Force deleting pod from API Server as it is no longer running")
+		pc.releasePodResources(ctx, pod)
 		key = fmt.Sprintf("%v/%v", key, pod.UID)
 		pc.deletePodsFromKubernetes.EnqueueWithoutRateLimit(ctx, key)
 		return nil
@@ -606,6 +743,7 @@ func (pc *PodController) syncPodInProvider(ctx context.Context, pod *corev1.Pod,
 		log.G(ctx).Debug("Deleting pod in provider")
 		if err := pc.deletePod(ctx, pod); errdefs.IsNotFound(err) {
 			log.G(ctx).Debug("Pod not found in provider")
+			pc.releasePodResources(ctx, pod)
 		} else if err != nil {
 			err := pkgerrors.Wrapf(err, "failed to delete pod %q in the provider", loggablePodName(pod))
 			span.SetStatus(err)
@@ -620,6 +758,7 @@ func (pc *PodController) syncPodInProvider(ctx context.Context, pod *corev1.Pod,
 	// Ignore the pod if it is in the "Failed" or "Succeeded" state.
 	if pod.Status.Phase == corev1.PodFailed || pod.Status.Phase == corev1.PodSucceeded {
 		log.G(ctx).Warnf("skipping sync of pod %q in %q phase", loggablePodName(pod), pod.Status.Phase)
+		pc.releasePodResources(ctx, pod)
 		return nil
 	}
 
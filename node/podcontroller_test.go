@@ -8,6 +8,8 @@ import (
 	"gotest.tools/assert"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	core "k8s.io/client-go/testing"
+	"k8s.io/utils/ptr"
 )
 
 func TestPodControllerExitOnContextCancel(t *testing.T) {
@@ -151,3 +153,69 @@ func TestPodEventFilter(t *testing.T) {
 		}
 	}
 }
+
+func TestPodControllerEnforcesActiveDeadline(t *testing.T) {
+	tc := newTestController()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- tc.Run(ctx, 1)
+	}()
+
+	select {
+	case <-ctx.Done():
+		t.Fatal(ctx.Err())
+	case <-tc.Ready():
+	case err := <-errCh:
+		t.Fatal(err)
+	}
+
+	pod := &corev1.Pod{}
+	pod.Namespace = "default"
+	pod.Name = "deadline"
+	pod.Spec = newPodSpec()
+	pod.Spec.ActiveDeadlineSeconds = ptr.To[int64](1)
+
+	_, err := tc.client.CoreV1().Pods(pod.Namespace).Create(ctx, pod, metav1.CreateOptions{})
+	assert.NilError(t, err)
+
+	assert.NilError(t, tc.mock.getDeletes().until(ctx, func(v int) bool { return v > 0 }))
+
+	var failed bool
+	for _, action := range tc.client.Actions() {
+		update, ok := action.(core.UpdateAction)
+		if !ok || action.GetSubresource() != "status" {
+			continue
+		}
+		p := update.GetObject().(*corev1.Pod)
+		if p.Status.Phase == corev1.PodFailed && p.Status.Reason == podStatusReasonDeadlineExceeded {
+			failed = true
+		}
+	}
+	assert.Assert(t, failed, "pod status was never set to failed due to the active deadline")
+}
+
+func TestActiveDeadlineRemaining(t *testing.T) {
+	now := time.Now()
+	start := metav1.NewTime(now.Add(-30 * time.Second))
+
+	pod := &corev1.Pod{}
+	_, ok := activeDeadlineRemaining(pod, now)
+	assert.Assert(t, !ok, "pods without a deadline should not be enforced")
+
+	pod.Spec.ActiveDeadlineSeconds = ptr.To[int64](60)
+	_, ok = activeDeadlineRemaining(pod, now)
+	assert.Assert(t, !ok, "pods which have not started should not be enforced")
+
+	pod.Status.StartTime = &start
+	remaining, ok := activeDeadlineRemaining(pod, now)
+	assert.Assert(t, ok)
+	assert.Equal(t, remaining, 30*time.Second)
+
+	pod.Status.Phase = corev1.PodSucceeded
+	_, ok = activeDeadlineRemaining(pod, now)
+	assert.Assert(t, !ok, "terminal pods should not be enforced")
+}
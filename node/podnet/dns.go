@@ -0,0 +1,442 @@
+// Copyright © 2017 The virtual-kubelet authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package podnet
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"strings"
+
+	pkgerrors "github.com/pkg/errors"
+	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
+	"github.com/virtual-kubelet/virtual-kubelet/log"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+)
+
+const (
+	// MaxDNSNameservers is the maximum number of nameservers a resolver will use.
+	MaxDNSNameservers = 3
+	// MaxDNSSearchPaths is the maximum number of search paths a pod's resolv.conf may contain.
+	MaxDNSSearchPaths = 32
+	// MaxDNSSearchListChars is the maximum total length of a pod's search paths.
+	MaxDNSSearchListChars = 2048
+
+	// ReasonDNSConfigForming is the reason used in events emitted when the pod's DNS configuration exceeds the
+	// resolver limits and has been truncated.
+	ReasonDNSConfigForming = "DNSConfigForming"
+	// ReasonMissingClusterDNS is the reason used in events emitted when a pod uses the ClusterFirst DNS policy but
+	// no cluster DNS server is known.
+	ReasonMissingClusterDNS = "MissingClusterDNS"
+)
+
+var (
+	// DefaultDNSService is the service whose cluster IPs are used as cluster DNS servers when none are configured.
+	DefaultDNSService = types.NamespacedName{Namespace: "kube-system", Name: "kube-dns"}
+
+	defaultDNSOptions = []string{"ndots:5"}
+)
+
+// ServiceLister lists the services of the cluster.
+// It is implemented by the resource manager passed to providers.
+type ServiceLister interface {
+	ListServices() ([]*corev1.Service, error)
+}
+
+// Config is used to configure a Configurer.
+type Config struct {
+	// ClusterDomain is the domain of the cluster, e.g. cluster.local.
+	// When empty, no cluster search paths are added.
+	ClusterDomain string
+
+	// ClusterDNS is the list of cluster DNS server addresses.
+	// When empty, the cluster IPs of DNSService are used.
+	ClusterDNS []string
+	// Services is used to look up DNSService when ClusterDNS is empty.
+	Services ServiceLister
+	// DNSService is the service which fronts the cluster DNS servers.
+	// Defaults to DefaultDNSService.
+	DNSService types.NamespacedName
+
+	// ResolverConfig is the path of the resolv.conf used as the basis for pods using the Default DNS policy.
+	// When empty, those pods resolve through a local resolver on NodeIPs, like the kubelet does when its
+	// --resolv-conf flag is set to the empty string.
+	ResolverConfig string
+	// NodeIPs are the addresses of the node.
+	NodeIPs []string
+	// HostsFile is the path of the node's hosts file, which host network pods use as their hosts file.
+	// Defaults to /etc/hosts.
+	HostsFile string
+
+	// EventRecorder is used to record events about pods whose DNS configuration is invalid or had to be adjusted.
+	// It is optional.
+	EventRecorder record.EventRecorder
+}
+
+// Configurer produces the resolv.conf, hosts file and hostname of pods.
+type Configurer struct {
+	cfg Config
+}
+
+// NewConfigurer creates a Configurer from the passed in config.
+func NewConfigurer(cfg Config) *Configurer {
+	if cfg.DNSService.Name == "" {
+		cfg.DNSService = DefaultDNSService
+	}
+	if cfg.HostsFile == "" {
+		cfg.HostsFile = "/etc/hosts"
+	}
+	return &Configurer{cfg: cfg}
+}
+
+// DNSConfig is the resolver configuration of a pod.
+type DNSConfig struct {
+	Servers  []string
+	Searches []string
+	Options  []string
+}
+
+// Bytes renders the DNS config in resolv.conf format.
+func (c *DNSConfig) Bytes() []byte {
+	var buf bytes.Buffer
+	if len(c.Searches) > 0 {
+		fmt.Fprintf(&buf, "search %s\n", strings.Join(c.Searches, " "))
+	}
+	for _, s := range c.Servers {
+		fmt.Fprintf(&buf, "nameserver %s\n", s)
+	}
+	if len(c.Options) > 0 {
+		fmt.Fprintf(&buf, "options %s\n", strings.Join(c.Options, " "))
+	}
+	return buf.Bytes()
+}
+
+type podDNSType int
+
+const (
+	podDNSCluster podDNSType = iota
+	podDNSHost
+	podDNSNone
+)
+
+// ResolvConf returns the content of the resolv.conf of the pod.
+func (c *Configurer) ResolvConf(ctx context.Context, pod *corev1.Pod) ([]byte, error) {
+	dnsConfig, err := c.DNSConfig(ctx, pod)
+	if err != nil {
+		return nil, err
+	}
+	return dnsConfig.Bytes(), nil
+}
+
+// DNSConfig returns the resolver configuration of the pod, according to its DNS policy and DNS config.
+// Based on GetPodDNS in pkg/kubelet/network/dns/dns.go.
+func (c *Configurer) DNSConfig(ctx context.Context, pod *corev1.Pod) (*DNSConfig, error) {
+	clusterDNS, err := c.clusterDNS()
+	if err != nil {
+		return nil, err
+	}
+
+	dnsType, err := c.podDNSType(ctx, pod, len(clusterDNS) > 0)
+	if err != nil {
+		return nil, err
+	}
+
+	dnsConfig, err := c.hostDNSConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	switch dnsType {
+	case podDNSNone:
+		dnsConfig = &DNSConfig{}
+	case podDNSCluster:
+		dnsConfig.Servers = slices.Clone(clusterDNS)
+		dnsConfig.Searches = c.searchesForClusterFirst(dnsConfig.Searches, pod)
+		dnsConfig.Options = slices.Clone(defaultDNSOptions)
+	case podDNSHost:
+		if c.cfg.ResolverConfig == "" {
+			dnsConfig.Servers = nil
+			for _, ip := range c.cfg.NodeIPs {
+				if parsed := net.ParseIP(ip); parsed != nil && parsed.To4() == nil {
+					dnsConfig.Servers = append(dnsConfig.Servers, "::1")
+				} else {
+					dnsConfig.Servers = append(dnsConfig.Servers, "127.0.0.1")
+				}
+			}
+			if len(dnsConfig.Servers) == 0 {
+				dnsConfig.Servers = []string{"127.0.0.1"}
+			}
+			dnsConfig.Searches = []string{"."}
+		}
+	}
+
+	if pod.Spec.DNSConfig != nil {
+		dnsConfig = appendDNSConfig(dnsConfig, pod.Spec.DNSConfig)
+	}
+	return c.formDNSConfigFitsLimits(ctx, dnsConfig, pod), nil
+}
+
+// podDNSType determines how the resolver of the pod should be configured.
+// Based on getPodDNSType in pkg/kubelet/network/dns/dns.go.
+func (c *Configurer) podDNSType(ctx context.Context, pod *corev1.Pod, haveClusterDNS bool) (podDNSType, error) {
+	dnsPolicy := pod.Spec.DNSPolicy
+	switch dnsPolicy {
+	case corev1.DNSNone:
+		return podDNSNone, nil
+	case corev1.DNSClusterFirstWithHostNet:
+		return c.clusterOrHost(ctx, pod, haveClusterDNS), nil
+	case corev1.DNSClusterFirst, "":
+		if !pod.Spec.HostNetwork {
+			return c.clusterOrHost(ctx, pod, haveClusterDNS), nil
+		}
+		// Fallback to DNSDefault for pods on the host network.
+		fallthrough
+	case corev1.DNSDefault:
+		return podDNSHost, nil
+	}
+	return podDNSCluster, errdefs.InvalidInputf("invalid DNSPolicy=%v", dnsPolicy)
+}
+
+func (c *Configurer) clusterOrHost(ctx context.Context, pod *corev1.Pod, haveClusterDNS bool) podDNSType {
+	if haveClusterDNS {
+		return podDNSCluster
+	}
+	log.G(ctx).WithField("pod", pod.Name).Warn("Pod uses the ClusterFirst DNS policy, but no cluster DNS server is known; falling back to the Default policy")
+	c.eventf(pod, corev1.EventTypeWarning, ReasonMissingClusterDNS, "pod: %q. kubelet does not have ClusterDNS IP configured and cannot create Pod using %q policy. Falling back to %q policy.", pod.Namespace+"/"+pod.Name, corev1.DNSClusterFirst, corev1.DNSDefault)
+	return podDNSHost
+}
+
+// clusterDNS returns the configured cluster DNS servers, or the cluster IPs of the DNS service otherwise.
+func (c *Configurer) clusterDNS() ([]string, error) {
+	if len(c.cfg.ClusterDNS) > 0 {
+		return c.cfg.ClusterDNS, nil
+	}
+	if c.cfg.Services == nil {
+		return nil, nil
+	}
+
+	services, err := c.cfg.Services.ListServices()
+	if err != nil {
+		return nil, pkgerrors.Wrap(err, "error listing services to find the cluster DNS service")
+	}
+	for _, svc := range services {
+		if svc.Namespace != c.cfg.DNSService.Namespace || svc.Name != c.cfg.DNSService.Name {
+			continue
+		}
+		ips := svc.Spec.ClusterIPs
+		if len(ips) == 0 && svc.Spec.ClusterIP != "" {
+			ips = []string{svc.Spec.ClusterIP}
+		}
+		var servers []string
+		for _, ip := range ips {
+			if ip != corev1.ClusterIPNone && net.ParseIP(ip) != nil {
+				servers = append(servers, ip)
+			}
+		}
+		return servers, nil
+	}
+	return nil, nil
+}
+
+// hostDNSConfig returns the resolver configuration of the node.
+func (c *Configurer) hostDNSConfig() (*DNSConfig, error) {
+	if c.cfg.ResolverConfig == "" {
+		return &DNSConfig{}, nil
+	}
+	f, err := os.Open(c.cfg.ResolverConfig)
+	if err != nil {
+		return nil, pkgerrors.Wrap(err, "error opening resolver config")
+	}
+	defer f.Close()
+
+	dnsConfig, err := parseResolvConf(f)
+	if err != nil {
+		return nil, pkgerrors.Wrapf(err, "error parsing resolver config %s", c.cfg.ResolverConfig)
+	}
+	return dnsConfig, nil
+}
+
+// parseResolvConf reads a resolv.conf file from the given reader.
+// Based on parseResolvConf in pkg/kubelet/network/dns/dns.go.
+func parseResolvConf(reader io.Reader) (*DNSConfig, error) {
+	dnsConfig := &DNSConfig{}
+
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexAny(line, "#;"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 1 {
+			continue
+		}
+		switch fields[0] {
+		case "nameserver":
+			if len(fields) > 1 {
+				dnsConfig.Servers = append(dnsConfig.Servers, fields[1])
+			}
+		case "search":
+			// Normalise search fields so the same domain with and without trailing dot will only count once, to
+			// avoid hitting search validation limits.
+			dnsConfig.Searches = []string{}
+			for _, s := range fields[1:] {
+				if s != "." {
+					dnsConfig.Searches = append(dnsConfig.Searches, strings.TrimSuffix(s, "."))
+				}
+			}
+		case "options":
+			dnsConfig.Options = appendOptions(dnsConfig.Options, fields[1:]...)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return dnsConfig, nil
+}
+
+// searchesForClusterFirst prepends the cluster search paths of the pod to the host's search paths.
+func (c *Configurer) searchesForClusterFirst(hostSearch []string, pod *corev1.Pod) []string {
+	if c.cfg.ClusterDomain == "" {
+		return hostSearch
+	}
+
+	nsSvcDomain := fmt.Sprintf("%s.svc.%s", pod.Namespace, c.cfg.ClusterDomain)
+	svcDomain := fmt.Sprintf("svc.%s", c.cfg.ClusterDomain)
+	clusterSearch := []string{nsSvcDomain, svcDomain, c.cfg.ClusterDomain}
+
+	return omitDuplicates(append(clusterSearch, hostSearch...))
+}
+
+// appendDNSConfig merges the pod's DNS config into the generated one.
+func appendDNSConfig(existing *DNSConfig, dnsConfig *corev1.PodDNSConfig) *DNSConfig {
+	existing.Servers = omitDuplicates(append(existing.Servers, dnsConfig.Nameservers...))
+	existing.Searches = omitDuplicates(append(existing.Searches, dnsConfig.Searches...))
+	existing.Options = mergeDNSOptions(existing.Options, dnsConfig.Options)
+	return existing
+}
+
+// formDNSConfigFitsLimits truncates the nameservers and search paths to the limits of the resolver.
+func (c *Configurer) formDNSConfigFitsLimits(ctx context.Context, dnsConfig *DNSConfig, pod *corev1.Pod) *DNSConfig {
+	if len(dnsConfig.Servers) > MaxDNSNameservers {
+		dnsConfig.Servers = dnsConfig.Servers[:MaxDNSNameservers]
+		msg := fmt.Sprintf("Nameserver limits were exceeded, some nameservers have been omitted, the applied nameserver line is: %s", strings.Join(dnsConfig.Servers, " "))
+		log.G(ctx).WithField("pod", pod.Name).Warn(msg)
+		c.eventf(pod, corev1.EventTypeWarning, ReasonDNSConfigForming, "%s", msg)
+	}
+
+	limitsExceeded := false
+	if len(dnsConfig.Searches) > MaxDNSSearchPaths {
+		dnsConfig.Searches = dnsConfig.Searches[:MaxDNSSearchPaths]
+		limitsExceeded = true
+	}
+	if l := len(strings.Join(dnsConfig.Searches, " ")); l > MaxDNSSearchListChars {
+		for l > MaxDNSSearchListChars {
+			last := dnsConfig.Searches[len(dnsConfig.Searches)-1]
+			dnsConfig.Searches = dnsConfig.Searches[:len(dnsConfig.Searches)-1]
+			l -= len(last) + 1
+		}
+		limitsExceeded = true
+	}
+	if limitsExceeded {
+		msg := fmt.Sprintf("Search Line limits were exceeded, some search paths have been omitted, the applied search line is: %s", strings.Join(dnsConfig.Searches, " "))
+		log.G(ctx).WithField("pod", pod.Name).Warn(msg)
+		c.eventf(pod, corev1.EventTypeWarning, ReasonDNSConfigForming, "%s", msg)
+	}
+	return dnsConfig
+}
+
+func (c *Configurer) eventf(pod *corev1.Pod, eventType, reason, messageFmt string, args ...any) {
+	if c.cfg.EventRecorder == nil {
+		return
+	}
+	c.cfg.EventRecorder.Eventf(pod, eventType, reason, messageFmt, args...)
+}
+
+// appendOptions appends options to the given list, replacing existing options with the same name.
+func appendOptions(options []string, newOption ...string) []string {
+	for _, option := range newOption {
+		optName := strings.Split(option, ":")[0]
+		replaced := false
+		for i, existing := range options {
+			if strings.Split(existing, ":")[0] == optName {
+				options[i] = option
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			options = append(options, option)
+		}
+	}
+	return options
+}
+
+// mergeDNSOptions merges the pod's DNS options into the existing options, the former taking precedence.
+func mergeDNSOptions(existing []string, dnsConfigOptions []corev1.PodDNSConfigOption) []string {
+	var names []string
+	values := make(map[string]string)
+	set := func(name, value string) {
+		if _, ok := values[name]; !ok {
+			names = append(names, name)
+		}
+		values[name] = value
+	}
+
+	for _, op := range existing {
+		if i := strings.Index(op, ":"); i != -1 {
+			set(op[:i], op[i+1:])
+		} else {
+			set(op, "")
+		}
+	}
+	for _, op := range dnsConfigOptions {
+		if op.Value != nil {
+			set(op.Name, *op.Value)
+		} else {
+			set(op.Name, "")
+		}
+	}
+
+	options := make([]string, 0, len(names))
+	for _, name := range names {
+		op := name
+		if values[name] != "" {
+			op = op + ":" + values[name]
+		}
+		options = append(options, op)
+	}
+	return options
+}
+
+func omitDuplicates(strs []string) []string {
+	uniqueStrs := make(map[string]bool)
+
+	var ret []string
+	for _, str := range strs {
+		if !uniqueStrs[str] {
+			ret = append(ret, str)
+			uniqueStrs[str] = true
+		}
+	}
+	return ret
+}
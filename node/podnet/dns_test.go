@@ -0,0 +1,148 @@
+package podnet
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
+	testutil "github.com/virtual-kubelet/virtual-kubelet/internal/test/util"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/ptr"
+)
+
+func newTestPod(dnsPolicy corev1.DNSPolicy, hostNetwork bool) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "ns",
+			Name:      "pod",
+		},
+		Spec: corev1.PodSpec{
+			DNSPolicy:   dnsPolicy,
+			HostNetwork: hostNetwork,
+		},
+	}
+}
+
+func writeResolvConf(t *testing.T, content string) string {
+	p := filepath.Join(t.TempDir(), "resolv.conf")
+	assert.NilError(t, os.WriteFile(p, []byte(content), 0600))
+	return p
+}
+
+func TestDNSConfigPolicies(t *testing.T) {
+	resolvConf := writeResolvConf(t, `# comment
+nameserver 192.168.0.1 ; another comment
+search example.com. corp.example.com
+options ndots:1 timeout:2
+options ndots:2
+`)
+	rm := testutil.FakeResourceManager(testutil.FakeService("kube-system", "kube-dns", "10.0.0.10", "UDP", 53))
+	c := NewConfigurer(Config{
+		ClusterDomain:  "cluster.local",
+		Services:       rm,
+		ResolverConfig: resolvConf,
+	})
+
+	clusterFirst := &DNSConfig{
+		Servers:  []string{"10.0.0.10"},
+		Searches: []string{"ns.svc.cluster.local", "svc.cluster.local", "cluster.local", "example.com", "corp.example.com"},
+		Options:  []string{"ndots:5"},
+	}
+	host := &DNSConfig{
+		Servers:  []string{"192.168.0.1"},
+		Searches: []string{"example.com", "corp.example.com"},
+		Options:  []string{"ndots:2", "timeout:2"},
+	}
+
+	for _, tc := range []struct {
+		policy      corev1.DNSPolicy
+		hostNetwork bool
+		expected    *DNSConfig
+	}{
+		{policy: "", expected: clusterFirst},
+		{policy: corev1.DNSClusterFirst, expected: clusterFirst},
+		{policy: corev1.DNSClusterFirst, hostNetwork: true, expected: host},
+		{policy: corev1.DNSClusterFirstWithHostNet, hostNetwork: true, expected: clusterFirst},
+		{policy: corev1.DNSDefault, expected: host},
+		{policy: corev1.DNSNone, expected: &DNSConfig{}},
+	} {
+		t.Run(string(tc.policy), func(t *testing.T) {
+			dnsConfig, err := c.DNSConfig(context.Background(), newTestPod(tc.policy, tc.hostNetwork))
+			assert.NilError(t, err)
+			assert.Check(t, is.DeepEqual(dnsConfig, tc.expected))
+		})
+	}
+
+	_, err := c.DNSConfig(context.Background(), newTestPod("Invalid", false))
+	assert.Check(t, errdefs.IsInvalidInput(err))
+}
+
+func TestDNSConfigMissingClusterDNS(t *testing.T) {
+	er := testutil.FakeEventRecorder(1)
+	c := NewConfigurer(Config{
+		ClusterDomain: "cluster.local",
+		Services:      testutil.FakeResourceManager(),
+		NodeIPs:       []string{"10.1.0.1", "fd00::1"},
+		EventRecorder: er,
+	})
+
+	dnsConfig, err := c.DNSConfig(context.Background(), newTestPod(corev1.DNSClusterFirst, false))
+	assert.NilError(t, err)
+	assert.Check(t, is.DeepEqual(dnsConfig, &DNSConfig{
+		Servers:  []string{"127.0.0.1", "::1"},
+		Searches: []string{"."},
+	}))
+	assert.Check(t, is.Len(er.Events, 1))
+	assert.Check(t, is.Contains(<-er.Events, ReasonMissingClusterDNS))
+}
+
+func TestResolvConfWithPodDNSConfig(t *testing.T) {
+	er := testutil.FakeEventRecorder(2)
+	c := NewConfigurer(Config{
+		ClusterDomain: "cluster.local",
+		ClusterDNS:    []string{"10.0.0.10"},
+		EventRecorder: er,
+	})
+
+	pod := newTestPod(corev1.DNSClusterFirst, false)
+	pod.Spec.DNSConfig = &corev1.PodDNSConfig{
+		Nameservers: []string{"10.0.0.10", "1.1.1.1", "8.8.8.8", "9.9.9.9"},
+		Searches:    []string{"svc.cluster.local", "example.com"},
+		Options: []corev1.PodDNSConfigOption{
+			{Name: "ndots", Value: ptr.To("2")},
+			{Name: "edns0"},
+		},
+	}
+
+	resolvConf, err := c.ResolvConf(context.Background(), pod)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(string(resolvConf), `search ns.svc.cluster.local svc.cluster.local cluster.local example.com
+nameserver 10.0.0.10
+nameserver 1.1.1.1
+nameserver 8.8.8.8
+options ndots:2 edns0
+`))
+	assert.Check(t, is.Len(er.Events, 1))
+	assert.Check(t, is.Contains(<-er.Events, ReasonDNSConfigForming))
+}
+
+func TestDNSConfigSearchLimits(t *testing.T) {
+	c := NewConfigurer(Config{ClusterDNS: []string{"10.0.0.10"}})
+
+	pod := newTestPod(corev1.DNSClusterFirst, false)
+	pod.Spec.DNSConfig = &corev1.PodDNSConfig{}
+	for i := range 40 {
+		pod.Spec.DNSConfig.Searches = append(pod.Spec.DNSConfig.Searches, strings.Repeat("a", 60)+string(rune('a'+i%26))+string(rune('a'+i/26)))
+	}
+
+	dnsConfig, err := c.DNSConfig(context.Background(), pod)
+	assert.NilError(t, err)
+	assert.Check(t, len(dnsConfig.Searches) <= MaxDNSSearchPaths)
+	assert.Check(t, len(strings.Join(dnsConfig.Searches, " ")) <= MaxDNSSearchListChars)
+}
@@ -0,0 +1,38 @@
+// Copyright © 2017 The virtual-kubelet authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+Package podnet generates the name resolution configuration of a pod the same
+way the kubelet does, so that providers do not have to reimplement it.
+
+It takes care of the pod's DNS policy, merging in the pod's DNS config, the
+cluster search path, ndots and the resolver limits when producing a
+resolv.conf, and of the pod's hostname, subdomain, FQDN and host aliases when
+producing a hosts file.
+
+	c := podnet.NewConfigurer(podnet.Config{
+		ClusterDomain: cfg.KubeClusterDomain,
+		Services:      cfg.ResourceManager,
+	})
+
+	resolvConf, err := c.ResolvConf(ctx, pod)
+	...
+	hosts, err := c.HostsFile(ctx, pod)
+	...
+	hostname, err := c.KernelHostname(pod)
+
+Unless configured explicitly, the cluster DNS server addresses are taken from
+the cluster IPs of the kube-system/kube-dns service.
+*/
+package podnet
@@ -0,0 +1,171 @@
+// Copyright © 2017 The virtual-kubelet authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package podnet
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	pkgerrors "github.com/pkg/errors"
+	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	managedHostsHeader                = "# Kubernetes-managed hosts file.\n"
+	managedHostsHeaderWithHostNetwork = "# Kubernetes-managed hosts file (host network).\n"
+
+	hostnameMaxLen = 63
+	fqdnMaxLen     = 64
+)
+
+// Hostname returns the hostname and the host domain of the pod.
+// The host domain is empty unless the pod has a subdomain.
+// Based on GeneratePodHostNameAndDomain in pkg/kubelet/kubelet_pods.go.
+func (c *Configurer) Hostname(pod *corev1.Pod) (hostname string, hostDomain string, err error) {
+	hostname = pod.Name
+	if len(pod.Spec.Hostname) > 0 {
+		if msgs := validation.IsDNS1123Label(pod.Spec.Hostname); len(msgs) != 0 {
+			return "", "", errdefs.InvalidInputf("pod Hostname %q is not a valid DNS label: %s", pod.Spec.Hostname, strings.Join(msgs, ";"))
+		}
+		hostname = pod.Spec.Hostname
+	}
+
+	hostname, err = truncatePodHostnameIfNeeded(pod.Name, hostname)
+	if err != nil {
+		return "", "", err
+	}
+
+	if len(pod.Spec.Subdomain) > 0 {
+		if msgs := validation.IsDNS1123Label(pod.Spec.Subdomain); len(msgs) != 0 {
+			return "", "", errdefs.InvalidInputf("pod Subdomain %q is not a valid DNS label: %s", pod.Spec.Subdomain, strings.Join(msgs, ";"))
+		}
+		hostDomain = fmt.Sprintf("%s.%s.svc.%s", pod.Spec.Subdomain, pod.Namespace, c.cfg.ClusterDomain)
+	}
+
+	return hostname, hostDomain, nil
+}
+
+// KernelHostname returns the hostname which should be set in the pod's UTS namespace.
+// This is the FQDN of the pod when it sets SetHostnameAsFQDN and has a subdomain, and its short hostname otherwise.
+// Based on GetNodenameForKernel in pkg/kubelet/util/util.go.
+func (c *Configurer) KernelHostname(pod *corev1.Pod) (string, error) {
+	hostname, hostDomain, err := c.Hostname(pod)
+	if err != nil {
+		return "", err
+	}
+
+	if pod.Spec.SetHostnameAsFQDN == nil || !*pod.Spec.SetHostnameAsFQDN {
+		return hostname, nil
+	}
+	if len(hostDomain) > 0 {
+		hostname = fmt.Sprintf("%s.%s", hostname, hostDomain)
+	}
+	if len(hostname) > fqdnMaxLen {
+		return "", errdefs.InvalidInputf("failed to construct FQDN from pod hostname and cluster domain, FQDN %s is too long (%d characters is the max, %d characters requested)", hostname, fqdnMaxLen, len(hostname))
+	}
+	return hostname, nil
+}
+
+// HostsFile returns the content of the hosts file of the pod.
+// Pods on the host network get the node's hosts file, others get one listing their own addresses. The pod's host
+// aliases are appended in both cases.
+// Based on managedHostsFileContent and nodeHostsFileContent in pkg/kubelet/kubelet_pods.go.
+func (c *Configurer) HostsFile(ctx context.Context, pod *corev1.Pod) ([]byte, error) {
+	if pod.Spec.HostNetwork {
+		hostsFileContent, err := os.ReadFile(c.cfg.HostsFile)
+		if err != nil {
+			return nil, pkgerrors.Wrap(err, "error reading the node's hosts file")
+		}
+
+		var buffer bytes.Buffer
+		buffer.WriteString(managedHostsHeaderWithHostNetwork)
+		buffer.Write(hostsFileContent)
+		buffer.Write(hostsEntriesFromHostAliases(pod.Spec.HostAliases))
+		return buffer.Bytes(), nil
+	}
+
+	hostname, hostDomain, err := c.Hostname(pod)
+	if err != nil {
+		return nil, err
+	}
+
+	var buffer bytes.Buffer
+	buffer.WriteString(managedHostsHeader)
+	buffer.WriteString("127.0.0.1\tlocalhost\n")                      // ipv4 localhost
+	buffer.WriteString("::1\tlocalhost ip6-localhost ip6-loopback\n") // ipv6 localhost
+	buffer.WriteString("fe00::0\tip6-localnet\n")
+	buffer.WriteString("fe00::0\tip6-mcastprefix\n")
+	buffer.WriteString("fe00::1\tip6-allnodes\n")
+	buffer.WriteString("fe00::2\tip6-allrouters\n")
+	for _, ip := range podIPs(pod) {
+		if len(hostDomain) > 0 {
+			fmt.Fprintf(&buffer, "%s\t%s.%s\t%s\n", ip, hostname, hostDomain, hostname)
+		} else {
+			fmt.Fprintf(&buffer, "%s\t%s\n", ip, hostname)
+		}
+	}
+	buffer.Write(hostsEntriesFromHostAliases(pod.Spec.HostAliases))
+	return buffer.Bytes(), nil
+}
+
+// podIPs returns the addresses of the pod, as found in its status.
+func podIPs(pod *corev1.Pod) []string {
+	if len(pod.Status.PodIPs) == 0 {
+		if pod.Status.PodIP == "" {
+			return nil
+		}
+		return []string{pod.Status.PodIP}
+	}
+	ips := make([]string, 0, len(pod.Status.PodIPs))
+	for _, ip := range pod.Status.PodIPs {
+		ips = append(ips, ip.IP)
+	}
+	return ips
+}
+
+func hostsEntriesFromHostAliases(hostAliases []corev1.HostAlias) []byte {
+	if len(hostAliases) == 0 {
+		return []byte{}
+	}
+
+	var buffer bytes.Buffer
+	buffer.WriteString("\n")
+	buffer.WriteString("# Entries added by HostAliases.\n")
+	// for each IP, write all aliases onto single line in hosts file
+	for _, hostAlias := range hostAliases {
+		fmt.Fprintf(&buffer, "%s\t%s\n", hostAlias.IP, strings.Join(hostAlias.Hostnames, "\t"))
+	}
+	return buffer.Bytes()
+}
+
+// truncatePodHostnameIfNeeded truncates the pod hostname if it's longer than 63 chars.
+func truncatePodHostnameIfNeeded(podName, hostname string) (string, error) {
+	if len(hostname) <= hostnameMaxLen {
+		return hostname, nil
+	}
+	truncated := hostname[:hostnameMaxLen]
+	// hostname should not end with '-' or '.'
+	truncated = strings.TrimRight(truncated, "-.")
+	if len(truncated) == 0 {
+		// This should never happen.
+		return "", errdefs.InvalidInputf("hostname for pod %q was invalid: %q", podName, hostname)
+	}
+	return truncated, nil
+}
@@ -0,0 +1,90 @@
+package podnet
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/utils/ptr"
+)
+
+func TestHostsFile(t *testing.T) {
+	c := NewConfigurer(Config{ClusterDomain: "cluster.local"})
+
+	pod := newTestPod(corev1.DNSClusterFirst, false)
+	pod.Spec.Hostname = "web"
+	pod.Spec.Subdomain = "frontend"
+	pod.Spec.HostAliases = []corev1.HostAlias{
+		{IP: "10.2.0.1", Hostnames: []string{"foo.local", "bar.local"}},
+	}
+	pod.Status.PodIPs = []corev1.PodIP{{IP: "10.1.0.5"}, {IP: "fd00::5"}}
+
+	hosts, err := c.HostsFile(context.Background(), pod)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(string(hosts), `# Kubernetes-managed hosts file.
+127.0.0.1	localhost
+::1	localhost ip6-localhost ip6-loopback
+fe00::0	ip6-localnet
+fe00::0	ip6-mcastprefix
+fe00::1	ip6-allnodes
+fe00::2	ip6-allrouters
+10.1.0.5	web.frontend.ns.svc.cluster.local	web
+fd00::5	web.frontend.ns.svc.cluster.local	web
+
+# Entries added by HostAliases.
+10.2.0.1	foo.local	bar.local
+`))
+}
+
+func TestHostsFileHostNetwork(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "hosts")
+	assert.NilError(t, os.WriteFile(p, []byte("127.0.0.1\tlocalhost\n"), 0600))
+	c := NewConfigurer(Config{HostsFile: p})
+
+	pod := newTestPod(corev1.DNSDefault, true)
+	pod.Spec.HostAliases = []corev1.HostAlias{
+		{IP: "10.2.0.1", Hostnames: []string{"foo.local"}},
+	}
+
+	hosts, err := c.HostsFile(context.Background(), pod)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(string(hosts), `# Kubernetes-managed hosts file (host network).
+127.0.0.1	localhost
+
+# Entries added by HostAliases.
+10.2.0.1	foo.local
+`))
+}
+
+func TestKernelHostname(t *testing.T) {
+	c := NewConfigurer(Config{ClusterDomain: "cluster.local"})
+
+	pod := newTestPod(corev1.DNSClusterFirst, false)
+	hostname, err := c.KernelHostname(pod)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(hostname, "pod"))
+
+	pod.Spec.Subdomain = "sub"
+	pod.Spec.SetHostnameAsFQDN = ptr.To(true)
+	hostname, err = c.KernelHostname(pod)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(hostname, "pod.sub.ns.svc.cluster.local"))
+
+	pod.Name = strings.Repeat("a", 62) + "-b"
+	hostname, _, err = c.Hostname(pod)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(hostname, strings.Repeat("a", 62)))
+
+	_, err = c.KernelHostname(pod)
+	assert.Check(t, errdefs.IsInvalidInput(err), "FQDNs longer than 64 characters should be rejected")
+
+	pod.Spec.Hostname = "Not_Valid"
+	_, _, err = c.Hostname(pod)
+	assert.Check(t, errdefs.IsInvalidInput(err))
+}
@@ -32,3 +32,6 @@ var DefaultRetryFunc = queue.DefaultRetryFunc
 
 // MaxRetries is the number of times we try to process a given key before permanently forgetting it.
 var MaxRetries = queue.MaxRetries
+
+// QueueTenantStats are the statistics of the pods of a tenant in a pod queue.
+type QueueTenantStats = queue.TenantStats
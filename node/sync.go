@@ -2,6 +2,7 @@ package node
 
 import (
 	"context"
+	"math"
 	"sync"
 	"time"
 
@@ -9,9 +10,13 @@ import (
 	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
 	"github.com/virtual-kubelet/virtual-kubelet/log"
 	"github.com/virtual-kubelet/virtual-kubelet/trace"
+	"golang.org/x/time/rate"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
 	corev1listers "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/tools/cache"
 )
@@ -26,12 +31,105 @@ const (
 	containerStatusTerminatedMessage = "Container was terminated. The exit code may not reflect the real exit code"
 )
 
+const (
+	// DefaultPodStatusPollInterval is the default interval the statuses of pods are polled at.
+	DefaultPodStatusPollInterval = 5 * time.Second
+	// DefaultPodStatusNotFoundGracePeriod is the default time after their creation pods which are not running yet
+	// may be missing from the provider before they are failed.
+	DefaultPodStatusNotFoundGracePeriod = time.Minute
+)
+
+// PodStatusPollingConfig configures how the statuses of pods are polled from providers which do not implement
+// PodNotifier.
+//
+// Each pod is polled at its own interval. The interval starts at MinInterval, and is multiplied by BackoffFactor,
+// up to MaxInterval, each time the pod is found running with the same status as before. It is reset to MinInterval
+// as soon as the status changes, or the pod is not running, for example while it starts. Pods whose spec is updated,
+// or which are being deleted, are polled right away.
+type PodStatusPollingConfig struct {
+	// MinInterval is the interval pods whose status changes are polled at. It defaults to
+	// DefaultPodStatusPollInterval.
+	MinInterval time.Duration
+	// MaxInterval is the longest interval stable pods are polled at. It defaults to MinInterval, so that all pods
+	// are polled at MinInterval.
+	MaxInterval time.Duration
+	// BackoffFactor is the factor the interval of stable pods is multiplied by. It defaults to 2.
+	BackoffFactor float64
+	// Jitter is the maximum fraction of the interval which is randomly added to it, so that pods whose intervals
+	// are the same are spread out. If it is zero, intervals are not jittered.
+	Jitter float64
+
+	// RequestsPerSecond is the budget of requests for pod statuses per second across all pods. A batch of statuses
+	// retrieved from a PodStatusBatchGetter counts as one request. If it is zero, requests are not limited.
+	RequestsPerSecond float64
+	// Burst is the number of requests which may be made at once. It defaults to RequestsPerSecond, rounded up.
+	Burst int
+
+	// NotFoundGracePeriod is how long after their creation pods which are not running yet may be missing from the
+	// provider before they are failed. It defaults to DefaultPodStatusNotFoundGracePeriod. If it is negative,
+	// there is no grace period.
+	NotFoundGracePeriod time.Duration
+	// NotFoundThreshold is the number of consecutive polls a pod must be missing from the provider before it is
+	// failed. It defaults to 1.
+	NotFoundThreshold int
+}
+
+func (c PodStatusPollingConfig) withDefaults() PodStatusPollingConfig {
+	if c.MinInterval <= 0 {
+		c.MinInterval = DefaultPodStatusPollInterval
+	}
+	if c.MaxInterval < c.MinInterval {
+		c.MaxInterval = c.MinInterval
+	}
+	if c.BackoffFactor < 1 {
+		c.BackoffFactor = 2
+	}
+	if c.Burst <= 0 {
+		c.Burst = int(math.Ceil(c.RequestsPerSecond))
+	}
+	if c.NotFoundGracePeriod == 0 {
+		c.NotFoundGracePeriod = DefaultPodStatusNotFoundGracePeriod
+	}
+	if c.NotFoundThreshold <= 0 {
+		c.NotFoundThreshold = 1
+	}
+	return c
+}
+
+// podPollState is the state of the polling of the status of a pod.
+type podPollState struct {
+	interval   time.Duration
+	next       time.Time
+	lastStatus *corev1.PodStatus
+	notFound   int
+
+	// generation and deleting are the generation of the pod, and whether it was being deleted, when it was polled.
+	generation int64
+	deleting   bool
+}
+
+// changed returns whether the pod was updated in Kubernetes since it was polled.
+func (s *podPollState) changed(pod *corev1.Pod) bool {
+	return pod.Generation != s.generation || (pod.DeletionTimestamp != nil) != s.deleting
+}
+
 // syncProviderWrapper wraps a PodLifecycleHandler to give it async-like pod status notification behavior.
 type syncProviderWrapper struct {
 	PodLifecycleHandler
 	notify func(*corev1.Pod)
 	l      corev1listers.PodLister
 
+	// statusBatchGetter is used to retrieve pod statuses in batches of up to statusBatchSize pods, if set.
+	statusBatchGetter PodStatusBatchGetter
+	statusBatchSize   int
+
+	// polling configures the polling of pod statuses, and limiter limits the requests for them, if set.
+	polling PodStatusPollingConfig
+	limiter *rate.Limiter
+	// pollStates is a map of "namespace/name" -> *podPollState of the pods which are polled.
+	// It is only accessed by the polling loop.
+	pollStates map[string]*podPollState
+
 	// deletedPods makes sure we don't set the "NotFound" status
 	// for pods which have been requested to be deleted.
 	// This is needed for our loop which just grabs pod statuses every 5 seconds.
@@ -97,42 +195,45 @@ func (p *syncProviderWrapper) DeletePod(ctx context.Context, pod *corev1.Pod) er
 }
 
 func (p *syncProviderWrapper) run(ctx context.Context) {
-	interval := 5 * time.Second
-	timer := time.NewTimer(interval)
-
+	timer := time.NewTimer(p.polling.MinInterval)
 	defer timer.Stop()
 
-	if !timer.Stop() {
-		<-timer.C
-	}
-
 	for {
 		log.G(ctx).Debug("Pod status update loop start")
-		timer.Reset(interval)
 		select {
 		case <-ctx.Done():
 			log.G(ctx).WithError(ctx.Err()).Debug("sync wrapper loop exiting")
 			return
 		case <-timer.C:
 		}
-		p.syncPodStatuses(ctx)
+		timer.Reset(p.syncPodStatuses(ctx))
 	}
 }
 
-func (p *syncProviderWrapper) syncPodStatuses(ctx context.Context) {
+// syncPodStatuses polls the statuses of the pods which are due, and returns how long until the next pods are due.
+func (p *syncProviderWrapper) syncPodStatuses(ctx context.Context) time.Duration {
 	ctx, span := trace.StartSpan(ctx, "syncProviderWrapper.syncPodStatuses")
 	defer span.End()
 
+	// Pods which are added are polled within MinInterval.
+	untilNext := p.polling.MinInterval
+
 	// Update all the pods with the provider status.
 	pods, err := p.l.List(labels.Everything())
 	if err != nil {
 		err = errors.Wrap(err, "error getting pod list from kubernetes")
 		span.SetStatus(err)
 		log.G(ctx).WithError(err).Error("Error updating pod statuses")
-		return
+		return untilNext
 	}
 	ctx = span.WithField(ctx, "nPods", int64(len(pods)))
 
+	if p.pollStates == nil {
+		p.pollStates = make(map[string]*podPollState)
+	}
+	now := time.Now()
+	polled := make(map[string]bool, len(pods))
+	toUpdate := make([]*corev1.Pod, 0, len(pods))
 	for _, pod := range pods {
 		if shouldSkipPodStatusUpdate(pod) {
 			log.G(ctx).WithFields(log.Fields{
@@ -143,12 +244,132 @@ func (p *syncProviderWrapper) syncPodStatuses(ctx context.Context) {
 			}).Debug("Skipping pod status update")
 			continue
 		}
+		key, err := cache.MetaNamespaceKeyFunc(pod)
+		if err != nil {
+			continue
+		}
+		polled[key] = true
+		if state, ok := p.pollStates[key]; ok && state.next.After(now) && !state.changed(pod) {
+			untilNext = min(untilNext, state.next.Sub(now))
+			continue
+		}
+		toUpdate = append(toUpdate, pod)
+	}
+	// Forget the pods which are no longer polled.
+	for key := range p.pollStates {
+		if !polled[key] {
+			delete(p.pollStates, key)
+		}
+	}
+	ctx = span.WithField(ctx, "nPodsDue", int64(len(toUpdate)))
+
+	if p.statusBatchGetter != nil {
+		size := p.statusBatchSize
+		if size <= 0 {
+			size = DefaultPodBatchSize
+		}
+		for start := 0; start < len(toUpdate); start += size {
+			if err := p.waitForRequest(ctx); err != nil {
+				return untilNext
+			}
+			p.updatePodStatuses(ctx, toUpdate[start:min(start+size, len(toUpdate))])
+		}
+		return untilNext
+	}
 
+	for _, pod := range toUpdate {
+		if err := p.waitForRequest(ctx); err != nil {
+			return untilNext
+		}
 		if err := p.updatePodStatus(ctx, pod); err != nil {
-			log.G(ctx).WithFields(map[string]any{
-				"name":      pod.Name,
-				"namespace": pod.Namespace,
-			}).WithError(err).Error("Could not fetch pod status")
+			logPodStatusError(ctx, pod, err)
+		}
+	}
+	return untilNext
+}
+
+// waitForRequest waits until the budget of requests allows another request for pod statuses.
+func (p *syncProviderWrapper) waitForRequest(ctx context.Context) error {
+	if p.limiter == nil {
+		return nil
+	}
+	return p.limiter.Wait(ctx)
+}
+
+// recordPoll updates the poll state of the pod with the result of polling its status, and schedules its next poll.
+// It returns the state.
+func (p *syncProviderWrapper) recordPoll(key string, podFromKubernetes *corev1.Pod, podStatus *corev1.PodStatus, err error) *podPollState {
+	if p.pollStates == nil {
+		p.pollStates = make(map[string]*podPollState)
+	}
+	state, ok := p.pollStates[key]
+	if !ok {
+		state = &podPollState{}
+		p.pollStates[key] = state
+	}
+
+	stable := ok && err == nil && podStatus != nil && state.lastStatus != nil &&
+		podStatus.Phase == corev1.PodRunning && podFromKubernetes.DeletionTimestamp == nil &&
+		!state.changed(podFromKubernetes) && equality.Semantic.DeepEqual(state.lastStatus, podStatus)
+	if stable {
+		state.interval = min(time.Duration(float64(state.interval)*p.polling.BackoffFactor), p.polling.MaxInterval)
+	} else {
+		state.interval = p.polling.MinInterval
+	}
+
+	switch {
+	case err == nil && podStatus != nil:
+		state.lastStatus = podStatus.DeepCopy()
+		state.notFound = 0
+	case err == nil || errdefs.IsNotFound(err):
+		state.lastStatus = nil
+		state.notFound++
+	}
+
+	state.generation = podFromKubernetes.Generation
+	state.deleting = podFromKubernetes.DeletionTimestamp != nil
+
+	interval := state.interval
+	if p.polling.Jitter > 0 {
+		interval = wait.Jitter(interval, p.polling.Jitter)
+	}
+	state.next = time.Now().Add(interval)
+	return state
+}
+
+func logPodStatusError(ctx context.Context, pod *corev1.Pod, err error) {
+	log.G(ctx).WithFields(map[string]any{
+		"name":      pod.Name,
+		"namespace": pod.Namespace,
+	}).WithError(err).Error("Could not fetch pod status")
+}
+
+// updatePodStatuses updates the statuses of a batch of pods with the statuses retrieved from the provider at once.
+func (p *syncProviderWrapper) updatePodStatuses(ctx context.Context, pods []*corev1.Pod) {
+	ctx, span := trace.StartSpan(ctx, "syncProviderWrapper.updatePodStatuses")
+	defer span.End()
+	ctx = span.WithField(ctx, "nPods", int64(len(pods)))
+
+	keys := make([]types.NamespacedName, 0, len(pods))
+	for _, pod := range pods {
+		keys = append(keys, types.NamespacedName{Namespace: pod.Namespace, Name: pod.Name})
+	}
+	statuses, err := p.statusBatchGetter.GetPodStatuses(ctx, keys)
+	if err != nil {
+		err = errors.Wrap(err, "error getting pod statuses from provider")
+		span.SetStatus(err)
+		log.G(ctx).WithError(err).Error("Error updating pod statuses")
+		return
+	}
+
+	for i, pod := range pods {
+		podStatus, ok := statuses[keys[i]]
+		var statusErr error
+		if !ok || podStatus == nil {
+			statusErr = errdefs.NotFoundf("pod %s not found in provider", keys[i])
+		}
+		if err := p.setPodStatus(ctx, pod, podStatus, statusErr); err != nil {
+			logPodStatusError(ctx, pod, err)
 		}
 	}
 }
@@ -158,8 +379,29 @@ func (p *syncProviderWrapper) updatePodStatus(ctx context.Context, podFromKubern
 	defer span.End()
 	ctx = addPodAttributes(ctx, span, podFromKubernetes)
 
-	var statusErr error
 	podStatus, err := p.GetPodStatus(ctx, podFromKubernetes.Namespace, podFromKubernetes.Name)
+	if err := p.setPodStatus(ctx, podFromKubernetes, podStatus, err); err != nil {
+		span.SetStatus(err)
+		return err
+	}
+	return nil
+}
+
+// setPodStatus notifies the status of the pod retrieved from the provider, or sets the pod to failed if it was not
+// found in the provider while it was running.
+func (p *syncProviderWrapper) setPodStatus(ctx context.Context, podFromKubernetes *corev1.Pod, podStatus *corev1.PodStatus, err error) error {
+	ctx, span := trace.StartSpan(ctx, "syncProviderWrapper.setPodStatus")
+	defer span.End()
+	ctx = addPodAttributes(ctx, span, podFromKubernetes)
+
+	key, keyErr := cache.MetaNamespaceKeyFunc(podFromKubernetes)
+	if keyErr != nil {
+		span.SetStatus(keyErr)
+		return keyErr
+	}
+	state := p.recordPoll(key, podFromKubernetes, podStatus, err)
+
+	var statusErr error
 	if err != nil {
 		if !errdefs.IsNotFound(err) {
 			span.SetStatus(err)
@@ -174,18 +416,18 @@ func (p *syncProviderWrapper) updatePodStatus(ctx context.Context, podFromKubern
 		return nil
 	}
 
-	key, err := cache.MetaNamespaceKeyFunc(podFromKubernetes)
-	if err != nil {
-		span.SetStatus(err)
-		return err
-	}
-
 	if _, exists := p.deletedPods.Load(key); exists {
 		log.G(ctx).Debug("pod is in known deleted state, ignoring")
 		return nil
 	}
 
-	if podFromKubernetes.Status.Phase != corev1.PodRunning && time.Since(podFromKubernetes.CreationTimestamp.Time) <= time.Minute {
+	if state.notFound < p.polling.NotFoundThreshold {
+		log.G(ctx).WithField("notFound", state.notFound).Debug("Pod not found in provider, waiting for the threshold to fail it")
+		span.SetStatus(statusErr)
+		return statusErr
+	}
+
+	if podFromKubernetes.Status.Phase != corev1.PodRunning && time.Since(podFromKubernetes.CreationTimestamp.Time) <= p.polling.NotFoundGracePeriod {
 		span.SetStatus(statusErr)
 		return statusErr
 	}
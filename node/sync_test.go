@@ -0,0 +1,122 @@
+package node
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corev1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// statusProvider is a mockProvider whose pod statuses are set by the test.
+type statusProvider struct {
+	*mockProvider
+	statuses map[string]*corev1.PodStatus
+	gets     int
+}
+
+func (p *statusProvider) GetPodStatus(ctx context.Context, namespace, name string) (*corev1.PodStatus, error) {
+	p.gets++
+	status, ok := p.statuses[name]
+	if !ok {
+		return nil, errdefs.NotFoundf("pod %s/%s not found", namespace, name)
+	}
+	return status.DeepCopy(), nil
+}
+
+func newPollingTestWrapper(t *testing.T, polling PodStatusPollingConfig, pods ...*corev1.Pod) (*syncProviderWrapper, *statusProvider, cache.Indexer, map[string]*corev1.Pod) {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, pod := range pods {
+		assert.NilError(t, indexer.Add(pod))
+	}
+	p := &statusProvider{mockProvider: newSyncMockProvider(), statuses: make(map[string]*corev1.PodStatus)}
+	notified := make(map[string]*corev1.Pod)
+	w := &syncProviderWrapper{
+		PodLifecycleHandler: p,
+		l:                   corev1listers.NewPodLister(indexer),
+		polling:             polling.withDefaults(),
+		notify: func(pod *corev1.Pod) {
+			notified[pod.Name] = pod
+		},
+	}
+	return w, p, indexer, notified
+}
+
+func runningTestPod(name string) *corev1.Pod {
+	pod := batchTestPod(name)
+	pod.CreationTimestamp = metav1.NewTime(time.Now().Add(-time.Hour))
+	pod.Status.Phase = corev1.PodRunning
+	return pod
+}
+
+func TestSyncProviderWrapperPollingBackoff(t *testing.T) {
+	ctx := context.Background()
+	pod := runningTestPod("a")
+	w, p, indexer, _ := newPollingTestWrapper(t, PodStatusPollingConfig{MinInterval: time.Second, MaxInterval: 4 * time.Second}, pod)
+	p.statuses["a"] = &corev1.PodStatus{Phase: corev1.PodRunning}
+
+	// poll makes the pod due, polls it, and returns its interval.
+	poll := func() time.Duration {
+		if state, ok := w.pollStates["default/a"]; ok {
+			state.next = time.Now()
+		}
+		w.syncPodStatuses(ctx)
+		return w.pollStates["default/a"].interval
+	}
+	assert.Check(t, is.Equal(poll(), time.Second))
+	assert.Check(t, is.Equal(poll(), 2*time.Second))
+	assert.Check(t, is.Equal(poll(), 4*time.Second))
+	assert.Check(t, is.Equal(poll(), 4*time.Second))
+
+	// Pods which are not due are not polled.
+	gets := p.gets
+	until := w.syncPodStatuses(ctx)
+	assert.Check(t, is.Equal(p.gets, gets))
+	assert.Check(t, until <= time.Second)
+
+	// Pods which are updated in Kubernetes are polled right away.
+	updated := pod.DeepCopy()
+	updated.Generation++
+	assert.NilError(t, indexer.Update(updated))
+	w.syncPodStatuses(ctx)
+	assert.Check(t, is.Equal(p.gets, gets+1))
+	assert.Check(t, is.Equal(w.pollStates["default/a"].interval, time.Second))
+
+	// Status changes reset the interval.
+	assert.Check(t, is.Equal(poll(), 2*time.Second))
+	p.statuses["a"] = &corev1.PodStatus{Phase: corev1.PodRunning, Message: "changed"}
+	assert.Check(t, is.Equal(poll(), time.Second))
+
+	// Pods which are gone are forgotten.
+	assert.NilError(t, indexer.Delete(updated))
+	w.syncPodStatuses(ctx)
+	assert.Check(t, is.Len(w.pollStates, 0))
+}
+
+func TestSyncProviderWrapperNotFound(t *testing.T) {
+	ctx := context.Background()
+	pending := batchTestPod("pending")
+	pending.CreationTimestamp = metav1.NewTime(time.Now().Add(-time.Minute))
+	w, _, _, notified := newPollingTestWrapper(t, PodStatusPollingConfig{
+		MinInterval:         time.Nanosecond,
+		NotFoundGracePeriod: 2 * time.Minute,
+		NotFoundThreshold:   2,
+	}, runningTestPod("running"), pending)
+
+	// Running pods are failed once they have been missing for NotFoundThreshold polls.
+	w.syncPodStatuses(ctx)
+	assert.Check(t, is.Len(notified, 0))
+	w.syncPodStatuses(ctx)
+	assert.Check(t, is.Len(notified, 1))
+	assert.Check(t, is.Equal(notified["running"].Status.Reason, podStatusReasonNotFound))
+
+	// Pending pods are not failed within the grace period.
+	_, ok := notified["pending"]
+	assert.Check(t, !ok)
+}